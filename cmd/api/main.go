@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 
 	"github.com/knave-de-coeur/user-api-service/internal/config"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
 	"github.com/knave-de-coeur/user-api-service/internal/handlers"
+	"github.com/knave-de-coeur/user-api-service/internal/mailer"
 	"github.com/knave-de-coeur/user-api-service/internal/middleware"
 	"github.com/knave-de-coeur/user-api-service/internal/services"
 	"github.com/knave-de-coeur/user-api-service/internal/utils"
@@ -28,6 +33,8 @@ func main() {
 
 	utils.Check(logger.Sync)
 
+	events.SetBaseURL(config.CurrentConfigs.AppBaseURL)
+
 	logger.Info("🚀 connecting to db")
 
 	dbConnection, err := utils.SetUpDBConnection(
@@ -62,7 +69,8 @@ func main() {
 
 	var nc *nats.Conn
 
-	if config.CurrentConfigs.NatsURL != "" {
+	switch {
+	case config.CurrentConfigs.NatsURL != "":
 		logger.Info("🚀 Setting up nats connection.")
 		// Connect to a server
 		// nc, err := nats.Connect("nats://127.0.0.1:4222")
@@ -70,10 +78,44 @@ func main() {
 		if err != nil {
 			logger.Fatal(fmt.Sprintf("❌ Failed to set up nats %s", err.Error()))
 		}
+	case config.CurrentConfigs.NatsEmbedded:
+		logger.Info("🚀 Starting embedded nats server.")
+
+		ns, err := utils.StartNatsServer(utils.NatsServerSettings{
+			Host:      config.CurrentConfigs.NatsEmbeddedHost,
+			Port:      config.CurrentConfigs.NatsEmbeddedPort,
+			JetStream: config.CurrentConfigs.NatsJetStream,
+			StoreDir:  config.CurrentConfigs.NatsStoreDir,
+		}, logger)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+
+		defer ns.Shutdown()
 
+		nc, err = nats.Connect(ns.ClientURL())
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("❌ Failed to connect to embedded nats %s", err.Error()))
+		}
+
+		logger.Info("✅ Embedded nats server listening", zap.String("url", ns.ClientURL()), zap.Bool("jetstream", config.CurrentConfigs.NatsJetStream))
+	}
+
+	if nc != nil {
 		logger.Info("✅ Connected to nats!")
 
-		utils.Check(nc.Drain)
+		defer utils.Check(nc.Drain)
+	}
+
+	switch {
+	case nc == nil:
+		logger.Warn("⚠️ no nats connection configured, user events are kept in the outbox until there is one")
+	case config.CurrentConfigs.NatsURL == "" && !config.CurrentConfigs.NatsJetStream:
+		logger.Warn("⚠️ embedded nats server runs without jetstream, user events are kept in the outbox")
+	default:
+		if err = setUpOutboxRelay(dbConnection, nc, logger); err != nil {
+			logger.Fatal(err.Error())
+		}
 	}
 
 	redisClient := redis.NewClient(&redis.Options{
@@ -101,15 +143,156 @@ func setUpRoutes(dbConn *gorm.DB, redisClient *redis.Client, nc *nats.Conn, logg
 		return nil, err
 	}
 
-	userService := services.NewUserService(dbConn, nc, logger, services.UserServiceSettings{
-		Port:      portNum,
-		Hostname:  config.CurrentConfigs.Host,
-		JWTSecret: config.CurrentConfigs.JWTSecret,
+	keySet, err := setUpKeySet(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenService := services.NewTokenService(redisClient, keySet, logger, services.TokenServiceSettings{
+		RefreshSecret:   config.CurrentConfigs.RefreshSecret,
+		AccessTokenTTL:  time.Duration(config.CurrentConfigs.AccessTokenExpiry) * time.Minute,
+		RefreshTokenTTL: time.Duration(config.CurrentConfigs.RefreshTokenExpiry) * time.Minute,
+	})
+
+	mail, err := mailer.New(mailer.Settings{
+		Driver:       config.CurrentConfigs.MailDriver,
+		From:         config.CurrentConfigs.MailFrom,
+		SMTPHost:     config.CurrentConfigs.SMTPHost,
+		SMTPPort:     config.CurrentConfigs.SMTPPort,
+		SMTPUsername: config.CurrentConfigs.SMTPUsername,
+		SMTPPassword: config.CurrentConfigs.SMTPPassword,
+		LogDir:       config.CurrentConfigs.MailLogDir,
+	}, logger)
+	if err != nil {
+		logger.Error("failed to set up mailer", zap.Error(err))
+		return nil, err
+	}
+
+	verificationService := services.NewVerificationService(redisClient, mail, logger, services.VerificationServiceSettings{
+		Secret:   config.CurrentConfigs.EmailTokenSecret,
+		TTL:      time.Duration(config.CurrentConfigs.EmailVerifyExpiry) * time.Minute,
+		ResetTTL: time.Duration(config.CurrentConfigs.PasswordResetTTL) * time.Minute,
+		BaseURL:  config.CurrentConfigs.AppBaseURL,
+	})
+
+	loginLimiter := services.NewLoginLimiter(redisClient, logger, services.LoginLimiterSettings{
+		Window:            time.Duration(config.CurrentConfigs.LoginRateWindow) * time.Minute,
+		IPLimit:           config.CurrentConfigs.LoginIPLimit,
+		AccountLimit:      config.CurrentConfigs.LoginAccountLimit,
+		LockoutThreshold:  config.CurrentConfigs.LockoutThreshold,
+		LockoutBase:       time.Duration(config.CurrentConfigs.LockoutBase) * time.Minute,
+		LockoutMax:        time.Duration(config.CurrentConfigs.LockoutMax) * time.Minute,
+		FailureTTL:        time.Duration(config.CurrentConfigs.LoginFailureExpiry) * time.Minute,
+		EmailWindow:       time.Duration(config.CurrentConfigs.EmailRateWindow) * time.Minute,
+		EmailIPLimit:      config.CurrentConfigs.EmailIPLimit,
+		EmailAddressLimit: config.CurrentConfigs.EmailAddressLimit,
+	})
+
+	hasher, err := utils.NewPasswordHasher(utils.HasherSettings{
+		Algorithm:         config.CurrentConfigs.PasswordHasher,
+		BcryptCost:        config.CurrentConfigs.BcryptCost,
+		Argon2Memory:      config.CurrentConfigs.Argon2Memory,
+		Argon2Iterations:  config.CurrentConfigs.Argon2Iterations,
+		Argon2Parallelism: config.CurrentConfigs.Argon2Parallelism,
+	})
+	if err != nil {
+		logger.Error("failed to set up password hasher", zap.Error(err))
+		return nil, err
+	}
+
+	passwords := &utils.PasswordPolicy{
+		MinLength:        config.CurrentConfigs.PasswordMinLength,
+		MaxLength:        config.CurrentConfigs.PasswordMaxLength,
+		MinCharClasses:   config.CurrentConfigs.PasswordMinClasses,
+		MinScore:         config.CurrentConfigs.PasswordMinScore,
+		DisallowPersonal: config.CurrentConfigs.PasswordNoPersonal,
+	}
+
+	if config.CurrentConfigs.BreachedDir != "" {
+		passwords.Breached = utils.NewPrefixFileChecker(config.CurrentConfigs.BreachedDir, config.CurrentConfigs.BreachedMinCount)
+	} else {
+		logger.Warn("⚠️ no breached passwords list configured, passwords won't be checked against breaches")
+	}
+
+	mfaService := services.NewMFAService(dbConn, redisClient, logger, services.MFAServiceSettings{
+		Issuer:               config.CurrentConfigs.MFAIssuer,
+		ChallengeTTL:         time.Duration(config.CurrentConfigs.MFAChallengeExpiry) * time.Minute,
+		MaxChallengeAttempts: config.CurrentConfigs.MFAChallengeTries,
+		RecoveryCodes:        config.CurrentConfigs.MFARecoveryCodes,
+	})
+
+	webAuthnService, err := services.NewWebAuthnService(dbConn, redisClient, logger, services.WebAuthnServiceSettings{
+		RPID:         config.CurrentConfigs.WebAuthnRPID,
+		RPName:       config.CurrentConfigs.WebAuthnRPName,
+		RPOrigins:    strings.Split(config.CurrentConfigs.WebAuthnRPOrigins, ","),
+		ChallengeTTL: time.Duration(config.CurrentConfigs.WebAuthnExpiry) * time.Minute,
+	})
+	if err != nil {
+		logger.Error("failed to set up webauthn", zap.Error(err))
+		return nil, err
+	}
+
+	if config.CurrentConfigs.OIDCIssuer == "" {
+		logger.Info("no external identity provider configured, external login is off")
+	}
+
+	identityService := services.NewIdentityService(dbConn, redisClient, logger, services.IdentityServiceSettings{
+		Provider:     config.CurrentConfigs.OIDCProvider,
+		Issuer:       config.CurrentConfigs.OIDCIssuer,
+		ClientID:     config.CurrentConfigs.OIDCClientID,
+		ClientSecret: config.CurrentConfigs.OIDCClientSecret,
+		RedirectURL:  config.CurrentConfigs.OIDCRedirectURL,
+		Scopes:       strings.Fields(config.CurrentConfigs.OIDCScopes),
+		StateTTL:     time.Duration(config.CurrentConfigs.OIDCStateExpiry) * time.Minute,
+	})
+
+	sessionService := services.NewSessionService(dbConn, redisClient, logger, services.SessionServiceSettings{
+		TTL: time.Duration(config.CurrentConfigs.RefreshTokenExpiry) * time.Minute,
+	})
+
+	personalTokenService := services.NewPersonalTokenService(dbConn, logger, services.PersonalTokenServiceSettings{
+		MaxTTL: time.Duration(config.CurrentConfigs.PATMaxExpiryDays) * 24 * time.Hour,
+	})
+
+	authClient := services.NewAuthClient(nc, hasher, logger, services.AuthClientSettings{
+		Timeout:          time.Duration(config.CurrentConfigs.AuthTimeout) * time.Millisecond,
+		Retries:          config.CurrentConfigs.AuthRetries,
+		RetryBackoff:     time.Duration(config.CurrentConfigs.AuthRetryBackoff) * time.Millisecond,
+		BreakerThreshold: config.CurrentConfigs.AuthBreakerLimit,
+		BreakerCooldown:  time.Duration(config.CurrentConfigs.AuthCooldown) * time.Second,
+	})
+
+	userService := services.NewUserService(dbConn, tokenService, verificationService, loginLimiter, hasher, passwords, mfaService, webAuthnService, identityService, sessionService, personalTokenService, authClient, logger, services.UserServiceSettings{
+		Port:                     portNum,
+		Hostname:                 config.CurrentConfigs.Host,
+		RequireEmailVerification: config.CurrentConfigs.RequireEmailVerify,
+		PasswordHistorySize:      config.CurrentConfigs.PasswordHistory,
+		PasswordMaxAge:           time.Duration(config.CurrentConfigs.PasswordMaxAgeDays) * 24 * time.Hour,
+		DeletionGracePeriod:      time.Duration(config.CurrentConfigs.DeletionGraceDays) * 24 * time.Hour,
+		PurgeBatchSize:           config.CurrentConfigs.PurgeBatchSize,
+	})
+
+	if config.CurrentConfigs.DeletionGraceDays > 0 {
+		go userService.RunPurgeJob(context.Background(), time.Duration(config.CurrentConfigs.PurgeInterval)*time.Minute)
+	} else {
+		logger.Info("no deletion grace period configured, soft deleted users are kept until hard deleted")
+	}
+
+	if keySet.SigningAlg() == "HS256" {
+		logger.Warn("⚠️ id tokens are signed with the shared HS256 secret, relying parties can't verify them without JWT_SIGNING_KEYS")
+	}
+
+	oauthService := services.NewOAuthService(dbConn, redisClient, tokenService, keySet, logger, services.OAuthServiceSettings{
+		Issuer:         config.CurrentConfigs.OAuthIssuer,
+		Scopes:         strings.Fields(config.CurrentConfigs.OAuthScopes),
+		CodeTTL:        time.Duration(config.CurrentConfigs.OAuthCodeExpiry) * time.Minute,
+		AccessTokenTTL: time.Duration(config.CurrentConfigs.OAuthAccessExpiry) * time.Minute,
 	})
 
 	r := gin.New()
 
 	r.Use(gin.Logger())
+	r.Use(middleware.ErrorHandler(logger))
 
 	// r.Use(gin.Middleware)
 	r.GET("/ping", func(c *gin.Context) {
@@ -118,9 +301,72 @@ func setUpRoutes(dbConn *gorm.DB, redisClient *redis.Client, nc *nats.Conn, logg
 		})
 	})
 
-	authMiddleware := middleware.NewAuthMiddleware(config.CurrentConfigs.JWTSecret)
+	authMiddleware := middleware.NewAuthMiddleware(tokenService, personalTokenService, sessionService)
 
-	handlers.NewUserHandler(userService, authMiddleware, redisClient, nc).SetUpRoutes(r.Group("/api/v1"))
+	if nc != nil {
+		if err = handlers.NewNatsHandler(userService, authMiddleware, logger).SetUpSubscriptions(nc); err != nil {
+			return nil, err
+		}
+	}
+
+	handlers.NewWellKnownHandler(keySet, oauthService).SetUpRoutes(r.Group("/.well-known"))
+
+	handlers.NewSchemaHandler().SetUpRoutes(r.Group("/api/v1"))
+
+	handlers.NewOAuthHandler(oauthService, authMiddleware).SetUpRoutes(r.Group("/oauth"))
+
+	handlers.NewUserHandler(userService, mfaService, webAuthnService, identityService, personalTokenService, sessionService, authMiddleware, passwords, redisClient, nc).SetUpRoutes(r.Group("/api/v1"))
 
 	return r, nil
 }
+
+// setUpOutboxRelay makes sure the user events stream exists and relays the outbox to it in the background
+func setUpOutboxRelay(dbConn *gorm.DB, nc *nats.Conn, logger *zap.Logger) error {
+
+	js, err := nc.JetStream()
+	if err != nil {
+		logger.Error("failed to set up jetstream", zap.Error(err))
+		return err
+	}
+
+	relay := services.NewOutboxRelay(dbConn, js, logger, services.OutboxRelaySettings{
+		Stream:      config.CurrentConfigs.OutboxStream,
+		Interval:    time.Duration(config.CurrentConfigs.OutboxInterval) * time.Second,
+		BatchSize:   config.CurrentConfigs.OutboxBatchSize,
+		MaxAttempts: config.CurrentConfigs.OutboxMaxAttempts,
+		Retention:   time.Duration(config.CurrentConfigs.OutboxRetention) * 24 * time.Hour,
+		Mode:        config.CurrentConfigs.CloudEventsMode,
+	})
+
+	if err = relay.EnsureStream(); err != nil {
+		return err
+	}
+
+	go relay.Run(context.Background())
+
+	logger.Info("✅ Relaying user events to jetstream", zap.String("stream", config.CurrentConfigs.OutboxStream))
+
+	return nil
+}
+
+// setUpKeySet loads the asymmetric signing keys from the configured PEM files, falling back to the shared JWT secret
+func setUpKeySet(logger *zap.Logger) (*services.KeySet, error) {
+
+	if config.CurrentConfigs.JWTSigningKeys == "" {
+		logger.Warn("⚠️ no JWT signing keys configured, signing tokens with the shared HS256 secret")
+		return services.NewHMACKeySet(config.CurrentConfigs.JWTSecret), nil
+	}
+
+	keySet, err := services.LoadKeySet(
+		strings.Split(config.CurrentConfigs.JWTSigningKeys, ","),
+		config.CurrentConfigs.JWTSigningKeyID,
+	)
+	if err != nil {
+		logger.Error("failed to load JWT signing keys", zap.Error(err))
+		return nil, err
+	}
+
+	logger.Info("✅ Loaded JWT signing keys", zap.String("kid", keySet.SigningKeyID()))
+
+	return keySet, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/config"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// replay-events publishes the user events written since a point in time to jetstream again, for when the stream
+// lost messages. Consumers that only need to reprocess events should start a consumer at that time instead.
+func main() {
+
+	since := flag.String("since", "", "replay events written since this RFC 3339 time or this long ago, such as 24h")
+	subject := flag.String("subject", "", "only replay events of this subject, such as user.deleted")
+	flag.Parse()
+
+	logger, err := utils.SetUpLogger()
+	if err != nil {
+		log.Fatalf("somethign went wrong setting up logger for replay: %+v", err)
+	}
+
+	defer utils.Check(logger.Sync)
+
+	events.SetBaseURL(config.CurrentConfigs.AppBaseURL)
+
+	from, err := parseSince(*since)
+	if err != nil {
+		logger.Fatal("❌ invalid -since", zap.Error(err))
+	}
+
+	natsURL := config.CurrentConfigs.NatsURL
+
+	// with an embedded server the events go to the one the api is running
+	if natsURL == "" && config.CurrentConfigs.NatsEmbedded {
+		natsURL = fmt.Sprintf("nats://%s:%d", config.CurrentConfigs.NatsEmbeddedHost, config.CurrentConfigs.NatsEmbeddedPort)
+	}
+
+	if natsURL == "" {
+		logger.Fatal("❌ NATS_URL has to be set to replay events")
+	}
+
+	dbConnection, err := utils.GetDBConnection(
+		config.CurrentConfigs.DBUser,
+		config.CurrentConfigs.DBPassword,
+		config.CurrentConfigs.Host,
+		config.CurrentConfigs.DBName,
+		logger,
+	)
+	if err != nil {
+		logger.Fatal("exiting replay...", zap.Error(err))
+	}
+
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("❌ Failed to set up nats %s", err.Error()))
+	}
+
+	defer utils.Check(nc.Drain)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		logger.Fatal("❌ Failed to set up jetstream", zap.Error(err))
+	}
+
+	relay := services.NewOutboxRelay(dbConnection, js, logger, services.OutboxRelaySettings{
+		Stream:      config.CurrentConfigs.OutboxStream,
+		BatchSize:   config.CurrentConfigs.OutboxBatchSize,
+		MaxAttempts: config.CurrentConfigs.OutboxMaxAttempts,
+		Retention:   time.Duration(config.CurrentConfigs.OutboxRetention) * 24 * time.Hour,
+		Mode:        config.CurrentConfigs.CloudEventsMode,
+	})
+
+	if err = relay.EnsureStream(); err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	ctx := context.Background()
+
+	requeued, err := relay.Requeue(ctx, from, *subject)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("🚀 Replaying events", zap.Int64("events", requeued), zap.Time("since", from), zap.String("subject", *subject))
+
+	// anything else pending goes out first, the events are relayed in the order they were written
+	published, err := relay.Relay(ctx)
+	if err != nil {
+		logger.Fatal("❌ Replay stopped, the api relays what's left once nats is reachable", zap.Int("published", published), zap.Error(err))
+	}
+
+	logger.Info("✅ Replayed events", zap.Int("published", published))
+}
+
+// parseSince reads the -since flag as a duration back from now or an RFC 3339 time
+func parseSince(since string) (time.Time, error) {
+
+	if since == "" {
+		return time.Time{}, fmt.Errorf("-since is required")
+	}
+
+	if ago, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+
+	return time.Parse(time.RFC3339, since)
+}
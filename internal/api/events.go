@@ -0,0 +1,66 @@
+package api
+
+import (
+	"time"
+
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+// UserCreatedEvent is published on pkg.UserCreated
+type UserCreatedEvent struct {
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserUpdatedEvent is published on pkg.UserUpdated with the user as it is after the change, Roles is only set when
+// they're what changed
+type UserUpdatedEvent struct {
+	UserID          uint       `json:"user_id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	FirstName       string     `json:"first_name"`
+	LastName        string     `json:"last_name"`
+	Age             int8       `json:"age"`
+	Roles           []pkg.Role `json:"roles,omitempty"`
+	PasswordChanged bool       `json:"password_changed"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// UserLoggedInEvent is published on pkg.UserLoggedIn
+type UserLoggedInEvent struct {
+	UserID     uint      `json:"user_id"`
+	SessionID  string    `json:"session_id"`
+	IP         string    `json:"ip"`
+	LoggedInAt time.Time `json:"logged_in_at"`
+}
+
+// PasswordResetEvent is published on pkg.UserPasswordReset
+type PasswordResetEvent struct {
+	UserID  uint      `json:"user_id"`
+	Email   string    `json:"email"`
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// UserDeletedEvent is published on pkg.UserDeleted, PurgeAt is when the user stops being restorable and is
+// left out when deleted users are never purged
+type UserDeletedEvent struct {
+	UserID    uint       `json:"user_id"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"`
+}
+
+// UserRestoredEvent is published on pkg.UserRestored
+type UserRestoredEvent struct {
+	UserID     uint      `json:"user_id"`
+	RestoredAt time.Time `json:"restored_at"`
+}
+
+// UserPurgedEvent is published on pkg.UserPurged, services holding data about the user should drop or anonymise it
+type UserPurgedEvent struct {
+	UserID   uint      `json:"user_id"`
+	PurgedAt time.Time `json:"purged_at"`
+}
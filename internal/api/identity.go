@@ -0,0 +1,35 @@
+package api
+
+// ExternalLoginRedirect is where the user agent has to be sent to sign in with the external provider, Binding has
+// to be kept by the client until it finishes the login, it ties the login to the browser that started it
+type ExternalLoginRedirect struct {
+	RedirectTo string `json:"redirect_to"`
+	Binding    string `json:"binding"`
+}
+
+// FinishExternalLoginRequest is the parsed struct of the /login/oidc/finish and /user/:uID/identities/finish endpoints,
+// the code and state the provider sent back to the redirect url
+type FinishExternalLoginRequest struct {
+	UserID uint   `json:"-"`
+	Code   string `json:"code" validate:"required"`
+	State  string `json:"state" validate:"required"`
+	// Binding is what the begin endpoint returned with the redirect
+	Binding string `json:"binding" validate:"required"`
+	// Client is only read when finishing a login
+	Client ClientInfo `json:"-"`
+}
+
+// Identity is an external account linked to a user
+type Identity struct {
+	ID          uint   `json:"id"`
+	Provider    string `json:"provider"`
+	Email       string `json:"email,omitempty"`
+	LastLoginAT string `json:"last_login_at,omitempty"`
+	CreatedAT   string `json:"created_at"`
+}
+
+// UnlinkIdentityRequest is the parsed struct of the DELETE /user/:uID/identities/:identityID endpoint
+type UnlinkIdentityRequest struct {
+	UserID     uint `json:"-" validate:"gt=0"`
+	IdentityID uint `json:"-" validate:"gt=0"`
+}
@@ -0,0 +1,43 @@
+package api
+
+import "github.com/knave-de-coeur/user-api-service/internal/pkg"
+
+// GetUserMessage is the request of pkg.UserGet
+type GetUserMessage struct {
+	ID uint `json:"id" validate:"gt=0"`
+}
+
+// GetUserByUsernameMessage is the request of pkg.UserGetByUsername
+type GetUserByUsernameMessage struct {
+	Username string `json:"username" validate:"required"`
+}
+
+// ValidateTokenMessage is the request of pkg.AuthValidateToken, IP is where the token was used from and is
+// recorded for personal access tokens
+type ValidateTokenMessage struct {
+	Token string `json:"token" validate:"required"`
+	IP    string `json:"ip,omitempty"`
+}
+
+// TokenClaims is the result of pkg.AuthValidateToken
+type TokenClaims struct {
+	UserID    uint       `json:"user_id"`
+	Roles     []pkg.Role `json:"roles"`
+	ExpiresAt int64      `json:"expires_at"`
+	SessionID string     `json:"session_id,omitempty"`
+	TokenID   uint       `json:"token_id,omitempty"`
+}
+
+// Reply is the data of every reply of the nats api, either Result or Error is set
+type Reply struct {
+	Result any         `json:"result,omitempty"`
+	Error  *ReplyError `json:"error,omitempty"`
+}
+
+// ReplyError describes why a request failed, Status and Code are the ones the http api would answer with
+type ReplyError struct {
+	Status  int          `json:"status"`
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
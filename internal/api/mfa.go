@@ -0,0 +1,36 @@
+package api
+
+// TOTPEnrolment is what an authenticator app needs to start generating codes
+type TOTPEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	// QRCode is the uri as a PNG data uri ready to be put in an img tag
+	QRCode string `json:"qr_code"`
+}
+
+// ConfirmTOTPRequest is the parsed struct of the /user/:uID/mfa/totp/confirm endpoint
+type ConfirmTOTPRequest struct {
+	UserID uint   `json:"-" validate:"gt=0"`
+	Code   string `json:"code" validate:"required,len=6,numeric"`
+}
+
+// DisableTOTPRequest is the parsed struct of the DELETE /user/:uID/mfa/totp endpoint, either code proves the user still holds the factor
+type DisableTOTPRequest struct {
+	UserID       uint       `json:"-" validate:"gt=0"`
+	Code         string     `json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode string     `json:"recovery_code" validate:"required_without=Code"`
+	Client       ClientInfo `json:"-"`
+}
+
+// RecoveryCodesResponse holds the recovery codes of a user, they're only ever shown once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFALoginRequest is the parsed struct of the /login/mfa endpoint
+type MFALoginRequest struct {
+	MFAToken     string     `json:"mfa_token" validate:"required"`
+	Code         string     `json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode string     `json:"recovery_code" validate:"required_without=Code"`
+	Client       ClientInfo `json:"-"`
+}
@@ -0,0 +1,101 @@
+package api
+
+// RegisterOAuthClientRequest is the parsed struct of the POST /oauth/clients endpoint, fields are named as in RFC 7591
+type RegisterOAuthClientRequest struct {
+	Name         string   `json:"client_name" validate:"required,max=255"`
+	RedirectURIs []string `json:"redirect_uris" validate:"unique,dive,required,uri"`
+	GrantTypes   []string `json:"grant_types" validate:"required,min=1,unique,dive,oneof=authorization_code client_credentials"`
+	// Scope is the space separated scopes the client may ask for
+	Scope string `json:"scope" validate:"required"`
+	// TokenEndpointAuthMethod is none for public clients such as single page and mobile apps
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method" validate:"omitempty,oneof=client_secret_basic client_secret_post none"`
+}
+
+// OAuthClient is a registered client, the secret is only ever set in the registration response
+type OAuthClient struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	Name                    string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	Scope                   string   `json:"scope"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+// AuthorizeRequest is the parsed query of GET /oauth/authorize, or the body of POST /oauth/authorize
+// when the user answers the consent prompt
+type AuthorizeRequest struct {
+	UserID              uint   `form:"-" json:"-"`
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	// Consent is approve or deny, only read from the body of POST /oauth/authorize
+	Consent string `form:"consent" json:"consent"`
+}
+
+// AuthorizeResponse either sends the user agent back to the client with RedirectTo or asks the user to consent to Scopes first
+type AuthorizeResponse struct {
+	RedirectTo      string   `json:"redirect_to,omitempty"`
+	ConsentRequired bool     `json:"consent_required,omitempty"`
+	ClientName      string   `json:"client_name,omitempty"`
+	Scopes          []string `json:"scopes,omitempty"`
+}
+
+// TokenRequest is the parsed form of the /oauth/token endpoint, client credentials may also come from basic auth
+type TokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+// TokenResponse is the RFC 6749 token response, IDToken is only set when the openid scope was granted
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// OAuthErrorResponse is the RFC 6749 error response the protocol endpoints send instead of MessageResponse
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// OAuthConsent is a client a user has granted access to
+type OAuthConsent struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+	GrantedAT  string   `json:"granted_at"`
+}
+
+// OpenIDConfiguration is the OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	AuthorizationResponseISSSupported bool     `json:"authorization_response_iss_parameter_supported"`
+}
@@ -0,0 +1,31 @@
+package api
+
+import "github.com/knave-de-coeur/user-api-service/internal/pkg"
+
+// NewPersonalTokenRequest is the parsed struct of the POST /user/:uID/tokens endpoint
+type NewPersonalTokenRequest struct {
+	UserID uint   `json:"-"`
+	Name   string `json:"name" validate:"required,max=100"`
+	// Scopes are the roles of the user the token acts with
+	Scopes        []pkg.Role `json:"scopes" validate:"required,min=1,unique,dive,oneof=user quiz_author admin"`
+	ExpiresInDays int        `json:"expires_in_days" validate:"required,min=1"`
+}
+
+// PersonalToken is a personal access token of a user, Token is only set in the response creating it
+type PersonalToken struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Token       string     `json:"token,omitempty"`
+	TokenPrefix string     `json:"token_prefix"`
+	Scopes      []pkg.Role `json:"scopes"`
+	ExpiresAT   string     `json:"expires_at"`
+	LastUsedAT  string     `json:"last_used_at,omitempty"`
+	LastUsedIP  string     `json:"last_used_ip,omitempty"`
+	CreatedAT   string     `json:"created_at"`
+}
+
+// RevokePersonalTokenRequest is the parsed struct of the DELETE /user/:uID/tokens/:tokenID endpoint
+type RevokePersonalTokenRequest struct {
+	UserID  uint `json:"-" validate:"gt=0"`
+	TokenID uint `json:"-" validate:"gt=0"`
+}
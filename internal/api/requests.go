@@ -11,11 +11,41 @@ type GeneratePasswordRequest struct {
 
 // LoginRequest is the parsed struct of the /login endpoint
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
 }
 
 // LogoutRequest is the parsed struct of the /logout endpoint
 type LogoutRequest struct {
-	UserID int `json:"user_id"`
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// RefreshTokenRequest is the parsed struct of the /token/refresh endpoint
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// VerifyEmailRequest is the parsed struct of the /user/verify endpoint
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// ResendVerificationRequest is the parsed struct of the /user/verify/resend endpoint
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	IP    string `json:"-"`
+}
+
+// ForgotPasswordRequest is the parsed struct of the /password/forgot endpoint
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	IP    string `json:"-"`
+}
+
+// ResetPasswordRequest is the parsed struct of the /password/reset endpoint
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,password"`
 }
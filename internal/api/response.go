@@ -9,14 +9,55 @@ type GeneratePasswordResponse struct {
 }
 
 type LoginResponse struct {
-	Token string
+	Token                  string `json:",omitempty"`
+	RefreshToken           string `json:"refresh_token,omitempty"`
+	ExpiresIn              int64  `json:"expires_in,omitempty"`
+	SessionID              string `json:"session_id,omitempty"`
+	PasswordChangeRequired bool   `json:"password_change_required,omitempty"`
+	// MFARequired is set instead of the tokens when the user has to send a second factor along with MFAToken to /login/mfa
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
+}
+
+// JWKS is the json web key set published for other services to verify our tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a single public key of the JWKS, only the members of its key type are set
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
 }
 
 // MessageResponse is a generic response struct that'll be marshalled to json and sent to the requester
 type MessageResponse struct {
+	Message    string       `json:"message"`
+	Result     any          `json:"result,omitempty"`
+	Pagination *Pagination  `json:"pagination,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Code       string       `json:"code,omitempty"`
+	Details    []FieldError `json:"details,omitempty"`
+}
+
+// FieldError describes why a single field of the request was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
 	Message string `json:"message"`
-	Result  any    `json:"result,omitempty"`
-	Error   string `json:"error,omitempty"`
+}
+
+// Pagination describes where a page of results sits in the full list, NextCursor is empty on the last page
+type Pagination struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	Limit      int    `json:"limit"`
+	Total      int64  `json:"total"`
 }
 
 func GenerateMessageResponse(message string, res interface{}, err error) *MessageResponse {
@@ -32,3 +73,12 @@ func GenerateMessageResponse(message string, res interface{}, err error) *Messag
 		Error:   errorMessage,
 	}
 }
+
+// GeneratePaginatedMessageResponse is GenerateMessageResponse for a single page of a list
+func GeneratePaginatedMessageResponse(message string, res interface{}, pagination *Pagination) *MessageResponse {
+
+	response := GenerateMessageResponse(message, res, nil)
+	response.Pagination = pagination
+
+	return response
+}
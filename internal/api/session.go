@@ -0,0 +1,25 @@
+package api
+
+// ClientInfo is the device a login came from, recorded on the session it starts
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// Session is a device the user is signed in on, Current marks the one the request was made from
+type Session struct {
+	ID         string `json:"id"`
+	Device     string `json:"device"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	IssuedAT   string `json:"issued_at"`
+	LastSeenAT string `json:"last_seen_at,omitempty"`
+	ExpiresAT  string `json:"expires_at"`
+	Current    bool   `json:"current"`
+}
+
+// RevokeSessionRequest is the parsed struct of the DELETE /user/:uID/sessions/:sessionID endpoint
+type RevokeSessionRequest struct {
+	UserID    uint   `json:"-" validate:"gt=0"`
+	SessionID string `json:"-" validate:"required"`
+}
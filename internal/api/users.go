@@ -1,16 +1,24 @@
 package api
 
+import (
+	"time"
+
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
 type User struct {
-	ID                 string `json:"ID,omitempty"`
-	FirstName          string `json:"first_name" validate:"required"`
-	LastName           string `json:"last_name" validate:"required"`
-	Email              string `json:"email" validate:"required,email"`
-	Age                int8   `json:"age" validate:"required"`
-	Username           string `json:"username" validate:"required"`
-	Password           string `json:"password,omitempty" validate:"required"`
-	CreatedAT          string `json:"created_at,omitempty"`
-	UpdatedAT          string `json:"updated_at,omitempty"`
-	LastLoginTimeStamp string `json:"last_login_time_stamp,omitempty"`
+	ID                 string     `json:"ID,omitempty"`
+	FirstName          string     `json:"first_name" validate:"required"`
+	LastName           string     `json:"last_name" validate:"required"`
+	Email              string     `json:"email" validate:"required,email"`
+	Age                int8       `json:"age" validate:"required"`
+	Username           string     `json:"username" validate:"required"`
+	Password           string     `json:"password,omitempty" validate:"required,password"`
+	CreatedAT          string     `json:"created_at,omitempty"`
+	UpdatedAT          string     `json:"updated_at,omitempty"`
+	LastLoginTimeStamp string     `json:"last_login_time_stamp,omitempty"`
+	DeletedAT          string     `json:"deleted_at,omitempty" gorm:"-"`
+	Roles              []pkg.Role `json:"roles,omitempty" gorm:"-"`
 }
 
 type NewUserRequest struct {
@@ -25,10 +33,37 @@ type UpdateUserRequest struct {
 	Age         int8   `json:"age" validate:"required"`
 	Username    string `json:"username" validate:"required"`
 	OldPassword string `json:"old_password,omitempty"`
-	NewPassword string `json:"new_password,omitempty"`
+	NewPassword string `json:"new_password,omitempty" validate:"omitempty,password"`
+	// Self is set when users update their own account rather than an admin doing it for them
+	Self bool `json:"-"`
 }
 
 type DeleteUserRequest struct {
 	ID         uint `json:"ID" validate:"gt=0"`
 	HardDelete bool `json:"hard_delete,omitempty"`
 }
+
+type RestoreUserRequest struct {
+	ID uint `json:"ID" validate:"gt=0"`
+}
+
+type UpdateUserRolesRequest struct {
+	ID    uint       `json:"ID" validate:"gt=0"`
+	Roles []pkg.Role `json:"roles" validate:"required,min=1,unique,dive,oneof=user quiz_author admin"`
+}
+
+// ListUsersRequest is the parsed query of the /users endpoint, zero values are treated as unset
+type ListUsersRequest struct {
+	Cursor          string    `form:"cursor"`
+	Limit           int       `form:"limit" validate:"omitempty,min=1,max=100"`
+	Sort            string    `form:"sort" validate:"omitempty,oneof=id -id username -username email -email age -age created_at -created_at last_login_time_stamp -last_login_time_stamp"`
+	Username        string    `form:"username"`
+	Email           string    `form:"email"`
+	MinAge          int8      `form:"min_age" validate:"omitempty,min=1"`
+	MaxAge          int8      `form:"max_age" validate:"omitempty,min=1,gtefield=MinAge"`
+	CreatedAfter    time.Time `form:"created_after"`
+	CreatedBefore   time.Time `form:"created_before"`
+	LastLoginAfter  time.Time `form:"last_login_after"`
+	LastLoginBefore time.Time `form:"last_login_before"`
+	Deleted         string    `form:"deleted" validate:"omitempty,oneof=exclude include only"`
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebAuthnCredential is a passkey registered by a user as shown to them
+type WebAuthnCredential struct {
+	ID             uint       `json:"id"`
+	Name           string     `json:"name"`
+	BackupEligible bool       `json:"backup_eligible"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// FinishPasskeyRegistrationRequest is the parsed struct of the /user/:uID/passkeys/register/finish endpoint,
+// Credential is the PublicKeyCredential returned by navigator.credentials.create as JSON
+type FinishPasskeyRegistrationRequest struct {
+	UserID     uint            `json:"-" validate:"gt=0"`
+	Name       string          `json:"name" validate:"max=64"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+// DeletePasskeyRequest is the parsed struct of the DELETE /user/:uID/passkeys/:credID endpoint
+type DeletePasskeyRequest struct {
+	UserID       uint `validate:"gt=0"`
+	CredentialID uint `validate:"gt=0"`
+}
+
+// BeginPasskeyLoginRequest is the parsed struct of the /login/passkey/begin endpoint,
+// without a username any passkey stored on the authenticator can be picked
+type BeginPasskeyLoginRequest struct {
+	Username string `json:"username"`
+}
+
+// FinishPasskeyLoginRequest is the parsed struct of the /login/passkey/finish endpoint,
+// Credential is the PublicKeyCredential returned by navigator.credentials.get as JSON
+type FinishPasskeyLoginRequest struct {
+	Credential json.RawMessage `json:"credential" validate:"required"`
+	Client     ClientInfo      `json:"-"`
+}
@@ -21,7 +21,87 @@ func fallbackConfigs() {
 	viper.SetDefault("REDIS_DB", 0)
 	viper.SetDefault("REDIS_EXPIRY", 60)
 	viper.SetDefault("NATS_URL", "nats://127.0.0.1:4222")
+	viper.SetDefault("NATS_EMBEDDED", false)
+	viper.SetDefault("NATS_EMBEDDED_HOST", "127.0.0.1")
+	viper.SetDefault("NATS_EMBEDDED_PORT", 4222)
+	viper.SetDefault("NATS_EMBEDDED_JETSTREAM", false)
+	viper.SetDefault("NATS_EMBEDDED_STORE_DIR", "")
 	viper.SetDefault("JWT_SECRET", "testsecret")
+	viper.SetDefault("JWT_SIGNING_KEYS", "")
+	viper.SetDefault("JWT_SIGNING_KEY_ID", "")
+	viper.SetDefault("REFRESH_SECRET", "testrefreshsecret")
+	viper.SetDefault("ACCESS_TOKEN_EXPIRY", 60)
+	viper.SetDefault("REFRESH_TOKEN_EXPIRY", 10080)
+	viper.SetDefault("APP_BASE_URL", "http://localhost:8080")
+	viper.SetDefault("EMAIL_TOKEN_SECRET", "testemailsecret")
+	viper.SetDefault("EMAIL_VERIFICATION_EXPIRY", 1440)
+	viper.SetDefault("REQUIRE_EMAIL_VERIFICATION", true)
+	viper.SetDefault("PASSWORD_RESET_EXPIRY", 30)
+	viper.SetDefault("LOGIN_RATE_WINDOW", 15)
+	viper.SetDefault("LOGIN_IP_LIMIT", 100)
+	viper.SetDefault("LOGIN_ACCOUNT_LIMIT", 20)
+	viper.SetDefault("LOGIN_LOCKOUT_THRESHOLD", 5)
+	viper.SetDefault("LOGIN_LOCKOUT_BASE", 1)
+	viper.SetDefault("LOGIN_LOCKOUT_MAX", 60)
+	viper.SetDefault("LOGIN_FAILURE_EXPIRY", 60)
+	viper.SetDefault("EMAIL_RATE_WINDOW", 60)
+	viper.SetDefault("EMAIL_IP_LIMIT", 20)
+	viper.SetDefault("EMAIL_ADDRESS_LIMIT", 3)
+	viper.SetDefault("PASSWORD_HASHER", "argon2id")
+	viper.SetDefault("BCRYPT_COST", 12)
+	viper.SetDefault("ARGON2_MEMORY", 65536)
+	viper.SetDefault("ARGON2_ITERATIONS", 3)
+	viper.SetDefault("ARGON2_PARALLELISM", 2)
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 10)
+	viper.SetDefault("PASSWORD_MAX_LENGTH", 128)
+	viper.SetDefault("PASSWORD_MIN_CHAR_CLASSES", 2)
+	viper.SetDefault("PASSWORD_MIN_SCORE", 3)
+	viper.SetDefault("PASSWORD_DISALLOW_PERSONAL", true)
+	viper.SetDefault("BREACHED_PASSWORDS_DIR", "")
+	viper.SetDefault("BREACHED_PASSWORDS_MIN_COUNT", 1)
+	viper.SetDefault("PASSWORD_HISTORY_SIZE", 5)
+	viper.SetDefault("PASSWORD_MAX_AGE_DAYS", 0)
+	viper.SetDefault("MFA_ISSUER", "user-api-service")
+	viper.SetDefault("MFA_CHALLENGE_EXPIRY", 5)
+	viper.SetDefault("MFA_CHALLENGE_ATTEMPTS", 5)
+	viper.SetDefault("MFA_RECOVERY_CODES", 10)
+	viper.SetDefault("WEBAUTHN_RP_ID", "localhost")
+	viper.SetDefault("WEBAUTHN_RP_NAME", "Quiz")
+	viper.SetDefault("WEBAUTHN_RP_ORIGINS", "http://localhost:8080")
+	viper.SetDefault("WEBAUTHN_CHALLENGE_EXPIRY", 5)
+	viper.SetDefault("OAUTH_ISSUER", "http://localhost:8080")
+	viper.SetDefault("OAUTH_SCOPES", "openid profile email")
+	viper.SetDefault("OAUTH_CODE_EXPIRY", 1)
+	viper.SetDefault("OAUTH_ACCESS_TOKEN_EXPIRY", 15)
+	viper.SetDefault("OIDC_PROVIDER", "oidc")
+	viper.SetDefault("OIDC_ISSUER", "")
+	viper.SetDefault("OIDC_CLIENT_ID", "")
+	viper.SetDefault("OIDC_CLIENT_SECRET", "")
+	viper.SetDefault("OIDC_REDIRECT_URL", "http://localhost:8080/login/callback")
+	viper.SetDefault("OIDC_SCOPES", "openid profile email")
+	viper.SetDefault("OIDC_STATE_EXPIRY", 10)
+	viper.SetDefault("PAT_MAX_EXPIRY_DAYS", 365)
+	viper.SetDefault("USER_DELETION_GRACE_DAYS", 30)
+	viper.SetDefault("USER_PURGE_INTERVAL", 60)
+	viper.SetDefault("USER_PURGE_BATCH_SIZE", 100)
+	viper.SetDefault("OUTBOX_STREAM", "USER_EVENTS")
+	viper.SetDefault("OUTBOX_RELAY_INTERVAL", 1)
+	viper.SetDefault("OUTBOX_BATCH_SIZE", 100)
+	viper.SetDefault("OUTBOX_MAX_ATTEMPTS", 10)
+	viper.SetDefault("OUTBOX_RETENTION_DAYS", 7)
+	viper.SetDefault("CLOUDEVENTS_MODE", "structured")
+	viper.SetDefault("AUTH_SERVICE_TIMEOUT", 2000)
+	viper.SetDefault("AUTH_SERVICE_RETRIES", 2)
+	viper.SetDefault("AUTH_SERVICE_RETRY_BACKOFF", 100)
+	viper.SetDefault("AUTH_SERVICE_BREAKER_THRESHOLD", 5)
+	viper.SetDefault("AUTH_SERVICE_BREAKER_COOLDOWN", 30)
+	viper.SetDefault("MAIL_DRIVER", "log")
+	viper.SetDefault("MAIL_FROM", "noreply@localhost")
+	viper.SetDefault("MAIL_LOG_DIR", "")
+	viper.SetDefault("SMTP_HOST", "localhost")
+	viper.SetDefault("SMTP_PORT", 587)
+	viper.SetDefault("SMTP_USERNAME", "")
+	viper.SetDefault("SMTP_PASSWORD", "")
 }
 
 // Configurations app configs from env file, env params or fallback configs
@@ -40,7 +120,87 @@ type Configurations struct {
 	RedisPassword      string `mapstructure:"REDIS_PASSWORD"`
 	RedisDB            int    `mapstructure:"REDIS_DB"`
 	NatsURL            string `mapstructure:"NATS_URL"`
+	NatsEmbedded       bool   `mapstructure:"NATS_EMBEDDED"`
+	NatsEmbeddedHost   string `mapstructure:"NATS_EMBEDDED_HOST"`
+	NatsEmbeddedPort   int    `mapstructure:"NATS_EMBEDDED_PORT"`
+	NatsJetStream      bool   `mapstructure:"NATS_EMBEDDED_JETSTREAM"`
+	NatsStoreDir       string `mapstructure:"NATS_EMBEDDED_STORE_DIR"`
 	JWTSecret          string `mapstructure:"JWT_SECRET"`
+	JWTSigningKeys     string `mapstructure:"JWT_SIGNING_KEYS"`
+	JWTSigningKeyID    string `mapstructure:"JWT_SIGNING_KEY_ID"`
+	RefreshSecret      string `mapstructure:"REFRESH_SECRET"`
+	AccessTokenExpiry  int    `mapstructure:"ACCESS_TOKEN_EXPIRY"`
+	RefreshTokenExpiry int    `mapstructure:"REFRESH_TOKEN_EXPIRY"`
+	AppBaseURL         string `mapstructure:"APP_BASE_URL"`
+	EmailTokenSecret   string `mapstructure:"EMAIL_TOKEN_SECRET"`
+	EmailVerifyExpiry  int    `mapstructure:"EMAIL_VERIFICATION_EXPIRY"`
+	RequireEmailVerify bool   `mapstructure:"REQUIRE_EMAIL_VERIFICATION"`
+	PasswordResetTTL   int    `mapstructure:"PASSWORD_RESET_EXPIRY"`
+	LoginRateWindow    int    `mapstructure:"LOGIN_RATE_WINDOW"`
+	LoginIPLimit       int    `mapstructure:"LOGIN_IP_LIMIT"`
+	LoginAccountLimit  int    `mapstructure:"LOGIN_ACCOUNT_LIMIT"`
+	LockoutThreshold   int    `mapstructure:"LOGIN_LOCKOUT_THRESHOLD"`
+	LockoutBase        int    `mapstructure:"LOGIN_LOCKOUT_BASE"`
+	LockoutMax         int    `mapstructure:"LOGIN_LOCKOUT_MAX"`
+	LoginFailureExpiry int    `mapstructure:"LOGIN_FAILURE_EXPIRY"`
+	EmailRateWindow    int    `mapstructure:"EMAIL_RATE_WINDOW"`
+	EmailIPLimit       int    `mapstructure:"EMAIL_IP_LIMIT"`
+	EmailAddressLimit  int    `mapstructure:"EMAIL_ADDRESS_LIMIT"`
+	PasswordHasher     string `mapstructure:"PASSWORD_HASHER"`
+	BcryptCost         int    `mapstructure:"BCRYPT_COST"`
+	Argon2Memory       uint32 `mapstructure:"ARGON2_MEMORY"`
+	Argon2Iterations   uint32 `mapstructure:"ARGON2_ITERATIONS"`
+	Argon2Parallelism  uint8  `mapstructure:"ARGON2_PARALLELISM"`
+	PasswordMinLength  int    `mapstructure:"PASSWORD_MIN_LENGTH"`
+	PasswordMaxLength  int    `mapstructure:"PASSWORD_MAX_LENGTH"`
+	PasswordMinClasses int    `mapstructure:"PASSWORD_MIN_CHAR_CLASSES"`
+	PasswordMinScore   int    `mapstructure:"PASSWORD_MIN_SCORE"`
+	PasswordNoPersonal bool   `mapstructure:"PASSWORD_DISALLOW_PERSONAL"`
+	BreachedDir        string `mapstructure:"BREACHED_PASSWORDS_DIR"`
+	BreachedMinCount   int    `mapstructure:"BREACHED_PASSWORDS_MIN_COUNT"`
+	PasswordHistory    int    `mapstructure:"PASSWORD_HISTORY_SIZE"`
+	PasswordMaxAgeDays int    `mapstructure:"PASSWORD_MAX_AGE_DAYS"`
+	MFAIssuer          string `mapstructure:"MFA_ISSUER"`
+	MFAChallengeExpiry int    `mapstructure:"MFA_CHALLENGE_EXPIRY"`
+	MFAChallengeTries  int    `mapstructure:"MFA_CHALLENGE_ATTEMPTS"`
+	MFARecoveryCodes   int    `mapstructure:"MFA_RECOVERY_CODES"`
+	WebAuthnRPID       string `mapstructure:"WEBAUTHN_RP_ID"`
+	WebAuthnRPName     string `mapstructure:"WEBAUTHN_RP_NAME"`
+	WebAuthnRPOrigins  string `mapstructure:"WEBAUTHN_RP_ORIGINS"`
+	WebAuthnExpiry     int    `mapstructure:"WEBAUTHN_CHALLENGE_EXPIRY"`
+	OAuthIssuer        string `mapstructure:"OAUTH_ISSUER"`
+	OAuthScopes        string `mapstructure:"OAUTH_SCOPES"`
+	OAuthCodeExpiry    int    `mapstructure:"OAUTH_CODE_EXPIRY"`
+	OAuthAccessExpiry  int    `mapstructure:"OAUTH_ACCESS_TOKEN_EXPIRY"`
+	OIDCProvider       string `mapstructure:"OIDC_PROVIDER"`
+	OIDCIssuer         string `mapstructure:"OIDC_ISSUER"`
+	OIDCClientID       string `mapstructure:"OIDC_CLIENT_ID"`
+	OIDCClientSecret   string `mapstructure:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL    string `mapstructure:"OIDC_REDIRECT_URL"`
+	OIDCScopes         string `mapstructure:"OIDC_SCOPES"`
+	OIDCStateExpiry    int    `mapstructure:"OIDC_STATE_EXPIRY"`
+	PATMaxExpiryDays   int    `mapstructure:"PAT_MAX_EXPIRY_DAYS"`
+	DeletionGraceDays  int    `mapstructure:"USER_DELETION_GRACE_DAYS"`
+	PurgeInterval      int    `mapstructure:"USER_PURGE_INTERVAL"`
+	PurgeBatchSize     int    `mapstructure:"USER_PURGE_BATCH_SIZE"`
+	OutboxStream       string `mapstructure:"OUTBOX_STREAM"`
+	OutboxInterval     int    `mapstructure:"OUTBOX_RELAY_INTERVAL"`
+	OutboxBatchSize    int    `mapstructure:"OUTBOX_BATCH_SIZE"`
+	OutboxMaxAttempts  int    `mapstructure:"OUTBOX_MAX_ATTEMPTS"`
+	OutboxRetention    int    `mapstructure:"OUTBOX_RETENTION_DAYS"`
+	CloudEventsMode    string `mapstructure:"CLOUDEVENTS_MODE"`
+	AuthTimeout        int    `mapstructure:"AUTH_SERVICE_TIMEOUT"`
+	AuthRetries        int    `mapstructure:"AUTH_SERVICE_RETRIES"`
+	AuthRetryBackoff   int    `mapstructure:"AUTH_SERVICE_RETRY_BACKOFF"`
+	AuthBreakerLimit   int    `mapstructure:"AUTH_SERVICE_BREAKER_THRESHOLD"`
+	AuthCooldown       int    `mapstructure:"AUTH_SERVICE_BREAKER_COOLDOWN"`
+	MailDriver         string `mapstructure:"MAIL_DRIVER"`
+	MailFrom           string `mapstructure:"MAIL_FROM"`
+	MailLogDir         string `mapstructure:"MAIL_LOG_DIR"`
+	SMTPHost           string `mapstructure:"SMTP_HOST"`
+	SMTPPort           int    `mapstructure:"SMTP_PORT"`
+	SMTPUsername       string `mapstructure:"SMTP_USERNAME"`
+	SMTPPassword       string `mapstructure:"SMTP_PASSWORD"`
 }
 
 var CurrentConfigs Configurations
@@ -72,7 +232,14 @@ func LoadConfig(path string) (config Configurations, err error) {
 		}
 	}
 
-	err = viper.Unmarshal(&config)
+	if err = viper.Unmarshal(&config); err != nil {
+		return
+	}
+
+	// the embedded server wins over NATS_URL, which has a default when there's no app.env
+	if config.NatsEmbedded {
+		config.NatsURL = ""
+	}
 
 	return
 }
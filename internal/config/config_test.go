@@ -0,0 +1,36 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig_Nats(t *testing.T) {
+
+	t.Run("nats url falls back to a local server without app.env", func(t *testing.T) {
+		configs, err := LoadConfig(t.TempDir())
+		require.NoError(t, err)
+		require.Equal(t, "nats://127.0.0.1:4222", configs.NatsURL)
+		require.False(t, configs.NatsEmbedded)
+	})
+
+	t.Run("embedded server without app.env", func(t *testing.T) {
+		t.Setenv("NATS_EMBEDDED", "true")
+
+		configs, err := LoadConfig(t.TempDir())
+		require.NoError(t, err)
+		require.True(t, configs.NatsEmbedded)
+		require.Empty(t, configs.NatsURL)
+	})
+
+	t.Run("embedded server wins over a nats url", func(t *testing.T) {
+		t.Setenv("NATS_EMBEDDED", "true")
+		t.Setenv("NATS_URL", "nats://nats.internal:4222")
+
+		configs, err := LoadConfig(t.TempDir())
+		require.NoError(t, err)
+		require.True(t, configs.NatsEmbedded)
+		require.Empty(t, configs.NatsURL)
+	})
+}
@@ -0,0 +1,319 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// SpecVersion is the CloudEvents version messages are wrapped in
+	SpecVersion = "1.0"
+	// Source identifies this service as the producer of the messages it publishes
+	Source = "/user-api-service"
+
+	// ModeStructured sends the whole event as the JSON body of a message
+	ModeStructured = "structured"
+	// ModeBinary sends the attributes as ce- headers and only the data as the body
+	ModeBinary = "binary"
+
+	ContentTypeStructured = "application/cloudevents+json"
+	ContentTypeJSON       = "application/json"
+
+	// SchemasPath is where the api serves the schemas, the dataschema of an event points under it
+	SchemasPath = "/api/v1/schemas"
+
+	// version is the schema version of the messages published, it's bumped on breaking changes to their data
+	version = 1
+
+	headerPrefix      = "ce-"
+	headerContentType = "Content-Type"
+)
+
+var (
+	ErrInvalidEvent       = errors.New("message isn't a valid cloudevent")
+	ErrUnknownType        = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("event type version isn't supported")
+)
+
+// baseURL is where the api is reached, the dataschema of the events created points under it
+var baseURL string
+
+var (
+	typeVersion = regexp.MustCompile(`^(.+)\.v([0-9]+)$`)
+	traceParent = regexp.MustCompile(`^00-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+)
+
+// Event is a CloudEvents 1.0 event with JSON data, TraceParent is the distributed tracing extension
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	TraceParent     string          `json:"traceparent,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// TypeOf is the type of the messages published on a subject, the subject followed by the schema version
+func TypeOf(subject string) string {
+	return fmt.Sprintf("%s.v%d", subject, version)
+}
+
+// ReplyOf is what the type of the replies to requests on a subject starts with
+func ReplyOf(subject string) string {
+	return subject + ".reply"
+}
+
+// SetBaseURL sets where the api is reached, for the dataschema of the events created to point to it
+func SetBaseURL(url string) {
+	baseURL = strings.TrimSuffix(url, "/")
+}
+
+// SchemaURL is where the schema of an event type is served
+func SchemaURL(eventType string) string {
+	return baseURL + SchemasPath + "/" + eventType
+}
+
+// New wraps data in an event of the type passed, refusing data that doesn't match the schema of the type
+func New(eventType string, data any) (*Event, error) {
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Validate(eventType, payload); err != nil {
+		return nil, fmt.Errorf("%s doesn't match its schema: %w", eventType, err)
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	trace, err := newTraceParent("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          Source,
+		Type:            eventType,
+		Time:            time.Now().UTC(),
+		DataContentType: ContentTypeJSON,
+		DataSchema:      SchemaURL(eventType),
+		TraceParent:     trace,
+		Data:            payload,
+	}, nil
+}
+
+// Reply wraps data in the reply to the event, in the same trace and version as it
+func (e *Event) Reply(data any) (*Event, error) {
+
+	base, v := splitType(e.Type)
+
+	reply, err := New(fmt.Sprintf("%s.v%d", ReplyOf(base), v), data)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.TraceParent, err = newTraceParent(e.TraceParent); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// DataAs unmarshals the data of the event into v
+func (e *Event) DataAs(v any) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Message encodes the event as a nats message on subject in structured or binary mode
+func (e *Event) Message(subject, mode string) (*nats.Msg, error) {
+
+	msg := nats.NewMsg(subject)
+
+	if mode != ModeBinary {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Header.Set(headerContentType, ContentTypeStructured)
+		msg.Data = data
+
+		return msg, nil
+	}
+
+	msg.Header.Set(headerPrefix+"specversion", e.SpecVersion)
+	msg.Header.Set(headerPrefix+"id", e.ID)
+	msg.Header.Set(headerPrefix+"source", e.Source)
+	msg.Header.Set(headerPrefix+"type", e.Type)
+	msg.Header.Set(headerPrefix+"time", e.Time.Format(time.RFC3339Nano))
+	if e.DataSchema != "" {
+		msg.Header.Set(headerPrefix+"dataschema", e.DataSchema)
+	}
+	if e.TraceParent != "" {
+		msg.Header.Set(headerPrefix+"traceparent", e.TraceParent)
+	}
+	msg.Header.Set(headerContentType, e.DataContentType)
+	msg.Data = e.Data
+
+	return msg, nil
+}
+
+// Unmarshal reads an event in structured mode
+func Unmarshal(data []byte) (*Event, error) {
+
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	if err := e.checkAttributes(); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// Parse reads an event from a message in either mode, binary when it carries a ce-specversion header
+func Parse(msg *nats.Msg) (*Event, error) {
+
+	if msg.Header.Get(headerPrefix+"specversion") == "" {
+		return Unmarshal(msg.Data)
+	}
+
+	e := &Event{
+		SpecVersion:     msg.Header.Get(headerPrefix + "specversion"),
+		ID:              msg.Header.Get(headerPrefix + "id"),
+		Source:          msg.Header.Get(headerPrefix + "source"),
+		Type:            msg.Header.Get(headerPrefix + "type"),
+		DataContentType: msg.Header.Get(headerContentType),
+		DataSchema:      msg.Header.Get(headerPrefix + "dataschema"),
+		TraceParent:     msg.Header.Get(headerPrefix + "traceparent"),
+		Data:            msg.Data,
+	}
+
+	if at := msg.Header.Get(headerPrefix + "time"); at != "" {
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad time attribute", ErrInvalidEvent)
+		}
+		e.Time = t
+	}
+
+	if err := e.checkAttributes(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Decode parses the event of a message and checks it's a supported version of base, such as pkg.UserGet or
+// ReplyOf(pkg.UserGet), with data matching its schema
+func Decode(msg *nats.Msg, base string) (*Event, error) {
+
+	e, err := Parse(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if eventBase, _ := splitType(e.Type); eventBase != base {
+		return nil, fmt.Errorf("%w: expected %s but got %s", ErrUnknownType, base, e.Type)
+	}
+
+	if _, ok := registry[e.Type]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, e.Type)
+	}
+
+	if err = Validate(e.Type, e.Data); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// ModeOf tells which mode a message was sent in, so replies can be sent in the same one
+func ModeOf(msg *nats.Msg) string {
+
+	if msg.Header.Get(headerPrefix+"specversion") != "" {
+		return ModeBinary
+	}
+
+	return ModeStructured
+}
+
+// checkAttributes makes sure the required attributes are set and the data is JSON
+func (e *Event) checkAttributes() error {
+
+	switch {
+	case e.SpecVersion != SpecVersion:
+		return fmt.Errorf("%w: specversion should be %s", ErrInvalidEvent, SpecVersion)
+	case e.ID == "" || e.Source == "" || e.Type == "":
+		return fmt.Errorf("%w: id, source and type are required", ErrInvalidEvent)
+	case e.DataContentType != "" && e.DataContentType != ContentTypeJSON:
+		return fmt.Errorf("%w: data has to be %s", ErrInvalidEvent, ContentTypeJSON)
+	case len(e.Data) == 0:
+		return fmt.Errorf("%w: data is required", ErrInvalidEvent)
+	}
+
+	return nil
+}
+
+// splitType splits an event type into the part before its version and the version, 0 when there's none
+func splitType(eventType string) (string, int) {
+
+	match := typeVersion.FindStringSubmatch(eventType)
+	if match == nil {
+		return eventType, 0
+	}
+
+	v, _ := strconv.Atoi(match[2])
+
+	return match[1], v
+}
+
+// newTraceParent starts a span in the trace of parent, or in a new trace when parent isn't a W3C traceparent
+func newTraceParent(parent string) (string, error) {
+
+	spanID, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+
+	if match := traceParent.FindStringSubmatch(parent); match != nil {
+		return fmt.Sprintf("00-%s-%s-01", match[1], spanID), nil
+	}
+
+	traceID, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", traceID, spanID), nil
+}
+
+// randomHex is n random bytes hex encoded, utils isn't used so the package doesn't load the configs
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
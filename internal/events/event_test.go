@@ -0,0 +1,117 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+func TestEvent_Message(t *testing.T) {
+	SetBaseURL("http://localhost:8080/")
+	defer SetBaseURL("")
+
+	event, err := New(TypeOf(pkg.UserGet), api.GetUserMessage{ID: 7})
+	require.NoError(t, err)
+	require.Equal(t, "user.get.v1", event.Type)
+	require.Equal(t, "http://localhost:8080/api/v1/schemas/user.get.v1", event.DataSchema)
+	require.Regexp(t, traceParent, event.TraceParent)
+
+	for _, mode := range []string{ModeStructured, ModeBinary} {
+		t.Run(mode, func(t *testing.T) {
+			msg, err := event.Message(pkg.UserGet, mode)
+			require.NoError(t, err)
+			require.Equal(t, mode, ModeOf(msg))
+
+			if mode == ModeBinary {
+				require.Equal(t, event.ID, msg.Header.Get("ce-id"))
+				require.JSONEq(t, `{"id": 7}`, string(msg.Data))
+			} else {
+				require.Equal(t, ContentTypeStructured, msg.Header.Get("Content-Type"))
+			}
+
+			decoded, err := Decode(msg, pkg.UserGet)
+			require.NoError(t, err)
+			require.Equal(t, event.ID, decoded.ID)
+			require.Equal(t, event.TraceParent, decoded.TraceParent)
+			require.True(t, event.Time.Equal(decoded.Time))
+
+			var getReq api.GetUserMessage
+			require.NoError(t, decoded.DataAs(&getReq))
+			require.Equal(t, uint(7), getReq.ID)
+		})
+	}
+
+	t.Run("replies stay in the trace", func(t *testing.T) {
+		reply, err := event.Reply(api.Reply{Error: &api.ReplyError{Status: 404, Code: "user_not_found", Message: "user not found"}})
+		require.NoError(t, err)
+		require.Equal(t, "user.get.reply.v1", reply.Type)
+		require.NotEqual(t, event.TraceParent, reply.TraceParent)
+		require.Equal(t, event.TraceParent[:35], reply.TraceParent[:35])
+	})
+
+	t.Run("data has to match the schema", func(t *testing.T) {
+		_, err := New(TypeOf(pkg.UserGet), api.GetUserMessage{})
+		require.Error(t, err)
+	})
+}
+
+func TestDecode(t *testing.T) {
+	structured := func(body string) *nats.Msg {
+		return &nats.Msg{Subject: pkg.UserGet, Data: []byte(body)}
+	}
+
+	testCases := []struct {
+		Name     string
+		Msg      *nats.Msg
+		Expected error
+	}{
+		{
+			Name:     "not an event",
+			Msg:      structured(`{"id": 7}`),
+			Expected: ErrInvalidEvent,
+		},
+		{
+			Name:     "another type",
+			Msg:      structured(`{"specversion": "1.0", "id": "1", "source": "/quiz", "type": "user.deleted.v1", "data": {}}`),
+			Expected: ErrUnknownType,
+		},
+		{
+			Name:     "newer version",
+			Msg:      structured(`{"specversion": "1.0", "id": "1", "source": "/quiz", "type": "user.get.v2", "data": {"id": 7}}`),
+			Expected: ErrUnsupportedVersion,
+		},
+		{
+			Name:     "data that isn't json",
+			Msg:      structured(`{"specversion": "1.0", "id": "1", "source": "/quiz", "type": "user.get.v1", "datacontenttype": "text/plain", "data": "7"}`),
+			Expected: ErrInvalidEvent,
+		},
+		{
+			Name: "binary without a source",
+			Msg: &nats.Msg{
+				Subject: pkg.UserGet,
+				Header:  nats.Header{"ce-specversion": {"1.0"}, "ce-id": {"1"}, "ce-type": {"user.get.v1"}},
+				Data:    []byte(`{"id": 7}`),
+			},
+			Expected: ErrInvalidEvent,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := Decode(test.Msg, pkg.UserGet)
+			require.ErrorIs(t, err, test.Expected)
+		})
+	}
+
+	t.Run("data not matching the schema", func(t *testing.T) {
+		_, err := Decode(structured(`{"specversion": "1.0", "id": "1", "source": "/quiz", "type": "user.get.v1", "data": {"id": "7"}}`), pkg.UserGet)
+
+		var errs SchemaErrors
+		require.ErrorAs(t, err, &errs)
+		require.Equal(t, "id", errs[0].Path)
+	})
+}
@@ -0,0 +1,201 @@
+package events
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// schemaLocation is where the embedded schemas are registered with the compiler, nothing is loaded from it
+const schemaLocation = "embed:///schemas/"
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// registry holds the compiled schema of the data of every event type, keyed by the type
+var registry = mustLoadSchemas()
+
+// printer renders the messages of schema errors
+var printer = message.NewPrinter(language.English)
+
+// SchemaError is a single way data doesn't match its schema, Path is the dotted path to the offending value
+type SchemaError struct {
+	Path    string
+	Keyword string
+	Message string
+}
+
+// SchemaErrors lists every way data doesn't match its schema, the errors of the validator broken down per property
+type SchemaErrors []SchemaError
+
+func (errs SchemaErrors) Error() string {
+
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		if e.Path == "" {
+			messages = append(messages, e.Message)
+			continue
+		}
+		messages = append(messages, fmt.Sprintf("%s %s", e.Path, e.Message))
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+// SchemaInfo describes a registered schema
+type SchemaInfo struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	URL     string `json:"url"`
+}
+
+// Schemas lists the schema of every event type, sorted by type
+func Schemas() []SchemaInfo {
+
+	schemas := make([]SchemaInfo, 0, len(registry))
+	for eventType := range registry {
+		_, version := splitType(eventType)
+		schemas = append(schemas, SchemaInfo{Type: eventType, Version: version, URL: SchemaURL(eventType)})
+	}
+
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Type < schemas[j].Type })
+
+	return schemas
+}
+
+// RawSchema returns the schema file of an event type as it's embedded
+func RawSchema(eventType string) ([]byte, bool) {
+
+	if _, ok := registry[eventType]; !ok {
+		return nil, false
+	}
+
+	raw, err := schemaFiles.ReadFile(path.Join("schemas", eventType+".json"))
+	if err != nil {
+		return nil, false
+	}
+
+	return raw, true
+}
+
+// Validate checks data against the schema of its event type
+func Validate(eventType string, data []byte) error {
+
+	schema, ok := registry[eventType]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownType, eventType)
+	}
+
+	return validate(schema, data)
+}
+
+// validate checks a JSON document against the schema, listing every way it doesn't match
+func validate(schema *jsonschema.Schema, data []byte) error {
+
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return SchemaErrors{{Keyword: "type", Message: "isn't valid json"}}
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if err = schema.Validate(value); !errors.As(err, &validationErr) {
+		return err
+	}
+
+	var errs SchemaErrors
+	collect(validationErr, &errs)
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+
+	return errs
+}
+
+// collect adapts the leaves of a validation error to schema errors, required and additionalProperties errors are
+// reported on every property they're about
+func collect(err *jsonschema.ValidationError, errs *SchemaErrors) {
+
+	if len(err.Causes) > 0 {
+		for _, cause := range err.Causes {
+			collect(cause, errs)
+		}
+		return
+	}
+
+	at := strings.Join(err.InstanceLocation, ".")
+
+	switch k := err.ErrorKind.(type) {
+	case *kind.Required:
+		for _, name := range k.Missing {
+			*errs = append(*errs, SchemaError{Path: join(at, name), Keyword: "required", Message: "is required"})
+		}
+	case *kind.AdditionalProperties:
+		for _, name := range k.Properties {
+			*errs = append(*errs, SchemaError{Path: join(at, name), Keyword: "additionalProperties", Message: "isn't allowed"})
+		}
+	default:
+		keyword := ""
+		if path := k.KeywordPath(); len(path) > 0 {
+			keyword = path[len(path)-1]
+		}
+		*errs = append(*errs, SchemaError{Path: at, Keyword: keyword, Message: k.LocalizedString(printer)})
+	}
+}
+
+func join(at, name string) string {
+
+	if at == "" {
+		return name
+	}
+
+	return at + "." + name
+}
+
+// mustLoadSchemas compiles every embedded schema, they're part of the binary so a broken one is a bug
+func mustLoadSchemas() map[string]*jsonschema.Schema {
+
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+
+	for _, entry := range entries {
+		raw, err := schemaFiles.ReadFile(path.Join("schemas", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+		if err != nil {
+			panic(fmt.Sprintf("schema %s: %s", entry.Name(), err))
+		}
+
+		if err = compiler.AddResource(schemaLocation+entry.Name(), doc); err != nil {
+			panic(err)
+		}
+	}
+
+	schemas := make(map[string]*jsonschema.Schema, len(entries))
+
+	for _, entry := range entries {
+		schema, err := compiler.Compile(schemaLocation + entry.Name())
+		if err != nil {
+			panic(fmt.Sprintf("schema %s: %s", entry.Name(), err))
+		}
+
+		schemas[strings.TrimSuffix(entry.Name(), ".json")] = schema
+	}
+
+	return schemas
+}
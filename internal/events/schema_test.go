@@ -0,0 +1,115 @@
+package events
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+func TestSchemas(t *testing.T) {
+	t.Run("every published subject has a schema", func(t *testing.T) {
+		subjects := append([]string{pkg.AuthGeneratePass, pkg.UserGet, pkg.UserGetByUsername, pkg.AuthValidateToken}, pkg.UserEventSubjects...)
+
+		for _, subject := range subjects {
+			_, ok := RawSchema(TypeOf(subject))
+			require.True(t, ok, subject)
+		}
+
+		for _, subject := range []string{pkg.AuthGeneratePass, pkg.UserGet, pkg.UserGetByUsername, pkg.AuthValidateToken} {
+			_, ok := RawSchema(TypeOf(ReplyOf(subject)))
+			require.True(t, ok, subject)
+		}
+	})
+
+	t.Run("listed in order with their url", func(t *testing.T) {
+		schemas := Schemas()
+		require.Len(t, schemas, len(registry))
+		require.Equal(t, SchemaInfo{Type: "auth.generate.password.reply.v1", Version: 1, URL: SchemaURL("auth.generate.password.reply.v1")}, schemas[0])
+	})
+}
+
+func TestSchema_Validate(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Type     string
+		Data     string
+		Expected SchemaErrors
+	}{
+		{
+			Name: "valid event",
+			Type: "user.deleted.v1",
+			Data: `{"user_id": 1, "deleted_at": "2026-10-18T10:00:00Z", "purge_at": "2026-11-17T10:00:00Z"}`,
+		},
+		{
+			Name: "missing and unexpected properties",
+			Type: "user.restored.v1",
+			Data: `{"user_id": 1, "password": "hash"}`,
+			Expected: SchemaErrors{
+				{Path: "password", Keyword: "additionalProperties", Message: "isn't allowed"},
+				{Path: "restored_at", Keyword: "required", Message: "is required"},
+			},
+		},
+		{
+			Name: "types, minimums and formats",
+			Type: "user.purged.v1",
+			Data: `{"user_id": 0, "purged_at": "yesterday"}`,
+			Expected: SchemaErrors{
+				{Path: "purged_at", Keyword: "format", Message: "'yesterday' is not valid date-time: less than 20 characters long"},
+				{Path: "user_id", Keyword: "minimum", Message: "minimum: got 0, want 1"},
+			},
+		},
+		{
+			Name: "integers aren't fractions",
+			Type: "user.get.v1",
+			Data: `{"id": 1.5}`,
+			Expected: SchemaErrors{
+				{Path: "id", Keyword: "type", Message: "got number, want integer"},
+			},
+		},
+		{
+			Name: "nested arrays and enums",
+			Type: "auth.validate_token.reply.v1",
+			Data: `{"result": {"user_id": 1, "roles": ["user", "root"], "expires_at": 1}}`,
+			Expected: SchemaErrors{
+				{Path: "result.roles.1", Keyword: "enum", Message: "value must be one of 'user', 'quiz_author', 'admin'"},
+			},
+		},
+		{
+			Name: "empty strings",
+			Type: "user.get_by_username.v1",
+			Data: `{"username": ""}`,
+			Expected: SchemaErrors{
+				{Path: "username", Keyword: "minLength", Message: "minLength: got 0, want 1"},
+			},
+		},
+		{
+			Name: "not json",
+			Type: "user.get.v1",
+			Data: `{`,
+			Expected: SchemaErrors{
+				{Keyword: "type", Message: "isn't valid json"},
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			err := Validate(test.Type, []byte(test.Data))
+			if test.Expected == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			var errs SchemaErrors
+			require.True(t, errors.As(err, &errs))
+			require.Equal(t, test.Expected, errs)
+		})
+	}
+
+	t.Run("unknown type", func(t *testing.T) {
+		require.ErrorIs(t, Validate("user.unknown.v1", []byte(`{}`)), ErrUnknownType)
+	})
+}
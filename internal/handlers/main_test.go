@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/mailer"
+	"github.com/knave-de-coeur/user-api-service/internal/middleware"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+var (
+	mockDB  *sql.DB
+	sqlMock sqlmock.Sqlmock
+
+	redisServer *miniredis.Miniredis
+
+	tokenService   *services.TokenService
+	authMiddleware *middleware.AuthMiddleware
+	userService    *services.UserService
+	natsHandler    *NatsHandler
+	testMailer     *failingMailer
+	log            *zap.Logger
+)
+
+// failingMailer counts the emails sent and fails to send them while failing is set
+type failingMailer struct {
+	sent    atomic.Int32
+	failing atomic.Bool
+}
+
+func (m *failingMailer) Send(context.Context, mailer.Message) error {
+	if m.failing.Load() {
+		return errors.New("smtp server unreachable")
+	}
+
+	m.sent.Add(1)
+
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	var err error
+
+	mockDB, sqlMock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		panic(fmt.Sprintf("an error '%s' was not expected when opening a stub database connection", err))
+	}
+	defer mockDB.Close()
+
+	gormDB, err := gorm.Open(mysql.New(mysql.Config{
+		DSN:                       "sqlmock_db_0",
+		DriverName:                "mysql",
+		Conn:                      mockDB,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+
+	redisServer, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer redisServer.Close()
+
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	log = zap.NewNop()
+
+	tokenService = services.NewTokenService(redisClient, services.NewHMACKeySet("testsecret"), log, services.TokenServiceSettings{
+		RefreshSecret:   "testrefreshsecret",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+	personalTokens := services.NewPersonalTokenService(gormDB, log, services.PersonalTokenServiceSettings{MaxTTL: 90 * 24 * time.Hour})
+	sessions := services.NewSessionService(gormDB, redisClient, log, services.SessionServiceSettings{TTL: time.Hour})
+
+	testMailer = &failingMailer{}
+	verifier := services.NewVerificationService(redisClient, testMailer, log, services.VerificationServiceSettings{
+		Secret:   "testemailsecret",
+		TTL:      time.Hour,
+		ResetTTL: time.Hour,
+		BaseURL:  "http://localhost:8080",
+	})
+
+	limiter := services.NewLoginLimiter(redisClient, log, services.LoginLimiterSettings{
+		EmailWindow:       time.Hour,
+		EmailIPLimit:      10,
+		EmailAddressLimit: 3,
+	})
+
+	userService = services.NewUserService(gormDB, tokenService, verifier, limiter, &utils.BcryptHasher{Cost: bcrypt.MinCost}, nil,
+		nil, nil, nil, sessions, personalTokens, nil, log, services.UserServiceSettings{})
+
+	authMiddleware = middleware.NewAuthMiddleware(tokenService, personalTokens, sessions)
+	natsHandler = NewNatsHandler(userService, authMiddleware, log)
+
+	m.Run()
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/middleware"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+var errUnsupportedVersion = &services.Error{Kind: services.ErrValidation, Code: "unsupported_version", Message: "event type version isn't supported", Field: "type"}
+
+type INatsHandler interface {
+	SetUpSubscriptions(nc *nats.Conn) error
+	getUser(msg *nats.Msg)
+	getUserByUsername(msg *nats.Msg)
+	validateToken(msg *nats.Msg)
+}
+
+// NatsHandler answers the requests other services send over nats, replies carry the statuses and error codes
+// the http api would answer with
+type NatsHandler struct {
+	UserService services.IUserService
+	Middleware  middleware.IAuthMiddleware
+	Validator   *validator.Validate
+	logger      *zap.Logger
+}
+
+func NewNatsHandler(service services.IUserService, auth middleware.IAuthMiddleware, logger *zap.Logger) *NatsHandler {
+	return &NatsHandler{
+		UserService: service,
+		Middleware:  auth,
+		Validator:   newValidator(nil),
+		logger:      logger,
+	}
+}
+
+// SetUpSubscriptions subscribes the responders in the pkg.ResponderQueue group so requests are spread across instances
+func (h *NatsHandler) SetUpSubscriptions(nc *nats.Conn) error {
+
+	responders := []struct {
+		subject string
+		handler nats.MsgHandler
+	}{
+		{pkg.UserGet, h.getUser},
+		{pkg.UserGetByUsername, h.getUserByUsername},
+		{pkg.AuthValidateToken, h.validateToken},
+	}
+
+	for _, responder := range responders {
+		if _, err := nc.QueueSubscribe(responder.subject, pkg.ResponderQueue, responder.handler); err != nil {
+			h.logger.Error("failed to subscribe responder", zap.String("subject", responder.subject), zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *NatsHandler) getUser(msg *nats.Msg) {
+
+	var getReq api.GetUserMessage
+
+	request, err := h.decode(msg, &getReq)
+	if err != nil {
+		h.respond(msg, nil, "missing or incorrect data received", nil, err)
+		return
+	}
+
+	user, err := h.UserService.GetUserByID(getReq.ID)
+	if err != nil {
+		h.respond(msg, request, "failed to get user", nil, err)
+		return
+	}
+
+	h.respond(msg, request, "", user, nil)
+}
+
+// getUserByUsername answers with the same user as getUser, the password hash is never sent
+func (h *NatsHandler) getUserByUsername(msg *nats.Msg) {
+
+	var getReq api.GetUserByUsernameMessage
+
+	request, err := h.decode(msg, &getReq)
+	if err != nil {
+		h.respond(msg, nil, "missing or incorrect data received", nil, err)
+		return
+	}
+
+	dbUser, err := h.UserService.GetUserByUsername(getReq.Username)
+	if err != nil {
+		h.respond(msg, request, "failed to get user", nil, err)
+		return
+	}
+
+	user, err := h.UserService.GetUserByID(dbUser.ID)
+	if err != nil {
+		h.respond(msg, request, "failed to get user", nil, err)
+		return
+	}
+
+	h.respond(msg, request, "", user, nil)
+}
+
+// validateToken checks a token exactly like RequireAuth does for the http api
+func (h *NatsHandler) validateToken(msg *nats.Msg) {
+
+	var validateReq api.ValidateTokenMessage
+
+	request, err := h.decode(msg, &validateReq)
+	if err != nil {
+		h.respond(msg, nil, "missing or incorrect data received", nil, err)
+		return
+	}
+
+	claims, err := h.Middleware.Authenticate(context.Background(), validateReq.Token, validateReq.IP)
+	if err != nil {
+		h.respond(msg, request, "something went wrong with the token", nil, err)
+		return
+	}
+
+	h.respond(msg, request, "", api.TokenClaims{
+		UserID:    claims.UserID,
+		Roles:     claims.Roles,
+		ExpiresAt: claims.ExpiresAt,
+		SessionID: claims.SessionID,
+		TokenID:   claims.TokenID,
+	}, nil)
+}
+
+// decode reads the cloudevent of the request, refusing versions of it this instance doesn't speak, and unmarshals
+// and validates its data
+func (h *NatsHandler) decode(msg *nats.Msg, req any) (*events.Event, error) {
+
+	request, err := events.Decode(msg, msg.Subject)
+	if errors.Is(err, events.ErrUnsupportedVersion) {
+		return nil, errUnsupportedVersion
+	}
+	if err != nil {
+		return nil, services.NewValidationError(err)
+	}
+
+	if err = request.DataAs(req); err != nil {
+		return nil, services.NewValidationError(err)
+	}
+
+	if err = h.Validator.Struct(req); err != nil {
+		return nil, services.NewValidationError(err)
+	}
+
+	return request, nil
+}
+
+// respond replies with the result, or with the error rendered like the http api would, in the mode of the request.
+// A reply that doesn't match its schema is logged and replaced by an internal error.
+func (h *NatsHandler) respond(msg *nats.Msg, request *events.Event, message string, result any, err error) {
+
+	reply := api.Reply{Result: result}
+
+	if err != nil {
+		reply.Error = h.replyError(msg, message, err)
+	}
+
+	event, err := h.wrapReply(msg, request, reply)
+	if err != nil {
+		h.logger.Error("reply doesn't match its schema", zap.String("subject", msg.Subject), zap.Error(err))
+
+		internalErr := &api.ReplyError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "internal server error"}
+		if event, err = h.wrapReply(msg, request, api.Reply{Error: internalErr}); err != nil {
+			h.logger.Error("something went wrong wrapping reply", zap.String("subject", msg.Subject), zap.Error(err))
+			return
+		}
+	}
+
+	out, err := event.Message(msg.Reply, events.ModeOf(msg))
+	if err != nil {
+		h.logger.Error("something went wrong encoding reply", zap.String("subject", msg.Subject), zap.Error(err))
+		return
+	}
+
+	if err = msg.RespondMsg(out); err != nil {
+		h.logger.Warn("failed to reply", zap.String("subject", msg.Subject), zap.Error(err))
+	}
+}
+
+func (h *NatsHandler) replyError(msg *nats.Msg, message string, err error) *api.ReplyError {
+
+	status, response := middleware.RenderError(message, err)
+	if status >= http.StatusInternalServerError {
+		h.logger.Error(message, zap.String("subject", msg.Subject), zap.Int("status", status), zap.Error(err))
+	}
+
+	return &api.ReplyError{
+		Status:  status,
+		Code:    response.Code,
+		Message: response.Error,
+		Details: response.Details,
+	}
+}
+
+// wrapReply wraps the reply in the trace of the request, requests that couldn't be read get a reply of the current version
+func (h *NatsHandler) wrapReply(msg *nats.Msg, request *events.Event, reply api.Reply) (*events.Event, error) {
+
+	if request != nil {
+		return request.Reply(reply)
+	}
+
+	return events.New(events.TypeOf(events.ReplyOf(msg.Subject)), reply)
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// runNats starts an in-process nats server and returns a function connecting to it
+func runNats(t *testing.T) func() *nats.Conn {
+	t.Helper()
+
+	ns, err := utils.StartNatsServer(utils.NatsServerSettings{Host: "127.0.0.1", Port: -1}, log)
+	require.NoError(t, err)
+	t.Cleanup(ns.Shutdown)
+
+	return func() *nats.Conn {
+		nc, err := nats.Connect(ns.ClientURL())
+		require.NoError(t, err)
+		t.Cleanup(nc.Close)
+
+		return nc
+	}
+}
+
+// request sends data as a request of the current version on subject and returns the reply, which has to be a
+// supported version of the reply type and match its schema
+func request(t *testing.T, nc *nats.Conn, subject, mode string, data any) (*events.Event, api.Reply) {
+	t.Helper()
+
+	event, err := events.New(events.TypeOf(subject), data)
+	require.NoError(t, err)
+
+	return requestEvent(t, nc, subject, mode, event)
+}
+
+func requestEvent(t *testing.T, nc *nats.Conn, subject, mode string, event *events.Event) (*events.Event, api.Reply) {
+	t.Helper()
+
+	msg, err := event.Message(subject, mode)
+	require.NoError(t, err)
+
+	out, err := nc.RequestMsg(msg, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, mode, events.ModeOf(out))
+
+	reply, err := events.Decode(out, events.ReplyOf(subject))
+	require.NoError(t, err)
+	require.Equal(t, events.TypeOf(events.ReplyOf(subject)), reply.Type)
+	require.NoError(t, events.Validate(reply.Type, reply.Data))
+
+	var data api.Reply
+	require.NoError(t, reply.DataAs(&data))
+
+	return reply, data
+}
+
+// expectUser expects user 7 to be looked up by the column passed, found when found is set
+func expectUser(column string, arg any, found bool) {
+	rows := sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "age", "username", "password", "created_at", "updated_at"})
+	if found {
+		rows.AddRow(7, "Ada", "Lovelace", "ada@example.com", 36, "ada", "$2a$04$hash", time.Now(), time.Now())
+	}
+
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE " + column + " = \\?").
+		WithArgs(arg).
+		WillReturnRows(rows)
+}
+
+func expectRoles() {
+	sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\? ORDER BY role").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin").AddRow("user"))
+}
+
+func TestNatsHandler_Responders(t *testing.T) {
+	connect := runNats(t)
+	nc := connect()
+
+	responder := connect()
+	require.NoError(t, natsHandler.SetUpSubscriptions(responder))
+	require.NoError(t, responder.Flush())
+
+	t.Run("user.get answers with the user and its roles", func(t *testing.T) {
+		expectUser("id", 7, true)
+		expectRoles()
+
+		_, reply := request(t, nc, pkg.UserGet, events.ModeStructured, api.GetUserMessage{ID: 7})
+		require.Nil(t, reply.Error)
+
+		user := reply.Result.(map[string]any)
+		require.Equal(t, "ada", user["username"])
+		require.Equal(t, []any{"admin", "user"}, user["roles"])
+		require.NotContains(t, user, "password")
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("user.get of an unknown user", func(t *testing.T) {
+		expectUser("id", 8, false)
+
+		_, reply := request(t, nc, pkg.UserGet, events.ModeStructured, api.GetUserMessage{ID: 8})
+		require.Nil(t, reply.Result)
+		require.Equal(t, &api.ReplyError{Status: 404, Code: "user_not_found", Message: "user not found"}, reply.Error)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("user.get_by_username answers in the mode of the request", func(t *testing.T) {
+		expectUser("username", "ada", true)
+		expectUser("id", 7, true)
+		expectRoles()
+
+		_, reply := request(t, nc, pkg.UserGetByUsername, events.ModeBinary, api.GetUserByUsernameMessage{Username: "ada"})
+		require.Nil(t, reply.Error)
+		require.Equal(t, "ada@example.com", reply.Result.(map[string]any)["email"])
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("user.get_by_username of an unknown user", func(t *testing.T) {
+		expectUser("username", "grace", false)
+
+		_, reply := request(t, nc, pkg.UserGetByUsername, events.ModeStructured, api.GetUserByUsernameMessage{Username: "grace"})
+		require.Equal(t, 404, reply.Error.Status)
+		require.Equal(t, "user_not_found", reply.Error.Code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("auth.validate_token answers with the claims of a token", func(t *testing.T) {
+		ctx := context.Background()
+
+		pair, err := tokenService.IssueTokenPair(ctx, services.TokenSubject{UserID: 7, Roles: []pkg.Role{pkg.RoleUser}})
+		require.NoError(t, err)
+
+		claims, err := tokenService.ValidateAccessToken(ctx, pair.Token)
+		require.NoError(t, err)
+		require.NoError(t, redisServer.Set("auth:session:"+claims.SessionID, "7"))
+
+		replyEvent, reply := request(t, nc, pkg.AuthValidateToken, events.ModeStructured, api.ValidateTokenMessage{Token: pair.Token, IP: "10.0.0.1"})
+		require.Nil(t, reply.Error)
+		require.Equal(t, map[string]any{
+			"user_id":    float64(7),
+			"roles":      []any{"user"},
+			"expires_at": float64(claims.ExpiresAt),
+			"session_id": claims.SessionID,
+		}, reply.Result)
+		require.NotEmpty(t, replyEvent.TraceParent)
+	})
+
+	t.Run("auth.validate_token of an invalid token", func(t *testing.T) {
+		_, reply := request(t, nc, pkg.AuthValidateToken, events.ModeStructured, api.ValidateTokenMessage{Token: "not-a-token"})
+		require.Nil(t, reply.Result)
+		require.Equal(t, 401, reply.Error.Status)
+		require.Equal(t, "invalid_token", reply.Error.Code)
+	})
+
+	t.Run("auth.validate_token of a revoked session", func(t *testing.T) {
+		ctx := context.Background()
+
+		pair, err := tokenService.IssueTokenPair(ctx, services.TokenSubject{UserID: 7, Roles: []pkg.Role{pkg.RoleUser}})
+		require.NoError(t, err)
+
+		claims, err := tokenService.ValidateAccessToken(ctx, pair.Token)
+		require.NoError(t, err)
+		require.NoError(t, redisServer.Set("auth:session:"+claims.SessionID, "revoked"))
+
+		_, reply := request(t, nc, pkg.AuthValidateToken, events.ModeStructured, api.ValidateTokenMessage{Token: pair.Token})
+		require.Equal(t, 401, reply.Error.Status)
+		require.Equal(t, "session_revoked", reply.Error.Code)
+	})
+
+	t.Run("requests of an unknown version are refused", func(t *testing.T) {
+		event, err := events.New(events.TypeOf(pkg.UserGet), api.GetUserMessage{ID: 7})
+		require.NoError(t, err)
+		event.Type = pkg.UserGet + ".v99"
+
+		_, reply := requestEvent(t, nc, pkg.UserGet, events.ModeStructured, event)
+		require.Equal(t, 400, reply.Error.Status)
+		require.Equal(t, "unsupported_version", reply.Error.Code)
+	})
+
+	t.Run("requests that aren't cloudevents", func(t *testing.T) {
+		msg := nats.NewMsg(pkg.UserGet)
+		msg.Data = []byte(`{"id": 7}`)
+
+		out, err := nc.RequestMsg(msg, time.Second)
+		require.NoError(t, err)
+
+		reply, err := events.Decode(out, events.ReplyOf(pkg.UserGet))
+		require.NoError(t, err)
+
+		var data api.Reply
+		require.NoError(t, reply.DataAs(&data))
+		require.Equal(t, 400, data.Error.Status)
+	})
+}
+
+func TestNatsHandler_QueueGroup(t *testing.T) {
+	connect := runNats(t)
+	nc := connect()
+
+	// two instances answering in the same queue group
+	first, second := connect(), connect()
+	require.NoError(t, natsHandler.SetUpSubscriptions(first))
+	require.NoError(t, natsHandler.SetUpSubscriptions(second))
+	require.NoError(t, first.Flush())
+	require.NoError(t, second.Flush())
+
+	inbox := nats.NewInbox()
+	var replies atomic.Int32
+	sub, err := nc.Subscribe(inbox, func(*nats.Msg) { replies.Add(1) })
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sub.Unsubscribe() })
+
+	const requests = 20
+	for i := 0; i < requests; i++ {
+		event, err := events.New(events.TypeOf(pkg.AuthValidateToken), api.ValidateTokenMessage{Token: "not-a-token"})
+		require.NoError(t, err)
+
+		msg, err := event.Message(pkg.AuthValidateToken, events.ModeStructured)
+		require.NoError(t, err)
+		msg.Reply = inbox
+
+		require.NoError(t, nc.PublishMsg(msg))
+	}
+	require.NoError(t, nc.Flush())
+
+	require.Eventually(t, func() bool { return replies.Load() == requests }, time.Second, 10*time.Millisecond)
+	// no request is answered twice
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(requests), replies.Load())
+
+	// every instance took its share
+	require.NotZero(t, first.Stats().InMsgs)
+	require.NotZero(t, second.Stats().InMsgs)
+	require.Equal(t, uint64(requests), first.Stats().InMsgs+second.Stats().InMsgs)
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/middleware"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+type IOAuthHandler interface {
+	SetUpRoutes(r *gin.RouterGroup)
+	authorize(c *gin.Context)
+	consent(c *gin.Context)
+	token(c *gin.Context)
+	userInfo(c *gin.Context)
+	listClients(c *gin.Context)
+	registerClient(c *gin.Context)
+	deleteClient(c *gin.Context)
+	listConsents(c *gin.Context)
+	revokeConsent(c *gin.Context)
+}
+
+// OAuthHandler serves the oauth 2.1 / openid connect provider, the token and userinfo endpoints answer in the
+// RFC 6749 error format so off the shelf client libraries understand them
+type OAuthHandler struct {
+	OAuth      services.IOAuthService
+	Middleware middleware.IAuthMiddleware
+	Validator  *validator.Validate
+}
+
+func NewOAuthHandler(oauth services.IOAuthService, auth middleware.IAuthMiddleware) *OAuthHandler {
+	return &OAuthHandler{
+		OAuth:      oauth,
+		Middleware: auth,
+		Validator:  newValidator(nil),
+	}
+}
+
+// SetUpRoutes sets up the oauth routes, these are unversioned as their paths are advertised in the discovery document
+func (h *OAuthHandler) SetUpRoutes(r *gin.RouterGroup) {
+
+	// the login page of the frontend calls these with the user's own token and follows redirect_to
+	r.GET("authorize", h.Middleware.RequireAuth(), h.authorize)
+	r.POST("authorize", h.Middleware.RequireAuth(), h.consent)
+
+	r.POST("token", h.token)
+	r.GET("userinfo", h.userInfo)
+	r.POST("userinfo", h.userInfo)
+
+	r.GET("consents", h.Middleware.RequireAuth(), h.listConsents)
+	r.DELETE("consents/:clientID", h.Middleware.RequireAuth(), h.revokeConsent)
+
+	r.Group("clients", h.Middleware.RequireAuth(), h.Middleware.RequireRole(pkg.RoleAdmin)).
+		GET("", h.listClients).
+		POST("", h.registerClient).
+		DELETE("/:clientID", h.deleteClient)
+
+}
+
+// authorize checks the authorization request for the logged-in user, answering with where to send the user agent
+// or with the scopes the user has to consent to first
+func (h *OAuthHandler) authorize(c *gin.Context) {
+	var authReq api.AuthorizeRequest
+
+	if err := c.ShouldBindQuery(&authReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse authorization request", services.NewValidationError(err))
+		return
+	}
+
+	// consent can only be given with a POST
+	authReq.Consent = ""
+	authReq.UserID = uint(c.GetInt("user_id"))
+
+	h.respondAuthorize(c, authReq)
+}
+
+// consent answers the consent prompt, the body repeats the authorization request along with consent set to approve or deny
+func (h *OAuthHandler) consent(c *gin.Context) {
+	var authReq api.AuthorizeRequest
+
+	if err := c.ShouldBind(&authReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse authorization request", services.NewValidationError(err))
+		return
+	}
+
+	if authReq.Consent != "approve" && authReq.Consent != "deny" {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewFieldError("consent", "must be approve or deny"))
+		return
+	}
+
+	authReq.UserID = uint(c.GetInt("user_id"))
+
+	h.respondAuthorize(c, authReq)
+}
+
+func (h *OAuthHandler) respondAuthorize(c *gin.Context, authReq api.AuthorizeRequest) {
+
+	res, err := h.OAuth.Authorize(c.Request.Context(), authReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to authorize client", err)
+		return
+	}
+
+	message := "redirect the user agent back to the client"
+	if res.ConsentRequired {
+		message = "the user has to consent to the scopes first"
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse(message, res, nil))
+}
+
+// token is the token endpoint, clients authenticate with basic auth or client_id and client_secret in the form
+func (h *OAuthHandler) token(c *gin.Context) {
+	var tokenReq api.TokenRequest
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	if err := c.ShouldBind(&tokenReq); err != nil {
+		abortWithOAuthError(c, services.NewValidationError(err))
+		return
+	}
+
+	// basic auth credentials are form encoded before being joined, RFC 6749 section 2.3.1
+	if clientID, secret, ok := c.Request.BasicAuth(); ok {
+		var idErr, secretErr error
+		tokenReq.ClientID, idErr = url.QueryUnescape(clientID)
+		tokenReq.ClientSecret, secretErr = url.QueryUnescape(secret)
+		if idErr != nil || secretErr != nil {
+			abortWithOAuthError(c, services.ErrInvalidClient)
+			return
+		}
+	}
+
+	res, err := h.OAuth.Exchange(c.Request.Context(), tokenReq)
+	if err != nil {
+		abortWithOAuthError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// userInfo returns the claims of the user the access token was issued for
+func (h *OAuthHandler) userInfo(c *gin.Context) {
+
+	accessToken := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if accessToken == "" || accessToken == c.GetHeader("Authorization") {
+		c.Header("WWW-Authenticate", `Bearer realm="userinfo"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := h.OAuth.UserInfo(c.Request.Context(), accessToken)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		// RFC 6750 has a single error code for every reason a bearer token is refused
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, api.OAuthErrorResponse{Error: "invalid_token", ErrorDescription: err.Error()})
+		return
+	} else if err != nil {
+		abortWithOAuthError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, claims)
+}
+
+func (h *OAuthHandler) listClients(c *gin.Context) {
+
+	clients, err := h.OAuth.ListClients()
+	if err != nil {
+		middleware.AbortWithError(c, "failed to get oauth clients", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got oauth clients", clients, nil))
+}
+
+// registerClient registers a new client, the secret is only shown in this response
+func (h *OAuthHandler) registerClient(c *gin.Context) {
+	var registerReq api.RegisterOAuthClientRequest
+
+	if err := c.ShouldBindJSON(&registerReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse oauth client", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(registerReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	client, err := h.OAuth.RegisterClient(registerReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to register oauth client", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, api.GenerateMessageResponse("oauth client registered", client, nil))
+}
+
+func (h *OAuthHandler) deleteClient(c *gin.Context) {
+
+	if err := h.OAuth.DeleteClient(c.Param("clientID")); err != nil {
+		middleware.AbortWithError(c, "failed to delete oauth client", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully deleted oauth client", nil, nil))
+}
+
+// listConsents returns the clients the logged-in user has granted access to
+func (h *OAuthHandler) listConsents(c *gin.Context) {
+
+	consents, err := h.OAuth.ListConsents(uint(c.GetInt("user_id")))
+	if err != nil {
+		middleware.AbortWithError(c, "failed to get oauth consents", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got oauth consents", consents, nil))
+}
+
+func (h *OAuthHandler) revokeConsent(c *gin.Context) {
+
+	if err := h.OAuth.RevokeConsent(uint(c.GetInt("user_id")), c.Param("clientID")); err != nil {
+		middleware.AbortWithError(c, "failed to revoke oauth consent", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully revoked oauth consent", nil, nil))
+}
+
+// abortWithOAuthError renders the error as an RFC 6749 error response, the status is picked the same way as for any other error
+func abortWithOAuthError(c *gin.Context, err error) {
+
+	status, _ := middleware.RenderError("", err)
+
+	response := api.OAuthErrorResponse{Error: "invalid_request", ErrorDescription: err.Error()}
+
+	var domainErr *services.Error
+	switch {
+	case errors.As(err, &domainErr):
+		response.Error = domainErr.Code
+		response.ErrorDescription = domainErr.Message
+	case status >= http.StatusInternalServerError:
+		response = api.OAuthErrorResponse{Error: "server_error"}
+	}
+
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(status, response)
+}
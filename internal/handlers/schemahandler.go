@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/middleware"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+var errSchemaNotFound = &services.Error{Kind: services.ErrNotFound, Code: "schema_not_found", Message: "no schema for this event type"}
+
+type ISchemaHandler interface {
+	SetUpRoutes(r *gin.RouterGroup)
+	listSchemas(c *gin.Context)
+	getSchema(c *gin.Context)
+}
+
+// SchemaHandler serves the JSON schemas of the data of every message sent over nats, the dataschema of an event
+// points at its schema here
+type SchemaHandler struct{}
+
+func NewSchemaHandler() *SchemaHandler {
+	return &SchemaHandler{}
+}
+
+// SetUpRoutes sets up the schema routes, these are public
+func (h *SchemaHandler) SetUpRoutes(r *gin.RouterGroup) {
+
+	r.GET("schemas", h.listSchemas)
+	r.GET("schemas/:type", h.getSchema)
+
+}
+
+func (h *SchemaHandler) listSchemas(c *gin.Context) {
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got schemas", events.Schemas(), nil))
+
+}
+
+// getSchema returns the schema file of an event type as it is, so validators can load it straight from here
+func (h *SchemaHandler) getSchema(c *gin.Context) {
+
+	schema, ok := events.RawSchema(c.Param("type"))
+	if !ok {
+		middleware.AbortWithError(c, "failed to get schema", errSchemaNotFound)
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, "application/schema+json", schema)
+
+}
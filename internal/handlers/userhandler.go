@@ -1,20 +1,24 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
+	"io"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/redis/go-redis/v9"
 
 	"github.com/knave-de-coeur/user-api-service/internal/api"
 	"github.com/knave-de-coeur/user-api-service/internal/middleware"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
 	"github.com/knave-de-coeur/user-api-service/internal/services"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/nats-io/nats.go"
-	"gorm.io/gorm"
 )
 
 type IUserHandler interface {
@@ -23,24 +27,65 @@ type IUserHandler interface {
 	newUser(c *gin.Context)
 	updateUser(c *gin.Context)
 	deleteUser(c *gin.Context)
+	restoreUser(c *gin.Context)
 	login(c *gin.Context)
+	refreshToken(c *gin.Context)
+	logout(c *gin.Context)
+	updateUserRoles(c *gin.Context)
+	verifyEmail(c *gin.Context)
+	resendVerification(c *gin.Context)
+	forgotPassword(c *gin.Context)
+	resetPassword(c *gin.Context)
+	loginMFA(c *gin.Context)
+	enrolTOTP(c *gin.Context)
+	confirmTOTP(c *gin.Context)
+	disableTOTP(c *gin.Context)
+	beginPasskeyLogin(c *gin.Context)
+	passkeyLogin(c *gin.Context)
+	listPasskeys(c *gin.Context)
+	beginPasskeyRegistration(c *gin.Context)
+	finishPasskeyRegistration(c *gin.Context)
+	deletePasskey(c *gin.Context)
+	beginExternalLogin(c *gin.Context)
+	externalLogin(c *gin.Context)
+	listIdentities(c *gin.Context)
+	beginLinkIdentity(c *gin.Context)
+	finishLinkIdentity(c *gin.Context)
+	unlinkIdentity(c *gin.Context)
+	listPersonalTokens(c *gin.Context)
+	createPersonalToken(c *gin.Context)
+	revokePersonalToken(c *gin.Context)
+	listSessions(c *gin.Context)
+	revokeSession(c *gin.Context)
+	revokeOtherSessions(c *gin.Context)
 }
 
 type UserHandler struct {
 	UserService services.IUserService
+	MFAService  services.IMFAService
+	Passkeys    services.IWebAuthnService
+	Identities  services.IIdentityService
+	Tokens      services.IPersonalTokenService
+	Sessions    services.ISessionService
 	Middleware  middleware.IAuthMiddleware
 	Validator   *validator.Validate
 	RedisClient *redis.Client
 	Nats        *nats.Conn
 }
 
-func NewUserHandler(service services.IUserService, auth middleware.IAuthMiddleware, redisClient *redis.Client,
-	nc *nats.Conn) *UserHandler {
+func NewUserHandler(service services.IUserService, mfa services.IMFAService, passkeys services.IWebAuthnService,
+	identities services.IIdentityService, tokens services.IPersonalTokenService,
+	sessions services.ISessionService, auth middleware.IAuthMiddleware, passwords *utils.PasswordPolicy, redisClient *redis.Client, nc *nats.Conn) *UserHandler {
 
 	return &UserHandler{
 		Nats:        nc,
 		UserService: service,
-		Validator:   validator.New(),
+		MFAService:  mfa,
+		Passkeys:    passkeys,
+		Identities:  identities,
+		Tokens:      tokens,
+		Sessions:    sessions,
+		Validator:   newValidator(passwords),
 		Middleware:  auth,
 		RedisClient: redisClient,
 	}
@@ -50,47 +95,85 @@ func NewUserHandler(service services.IUserService, auth middleware.IAuthMiddlewa
 func (h *UserHandler) SetUpRoutes(r *gin.RouterGroup) {
 
 	r.POST("login", h.login)
-	// TODO: finalize logout
-	//r.POST("logout", h.logout)
-
-	r.GET("users", h.getUsers)
+	r.POST("login/mfa", h.loginMFA)
+	r.POST("login/passkey/begin", h.beginPasskeyLogin)
+	r.POST("login/passkey/finish", h.passkeyLogin)
+	r.POST("login/oidc/begin", h.beginExternalLogin)
+	r.POST("login/oidc/finish", h.externalLogin)
+	r.POST("logout", h.logout)
+	r.POST("token/refresh", h.refreshToken)
+	r.POST("password/forgot", h.forgotPassword)
+	r.POST("password/reset", h.resetPassword)
+
+	r.GET("users", h.Middleware.RequireAuth(), h.Middleware.RequireRole(pkg.RoleAdmin), h.getUsers)
 
 	r.Group("user").
 		POST("", h.newUser).
-		GET("/:uID", h.Middleware.RequireAuth(), h.getUserByID).
-		PUT("/:uID", h.Middleware.RequireAuth(), h.updateUser).
-		DELETE("/:uID", h.Middleware.RequireAuth(), h.deleteUser)
+		POST("/verify", h.verifyEmail).
+		POST("/verify/resend", h.resendVerification).
+		GET("/:uID", h.Middleware.RequireAuth(), h.Middleware.RequireSelfOrRole(pkg.RoleAdmin), h.getUserByID).
+		PUT("/:uID", h.Middleware.RequireAuth(), h.Middleware.RequireSelfOrRole(pkg.RoleAdmin), h.Middleware.RequireSession(), h.updateUser).
+		DELETE("/:uID", h.Middleware.RequireAuth(), h.Middleware.RequireSelfOrRole(pkg.RoleAdmin), h.Middleware.RequireSession(), h.deleteUser).
+		POST("/:uID/restore", h.Middleware.RequireAuth(), h.Middleware.RequireRole(pkg.RoleAdmin), h.restoreUser).
+		PUT("/:uID/roles", h.Middleware.RequireAuth(), h.Middleware.RequireRole(pkg.RoleAdmin), h.updateUserRoles)
+
+	// credentials are only ever managed by their owner, admins included, and never with a personal access token
+	r.Group("user/:uID", h.Middleware.RequireAuth(), h.Middleware.RequireSelfOrRole(), h.Middleware.RequireSession()).
+		POST("/mfa/totp", h.enrolTOTP).
+		POST("/mfa/totp/confirm", h.confirmTOTP).
+		DELETE("/mfa/totp", h.disableTOTP).
+		GET("/passkeys", h.listPasskeys).
+		POST("/passkeys/register/begin", h.beginPasskeyRegistration).
+		POST("/passkeys/register/finish", h.finishPasskeyRegistration).
+		DELETE("/passkeys/:credID", h.deletePasskey).
+		GET("/identities", h.listIdentities).
+		POST("/identities/begin", h.beginLinkIdentity).
+		POST("/identities/finish", h.finishLinkIdentity).
+		DELETE("/identities/:identityID", h.unlinkIdentity).
+		GET("/tokens", h.listPersonalTokens).
+		POST("/tokens", h.createPersonalToken).
+		DELETE("/tokens/:tokenID", h.revokePersonalToken).
+		GET("/sessions", h.listSessions).
+		DELETE("/sessions", h.revokeOtherSessions).
+		DELETE("/sessions/:sessionID", h.revokeSession)
 
 }
 
 func (h *UserHandler) getUsers(c *gin.Context) {
 
-	users, err := h.UserService.GetBasicUserDataList()
+	var listReq api.ListUsersRequest
+
+	if err := c.ShouldBindQuery(&listReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse users query", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(listReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	users, pagination, err := h.UserService.ListUsers(listReq)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to get users", nil, err))
+		middleware.AbortWithError(c, "failed to get users", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully grabbed all users", users, nil))
+	c.JSON(http.StatusOK, api.GeneratePaginatedMessageResponse("successfully grabbed users", users, pagination))
 
 }
 
 func (h *UserHandler) getUserByID(c *gin.Context) {
 
-	userID := c.Param("uID")
-	userIDint, err := strconv.Atoi(userID)
-
+	userID, err := userIDParam(c)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("failed to get userID", nil, err))
-		return
-	} else if userIDint < 1 {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("failed to get user", nil, fmt.Errorf("invalid user id")))
+		middleware.AbortWithError(c, "failed to get userID", err)
 		return
 	}
 
-	user, err := h.UserService.GetUserByID(uint(userIDint))
+	user, err := h.UserService.GetUserByID(userID)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to get user", nil, err))
+		middleware.AbortWithError(c, "failed to get user", err)
 		return
 	}
 
@@ -103,18 +186,18 @@ func (h *UserHandler) newUser(c *gin.Context) {
 	var newUserReq api.NewUserRequest
 
 	if err := c.ShouldBindJSON(&newUserReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to parse new user request", nil, err))
+		middleware.AbortWithError(c, "failed to parse new user request", services.NewValidationError(err))
 		return
 	}
 
 	if err := h.Validator.Struct(newUserReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("missing or incorrect data received", nil, err))
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
 		return
 	}
 
 	res, err := h.UserService.InsertUser(newUserReq)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to add user", nil, err))
+		middleware.AbortWithError(c, "failed to add user", err)
 		return
 	}
 
@@ -124,36 +207,29 @@ func (h *UserHandler) newUser(c *gin.Context) {
 
 func (h *UserHandler) updateUser(c *gin.Context) {
 
-	userID := c.Param("uID")
-	userIDint, err := strconv.Atoi(userID)
+	userID, err := userIDParam(c)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("wrong id format in url", nil, err))
+		middleware.AbortWithError(c, "wrong id format in url", err)
 		return
 	}
 
 	var updateUserReq api.UpdateUserRequest
 
 	if err = c.ShouldBindJSON(&updateUserReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to parse new user request", nil, err))
+		middleware.AbortWithError(c, "failed to parse update user request", services.NewValidationError(err))
 		return
 	}
 
-	updateUserReq.ID = uint(userIDint)
+	updateUserReq.ID = userID
+	updateUserReq.Self = c.GetInt("user_id") == int(userID)
 
 	if err = h.Validator.Struct(updateUserReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("missing or incorrect data received", nil, err))
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
 		return
 	}
 
-	err = h.UserService.UpdateUser(updateUserReq)
-	if err != nil {
-		var status int
-		if err == gorm.ErrRecordNotFound {
-			status = http.StatusNotModified
-		} else {
-			status = http.StatusInternalServerError
-		}
-		c.AbortWithStatusJSON(status, api.GenerateMessageResponse("failed to update user", nil, err))
+	if err = h.UserService.UpdateUser(updateUserReq); err != nil {
+		middleware.AbortWithError(c, "failed to update user", err)
 		return
 	}
 
@@ -163,60 +239,782 @@ func (h *UserHandler) updateUser(c *gin.Context) {
 
 func (h *UserHandler) deleteUser(c *gin.Context) {
 
-	userID := c.Param("uID")
-	userIDint, err := strconv.Atoi(userID)
+	userID, err := userIDParam(c)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("wrong id format in url", nil, err))
+		middleware.AbortWithError(c, "wrong id format in url", err)
 		return
 	}
 
 	var deleteUserReq api.DeleteUserRequest
 
 	if err = c.ShouldBindJSON(&deleteUserReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to parse new user request", nil, err))
+		middleware.AbortWithError(c, "failed to parse delete user request", services.NewValidationError(err))
 		return
 	}
 
-	deleteUserReq.ID = uint(userIDint)
+	deleteUserReq.ID = userID
 
 	if err = h.Validator.Struct(deleteUserReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("missing or incorrect data received", nil, err))
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
 		return
 	}
 
-	err = h.UserService.DeleteUser(deleteUserReq)
-	if err != nil {
-		var status int
-		if err == gorm.ErrRecordNotFound {
-			status = http.StatusNotModified
-		} else {
-			status = http.StatusInternalServerError
-		}
-		c.AbortWithStatusJSON(status, api.GenerateMessageResponse("failed to delete user", nil, err))
+	if err = h.UserService.DeleteUser(deleteUserReq); err != nil {
+		middleware.AbortWithError(c, "failed to delete user", err)
 		return
 	}
 
 	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully deleted user", nil, nil))
 }
 
+// restoreUser undoes the soft delete of a user that wasn't purged yet, admin only
+func (h *UserHandler) restoreUser(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	restoreReq := api.RestoreUserRequest{ID: userID}
+
+	if err = h.Validator.Struct(restoreReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	if err = h.UserService.RestoreUser(restoreReq); err != nil {
+		middleware.AbortWithError(c, "failed to restore user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully restored user", nil, nil))
+}
+
+// updateUserRoles replaces the roles of the user, admin only
+func (h *UserHandler) updateUserRoles(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	var rolesReq api.UpdateUserRolesRequest
+
+	if err = c.ShouldBindJSON(&rolesReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse user roles request", services.NewValidationError(err))
+		return
+	}
+
+	rolesReq.ID = userID
+
+	if err = h.Validator.Struct(rolesReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	if err = h.UserService.SetUserRoles(rolesReq); err != nil {
+		middleware.AbortWithError(c, "failed to update user roles", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully updated user roles", nil, nil))
+}
+
+// verifyEmail redeems the token mailed to the user, marking their email as verified
+func (h *UserHandler) verifyEmail(c *gin.Context) {
+	var verifyReq api.VerifyEmailRequest
+
+	if err := c.ShouldBindJSON(&verifyReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse verify email request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(verifyReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.UserService.VerifyEmail(verifyReq); err != nil {
+		middleware.AbortWithError(c, "failed to verify email", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("email verified", nil, nil))
+}
+
+// resendVerification always answers the same way so it can't be used to look up registered emails
+func (h *UserHandler) resendVerification(c *gin.Context) {
+	var resendReq api.ResendVerificationRequest
+
+	if err := c.ShouldBindJSON(&resendReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse resend verification request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(resendReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	resendReq.IP = c.ClientIP()
+
+	if err := h.UserService.ResendVerification(resendReq); err != nil {
+		middleware.AbortWithError(c, "failed to resend verification email", err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, api.GenerateMessageResponse("if the email is registered and unverified a verification email is on its way", nil, nil))
+}
+
+// forgotPassword always answers the same way so it can't be used to look up registered emails
+func (h *UserHandler) forgotPassword(c *gin.Context) {
+	var forgotReq api.ForgotPasswordRequest
+
+	if err := c.ShouldBindJSON(&forgotReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse forgot password request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(forgotReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	forgotReq.IP = c.ClientIP()
+
+	if err := h.UserService.ForgotPassword(forgotReq); err != nil {
+		middleware.AbortWithError(c, "failed to send reset email", err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, api.GenerateMessageResponse("if the email is registered a reset email is on its way", nil, nil))
+}
+
+// resetPassword sets a new password using the token mailed by forgotPassword
+func (h *UserHandler) resetPassword(c *gin.Context) {
+	var resetReq api.ResetPasswordRequest
+
+	if err := c.ShouldBindJSON(&resetReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse reset password request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(resetReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.UserService.ResetPassword(resetReq); err != nil {
+		middleware.AbortWithError(c, "failed to reset password", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("password reset", nil, nil))
+}
+
 // Login endpoint function that checks username and password and sets user appropriately
 func (h *UserHandler) login(c *gin.Context) {
 	var loginReq api.LoginRequest
 
 	if err := c.ShouldBindJSON(&loginReq); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, api.GenerateMessageResponse("failed to login", nil, err))
+		middleware.AbortWithError(c, "failed to login", services.NewValidationError(err))
 		return
 	}
 
+	loginReq.IP = c.ClientIP()
+	loginReq.UserAgent = c.Request.UserAgent()
+
 	user, err := h.UserService.Login(loginReq)
-	if err != nil && err == gorm.ErrRecordNotFound {
-		c.AbortWithStatusJSON(http.StatusNotFound, api.GenerateMessageResponse("failed to login requested user", nil, err))
-		return
-	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, api.GenerateMessageResponse("failed to login requested user", nil, err))
+	if err != nil {
+		middleware.AbortWithError(c, "failed to login requested user", err)
 		return
 	}
 
 	c.JSON(http.StatusOK, api.GenerateMessageResponse("login successful", user, nil))
 
 }
+
+// loginMFA completes a login that asked for a second factor, exchanging the mfa token and a code for the token pair
+func (h *UserHandler) loginMFA(c *gin.Context) {
+	var mfaReq api.MFALoginRequest
+
+	if err := c.ShouldBindJSON(&mfaReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse mfa login request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(mfaReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	mfaReq.Client = clientInfo(c)
+
+	tokens, err := h.UserService.CompleteMFALogin(mfaReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to login requested user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("login successful", tokens, nil))
+}
+
+// enrolTOTP generates a TOTP secret for the user to scan into their authenticator app
+func (h *UserHandler) enrolTOTP(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	enrolment, err := h.MFAService.EnrolTOTP(userID)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to enrol totp", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("scan the qr code and confirm with a code", enrolment, nil))
+}
+
+// confirmTOTP turns on two factor authentication, the recovery codes are only shown in this response
+func (h *UserHandler) confirmTOTP(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	var confirmReq api.ConfirmTOTPRequest
+
+	if err = c.ShouldBindJSON(&confirmReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse confirm totp request", services.NewValidationError(err))
+		return
+	}
+
+	confirmReq.UserID = userID
+
+	if err = h.Validator.Struct(confirmReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	codes, err := h.MFAService.ConfirmTOTP(confirmReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to confirm totp", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("two factor authentication enabled", codes, nil))
+}
+
+// disableTOTP turns off two factor authentication given a current code or a recovery code
+func (h *UserHandler) disableTOTP(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	var disableReq api.DisableTOTPRequest
+
+	if err = c.ShouldBindJSON(&disableReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse disable totp request", services.NewValidationError(err))
+		return
+	}
+
+	disableReq.UserID = userID
+
+	if err = h.Validator.Struct(disableReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	if err = h.MFAService.DisableTOTP(disableReq); err != nil {
+		middleware.AbortWithError(c, "failed to disable totp", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("two factor authentication disabled", nil, nil))
+}
+
+// beginPasskeyLogin returns the options for navigator.credentials.get, the username is optional
+func (h *UserHandler) beginPasskeyLogin(c *gin.Context) {
+	var beginReq api.BeginPasskeyLoginRequest
+
+	// an empty body starts a login with whichever passkey the authenticator offers
+	if err := c.ShouldBindJSON(&beginReq); err != nil && !errors.Is(err, io.EOF) {
+		middleware.AbortWithError(c, "failed to parse passkey login request", services.NewValidationError(err))
+		return
+	}
+
+	options, err := h.Passkeys.BeginLogin(c.Request.Context(), beginReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to begin passkey login", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("sign the challenge with a passkey", options, nil))
+}
+
+// passkeyLogin exchanges the assertion signed by the authenticator for the token pair
+func (h *UserHandler) passkeyLogin(c *gin.Context) {
+	var finishReq api.FinishPasskeyLoginRequest
+
+	if err := c.ShouldBindJSON(&finishReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse passkey login request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(finishReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	finishReq.Client = clientInfo(c)
+
+	tokens, err := h.UserService.PasskeyLogin(finishReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to login requested user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("login successful", tokens, nil))
+}
+
+func (h *UserHandler) listPasskeys(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	passkeys, err := h.Passkeys.ListCredentials(userID)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to get passkeys", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got passkeys", passkeys, nil))
+}
+
+// beginPasskeyRegistration returns the options for navigator.credentials.create
+func (h *UserHandler) beginPasskeyRegistration(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	options, err := h.Passkeys.BeginRegistration(c.Request.Context(), userID)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to begin passkey registration", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("create a passkey with the options", options, nil))
+}
+
+// finishPasskeyRegistration stores the passkey created by the authenticator
+func (h *UserHandler) finishPasskeyRegistration(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	var finishReq api.FinishPasskeyRegistrationRequest
+
+	if err = c.ShouldBindJSON(&finishReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse passkey registration request", services.NewValidationError(err))
+		return
+	}
+
+	finishReq.UserID = userID
+
+	if err = h.Validator.Struct(finishReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	passkey, err := h.Passkeys.FinishRegistration(c.Request.Context(), finishReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to register passkey", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, api.GenerateMessageResponse("passkey registered", passkey, nil))
+}
+
+func (h *UserHandler) deletePasskey(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	credentialID, err := strconv.Atoi(c.Param("credID"))
+	if err != nil || credentialID < 1 {
+		middleware.AbortWithError(c, "wrong id format in url", services.NewFieldError("credID", "must be a positive integer"))
+		return
+	}
+
+	if err = h.Passkeys.DeleteCredential(api.DeletePasskeyRequest{UserID: userID, CredentialID: uint(credentialID)}); err != nil {
+		middleware.AbortWithError(c, "failed to delete passkey", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully deleted passkey", nil, nil))
+}
+
+// beginExternalLogin returns where to send the user agent to sign in with the external identity provider
+func (h *UserHandler) beginExternalLogin(c *gin.Context) {
+
+	redirect, err := h.Identities.BeginAuth(c.Request.Context(), 0)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to begin external login", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("sign in with the identity provider", redirect, nil))
+}
+
+// externalLogin exchanges the code the identity provider sent back for the token pair, creating the user on their first login
+func (h *UserHandler) externalLogin(c *gin.Context) {
+	var finishReq api.FinishExternalLoginRequest
+
+	if err := c.ShouldBindJSON(&finishReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse external login request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(finishReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	finishReq.Client = clientInfo(c)
+
+	tokens, err := h.UserService.ExternalLogin(finishReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to login requested user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("login successful", tokens, nil))
+}
+
+func (h *UserHandler) listIdentities(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	identities, err := h.Identities.ListIdentities(userID)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to get identities", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got identities", identities, nil))
+}
+
+// beginLinkIdentity returns where to send the user agent to link the identity provider to the account
+func (h *UserHandler) beginLinkIdentity(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	redirect, err := h.Identities.BeginAuth(c.Request.Context(), userID)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to begin linking identity", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("sign in with the identity provider", redirect, nil))
+}
+
+// finishLinkIdentity links the external account the identity provider sent back
+func (h *UserHandler) finishLinkIdentity(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	var finishReq api.FinishExternalLoginRequest
+
+	if err = c.ShouldBindJSON(&finishReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse link identity request", services.NewValidationError(err))
+		return
+	}
+
+	finishReq.UserID = userID
+
+	if err = h.Validator.Struct(finishReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	identity, err := h.Identities.LinkIdentity(c.Request.Context(), finishReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to link identity", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, api.GenerateMessageResponse("identity linked", identity, nil))
+}
+
+func (h *UserHandler) unlinkIdentity(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	identityID, err := strconv.Atoi(c.Param("identityID"))
+	if err != nil || identityID < 1 {
+		middleware.AbortWithError(c, "wrong id format in url", services.NewFieldError("identityID", "must be a positive integer"))
+		return
+	}
+
+	if err = h.Identities.UnlinkIdentity(api.UnlinkIdentityRequest{UserID: userID, IdentityID: uint(identityID)}); err != nil {
+		middleware.AbortWithError(c, "failed to unlink identity", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully unlinked identity", nil, nil))
+}
+
+func (h *UserHandler) listPersonalTokens(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	tokens, err := h.Tokens.ListTokens(userID)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to get personal access tokens", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got personal access tokens", tokens, nil))
+}
+
+// createPersonalToken creates a personal access token, the token is only shown in this response
+func (h *UserHandler) createPersonalToken(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	var newTokenReq api.NewPersonalTokenRequest
+
+	if err = c.ShouldBindJSON(&newTokenReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse personal access token", services.NewValidationError(err))
+		return
+	}
+
+	newTokenReq.UserID = userID
+
+	if err = h.Validator.Struct(newTokenReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	token, err := h.Tokens.CreateToken(newTokenReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to create personal access token", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, api.GenerateMessageResponse("personal access token created, copy it now as it won't be shown again", token, nil))
+}
+
+func (h *UserHandler) revokePersonalToken(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(c.Param("tokenID"))
+	if err != nil || tokenID < 1 {
+		middleware.AbortWithError(c, "wrong id format in url", services.NewFieldError("tokenID", "must be a positive integer"))
+		return
+	}
+
+	if err = h.Tokens.RevokeToken(api.RevokePersonalTokenRequest{UserID: userID, TokenID: uint(tokenID)}); err != nil {
+		middleware.AbortWithError(c, "failed to revoke personal access token", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully revoked personal access token", nil, nil))
+}
+
+// listSessions returns the devices the user is signed in on, marking the one the request came from
+func (h *UserHandler) listSessions(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	sessions, err := h.Sessions.ListSessions(userID, c.GetString("session_id"))
+	if err != nil {
+		middleware.AbortWithError(c, "failed to get sessions", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully got sessions", sessions, nil))
+}
+
+func (h *UserHandler) revokeSession(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	revokeReq := api.RevokeSessionRequest{UserID: userID, SessionID: c.Param("sessionID")}
+
+	if err = h.Sessions.RevokeSession(c.Request.Context(), revokeReq); err != nil {
+		middleware.AbortWithError(c, "failed to revoke session", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully revoked session", nil, nil))
+}
+
+// revokeOtherSessions signs the user out everywhere but the session the request came from
+func (h *UserHandler) revokeOtherSessions(c *gin.Context) {
+
+	userID, err := userIDParam(c)
+	if err != nil {
+		middleware.AbortWithError(c, "wrong id format in url", err)
+		return
+	}
+
+	revoked, err := h.Sessions.RevokeSessions(c.Request.Context(), userID, c.GetString("session_id"))
+	if err != nil {
+		middleware.AbortWithError(c, "failed to revoke sessions", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("successfully revoked other sessions", gin.H{"revoked": revoked}, nil))
+}
+
+// refreshToken exchanges a refresh token for a new access/refresh pair
+func (h *UserHandler) refreshToken(c *gin.Context) {
+	var refreshReq api.RefreshTokenRequest
+
+	if err := c.ShouldBindJSON(&refreshReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse refresh request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(refreshReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	tokens, err := h.UserService.RefreshToken(refreshReq)
+	if err != nil {
+		middleware.AbortWithError(c, "failed to refresh token", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("token refreshed", tokens, nil))
+}
+
+// logout revokes the refresh token family of the session
+func (h *UserHandler) logout(c *gin.Context) {
+	var logoutReq api.LogoutRequest
+
+	if err := c.ShouldBindJSON(&logoutReq); err != nil {
+		middleware.AbortWithError(c, "failed to parse logout request", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.Validator.Struct(logoutReq); err != nil {
+		middleware.AbortWithError(c, "missing or incorrect data received", services.NewValidationError(err))
+		return
+	}
+
+	if err := h.UserService.Logout(logoutReq); err != nil {
+		middleware.AbortWithError(c, "failed to logout", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.GenerateMessageResponse("logout successful", nil, nil))
+}
+
+// userIDParam parses the :uID url param
+func userIDParam(c *gin.Context) (uint, error) {
+
+	userID, err := strconv.Atoi(c.Param("uID"))
+	if err != nil || userID < 1 {
+		return 0, services.NewFieldError("uID", "must be a positive integer")
+	}
+
+	return uint(userID), nil
+}
+
+// clientInfo is the device the request came from, recorded on the session a login starts
+func clientInfo(c *gin.Context) api.ClientInfo {
+	return api.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// newValidator reports fields by the name clients send them as rather than the go field name
+// and registers the password tag checking the password policy
+func newValidator(passwords *utils.PasswordPolicy) *validator.Validate {
+
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{"json", "form"} {
+			name := strings.SplitN(field.Tag.Get(tag), ",", 2)[0]
+			if name == "-" {
+				return ""
+			} else if name != "" {
+				return name
+			}
+		}
+		return field.Name
+	})
+
+	// the username and email sent along with the password, if any, are checked against it
+	_ = v.RegisterValidation("password", func(fl validator.FieldLevel) bool {
+		var personal []string
+		for _, name := range []string{"Username", "Email"} {
+			if field := reflect.Indirect(fl.Parent()).FieldByName(name); field.IsValid() && field.Kind() == reflect.String {
+				personal = append(personal, field.String())
+			}
+		}
+
+		return len(passwords.Check(fl.Field().String(), personal...)) == 0
+	})
+
+	return v
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/middleware"
+)
+
+// post sends body to the user routes and returns the status answered
+func post(t *testing.T, path, body string) int {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(middleware.ErrorHandler(log))
+	NewUserHandler(userService, nil, nil, nil, nil, nil, authMiddleware, nil, nil, nil).SetUpRoutes(r.Group("/api/v1"))
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+// expectUserByEmail expects the user with the email to be looked up, found unverified when found is set
+func expectUserByEmail(email string, found bool) {
+	rows := sqlmock.NewRows([]string{"id", "email", "email_verified_at"})
+	if found {
+		rows.AddRow(7, email, nil)
+	}
+
+	sqlMock.ExpectQuery("SELECT `id`,`email`,`email_verified_at` FROM `users` WHERE email = \\?").
+		WithArgs(email).
+		WillReturnRows(rows)
+}
+
+func TestUserHandler_ResendVerification(t *testing.T) {
+
+	t.Run("registered email", func(t *testing.T) {
+		expectUserByEmail("ada@example.com", true)
+		sent := testMailer.sent.Load()
+
+		require.Equal(t, http.StatusAccepted, post(t, "/api/v1/user/verify/resend", `{"email": "ada@example.com"}`))
+		require.Equal(t, sent+1, testMailer.sent.Load())
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		expectUserByEmail("grace@example.com", false)
+
+		require.Equal(t, http.StatusAccepted, post(t, "/api/v1/user/verify/resend", `{"email": "grace@example.com"}`))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("failing to send answers like an unknown email", func(t *testing.T) {
+		expectUserByEmail("ada@example.com", true)
+
+		testMailer.failing.Store(true)
+		defer testMailer.failing.Store(false)
+
+		require.Equal(t, http.StatusAccepted, post(t, "/api/v1/user/verify/resend", `{"email": "ada@example.com"}`))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestUserHandler_ForgotPassword(t *testing.T) {
+
+	t.Run("unknown email", func(t *testing.T) {
+		expectUserByEmail("hopper@example.com", false)
+
+		require.Equal(t, http.StatusAccepted, post(t, "/api/v1/password/forgot", `{"email": "hopper@example.com"}`))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("requests over the limit of an address", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			expectUserByEmail("hopper@example.com", false)
+			require.Equal(t, http.StatusAccepted, post(t, "/api/v1/password/forgot", `{"email": "hopper@example.com"}`))
+		}
+
+		require.Equal(t, http.StatusTooManyRequests, post(t, "/api/v1/password/forgot", `{"email": "hopper@example.com"}`))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
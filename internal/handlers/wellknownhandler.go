@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+type IWellKnownHandler interface {
+	SetUpRoutes(r *gin.RouterGroup)
+	getJWKS(c *gin.Context)
+	getOpenIDConfiguration(c *gin.Context)
+}
+
+// WellKnownHandler serves the public discovery documents other services use to trust our tokens
+type WellKnownHandler struct {
+	Keys  *services.KeySet
+	OAuth services.IOAuthService
+}
+
+func NewWellKnownHandler(keys *services.KeySet, oauth services.IOAuthService) *WellKnownHandler {
+	return &WellKnownHandler{
+		Keys:  keys,
+		OAuth: oauth,
+	}
+}
+
+// SetUpRoutes sets up the well known routes, these are public and unversioned
+func (h *WellKnownHandler) SetUpRoutes(r *gin.RouterGroup) {
+
+	r.GET("jwks.json", h.getJWKS)
+	r.GET("openid-configuration", h.getOpenIDConfiguration)
+
+}
+
+// getJWKS returns the public keys tokens are verified with, in the plain JWKS format clients expect
+func (h *WellKnownHandler) getJWKS(c *gin.Context) {
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.Keys.JWKS())
+
+}
+
+// getOpenIDConfiguration returns the discovery document relying parties configure themselves from
+func (h *WellKnownHandler) getOpenIDConfiguration(c *gin.Context) {
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.OAuth.Discovery())
+
+}
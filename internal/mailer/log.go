@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LogMailer never leaves the machine, it writes every message to the log and,
+// when a directory is set, to a .eml file so tests and developers can read them back
+type LogMailer struct {
+	dir    string
+	logger *zap.Logger
+
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewLogMailer(dir string, logger *zap.Logger) *LogMailer {
+	return &LogMailer{
+		dir:    dir,
+		logger: logger,
+	}
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, msg)
+
+	if m.logger != nil {
+		m.logger.Info("📧 mail sent", zap.String("to", msg.To), zap.String("subject", msg.Subject), zap.String("body", msg.Body))
+	}
+
+	if m.dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%03d.eml", time.Now().UnixNano(), len(m.sent))
+
+	return os.WriteFile(filepath.Join(m.dir, name), buildMessage("noreply@localhost", msg), 0o600)
+}
+
+// Sent returns every message sent so far, oldest first
+func (m *LogMailer) Sent() []Message {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.sent...)
+}
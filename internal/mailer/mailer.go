@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DriverSMTP = "smtp"
+	DriverLog  = "log"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users, implementations must be safe for concurrent use
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Settings used to pick and configure the mailer
+type Settings struct {
+	Driver       string
+	From         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	LogDir       string
+}
+
+// New returns the mailer matching the configured driver
+func New(settings Settings, logger *zap.Logger) (Mailer, error) {
+	switch settings.Driver {
+	case DriverSMTP:
+		return NewSMTPMailer(settings), nil
+	case DriverLog, "":
+		return NewLogMailer(settings.LogDir, logger), nil
+	}
+
+	return nil, fmt.Errorf("unknown mail driver %s", settings.Driver)
+}
@@ -0,0 +1,60 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// SMTPMailer delivers mail through an SMTP relay, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(settings Settings) *SMTPMailer {
+
+	var auth smtp.Auth
+	if settings.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", settings.SMTPUsername, settings.SMTPPassword, settings.SMTPHost)
+	}
+
+	return &SMTPMailer{
+		addr: net.JoinHostPort(settings.SMTPHost, strconv.Itoa(settings.SMTPPort)),
+		from: settings.From,
+		auth: auth,
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, buildMessage(m.from, msg)); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", msg.To, err)
+	}
+
+	return nil
+}
+
+// buildMessage renders the message with the headers mail clients expect
+func buildMessage(from string, msg Message) []byte {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
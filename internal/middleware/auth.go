@@ -1,98 +1,164 @@
 package middleware
 
 import (
-	"errors"
-	"fmt"
-	"net/http"
+	"context"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 
-	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+var (
+	errMissingToken = &services.Error{Kind: services.ErrInvalidCredentials, Code: "missing_token", Message: "missing token in request"}
+	errMissingRole  = &services.Error{Kind: services.ErrForbidden, Code: "missing_role", Message: "user is not allowed to access this resource"}
+	errWrongUser    = &services.Error{Kind: services.ErrForbidden, Code: "wrong_user", Message: "token is not valid for this user"}
+	errNoSession    = &services.Error{Kind: services.ErrForbidden, Code: "session_required", Message: "personal access tokens can't be used here, log in instead"}
 )
 
 type IAuthMiddleware interface {
 	RequireAuth() gin.HandlerFunc
+	Authenticate(ctx context.Context, token, ip string) (*services.AccessClaims, error)
+	RequireRole(roles ...pkg.Role) gin.HandlerFunc
+	RequireSelfOrRole(roles ...pkg.Role) gin.HandlerFunc
+	RequireSession() gin.HandlerFunc
 }
 
 type AuthMiddleware struct {
-	jwtSecret string
+	tokens         services.ITokenService
+	personalTokens services.IPersonalTokenService
+	sessions       services.ISessionService
 }
 
-func NewAuthMiddleware(jwtSecret string) *AuthMiddleware {
+func NewAuthMiddleware(tokens services.ITokenService, personalTokens services.IPersonalTokenService, sessions services.ISessionService) *AuthMiddleware {
 	return &AuthMiddleware{
-		jwtSecret: jwtSecret,
+		tokens:         tokens,
+		personalTokens: personalTokens,
+		sessions:       sessions,
 	}
 }
 
+// RequireAuth validates the bearer token with Authenticate and stores its claims on the context
 func (a *AuthMiddleware) RequireAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := c.Request.Header.Get("Authorization")
 		authSplit := strings.Split(auth, "Bearer ")
-		if len(authSplit) < 2 {
-			c.AbortWithStatusJSON(
-				http.StatusBadRequest,
-				api.GenerateMessageResponse("no token", nil, errors.New("missing token in request")),
-			)
+		if len(authSplit) < 2 || authSplit[1] == "" {
+			AbortWithError(c, "no token", errMissingToken)
 			return
 		}
-		tokenString := authSplit[1]
-		if tokenString == "" {
-			c.AbortWithStatusJSON(
-				http.StatusBadRequest,
-				api.GenerateMessageResponse("no token", nil, errors.New("missing token in request")),
-			)
+
+		claims, err := a.Authenticate(c.Request.Context(), authSplit[1], c.ClientIP())
+		if err != nil {
+			AbortWithError(c, "something went wrong with the token", err)
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected method: %s", token.Header["alg"])
-			}
-			return []byte(a.jwtSecret), nil
-		})
+		c.Set("user_id", int(claims.UserID))
+		c.Set("session_id", claims.SessionID)
+		c.Set("token_claims", claims)
+
+		c.Next()
+	}
+}
+
+// Authenticate validates a JWT or a personal access token used from ip and returns its claims.
+// JWTs are refused as soon as the session they were issued in is revoked.
+func (a *AuthMiddleware) Authenticate(ctx context.Context, token, ip string) (*services.AccessClaims, error) {
+
+	if token == "" {
+		return nil, errMissingToken
+	}
+
+	var (
+		claims *services.AccessClaims
+		err    error
+	)
+
+	if strings.HasPrefix(token, pkg.PersonalAccessTokenPrefix) {
+		claims, err = a.personalTokens.ValidateToken(ctx, token, ip)
+	} else {
+		claims, err = a.tokens.ValidateAccessToken(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.SessionID != "" {
+		active, err := a.sessions.IsActive(ctx, claims.UserID, claims.SessionID)
 		if err != nil {
-			c.AbortWithStatusJSON(
-				http.StatusForbidden,
-				api.GenerateMessageResponse("something went wrong with the token", nil, err),
-			)
+			return nil, err
+		} else if !active {
+			return nil, services.ErrSessionRevoked
+		}
+	}
+
+	return claims, nil
+}
+
+// RequireRole only lets through tokens holding at least one of the roles passed, must be chained after RequireAuth
+func (a *AuthMiddleware) RequireRole(roles ...pkg.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := tokenClaims(c)
+		if !ok || !claims.HasRole(roles...) {
+			AbortWithError(c, "missing role", errMissingRole)
 			return
 		}
 
-		var tokenUID int
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			tokenUID, _ = strconv.Atoi(fmt.Sprint(claims["sub"]))
-			if float64(time.Now().Unix()) > claims["exp"].(float64) {
-				c.AbortWithStatusJSON(
-					http.StatusForbidden,
-					api.GenerateMessageResponse("expired token", nil, errors.New("token is no longer valid")),
-				)
-				return
-			}
-		} else {
-			c.AbortWithStatusJSON(
-				http.StatusForbidden,
-				api.GenerateMessageResponse("bad token", nil, errors.New("token is not valid")),
-			)
+		c.Next()
+	}
+}
+
+// RequireSelfOrRole scopes :uID routes to the token owner unless the token holds one of the roles passed,
+// must be chained after RequireAuth
+func (a *AuthMiddleware) RequireSelfOrRole(roles ...pkg.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := tokenClaims(c)
+		if !ok {
+			AbortWithError(c, "bad token", services.ErrInvalidAccessToken)
 			return
 		}
 
-		paramUserID := c.Param("uID")
-		userIDint, _ := strconv.Atoi(paramUserID)
+		// an id that isn't a number is nobody's, rather than matching a zero user id
+		userIDint, err := strconv.Atoi(c.Param("uID"))
 
-		if tokenUID != userIDint {
-			c.AbortWithStatusJSON(
-				http.StatusForbidden,
-				api.GenerateMessageResponse("incorrect token for user", nil, errors.New("token is not valid")),
-			)
+		if (err != nil || int(claims.UserID) != userIDint) && !claims.HasRole(roles...) {
+			AbortWithError(c, "incorrect token for user", errWrongUser)
 			return
 		}
 
-		c.Set("user_id", tokenUID)
+		c.Next()
+	}
+}
+
+// RequireSession turns away personal access tokens from routes managing the user's credentials, so a leaked
+// token can't be used to mint more tokens or take over the account. Must be chained after RequireAuth.
+func (a *AuthMiddleware) RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := tokenClaims(c)
+		if !ok {
+			AbortWithError(c, "bad token", services.ErrInvalidAccessToken)
+			return
+		}
+
+		if claims.TokenID != 0 {
+			AbortWithError(c, "personal access token used", errNoSession)
+			return
+		}
 
 		c.Next()
 	}
 }
+
+func tokenClaims(c *gin.Context) (*services.AccessClaims, bool) {
+	value, exists := c.Get("token_claims")
+	if !exists {
+		return nil, false
+	}
+
+	claims, ok := value.(*services.AccessClaims)
+
+	return claims, ok
+}
@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+// serve runs a request for target through a router serving path with handlers and returns the status and error code answered
+func serve(t *testing.T, path, target string, header http.Header, handlers ...gin.HandlerFunc) (int, string) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(ErrorHandler(zap.NewNop()))
+	r.GET(path, append(handlers, func(c *gin.Context) { c.Status(http.StatusNoContent) })...)
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code == http.StatusNoContent {
+		return w.Code, ""
+	}
+
+	var response api.MessageResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	return w.Code, response.Code
+}
+
+// withClaims stands in for RequireAuth, storing claims on the context like it does
+func withClaims(claims *services.AccessClaims) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("token_claims", claims)
+		c.Next()
+	}
+}
+
+func TestAuthMiddleware_RequireRole(t *testing.T) {
+	a := NewAuthMiddleware(nil, nil, nil)
+
+	testCases := []struct {
+		Name           string
+		Claims         *services.AccessClaims
+		ExpectedStatus int
+		ExpectedCode   string
+	}{
+		{
+			Name:           "role held",
+			Claims:         &services.AccessClaims{UserID: 1, Roles: []pkg.Role{pkg.RoleUser, pkg.RoleAdmin}},
+			ExpectedStatus: http.StatusNoContent,
+		},
+		{
+			Name:           "another role",
+			Claims:         &services.AccessClaims{UserID: 1, Roles: []pkg.Role{pkg.RoleQuizAuthor}},
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedCode:   "missing_role",
+		},
+		{
+			Name:           "no roles",
+			Claims:         &services.AccessClaims{UserID: 1},
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedCode:   "missing_role",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			status, code := serve(t, "/users", "/users", nil, withClaims(test.Claims), a.RequireRole(pkg.RoleAdmin))
+			require.Equal(t, test.ExpectedStatus, status)
+			require.Equal(t, test.ExpectedCode, code)
+		})
+	}
+
+	t.Run("without RequireAuth", func(t *testing.T) {
+		status, code := serve(t, "/users", "/users", nil, a.RequireRole(pkg.RoleAdmin))
+		require.Equal(t, http.StatusForbidden, status)
+		require.Equal(t, "missing_role", code)
+	})
+}
+
+func TestAuthMiddleware_RequireSelfOrRole(t *testing.T) {
+	a := NewAuthMiddleware(nil, nil, nil)
+	user := &services.AccessClaims{UserID: 7, Roles: []pkg.Role{pkg.RoleUser}}
+	admin := &services.AccessClaims{UserID: 1, Roles: []pkg.Role{pkg.RoleUser, pkg.RoleAdmin}}
+
+	testCases := []struct {
+		Name           string
+		Claims         *services.AccessClaims
+		Target         string
+		ExpectedStatus int
+		ExpectedCode   string
+	}{
+		{
+			Name:           "self",
+			Claims:         user,
+			Target:         "/user/7",
+			ExpectedStatus: http.StatusNoContent,
+		},
+		{
+			Name:           "another user",
+			Claims:         user,
+			Target:         "/user/8",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedCode:   "wrong_user",
+		},
+		{
+			Name:           "admin override",
+			Claims:         admin,
+			Target:         "/user/8",
+			ExpectedStatus: http.StatusNoContent,
+		},
+		{
+			Name:           "id that isn't a number",
+			Claims:         user,
+			Target:         "/user/7abc",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedCode:   "wrong_user",
+		},
+		{
+			Name:           "user id zero isn't matched by an unparsable id",
+			Claims:         &services.AccessClaims{Roles: []pkg.Role{pkg.RoleUser}},
+			Target:         "/user/me",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedCode:   "wrong_user",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			status, code := serve(t, "/user/:uID", test.Target, nil, withClaims(test.Claims), a.RequireSelfOrRole(pkg.RoleAdmin))
+			require.Equal(t, test.ExpectedStatus, status)
+			require.Equal(t, test.ExpectedCode, code)
+		})
+	}
+
+	t.Run("admins are held to their own id without the override", func(t *testing.T) {
+		status, code := serve(t, "/user/:uID", "/user/8", nil, withClaims(admin), a.RequireSelfOrRole())
+		require.Equal(t, http.StatusForbidden, status)
+		require.Equal(t, "wrong_user", code)
+	})
+}
+
+// personalToken is the personal access token of user 7 the tests below look up
+var personalToken = pkg.PersonalAccessTokenPrefix + strings.Repeat("cd", 32)
+
+// expectPersonalToken expects personalToken to be looked up, expiring at expiresAt, or not found when expiresAt is zero
+func expectPersonalToken(expiresAt time.Time) {
+	sum := sha256.Sum256([]byte(personalToken))
+	rows := sqlmock.NewRows([]string{"id", "user_id", "name", "token_hash", "token_prefix", "scopes", "expires_at", "last_used_at", "last_used_ip", "created_at"})
+	if !expiresAt.IsZero() {
+		rows.AddRow(5, 7, "ci", hex.EncodeToString(sum[:]), personalToken[:11], "user", expiresAt, time.Now(), "192.0.2.1", time.Now())
+	}
+
+	sqlMock.ExpectQuery("SELECT personal_access_tokens.\\* FROM `personal_access_tokens` JOIN users").
+		WithArgs(hex.EncodeToString(sum[:])).
+		WillReturnRows(rows)
+
+	if !expiresAt.IsZero() && time.Now().Before(expiresAt) {
+		sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\? AND role IN \\(\\?\\) ORDER BY role").
+			WithArgs(7, "user").
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+	}
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestAuthMiddleware_RequireAuth(t *testing.T) {
+
+	t.Run("valid personal access token", func(t *testing.T) {
+		expectPersonalToken(time.Now().Add(time.Hour))
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(personalToken), authMiddleware.RequireAuth(), authMiddleware.RequireSelfOrRole())
+		require.Equal(t, http.StatusNoContent, status, code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("revoked personal access token", func(t *testing.T) {
+		expectPersonalToken(time.Time{})
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(personalToken), authMiddleware.RequireAuth())
+		require.Equal(t, http.StatusUnauthorized, status)
+		require.Equal(t, "invalid_token", code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("expired personal access token", func(t *testing.T) {
+		expectPersonalToken(time.Now().Add(-time.Hour))
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(personalToken), authMiddleware.RequireAuth())
+		require.Equal(t, http.StatusUnauthorized, status)
+		require.Equal(t, "personal_token_expired", code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("token of a revoked session", func(t *testing.T) {
+		ctx := context.Background()
+
+		pair, err := tokenService.IssueTokenPair(ctx, services.TokenSubject{UserID: 7, Roles: []pkg.Role{pkg.RoleUser}})
+		require.NoError(t, err)
+
+		claims, err := tokenService.ValidateAccessToken(ctx, pair.Token)
+		require.NoError(t, err)
+		require.NoError(t, redisServer.Set("auth:session:"+claims.SessionID, "7"))
+
+		status, _ := serve(t, "/user/:uID", "/user/7", bearer(pair.Token), authMiddleware.RequireAuth())
+		require.Equal(t, http.StatusNoContent, status)
+
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `sessions` SET `revoked_at`=\\? WHERE id = \\? AND user_id = \\? AND revoked_at IS NULL").
+			WithArgs(sqlmock.AnyArg(), claims.SessionID, 7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		require.NoError(t, authMiddleware.sessions.RevokeSession(ctx, api.RevokeSessionRequest{UserID: 7, SessionID: claims.SessionID}))
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(pair.Token), authMiddleware.RequireAuth())
+		require.Equal(t, http.StatusUnauthorized, status)
+		require.Equal(t, "session_revoked", code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("token of a session revoked while it wasn't cached", func(t *testing.T) {
+		ctx := context.Background()
+
+		pair, err := tokenService.IssueTokenPair(ctx, services.TokenSubject{UserID: 7, Roles: []pkg.Role{pkg.RoleUser}})
+		require.NoError(t, err)
+
+		sqlMock.ExpectQuery("SELECT \\* FROM `sessions` WHERE id = \\? AND user_id = \\? AND revoked_at IS NULL").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(pair.Token), authMiddleware.RequireAuth())
+		require.Equal(t, http.StatusUnauthorized, status)
+		require.Equal(t, "session_revoked", code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		status, code := serve(t, "/user/:uID", "/user/7", nil, authMiddleware.RequireAuth())
+		require.Equal(t, http.StatusUnauthorized, status)
+		require.Equal(t, "missing_token", code)
+	})
+}
+
+func TestAuthMiddleware_RequireSession(t *testing.T) {
+
+	t.Run("personal access token is turned away", func(t *testing.T) {
+		expectPersonalToken(time.Now().Add(time.Hour))
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(personalToken), authMiddleware.RequireAuth(), authMiddleware.RequireSelfOrRole(), authMiddleware.RequireSession())
+		require.Equal(t, http.StatusForbidden, status)
+		require.Equal(t, "session_required", code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("token of a login session", func(t *testing.T) {
+		ctx := context.Background()
+
+		pair, err := tokenService.IssueTokenPair(ctx, services.TokenSubject{UserID: 7, Roles: []pkg.Role{pkg.RoleUser}})
+		require.NoError(t, err)
+
+		claims, err := tokenService.ValidateAccessToken(ctx, pair.Token)
+		require.NoError(t, err)
+		require.NoError(t, redisServer.Set("auth:session:"+claims.SessionID, "7"))
+
+		status, code := serve(t, "/user/:uID", "/user/7", bearer(pair.Token), authMiddleware.RequireAuth(), authMiddleware.RequireSelfOrRole(), authMiddleware.RequireSession())
+		require.Equal(t, http.StatusNoContent, status, code)
+	})
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+// ErrorHandler renders the error left on the context by AbortWithError once the rest of the chain has run
+func ErrorHandler(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+
+		ginErr := c.Errors.Last()
+		message, _ := ginErr.Meta.(string)
+
+		status, response := RenderError(message, ginErr.Err)
+		if status >= http.StatusInternalServerError {
+			logger.Error(message, zap.String("path", c.FullPath()), zap.Int("status", status), zap.Error(ginErr.Err))
+		}
+
+		var rateLimitErr *services.RateLimitError
+		if errors.As(ginErr.Err, &rateLimitErr) {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+		}
+
+		c.JSON(status, response)
+	}
+}
+
+// AbortWithError stops the chain and leaves the error for ErrorHandler to render with the message passed
+func AbortWithError(c *gin.Context, message string, err error) {
+	_ = c.Error(err).SetMeta(message)
+	c.Abort()
+}
+
+// RenderError maps the category of the error to a status code and builds the response body.
+// Errors that don't belong to a category are internal and their details aren't sent back.
+func RenderError(message string, err error) (int, *api.MessageResponse) {
+
+	status, code := http.StatusInternalServerError, "internal_error"
+
+	switch {
+	case errors.Is(err, services.ErrValidation):
+		status, code = http.StatusBadRequest, "validation_failed"
+	case errors.Is(err, services.ErrInvalidCredentials):
+		status, code = http.StatusUnauthorized, "invalid_credentials"
+	case errors.Is(err, services.ErrForbidden):
+		status, code = http.StatusForbidden, "forbidden"
+	case errors.Is(err, services.ErrNotFound):
+		status, code = http.StatusNotFound, "not_found"
+	case errors.Is(err, services.ErrConflict):
+		status, code = http.StatusConflict, "conflict"
+	case errors.Is(err, services.ErrRateLimited):
+		status, code = http.StatusTooManyRequests, "rate_limited"
+	case errors.Is(err, services.ErrUpstreamUnavailable):
+		status, code = http.StatusServiceUnavailable, "upstream_unavailable"
+	}
+
+	if status == http.StatusInternalServerError {
+		err = errors.New("internal server error")
+	}
+
+	response := api.GenerateMessageResponse(message, nil, err)
+	response.Code = code
+
+	var domainErr *services.Error
+	if errors.As(err, &domainErr) {
+		response.Code = domainErr.Code
+		if domainErr.Field != "" {
+			response.Details = []api.FieldError{{Field: domainErr.Field, Message: domainErr.Message}}
+		}
+	}
+
+	var rateLimitErr *services.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		response.Code = rateLimitErr.Code
+	}
+
+	var validationErr *services.ValidationError
+	if errors.As(err, &validationErr) {
+		response.Details = validationErr.Fields
+	}
+
+	return status, response
+}
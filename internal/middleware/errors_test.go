@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+func TestRenderError(t *testing.T) {
+	type signup struct {
+		Email string `validate:"required,email"`
+	}
+
+	validationErr := services.NewValidationError(validator.New().Struct(signup{Email: "nope"}))
+
+	testCases := []struct {
+		Name           string
+		Input          error
+		ExpectedStatus int
+		ExpectedCode   string
+		ExpectedError  string
+		ExpectedFields []string
+	}{
+		{
+			Name:           "Validator errors are broken down per field",
+			Input:          validationErr,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedCode:   "validation_failed",
+			ExpectedError:  validationErr.Error(),
+			ExpectedFields: []string{"Email"},
+		},
+		{
+			Name:           "Conflict keeps the domain code and field",
+			Input:          services.ErrEmailTaken,
+			ExpectedStatus: http.StatusConflict,
+			ExpectedCode:   "email_taken",
+			ExpectedError:  "email already registered",
+			ExpectedFields: []string{"email"},
+		},
+		{
+			Name:           "Not found",
+			Input:          services.ErrUserNotFound,
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedCode:   "user_not_found",
+			ExpectedError:  "user not found",
+		},
+		{
+			Name:           "Revoked token",
+			Input:          services.ErrTokenRevoked,
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedCode:   "token_revoked",
+			ExpectedError:  "token has been revoked",
+		},
+		{
+			Name:           "Rate limited keeps its code",
+			Input:          &services.RateLimitError{Code: "account_locked", Message: "too many failed logins, try again later", RetryAfter: time.Minute},
+			ExpectedStatus: http.StatusTooManyRequests,
+			ExpectedCode:   "account_locked",
+			ExpectedError:  "too many failed logins, try again later",
+		},
+		{
+			Name:           "Unknown errors are hidden",
+			Input:          errors.New("dial tcp 10.0.0.1:3306: connection refused"),
+			ExpectedStatus: http.StatusInternalServerError,
+			ExpectedCode:   "internal_error",
+			ExpectedError:  "internal server error",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			status, response := RenderError("failed", test.Input)
+
+			require.Equal(t, test.ExpectedStatus, status)
+			require.Equal(t, test.ExpectedCode, response.Code)
+			require.Equal(t, test.ExpectedError, response.Error)
+
+			fields := make([]string, 0, len(response.Details))
+			for _, detail := range response.Details {
+				fields = append(fields, detail.Field)
+			}
+			require.ElementsMatch(t, test.ExpectedFields, fields)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/services"
+)
+
+var (
+	mockDB  *sql.DB
+	sqlMock sqlmock.Sqlmock
+
+	redisServer *miniredis.Miniredis
+
+	authMiddleware *AuthMiddleware
+	tokenService   *services.TokenService
+)
+
+func TestMain(m *testing.M) {
+	var err error
+
+	mockDB, sqlMock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		panic(fmt.Sprintf("an error '%s' was not expected when opening a stub database connection", err))
+	}
+	defer mockDB.Close()
+
+	gormDB, err := gorm.Open(mysql.New(mysql.Config{
+		DSN:                       "sqlmock_db_0",
+		DriverName:                "mysql",
+		Conn:                      mockDB,
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+
+	redisServer, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer redisServer.Close()
+
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	log := zap.NewNop()
+
+	tokenService = services.NewTokenService(redisClient, services.NewHMACKeySet("testsecret"), log, services.TokenServiceSettings{
+		RefreshSecret:   "testrefreshsecret",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+
+	authMiddleware = NewAuthMiddleware(
+		tokenService,
+		services.NewPersonalTokenService(gormDB, log, services.PersonalTokenServiceSettings{MaxTTL: 90 * 24 * time.Hour}),
+		services.NewSessionService(gormDB, redisClient, log, services.SessionServiceSettings{TTL: time.Hour}),
+	)
+
+	m.Run()
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_roles
+(
+    user_id    BIGINT UNSIGNED NOT NULL,
+    role       VARCHAR(32)     NOT NULL,
+    created_at DATETIME(3)     NULL,
+    PRIMARY KEY (user_id, role),
+    CONSTRAINT fk_user_roles_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
+
+insert into user_roles (user_id, role, created_at)
+select id, 'user', NOW()
+from users;
@@ -0,0 +1,2 @@
+DROP INDEX idx_users_email ON users;
+DROP INDEX idx_users_username ON users;
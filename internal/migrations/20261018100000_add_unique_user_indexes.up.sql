@@ -0,0 +1,2 @@
+CREATE UNIQUE INDEX idx_users_email ON users (email);
+CREATE UNIQUE INDEX idx_users_username ON users (username);
@@ -0,0 +1,2 @@
+-- accounts created before email verification existed are trusted as they are
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS password_history
+(
+    id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id    BIGINT UNSIGNED NOT NULL,
+    password   VARCHAR(255)    NOT NULL,
+    created_at DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    INDEX idx_password_history_user (user_id, id),
+    CONSTRAINT fk_password_history_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
+
+-- the current password of every user is the start of their history
+insert into password_history (user_id, password, created_at)
+select id, password, NOW()
+from users
+where password <> '';
+
+-- the last update is the best guess at when existing passwords were set
+UPDATE users SET password_changed_at = COALESCE(updated_at, created_at) WHERE password_changed_at IS NULL;
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS user_totp
+(
+    user_id        BIGINT UNSIGNED NOT NULL,
+    secret         VARCHAR(64)     NOT NULL,
+    confirmed_at   DATETIME(3)     NULL,
+    last_used_step BIGINT          NOT NULL DEFAULT 0,
+    created_at     DATETIME(3)     NULL,
+    PRIMARY KEY (user_id),
+    CONSTRAINT fk_user_totp_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes
+(
+    id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id    BIGINT UNSIGNED NOT NULL,
+    code_hash  CHAR(64)        NOT NULL,
+    used_at    DATETIME(3)     NULL,
+    created_at DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_mfa_recovery_codes_hash (user_id, code_hash),
+    CONSTRAINT fk_mfa_recovery_codes_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS webauthn_credentials
+(
+    id               BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id          BIGINT UNSIGNED NOT NULL,
+    credential_id    VARBINARY(1023) NOT NULL,
+    public_key       BLOB            NOT NULL,
+    attestation_type VARCHAR(32)     NOT NULL DEFAULT '',
+    aaguid           VARBINARY(16)   NULL,
+    sign_count       INT UNSIGNED    NOT NULL DEFAULT 0,
+    transports       VARCHAR(255)    NOT NULL DEFAULT '',
+    backup_eligible  BOOLEAN         NOT NULL DEFAULT FALSE,
+    backup_state     BOOLEAN         NOT NULL DEFAULT FALSE,
+    name             VARCHAR(64)     NOT NULL DEFAULT '',
+    last_used_at     DATETIME(3)     NULL,
+    created_at       DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_webauthn_credentials_credential_id (credential_id),
+    INDEX idx_webauthn_credentials_user_id (user_id),
+    CONSTRAINT fk_webauthn_credentials_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS oauth_clients
+(
+    id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    client_id     VARCHAR(64)     NOT NULL,
+    secret_hash   VARCHAR(64)     NOT NULL DEFAULT '',
+    name          VARCHAR(255)    NOT NULL,
+    redirect_uris TEXT            NOT NULL,
+    grant_types   VARCHAR(255)    NOT NULL DEFAULT '',
+    scopes        VARCHAR(1024)   NOT NULL DEFAULT '',
+    created_at    DATETIME(3)     NULL,
+    updated_at    DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_oauth_clients_client_id (client_id)
+) ENGINE = InnoDB;
+
+CREATE TABLE IF NOT EXISTS oauth_consents
+(
+    user_id    BIGINT UNSIGNED NOT NULL,
+    client_id  VARCHAR(64)     NOT NULL,
+    scopes     VARCHAR(1024)   NOT NULL DEFAULT '',
+    created_at DATETIME(3)     NULL,
+    updated_at DATETIME(3)     NULL,
+    PRIMARY KEY (user_id, client_id),
+    INDEX idx_oauth_consents_client_id (client_id),
+    CONSTRAINT fk_oauth_consents_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_oauth_consents_client FOREIGN KEY (client_id) REFERENCES oauth_clients (client_id) ON DELETE CASCADE
+) ENGINE = InnoDB;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS identities
+(
+    id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id       BIGINT UNSIGNED NOT NULL,
+    provider      VARCHAR(64)     NOT NULL,
+    subject       VARCHAR(255)    NOT NULL,
+    email         VARCHAR(255)    NOT NULL DEFAULT '',
+    last_login_at DATETIME(3)     NULL,
+    created_at    DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_identities_provider_subject (provider, subject),
+    UNIQUE INDEX idx_identities_user_provider (user_id, provider),
+    CONSTRAINT fk_identities_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
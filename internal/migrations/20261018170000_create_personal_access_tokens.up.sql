@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS personal_access_tokens
+(
+    id           BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id      BIGINT UNSIGNED NOT NULL,
+    name         VARCHAR(100)    NOT NULL,
+    token_hash   CHAR(64)        NOT NULL,
+    token_prefix VARCHAR(16)     NOT NULL,
+    scopes       VARCHAR(255)    NOT NULL,
+    expires_at   DATETIME(3)     NOT NULL,
+    last_used_at DATETIME(3)     NULL,
+    last_used_ip VARCHAR(45)     NOT NULL DEFAULT '',
+    created_at   DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_personal_access_tokens_token_hash (token_hash),
+    INDEX idx_personal_access_tokens_user_id (user_id),
+    CONSTRAINT fk_personal_access_tokens_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
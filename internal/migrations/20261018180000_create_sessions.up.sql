@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id           CHAR(32)        NOT NULL,
+    user_id      BIGINT UNSIGNED NOT NULL,
+    device       VARCHAR(100)    NOT NULL DEFAULT '',
+    user_agent   VARCHAR(512)    NOT NULL DEFAULT '',
+    ip           VARCHAR(45)     NOT NULL DEFAULT '',
+    created_at   DATETIME(3)     NULL,
+    last_seen_at DATETIME(3)     NULL,
+    expires_at   DATETIME(3)     NOT NULL,
+    revoked_at   DATETIME(3)     NULL,
+    PRIMARY KEY (id),
+    INDEX idx_sessions_user_id (user_id),
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB;
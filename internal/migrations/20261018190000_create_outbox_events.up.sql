@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS outbox_events
+(
+    id           BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    event_id     CHAR(32)        NOT NULL,
+    subject      VARCHAR(255)    NOT NULL,
+    payload      BLOB            NOT NULL,
+    created_at   DATETIME(3)     NULL,
+    published_at DATETIME(3)     NULL,
+    attempts     INT             NOT NULL DEFAULT 0,
+    last_error   VARCHAR(512)    NOT NULL DEFAULT '',
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_outbox_events_event_id (event_id),
+    INDEX idx_outbox_events_published_at (published_at, id)
+) ENGINE = InnoDB;
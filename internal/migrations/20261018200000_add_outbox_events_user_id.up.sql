@@ -0,0 +1,11 @@
+ALTER TABLE outbox_events
+    ADD COLUMN user_id BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER subject,
+    ADD INDEX idx_outbox_events_user_id (user_id);
+
+-- events written before the column existed are either structured cloudevents or their bare data
+UPDATE outbox_events
+SET user_id = COALESCE(
+        JSON_EXTRACT(CAST(payload AS CHAR), '$.data.user_id'),
+        JSON_EXTRACT(CAST(payload AS CHAR), '$.user_id'),
+        0)
+WHERE JSON_VALID(CAST(payload AS CHAR));
@@ -0,0 +1,2 @@
+ALTER TABLE outbox_events
+    DROP COLUMN parked_at;
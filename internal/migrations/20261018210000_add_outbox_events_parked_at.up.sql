@@ -0,0 +1,2 @@
+ALTER TABLE outbox_events
+    ADD COLUMN parked_at DATETIME(3) NULL AFTER last_error;
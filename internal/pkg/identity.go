@@ -0,0 +1,22 @@
+package pkg
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Identity links the subject of an external identity provider to a user, a user has at most one per provider
+type Identity struct {
+	ID       uint `gorm:"primaryKey"`
+	UserID   uint
+	Provider string
+	Subject  string
+	// Email is the address the provider had for the subject when it was linked, only kept to show the user
+	Email       string
+	LastLoginAt sql.NullTime
+	CreatedAt   time.Time
+}
+
+func (Identity) TableName() string {
+	return "identities"
+}
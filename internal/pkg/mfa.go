@@ -0,0 +1,32 @@
+package pkg
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UserTOTP is the TOTP secret of a user, it only guards logins once ConfirmedAt is set
+type UserTOTP struct {
+	UserID       uint `gorm:"primaryKey"`
+	Secret       string
+	ConfirmedAt  sql.NullTime
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+func (UserTOTP) TableName() string {
+	return "user_totp"
+}
+
+// RecoveryCode is a single use code that stands in for a TOTP code, only its hash is stored
+type RecoveryCode struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint
+	CodeHash  string
+	UsedAt    sql.NullTime
+	CreatedAt time.Time
+}
+
+func (RecoveryCode) TableName() string {
+	return "mfa_recovery_codes"
+}
@@ -0,0 +1,40 @@
+package pkg
+
+import "time"
+
+// OAuthClient is an application registered to ask users for access through the oauth provider
+type OAuthClient struct {
+	ID       uint `gorm:"primaryKey"`
+	ClientID string
+	// SecretHash is empty for public clients, they can't keep a secret and rely on PKCE alone
+	SecretHash string
+	Name       string
+	// RedirectURIs, GrantTypes and Scopes are space separated the same way scopes are on the wire
+	RedirectURIs string
+	GrantTypes   string
+	Scopes       string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// Public reports whether the client authenticates without a secret
+func (client *OAuthClient) Public() bool {
+	return client.SecretHash == ""
+}
+
+// OAuthConsent records the scopes a user granted a client so they're only asked again for new ones
+type OAuthConsent struct {
+	UserID    uint   `gorm:"primaryKey"`
+	ClientID  string `gorm:"primaryKey"`
+	Scopes    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (OAuthConsent) TableName() string {
+	return "oauth_consents"
+}
@@ -0,0 +1,26 @@
+package pkg
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OutboxEvent is an event written in the same transaction as the change it describes and relayed to jetstream
+// afterwards, EventID is the deduplication id it's published with and UserID the user it's about. ParkedAt is set
+// once it failed to publish too often, it's skipped by the relay until it's requeued.
+type OutboxEvent struct {
+	ID          uint64 `gorm:"primaryKey"`
+	EventID     string
+	Subject     string
+	UserID      uint
+	Payload     []byte
+	CreatedAt   time.Time
+	PublishedAt sql.NullTime
+	Attempts    int
+	LastError   string
+	ParkedAt    sql.NullTime
+}
+
+func (OutboxEvent) TableName() string {
+	return "outbox_events"
+}
@@ -0,0 +1,15 @@
+package pkg
+
+import "time"
+
+// PasswordHistory is a password hash a user has had, kept to stop them from going back to it
+type PasswordHistory struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint
+	Password  string
+	CreatedAt time.Time
+}
+
+func (PasswordHistory) TableName() string {
+	return "password_history"
+}
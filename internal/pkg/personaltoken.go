@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PersonalAccessTokenPrefix starts every personal access token so they can be told apart from JWTs and found by secret scanners
+const PersonalAccessTokenPrefix = "qpat_"
+
+// PersonalAccessToken is a long lived token a user creates for scripts and pipelines, only its hash is kept
+type PersonalAccessToken struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint
+	Name      string
+	TokenHash string
+	// TokenPrefix is the start of the token, kept so the user can tell their tokens apart
+	TokenPrefix string
+	// Scopes are the space separated roles the token acts with, as long as the user still holds them
+	Scopes     string
+	ExpiresAt  time.Time
+	LastUsedAt sql.NullTime
+	LastUsedIP string
+	CreatedAt  time.Time
+}
+
+func (PersonalAccessToken) TableName() string {
+	return "personal_access_tokens"
+}
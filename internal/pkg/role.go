@@ -0,0 +1,19 @@
+package pkg
+
+import "time"
+
+// Role grants a user access to parts of the api beyond their own account
+type Role string
+
+const (
+	RoleUser       Role = "user"
+	RoleQuizAuthor Role = "quiz_author"
+	RoleAdmin      Role = "admin"
+)
+
+// UserRole is a single role assigned to a user, a user can hold several
+type UserRole struct {
+	UserID    uint `gorm:"primaryKey"`
+	Role      Role `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session is a login of a user on a device, it lasts as long as the refresh token family it shares its id with
+type Session struct {
+	ID     string `gorm:"primaryKey"`
+	UserID uint
+	// Device is a readable summary of the user agent such as "Firefox on Linux"
+	Device     string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt sql.NullTime
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
@@ -1,3 +1,43 @@
 package pkg
 
 const AuthGeneratePass = "auth.generate.password"
+
+// ResponderQueue is the queue group every instance answers requests in, so each request is handled once
+const ResponderQueue = "user-api-service"
+
+// UserGet is requested with a user id to get the user and its roles
+const UserGet = "user.get"
+
+// UserGetByUsername is requested with a username to get the user and its roles
+const UserGetByUsername = "user.get_by_username"
+
+// AuthValidateToken is requested with an access token or personal access token to get the claims it carries
+const AuthValidateToken = "auth.validate_token"
+
+// UserEventsStream is the jetstream stream user lifecycle events are relayed to from the outbox
+const UserEventsStream = "USER_EVENTS"
+
+// UserCreated is published when a user signs up or is provisioned by an external provider
+const UserCreated = "user.created"
+
+// UserUpdated is published when the profile, password or roles of a user change
+const UserUpdated = "user.updated"
+
+// UserLoggedIn is published when a user gets through every login check and a session starts
+const UserLoggedIn = "user.logged_in"
+
+// UserPasswordReset is published after a user sets a new password with a reset token
+const UserPasswordReset = "user.password.reset"
+
+// UserDeleted is published when a user is soft deleted and can still be restored until it's purged
+const UserDeleted = "user.deleted"
+
+// UserRestored is published when an admin restores a soft deleted user
+const UserRestored = "user.restored"
+
+// UserPurged is published once a user is gone for good, either hard deleted or purged after the grace period
+const UserPurged = "user.purged"
+
+// UserEventSubjects lists every subject of UserEventsStream, request subjects must never be added as the stream
+// would answer them
+var UserEventSubjects = []string{UserCreated, UserUpdated, UserLoggedIn, UserPasswordReset, UserDeleted, UserRestored, UserPurged}
@@ -11,9 +11,11 @@ type User struct {
 	gorm.Model
 	FirstName          string       `json:"first_name"`
 	LastName           string       `json:"last_name"`
-	Email              string       `json:"email"`
+	Email              string       `json:"email" gorm:"size:255"`
 	Age                int8         `json:"age"`
-	Username           string       `json:"username"`
+	Username           string       `json:"username" gorm:"size:255"`
 	Password           string       `json:"password"`
+	EmailVerifiedAt    sql.NullTime `json:"-"`
+	PasswordChangedAt  sql.NullTime `json:"-"`
 	LastLoginTimeStamp sql.NullTime `json:"-"`
 }
@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"database/sql"
+	"time"
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user, only its public key is stored
+type WebAuthnCredential struct {
+	ID              uint `gorm:"primaryKey"`
+	UserID          uint
+	CredentialID    []byte
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte `gorm:"column:aaguid"`
+	SignCount       uint32
+	// Transports is the comma separated transports the authenticator reported, used as a hint when asking for it again
+	Transports     string
+	BackupEligible bool
+	BackupState    bool
+	Name           string
+	LastUsedAt     sql.NullTime
+	CreatedAt      time.Time
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+var (
+	errNotPasswordHash   = errors.New("password isn't a bcrypt or argon2id hash")
+	errWrongPasswordHash = errors.New("password hash doesn't match the password")
+)
+
+// AuthClient asks the auth service to hash the passwords of new users over nats. Failed requests are retried
+// with jittered backoff and the password is hashed locally once they run out, so signups don't depend on the
+// auth service. After BreakerThreshold signups in a row had to fall back the breaker opens and passwords are
+// hashed locally straight away for BreakerCooldown, then a single request is let through to probe the service.
+type AuthClient struct {
+	Nats     *nats.Conn
+	Hasher   utils.PasswordHasher
+	logger   *zap.Logger
+	settings AuthClientSettings
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// AuthClientSettings holds how long a request to the auth service may take and how failures are handled
+type AuthClientSettings struct {
+	Timeout          time.Duration
+	Retries          int
+	RetryBackoff     time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+type IAuthClient interface {
+	HashPassword(ctx context.Context, req api.GeneratePasswordRequest) (string, error)
+}
+
+func NewAuthClient(nc *nats.Conn, hasher utils.PasswordHasher, logger *zap.Logger, settings AuthClientSettings) *AuthClient {
+	return &AuthClient{
+		Nats:     nc,
+		Hasher:   hasher,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// HashPassword returns the hash of the password of a new user, from the auth service when it's reachable
+func (client *AuthClient) HashPassword(ctx context.Context, req api.GeneratePasswordRequest) (string, error) {
+
+	if client.Nats == nil || !client.allow() {
+		return client.hashLocally(req)
+	}
+
+	request, err := events.New(events.TypeOf(pkg.AuthGeneratePass), req)
+	if err != nil {
+		client.logger.Error("something went wrong wrapping the auth service request, hashing locally", zap.Error(err))
+		return client.hashLocally(req)
+	}
+
+	for attempt := 0; attempt <= client.settings.Retries; attempt++ {
+		if attempt > 0 {
+			if err = sleepCtx(ctx, client.backoff(attempt)); err != nil {
+				break
+			}
+		}
+
+		var hash string
+		if hash, err = client.request(ctx, request, req.Password); err == nil {
+			client.recordResult(true)
+			return hash, nil
+		}
+
+		client.logger.Warn("auth service request failed", zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+
+	client.recordResult(false)
+
+	client.logger.Error("couldn't get a password hash from the auth service, hashing locally", zap.Error(err))
+
+	return client.hashLocally(req)
+}
+
+// request makes a single request to the auth service, retries send the same event so it can tell them apart.
+// Requests always go out in binary mode so auth services that don't speak cloudevents yet still find the plain
+// data in the body, and their plain replies are taken with a warning. Only a hash of the password passed is taken,
+// anything else is a bad response: a hash of another password would let whoever knows it into the new account.
+func (client *AuthClient) request(ctx context.Context, request *events.Event, password string) (string, error) {
+
+	msg, err := request.Message(pkg.AuthGeneratePass, events.ModeBinary)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, client.settings.Timeout)
+	defer cancel()
+
+	res, err := client.Nats.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return "", upstreamError("auth_service_unavailable", "couldn't get a response from auth service", err)
+	}
+
+	var gpResponse api.GeneratePasswordResponse
+
+	reply, err := events.Decode(res, events.ReplyOf(pkg.AuthGeneratePass))
+	switch {
+	case err == nil:
+		err = reply.DataAs(&gpResponse)
+	case errors.Is(err, events.ErrInvalidEvent) && events.ModeOf(res) == events.ModeStructured:
+		client.logger.Warn("auth service replied without a cloudevent, it should be updated", zap.String("subject", pkg.AuthGeneratePass))
+		err = client.decodePlain(res.Data, &gpResponse)
+	}
+	if err != nil {
+		return "", upstreamError("auth_service_bad_response", "bad response from auth service", err)
+	}
+
+	if !utils.IsPasswordHash(gpResponse.Password) {
+		return "", upstreamError("auth_service_bad_response", "bad response from auth service", errNotPasswordHash)
+	}
+
+	if match, err := utils.ComparePasswords(gpResponse.Password, []byte(password)); err != nil || !match {
+		return "", upstreamError("auth_service_bad_response", "bad response from auth service", errWrongPasswordHash)
+	}
+
+	return gpResponse.Password, nil
+}
+
+// decodePlain reads a reply sent before the auth service wrapped its replies in cloudevents, it still has to match
+// the schema of the first reply version
+func (client *AuthClient) decodePlain(data []byte, v any) error {
+
+	if err := events.Validate(events.TypeOf(events.ReplyOf(pkg.AuthGeneratePass)), data); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (client *AuthClient) hashLocally(req api.GeneratePasswordRequest) (string, error) {
+
+	hash, err := client.Hasher.Hash([]byte(req.Password))
+	if err != nil {
+		client.logger.Error("failed to encrypt pass", zap.String("username", req.Username), zap.Error(err))
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// allow reports whether the auth service should be asked, only one request probes it once the cooldown is over
+func (client *AuthClient) allow() bool {
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.openUntil.IsZero() {
+		return true
+	}
+
+	if time.Now().Before(client.openUntil) || client.probing {
+		return false
+	}
+
+	client.probing = true
+
+	return true
+}
+
+// recordResult closes the breaker on success and opens it once enough signups in a row had to fall back
+func (client *AuthClient) recordResult(ok bool) {
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.probing = false
+
+	if ok {
+		client.failures = 0
+		client.openUntil = time.Time{}
+		return
+	}
+
+	client.failures++
+
+	if client.settings.BreakerThreshold > 0 && client.failures >= client.settings.BreakerThreshold {
+		if client.openUntil.IsZero() {
+			client.logger.Warn("auth service keeps failing, hashing passwords locally for a while", zap.Duration("cooldown", client.settings.BreakerCooldown))
+		}
+		client.openUntil = time.Now().Add(client.settings.BreakerCooldown)
+	}
+}
+
+// backoff is a random wait up to RetryBackoff doubled for every attempt already made, so instances retrying
+// at the same time spread out
+func (client *AuthClient) backoff(attempt int) time.Duration {
+
+	ceiling := client.settings.RetryBackoff << (attempt - 1)
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// sleepCtx waits for d unless ctx is done first
+func sleepCtx(ctx context.Context, d time.Duration) error {
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
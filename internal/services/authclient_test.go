@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// authServiceHash is the hash of the password the tests sign up with that the stand in for the auth service answers with
+const authServiceHash = "$2a$04$kNiLwOGDX1AwzlSFDo9fUuN1FDLQGS.9GKWDWZ828GR/ed.9m264y"
+
+// respondWith subscribes a stand in for the auth service answering every request after the first skip ones
+// with password, wrapped in a cloudevent when it's set. It returns how many requests it got.
+func respondWith(t *testing.T, nc *nats.Conn, skip int32, password string) *atomic.Int32 {
+	t.Helper()
+
+	var received atomic.Int32
+
+	sub, err := nc.Subscribe(pkg.AuthGeneratePass, func(msg *nats.Msg) {
+		if received.Add(1) <= skip {
+			return
+		}
+
+		request, err := events.Decode(msg, pkg.AuthGeneratePass)
+		if err != nil || password == "" {
+			_ = msg.Respond([]byte(`{"password":""}`))
+			return
+		}
+
+		reply, _ := request.Reply(api.GeneratePasswordResponse{Password: password})
+		out, _ := reply.Message(msg.Reply, events.ModeOf(msg))
+		_ = msg.RespondMsg(out)
+	})
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+	t.Cleanup(func() { _ = sub.Unsubscribe() })
+
+	return &received
+}
+
+func TestAuthClient_HashPassword(t *testing.T) {
+	ctx := context.Background()
+	req := api.GeneratePasswordRequest{Username: "alexm1496", Password: "Correct-Horse-2931"}
+	hasher := &utils.BcryptHasher{Cost: bcrypt.MinCost}
+	settings := AuthClientSettings{
+		Timeout:          100 * time.Millisecond,
+		Retries:          2,
+		RetryBackoff:     10 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  200 * time.Millisecond,
+	}
+
+	requireLocalHash := func(t *testing.T, hash string) {
+		ok, err := utils.ComparePasswords(hash, []byte(req.Password))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	t.Run("hash from the auth service", func(t *testing.T) {
+		nc := runJetStream(t)
+		received := respondWith(t, nc, 0, authServiceHash)
+
+		hash, err := NewAuthClient(nc, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, authServiceHash, hash)
+		require.EqualValues(t, 1, received.Load())
+	})
+
+	t.Run("auth service that doesn't speak cloudevents yet", func(t *testing.T) {
+		nc := runJetStream(t)
+
+		var received atomic.Int32
+		sub, err := nc.Subscribe(pkg.AuthGeneratePass, func(msg *nats.Msg) {
+			received.Add(1)
+
+			// the request is sent in binary mode, the body is the plain data
+			var plain api.GeneratePasswordRequest
+			if json.Unmarshal(msg.Data, &plain) != nil || plain != req {
+				return
+			}
+			_ = msg.Respond([]byte(`{"password":"` + authServiceHash + `"}`))
+		})
+		require.NoError(t, err)
+		require.NoError(t, nc.Flush())
+		t.Cleanup(func() { _ = sub.Unsubscribe() })
+
+		hash, err := NewAuthClient(nc, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, authServiceHash, hash)
+		require.EqualValues(t, 1, received.Load())
+	})
+
+	t.Run("retries after a timeout", func(t *testing.T) {
+		nc := runJetStream(t)
+		received := respondWith(t, nc, 1, authServiceHash)
+
+		hash, err := NewAuthClient(nc, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, authServiceHash, hash)
+		require.EqualValues(t, 2, received.Load())
+	})
+
+	t.Run("plain replies without a hash fall back after retries", func(t *testing.T) {
+		nc := runJetStream(t)
+		received := respondWith(t, nc, 0, "")
+
+		hash, err := NewAuthClient(nc, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		requireLocalHash(t, hash)
+		require.EqualValues(t, 3, received.Load())
+	})
+
+	t.Run("replies that aren't a hash fall back after retries", func(t *testing.T) {
+		nc := runJetStream(t)
+		received := respondWith(t, nc, 0, req.Password)
+
+		hash, err := NewAuthClient(nc, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.NotEqual(t, req.Password, hash)
+		requireLocalHash(t, hash)
+		require.EqualValues(t, 3, received.Load())
+	})
+
+	t.Run("hashes of another password fall back after retries", func(t *testing.T) {
+		other, err := hasher.Hash([]byte("Known-Password-1234"))
+		require.NoError(t, err)
+
+		nc := runJetStream(t)
+		received := respondWith(t, nc, 0, other)
+
+		hash, err := NewAuthClient(nc, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.NotEqual(t, other, hash)
+		requireLocalHash(t, hash)
+		require.EqualValues(t, 3, received.Load())
+	})
+
+	t.Run("no nats hashes locally", func(t *testing.T) {
+		hash, err := NewAuthClient(nil, hasher, log, settings).HashPassword(ctx, req)
+		require.NoError(t, err)
+		requireLocalHash(t, hash)
+	})
+
+	t.Run("breaker opens and lets a probe through after the cooldown", func(t *testing.T) {
+		nc := runJetStream(t)
+		client := NewAuthClient(nc, hasher, log, settings)
+
+		// nobody is listening, every attempt fails straight away
+		for i := 0; i < settings.BreakerThreshold; i++ {
+			hash, err := client.HashPassword(ctx, req)
+			require.NoError(t, err)
+			requireLocalHash(t, hash)
+		}
+
+		received := respondWith(t, nc, 0, authServiceHash)
+
+		hash, err := client.HashPassword(ctx, req)
+		require.NoError(t, err)
+		requireLocalHash(t, hash)
+		require.EqualValues(t, 0, received.Load())
+
+		time.Sleep(settings.BreakerCooldown)
+
+		hash, err = client.HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, authServiceHash, hash)
+
+		hash, err = client.HashPassword(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, authServiceHash, hash)
+		require.EqualValues(t, 2, received.Load())
+	})
+}
+
+func TestUserService_InsertUser_AuthServiceHash(t *testing.T) {
+	nc := runJetStream(t)
+	respondWith(t, nc, 0, authServiceHash)
+
+	service := *userService
+	service.Auth = NewAuthClient(nc, service.Hasher, log, AuthClientSettings{Timeout: time.Second})
+
+	req := api.NewUserRequest{User: &api.User{
+		FirstName: "Alex",
+		LastName:  "Mifsud",
+		Email:     "alexanderm1496@gmail.com",
+		Age:       27,
+		Username:  "alexm1496",
+		Password:  "Correct-Horse-2931",
+	}}
+
+	sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE").
+		WithArgs(req.Email, req.Username, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "username"}))
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("INSERT INTO `users`").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Alex", "Mifsud", req.Email, 27, req.Username, authServiceHash, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(90, 1))
+	sqlMock.ExpectExec("INSERT INTO `user_roles`").
+		WithArgs(90, "user", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectExec("INSERT INTO `password_history`").
+		WithArgs(90, authServiceHash, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlMock.ExpectQuery("SELECT `id` FROM `password_history` WHERE user_id = \\? ORDER BY id DESC LIMIT 3").
+		WithArgs(90).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	sqlMock.ExpectExec("DELETE FROM `password_history` WHERE user_id = \\? AND id NOT IN \\(\\?\\)").
+		WithArgs(90, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectOutboxEvent(pkg.UserCreated)
+	sqlMock.ExpectCommit()
+
+	user, err := service.InsertUser(req)
+	require.NoError(t, err)
+	require.Equal(t, "90", user.ID)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+)
+
+// mysqlDuplicateEntry is the error number mysql returns when a unique index is violated
+const mysqlDuplicateEntry = 1062
+
+// Error categories, every error returned by the services should match one of these with errors.Is
+// so the transport layer can pick a status code without knowing about individual errors.
+var (
+	ErrNotFound            = errors.New("not found")
+	ErrConflict            = errors.New("conflict")
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrForbidden           = errors.New("forbidden")
+	ErrValidation          = errors.New("validation failed")
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	ErrRateLimited         = errors.New("rate limited")
+)
+
+// Error is a domain error belonging to one of the categories above with a stable code clients can switch on
+type Error struct {
+	Kind    error
+	Code    string
+	Message string
+	Field   string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err.Error())
+	}
+	return e.Message
+}
+
+// Is matches the category of the error as well as the error itself
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var (
+	ErrUserNotFound     = &Error{Kind: ErrNotFound, Code: "user_not_found", Message: "user not found"}
+	ErrEmailTaken       = &Error{Kind: ErrConflict, Code: "email_taken", Message: "email already registered", Field: "email"}
+	ErrUsernameTaken    = &Error{Kind: ErrConflict, Code: "username_taken", Message: "username taken", Field: "username"}
+	ErrPasswordMismatch = &Error{Kind: ErrInvalidCredentials, Code: "password_mismatch", Message: "passwords don't match"}
+	ErrPasswordRequired = &Error{Kind: ErrValidation, Code: "password_required", Message: "the current password is needed to change the email", Field: "old_password"}
+	ErrBreachedPassword = &Error{Kind: ErrValidation, Code: "breached_password", Message: "password has appeared in a data breach, choose another", Field: "password"}
+	ErrInvalidLogin     = &Error{Kind: ErrInvalidCredentials, Code: "invalid_credentials", Message: "invalid username or password"}
+	ErrEmailNotVerified = &Error{Kind: ErrForbidden, Code: "email_not_verified", Message: "email address not verified"}
+)
+
+// ValidationError holds every field that failed validation
+type ValidationError struct {
+	Fields []api.FieldError
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Fields) == 0 && e.Err != nil {
+		return e.Err.Error()
+	}
+
+	fields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		fields = append(fields, fmt.Sprintf("%s %s", field.Field, field.Message))
+	}
+
+	return strings.Join(fields, ", ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// NewValidationError wraps request parsing, validator and schema errors, validator and schema errors are broken
+// down per field
+func NewValidationError(err error) error {
+
+	var schemaErrs events.SchemaErrors
+	if errors.As(err, &schemaErrs) {
+		validationErr := &ValidationError{Err: err}
+		for _, se := range schemaErrs {
+			validationErr.Fields = append(validationErr.Fields, api.FieldError{Field: se.Path, Rule: se.Keyword, Message: se.Message})
+		}
+		return validationErr
+	}
+
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return &ValidationError{Err: err}
+	}
+
+	validationErr := &ValidationError{Err: err}
+	for _, fe := range fieldErrs {
+		message := fmt.Sprintf("failed on the '%s' rule", fe.Tag())
+		if fe.Tag() == "password" {
+			message = "doesn't meet the password policy"
+		} else if fe.Param() != "" {
+			message = fmt.Sprintf("failed on the '%s=%s' rule", fe.Tag(), fe.Param())
+		}
+
+		validationErr.Fields = append(validationErr.Fields, api.FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Message: message,
+		})
+	}
+
+	return validationErr
+}
+
+// NewFieldError is a validation error for a single field that isn't covered by struct tags
+func NewFieldError(field, message string) error {
+	return &ValidationError{Fields: []api.FieldError{{Field: field, Message: message}}}
+}
+
+// upstreamError marks a failure talking to another service
+func upstreamError(code, message string, err error) error {
+	return &Error{Kind: ErrUpstreamUnavailable, Code: code, Message: message, Err: err}
+}
+
+// translateDuplicateKey maps unique index violations to the matching domain error
+func translateDuplicateKey(err error) error {
+
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != mysqlDuplicateEntry {
+		return err
+	}
+
+	switch {
+	case strings.Contains(mysqlErr.Message, "idx_users_email"):
+		return ErrEmailTaken
+	case strings.Contains(mysqlErr.Message, "idx_users_username"):
+		return ErrUsernameTaken
+	case strings.Contains(mysqlErr.Message, "idx_webauthn_credentials_credential_id"):
+		return ErrPasskeyRegistered
+	case strings.Contains(mysqlErr.Message, "idx_identities_provider_subject"):
+		return ErrIdentityLinked
+	case strings.Contains(mysqlErr.Message, "idx_identities_user_provider"):
+		return ErrProviderLinked
+	}
+
+	return err
+}
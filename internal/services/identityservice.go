@@ -0,0 +1,382 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// oidcStateKey holds what a login or link through the external provider was started with until the provider
+// sends the user agent back, keyed by the state passed along
+const oidcStateKey = "auth:oidc:state:%s"
+
+var (
+	ErrExternalLoginDisabled = &Error{Kind: ErrNotFound, Code: "external_login_disabled", Message: "no external identity provider is configured"}
+	ErrInvalidExternalLogin  = &Error{Kind: ErrInvalidCredentials, Code: "invalid_external_login", Message: "external login couldn't be verified, start again"}
+	ErrExternalEmailMissing  = &Error{Kind: ErrValidation, Code: "external_email_missing", Message: "the identity provider didn't share an email address"}
+	ErrExternalEmailTaken    = &Error{Kind: ErrConflict, Code: "external_email_taken", Message: "an account already uses this email, log in to it and link the provider from there", Field: "email"}
+	ErrIdentityNotFound      = &Error{Kind: ErrNotFound, Code: "identity_not_found", Message: "identity not found"}
+	ErrIdentityLinked        = &Error{Kind: ErrConflict, Code: "identity_already_linked", Message: "the external account is already linked to a user"}
+	ErrProviderLinked        = &Error{Kind: ErrConflict, Code: "provider_already_linked", Message: "an account of this provider is already linked"}
+	ErrLastLoginMethod       = &Error{Kind: ErrConflict, Code: "last_login_method", Message: "can't unlink the only way left to log in, set a password first"}
+)
+
+type IdentityService struct {
+	DBConn   *gorm.DB
+	Redis    *redis.Client
+	logger   *zap.Logger
+	settings IdentityServiceSettings
+
+	// the provider is discovered on first use so the api can start while it's unreachable
+	mu       sync.Mutex
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// httpCtx carries the client every request to the provider is made with
+	httpCtx context.Context
+}
+
+// IdentityServiceSettings holds the external OpenID Connect provider users can sign in with, it's off without an issuer
+type IdentityServiceSettings struct {
+	Provider     string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	StateTTL     time.Duration
+}
+
+// ExternalIdentity is what the external provider vouched for in its ID token
+type ExternalIdentity struct {
+	Provider          string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	GivenName         string
+	FamilyName        string
+	PreferredUsername string
+}
+
+// oidcState is what a login or link was started with
+type oidcState struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// BindingHash is the sha256 of the binding handed to the client that started it, the binding itself isn't stored
+	BindingHash string `json:"binding_hash"`
+	// LinkUserID is set when a logged-in user links the provider to their account
+	LinkUserID uint `json:"link_user_id,omitempty"`
+}
+
+type IIdentityService interface {
+	BeginAuth(ctx context.Context, linkUserID uint) (*api.ExternalLoginRedirect, error)
+	Exchange(ctx context.Context, req api.FinishExternalLoginRequest) (*ExternalIdentity, error)
+	FindUser(identity *ExternalIdentity) (uint, error)
+	LinkIdentity(ctx context.Context, req api.FinishExternalLoginRequest) (*api.Identity, error)
+	ListIdentities(userID uint) ([]api.Identity, error)
+	UnlinkIdentity(req api.UnlinkIdentityRequest) error
+}
+
+func NewIdentityService(dbConn *gorm.DB, redisClient *redis.Client, logger *zap.Logger, settings IdentityServiceSettings) *IdentityService {
+	return &IdentityService{
+		DBConn:   dbConn,
+		Redis:    redisClient,
+		logger:   logger,
+		settings: settings,
+		httpCtx:  oidc.ClientContext(context.Background(), &http.Client{Timeout: 10 * time.Second}),
+	}
+}
+
+// BeginAuth returns the authorization url of the provider, the request is bound to a nonce and a PKCE verifier
+// kept until the provider sends the user agent back. The binding returned with it has to be sent back to finish,
+// so a code and state of someone else's login can't be finished by another browser.
+// A linkUserID starts linking the provider to that user instead of a login.
+func (service *IdentityService) BeginAuth(ctx context.Context, linkUserID uint) (*api.ExternalLoginRedirect, error) {
+
+	config, _, err := service.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	binding, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	data, err := json.Marshal(oidcState{Nonce: nonce, Verifier: verifier, BindingHash: hashToken(binding), LinkUserID: linkUserID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = service.Redis.Set(ctx, fmt.Sprintf(oidcStateKey, state), data, service.settings.StateTTL).Err(); err != nil {
+		service.logger.Error("failed to store external login state", zap.Error(err))
+		return nil, err
+	}
+
+	return &api.ExternalLoginRedirect{
+		RedirectTo: config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)),
+		Binding:    binding,
+	}, nil
+}
+
+// Exchange redeems the code the provider sent back and verifies the ID token it's exchanged for. The state is
+// redeemed first so every one is only answered once, and it has to have been started with the binding passed and
+// for the same purpose: a login when req.UserID is zero, linking that user otherwise.
+func (service *IdentityService) Exchange(ctx context.Context, req api.FinishExternalLoginRequest) (*ExternalIdentity, error) {
+
+	config, verifier, err := service.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := takeKeyScript.Run(ctx, service.Redis, []string{fmt.Sprintf(oidcStateKey, req.State)}).Text()
+	if err == redis.Nil {
+		return nil, ErrInvalidExternalLogin
+	} else if err != nil {
+		service.logger.Error("failed to redeem external login state", zap.Error(err))
+		return nil, err
+	}
+
+	var state oidcState
+	if err = json.Unmarshal([]byte(data), &state); err != nil {
+		service.logger.Error("something went wrong unmarshalling external login state", zap.Error(err))
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(req.Binding)), []byte(state.BindingHash)) != 1 {
+		service.logger.Warn("external login finished without the binding it was started with")
+		return nil, ErrInvalidExternalLogin
+	}
+
+	if state.LinkUserID != req.UserID {
+		return nil, ErrInvalidExternalLogin
+	}
+
+	token, err := config.Exchange(service.httpCtx, req.Code, oauth2.VerifierOption(state.Verifier))
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		service.logger.Info("identity provider refused the code", zap.Error(err))
+		return nil, ErrInvalidExternalLogin
+	} else if err != nil {
+		service.logger.Error("couldn't exchange the code with the identity provider", zap.Error(err))
+		return nil, upstreamError("identity_provider_unavailable", "couldn't reach the identity provider", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, upstreamError("identity_provider_bad_response", "identity provider didn't return an id token", nil)
+	}
+
+	idToken, err := verifier.Verify(service.httpCtx, rawIDToken)
+	if err != nil {
+		service.logger.Info("id token from the identity provider rejected", zap.Error(err))
+		return nil, ErrInvalidExternalLogin
+	}
+
+	if idToken.Nonce != state.Nonce {
+		service.logger.Warn("id token nonce doesn't match the login it was issued for")
+		return nil, ErrInvalidExternalLogin
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		GivenName         string `json:"given_name"`
+		FamilyName        string `json:"family_name"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+
+	if err = idToken.Claims(&claims); err != nil {
+		service.logger.Info("unparsable id token claims", zap.Error(err))
+		return nil, ErrInvalidExternalLogin
+	}
+
+	return &ExternalIdentity{
+		Provider:          service.settings.Provider,
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		GivenName:         claims.GivenName,
+		FamilyName:        claims.FamilyName,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// FindUser returns the user the identity is linked to and records the login, ErrIdentityNotFound when it isn't linked yet
+func (service *IdentityService) FindUser(identity *ExternalIdentity) (uint, error) {
+
+	var linked pkg.Identity
+
+	res := service.DBConn.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).Take(&linked)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return 0, ErrIdentityNotFound
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting identity", zap.String("provider", identity.Provider), zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	res = service.DBConn.Model(&linked).Update("last_login_at", service.DBConn.NowFunc())
+	if res.Error != nil {
+		service.logger.Error("something went wrong updating identity", zap.Uint("identityID", linked.ID), zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	return linked.UserID, nil
+}
+
+// LinkIdentity finishes linking the provider to the logged-in user
+func (service *IdentityService) LinkIdentity(ctx context.Context, req api.FinishExternalLoginRequest) (*api.Identity, error) {
+
+	identity, err := service.Exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	linked := &pkg.Identity{
+		UserID:   req.UserID,
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+
+	if res := service.DBConn.Create(linked); res.Error != nil {
+		service.logger.Error("something went wrong linking identity", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return nil, translateDuplicateKey(res.Error)
+	}
+
+	service.logger.Info("linked identity", zap.Uint("userID", req.UserID), zap.String("provider", identity.Provider))
+
+	response := toAPIIdentity(*linked)
+
+	return &response, nil
+}
+
+// ListIdentities returns the external accounts linked to the user, oldest first
+func (service *IdentityService) ListIdentities(userID uint) ([]api.Identity, error) {
+
+	var rows []pkg.Identity
+
+	res := service.DBConn.Where("user_id = ?", userID).Order("id").Find(&rows)
+	if res.Error != nil {
+		service.logger.Error("something went wrong listing identities", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	identities := make([]api.Identity, 0, len(rows))
+	for _, row := range rows {
+		identities = append(identities, toAPIIdentity(row))
+	}
+
+	return identities, nil
+}
+
+// UnlinkIdentity removes an external account from the user, as long as it leaves them another way to log in
+func (service *IdentityService) UnlinkIdentity(req api.UnlinkIdentityRequest) error {
+
+	var loginMethods struct {
+		HasPassword bool
+		Identities  int64
+		Passkeys    int64
+	}
+
+	res := service.DBConn.Raw(`SELECT
+		COALESCE((SELECT password <> '' FROM users WHERE id = ?), FALSE) AS has_password,
+		(SELECT COUNT(*) FROM identities WHERE user_id = ? AND id <> ?) AS identities,
+		(SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = ?) AS passkeys`,
+		req.UserID, req.UserID, req.IdentityID, req.UserID,
+	).Scan(&loginMethods)
+	if res.Error != nil {
+		service.logger.Error("something went wrong counting login methods", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if !loginMethods.HasPassword && loginMethods.Identities == 0 && loginMethods.Passkeys == 0 {
+		return ErrLastLoginMethod
+	}
+
+	res = service.DBConn.Where("id = ? AND user_id = ?", req.IdentityID, req.UserID).Delete(&pkg.Identity{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong unlinking identity", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+
+	return nil
+}
+
+// provider discovers the provider from its issuer the first time it's needed, failures are retried on the next call
+func (service *IdentityService) provider() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+
+	if service.settings.Issuer == "" {
+		return nil, nil, ErrExternalLoginDisabled
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.verifier != nil {
+		return service.config, service.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(service.httpCtx, service.settings.Issuer)
+	if err != nil {
+		service.logger.Error("couldn't discover the identity provider", zap.String("issuer", service.settings.Issuer), zap.Error(err))
+		return nil, nil, upstreamError("identity_provider_unavailable", "couldn't reach the identity provider", err)
+	}
+
+	service.config = &oauth2.Config{
+		ClientID:     service.settings.ClientID,
+		ClientSecret: service.settings.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  service.settings.RedirectURL,
+		Scopes:       service.settings.Scopes,
+	}
+	service.verifier = provider.Verifier(&oidc.Config{ClientID: service.settings.ClientID})
+
+	return service.config, service.verifier, nil
+}
+
+func toAPIIdentity(identity pkg.Identity) api.Identity {
+
+	response := api.Identity{
+		ID:        identity.ID,
+		Provider:  identity.Provider,
+		Email:     identity.Email,
+		CreatedAT: identity.CreatedAt.Format(time.RFC3339),
+	}
+
+	if identity.LastLoginAt.Valid {
+		response.LastLoginAT = identity.LastLoginAt.Time.Format(time.RFC3339)
+	}
+
+	return response
+}
@@ -0,0 +1,434 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+// stubIssuer is a local OpenID Connect provider answering discovery, jwks and the token endpoint,
+// logins are started with the code it will accept instead of going through an authorization page
+type stubIssuer struct {
+	*httptest.Server
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+
+	mu      sync.Mutex
+	pending map[string]stubGrant
+}
+
+// stubGrant is what the stub issuer answers a code with
+type stubGrant struct {
+	claims        jwt.MapClaims
+	codeChallenge string
+}
+
+func newStubIssuer(clientID, clientSecret string) *stubIssuer {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	issuer := &stubIssuer{clientID: clientID, clientSecret: clientSecret, key: key, pending: map[string]stubGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+
+	issuer.Server = httptest.NewServer(mux)
+
+	return issuer
+}
+
+func (issuer *stubIssuer) discovery(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer.URL,
+		"authorization_endpoint":                issuer.URL + "/authorize",
+		"token_endpoint":                        issuer.URL + "/token",
+		"jwks_uri":                              issuer.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (issuer *stubIssuer) jwks(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(issuer.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (issuer *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+
+	clientID, secret, _ := r.BasicAuth()
+	if clientID != issuer.clientID || secret != issuer.clientSecret {
+		issuer.fail(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	issuer.mu.Lock()
+	grant, ok := issuer.pending[r.PostFormValue("code")]
+	delete(issuer.pending, r.PostFormValue("code"))
+	issuer.mu.Unlock()
+
+	verifierSum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifierSum[:]) != grant.codeChallenge {
+		issuer.fail(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	idToken.Header["kid"] = "stub"
+
+	signed, err := idToken.SignedString(issuer.key)
+	if err != nil {
+		issuer.fail(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "stub-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func (issuer *stubIssuer) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// login starts a login through identityService and has the stub issuer accept it for subject, the claims passed
+// are added to the ID token. It returns what the frontend sends back once the provider redirected to it.
+func (issuer *stubIssuer) login(t *testing.T, linkUserID uint, subject string, extra jwt.MapClaims) api.FinishExternalLoginRequest {
+	t.Helper()
+
+	redirect, err := identityService.BeginAuth(context.Background(), linkUserID)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(redirect.RedirectTo, issuer.URL+"/authorize?"))
+
+	authURL, err := url.Parse(redirect.RedirectTo)
+	require.NoError(t, err)
+
+	query := authURL.Query()
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+	require.Equal(t, issuer.clientID, query.Get("client_id"))
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   issuer.URL,
+		"sub":   subject,
+		"aud":   issuer.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+
+	code := "code-" + query.Get("state")
+
+	issuer.mu.Lock()
+	issuer.pending[code] = stubGrant{claims: claims, codeChallenge: query.Get("code_challenge")}
+	issuer.mu.Unlock()
+
+	return api.FinishExternalLoginRequest{UserID: linkUserID, Code: code, State: query.Get("state"), Binding: redirect.Binding}
+}
+
+func expectNoIdentity(subject string) {
+	sqlMock.ExpectQuery("SELECT \\* FROM `identities` WHERE provider = \\? AND subject = \\? LIMIT 1").
+		WithArgs("stub", subject).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+func expectLoginTokens(userID int) {
+	sqlMock.ExpectQuery("SELECT \\* FROM `user_totp` WHERE user_id = \\?").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\?").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+	expectSessionCreated(userID)
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `users` SET `last_login_time_stamp`=\\? WHERE id = \\?").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectOutboxEvent(pkg.UserLoggedIn)
+	sqlMock.ExpectCommit()
+}
+
+func TestUserService_ExternalLogin(t *testing.T) {
+
+	t.Run("first login provisions a user", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-1", jwt.MapClaims{
+			"email":              "ada@example.com",
+			"email_verified":     true,
+			"given_name":         "Ada",
+			"family_name":        "Lovelace",
+			"preferred_username": "Ada L",
+		})
+
+		expectNoIdentity("stub-sub-1")
+		sqlMock.ExpectQuery("SELECT count\\(\\*\\) FROM `users` WHERE username = \\?").
+			WithArgs("adal").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE \\(email = \\? OR username = \\?\\) AND id <> \\? LIMIT 2").
+			WithArgs("ada@example.com", "adal", 0).
+			WillReturnRows(sqlmock.NewRows([]string{"email", "username"}))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("INSERT INTO `users`").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Ada", "Lovelace", "ada@example.com", "adal", "", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(80, 1))
+		sqlMock.ExpectExec("INSERT INTO `user_roles`").
+			WithArgs(80, "user", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec("INSERT INTO `identities`").
+			WithArgs(80, "stub", "stub-sub-1", "ada@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(5, 1))
+		expectOutboxEvent(pkg.UserCreated)
+		sqlMock.ExpectCommit()
+		sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE id = \\?").
+			WithArgs(80).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email_verified_at"}).AddRow(80, "adal", time.Now()))
+		expectLoginTokens(80)
+
+		res, err := userService.ExternalLogin(req)
+		require.NoError(t, err)
+		require.NotEmpty(t, res.Token)
+		require.False(t, res.PasswordChangeRequired)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		t.Run("state can't be replayed", func(t *testing.T) {
+			_, err := userService.ExternalLogin(req)
+			require.ErrorIs(t, err, ErrInvalidExternalLogin)
+			require.NoError(t, sqlMock.ExpectationsWereMet())
+		})
+	})
+
+	t.Run("linked identity logs into its user", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-2", jwt.MapClaims{"email": "grace@example.com", "email_verified": true})
+
+		sqlMock.ExpectQuery("SELECT \\* FROM `identities` WHERE provider = \\? AND subject = \\? LIMIT 1").
+			WithArgs("stub", "stub-sub-2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider", "subject"}).AddRow(6, 81, "stub", "stub-sub-2"))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `identities` SET `last_login_at`=\\? WHERE `id` = \\?").
+			WithArgs(sqlmock.AnyArg(), 6).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+		sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE id = \\?").
+			WithArgs(81).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email_verified_at"}).AddRow(81, "grace", time.Now()))
+		expectLoginTokens(81)
+
+		res, err := userService.ExternalLogin(req)
+		require.NoError(t, err)
+		require.NotEmpty(t, res.Token)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("email of an existing account isn't taken over", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-3", jwt.MapClaims{"email": "Taken@example.com", "email_verified": true})
+
+		expectNoIdentity("stub-sub-3")
+		sqlMock.ExpectQuery("SELECT count\\(\\*\\) FROM `users` WHERE username = \\?").
+			WithArgs("taken").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE \\(email = \\? OR username = \\?\\) AND id <> \\? LIMIT 2").
+			WithArgs("Taken@example.com", "taken", 0).
+			WillReturnRows(sqlmock.NewRows([]string{"email", "username"}).AddRow("taken@example.com", "someoneelse"))
+
+		_, err := userService.ExternalLogin(req)
+		require.ErrorIs(t, err, ErrExternalEmailTaken)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("identity without an email isn't provisioned", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-4", nil)
+
+		expectNoIdentity("stub-sub-4")
+
+		_, err := userService.ExternalLogin(req)
+		require.ErrorIs(t, err, ErrExternalEmailMissing)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("id token for another login is rejected", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-5", jwt.MapClaims{"nonce": "forged"})
+
+		_, err := userService.ExternalLogin(req)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("login started by another browser is rejected", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-11", nil)
+
+		planted := req
+		planted.Binding = "binding-of-the-victim"
+
+		_, err := userService.ExternalLogin(planted)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+
+		// the state is spent either way
+		_, err = userService.ExternalLogin(req)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+	})
+
+	t.Run("code refused by the provider is rejected", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-6", nil)
+		req.Code = "not-issued"
+
+		_, err := userService.ExternalLogin(req)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+	})
+
+	t.Run("link can't be finished as a login", func(t *testing.T) {
+		req := identityIssuer.login(t, 82, "stub-sub-7", nil)
+
+		_, err := userService.ExternalLogin(req)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+	})
+
+	t.Run("user without a password can't log in with one", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE username = \\?").
+			WithArgs("adal").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password"}).AddRow(80, "adal", ""))
+
+		_, err := userService.Login(api.LoginRequest{Username: "adal", Password: "", IP: "10.0.3.1"})
+		require.ErrorIs(t, err, ErrInvalidLogin)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestIdentityService_Link(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("link adds the identity to the user", func(t *testing.T) {
+		req := identityIssuer.login(t, 83, "stub-sub-8", jwt.MapClaims{"email": "linked@example.com"})
+
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("INSERT INTO `identities`").
+			WithArgs(83, "stub", "stub-sub-8", "linked@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(9, 1))
+		sqlMock.ExpectCommit()
+
+		identity, err := identityService.LinkIdentity(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, uint(9), identity.ID)
+		require.Equal(t, "stub", identity.Provider)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("identity of another user isn't linked", func(t *testing.T) {
+		req := identityIssuer.login(t, 83, "stub-sub-2", nil)
+
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("INSERT INTO `identities`").
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'stub-stub-sub-2' for key 'identities.idx_identities_provider_subject'"})
+		sqlMock.ExpectRollback()
+
+		_, err := identityService.LinkIdentity(ctx, req)
+		require.ErrorIs(t, err, ErrIdentityLinked)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("login can't be finished as a link", func(t *testing.T) {
+		req := identityIssuer.login(t, 0, "stub-sub-9", nil)
+		req.UserID = 83
+
+		_, err := identityService.LinkIdentity(ctx, req)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+	})
+
+	t.Run("link of another user can't be finished", func(t *testing.T) {
+		req := identityIssuer.login(t, 84, "stub-sub-10", nil)
+		req.UserID = 83
+
+		_, err := identityService.LinkIdentity(ctx, req)
+		require.ErrorIs(t, err, ErrInvalidExternalLogin)
+	})
+
+	t.Run("disabled without an issuer", func(t *testing.T) {
+		disabled := NewIdentityService(gormDB, nil, zap.NewNop(), IdentityServiceSettings{Provider: "stub"})
+
+		_, err := disabled.BeginAuth(ctx, 0)
+		require.ErrorIs(t, err, ErrExternalLoginDisabled)
+	})
+}
+
+func TestIdentityService_UnlinkIdentity(t *testing.T) {
+
+	expectLoginMethods := func(hasPassword bool, identities, passkeys int) {
+		sqlMock.ExpectQuery("SELECT\\s+COALESCE\\(\\(SELECT password <> '' FROM users WHERE id = \\?\\), FALSE\\) AS has_password").
+			WithArgs(85, 85, 10, 85).
+			WillReturnRows(sqlmock.NewRows([]string{"has_password", "identities", "passkeys"}).AddRow(hasPassword, identities, passkeys))
+	}
+
+	t.Run("last login method is kept", func(t *testing.T) {
+		expectLoginMethods(false, 0, 0)
+
+		err := identityService.UnlinkIdentity(api.UnlinkIdentityRequest{UserID: 85, IdentityID: 10})
+		require.ErrorIs(t, err, ErrLastLoginMethod)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("unlinks when a passkey is left", func(t *testing.T) {
+		expectLoginMethods(false, 0, 1)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("DELETE FROM `identities` WHERE id = \\? AND user_id = \\?").
+			WithArgs(10, 85).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		err := identityService.UnlinkIdentity(api.UnlinkIdentityRequest{UserID: 85, IdentityID: 10})
+		require.NoError(t, err)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("identity of another user isn't found", func(t *testing.T) {
+		expectLoginMethods(true, 0, 0)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("DELETE FROM `identities` WHERE id = \\? AND user_id = \\?").
+			WithArgs(10, 85).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectCommit()
+
+		err := identityService.UnlinkIdentity(api.UnlinkIdentityRequest{UserID: 85, IdentityID: 10})
+		require.ErrorIs(t, err, ErrIdentityNotFound)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
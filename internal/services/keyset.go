@@ -0,0 +1,236 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+// SigningKey is a single key of the key set, keys loaded from public PEM files can only verify tokens
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet holds every key tokens may be verified with and the one new tokens are signed with.
+// Keeping the previous keys in the set while rotating lets tokens they signed live out their expiry.
+type KeySet struct {
+	keys    map[string]*SigningKey
+	order   []string
+	signing *SigningKey
+}
+
+// NewHMACKeySet returns a key set that signs and verifies with a shared HS256 secret, nothing is published in the JWKS
+func NewHMACKeySet(secret string) *KeySet {
+	key := &SigningKey{
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+
+	return &KeySet{
+		keys:    map[string]*SigningKey{"": key},
+		order:   []string{""},
+		signing: key,
+	}
+}
+
+// LoadKeySet reads RSA or Ed25519 keys from the PEM files passed and signs with the key matching signingKeyID,
+// or the first private key when signingKeyID is empty. Key IDs are the RFC 7638 thumbprints of the public keys.
+func LoadKeySet(paths []string, signingKeyID string) (*KeySet, error) {
+
+	keySet := &KeySet{keys: map[string]*SigningKey{}}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading key %s: %w", path, err)
+		}
+
+		key, err := parsePEMKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing key %s: %w", path, err)
+		}
+
+		if _, exists := keySet.keys[key.ID]; exists {
+			continue
+		}
+
+		keySet.keys[key.ID] = key
+		keySet.order = append(keySet.order, key.ID)
+
+		if keySet.signing == nil && key.signKey != nil && (signingKeyID == "" || signingKeyID == key.ID) {
+			keySet.signing = key
+		}
+	}
+
+	if keySet.signing == nil {
+		return nil, fmt.Errorf("no private key found for signing key id %q", signingKeyID)
+	}
+
+	return keySet, nil
+}
+
+// SigningKeyID is the kid of the key currently signing tokens
+func (keySet *KeySet) SigningKeyID() string {
+	return keySet.signing.ID
+}
+
+// SigningAlg is the JWS algorithm of the key currently signing tokens
+func (keySet *KeySet) SigningAlg() string {
+	return keySet.signing.Method.Alg()
+}
+
+// Sign signs the claims with the current signing key and sets its kid in the token header
+func (keySet *KeySet) Sign(claims jwt.Claims) (string, error) {
+
+	token := jwt.NewWithClaims(keySet.signing.Method, claims)
+	if keySet.signing.ID != "" {
+		token.Header["kid"] = keySet.signing.ID
+	}
+
+	return token.SignedString(keySet.signing.signKey)
+}
+
+// Keyfunc picks the verification key from the kid header, rejecting tokens signed with an algorithm other than the key's
+func (keySet *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := keySet.keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected method: %s", token.Header["alg"])
+	}
+
+	return key.verifyKey, nil
+}
+
+// JWKS returns the public keys of the set, shared secrets are never published
+func (keySet *KeySet) JWKS() api.JWKS {
+
+	jwks := api.JWKS{Keys: []api.JWK{}}
+
+	for _, kid := range keySet.order {
+		if jwk, ok := publicJWK(keySet.keys[kid]); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+
+	return jwks
+}
+
+func parsePEMKey(data []byte) (*SigningKey, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var (
+		private interface{}
+		public  interface{}
+		err     error
+	)
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if signer, ok := private.(crypto.Signer); ok {
+		public = signer.Public()
+	}
+
+	key := &SigningKey{signKey: private}
+
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+		key.verifyKey = pub
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.verifyKey = pub
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	jwk, _ := publicJWK(key)
+	key.ID = jwkThumbprint(jwk)
+
+	return key, nil
+}
+
+func publicJWK(key *SigningKey) (api.JWK, bool) {
+
+	switch pub := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return api.JWK{
+			Kty: "RSA",
+			Kid: key.ID,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return api.JWK{
+			Kty: "OKP",
+			Kid: key.ID,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}, true
+	}
+
+	return api.JWK{}, false
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint from the required members of the key in lexicographic order
+func jwkThumbprint(jwk api.JWK) string {
+
+	var members map[string]string
+	if jwk.Kty == "RSA" {
+		members = map[string]string{"e": jwk.E, "kty": jwk.Kty, "n": jwk.N}
+	} else {
+		members = map[string]string{"crv": jwk.Crv, "kty": jwk.Kty, "x": jwk.X}
+	}
+
+	// encoding/json sorts map keys which gives us the canonical member order
+	canonical, _ := json.Marshal(members)
+	sum := sha256.Sum256(canonical)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
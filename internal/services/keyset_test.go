@@ -0,0 +1,116 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeys generates an RSA and an Ed25519 private key plus the public half of the Ed25519 key as PEM files
+func writeKeys(t *testing.T) (rsaPath, edPath, edPublicPath string) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+
+	rsaPath = write("rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	edPath = write("ed25519.pem", "PRIVATE KEY", edDER)
+
+	edPublicDER, err := x509.MarshalPKIXPublicKey(edPublic)
+	require.NoError(t, err)
+	edPublicPath = write("ed25519.pub.pem", "PUBLIC KEY", edPublicDER)
+
+	return rsaPath, edPath, edPublicPath
+}
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": 1, "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestKeySet_Rotation(t *testing.T) {
+	rsaPath, edPath, edPublicPath := writeKeys(t)
+
+	oldKeys, err := LoadKeySet([]string{rsaPath}, "")
+	require.NoError(t, err)
+
+	oldToken, err := oldKeys.Sign(testClaims())
+	require.NoError(t, err)
+
+	// rotate to the ed25519 key while still trusting the rsa key
+	edOnly, err := LoadKeySet([]string{edPath}, "")
+	require.NoError(t, err)
+
+	rotated, err := LoadKeySet([]string{rsaPath, edPath}, edOnly.SigningKeyID())
+	require.NoError(t, err)
+	require.Equal(t, edOnly.SigningKeyID(), rotated.SigningKeyID())
+
+	newToken, err := rotated.Sign(testClaims())
+	require.NoError(t, err)
+
+	parsed, err := jwt.Parse(newToken, rotated.Keyfunc)
+	require.NoError(t, err)
+	require.Equal(t, "EdDSA", parsed.Method.Alg())
+	require.Equal(t, rotated.SigningKeyID(), parsed.Header["kid"])
+
+	_, err = jwt.Parse(oldToken, rotated.Keyfunc)
+	require.NoError(t, err)
+
+	jwks := rotated.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, "RSA", jwks.Keys[0].Kty)
+	require.Equal(t, "OKP", jwks.Keys[1].Kty)
+
+	// once retired the old key only verifies
+	verifyOnly, err := LoadKeySet([]string{edPath, edPublicPath, rsaPath}, oldKeys.SigningKeyID())
+	require.NoError(t, err)
+	require.Len(t, verifyOnly.JWKS().Keys, 2)
+
+	_, err = LoadKeySet([]string{edPublicPath}, "")
+	require.Error(t, err)
+}
+
+func TestKeySet_Keyfunc(t *testing.T) {
+	rsaPath, _, _ := writeKeys(t)
+
+	keys, err := LoadKeySet([]string{rsaPath}, "")
+	require.NoError(t, err)
+
+	t.Run("unknown kid is rejected", func(t *testing.T) {
+		token, err := NewHMACKeySet("secret").Sign(testClaims())
+		require.NoError(t, err)
+
+		_, err = jwt.Parse(token, keys.Keyfunc)
+		require.Error(t, err)
+	})
+
+	t.Run("algorithm must match the key", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+		token.Header["kid"] = keys.SigningKeyID()
+		signed, err := token.SignedString([]byte("secret"))
+		require.NoError(t, err)
+
+		_, err = jwt.Parse(signed, keys.Keyfunc)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+const (
+	// loginIPAttemptsKey is a sorted set of the login attempts made from an ip scored by when they were made
+	loginIPAttemptsKey = "auth:login:ip:%s"
+	// loginAccountAttemptsKey is a sorted set of the login attempts made against a username scored by when they were made
+	loginAccountAttemptsKey = "auth:login:account:%s"
+	// loginFailuresKey counts the consecutive failed logins of a username
+	loginFailuresKey = "auth:login:failures:%s"
+	// loginLockoutKey blocks logins for a username until it expires
+	loginLockoutKey = "auth:login:lockout:%s"
+	// emailIPAttemptsKey is a sorted set of the verification and reset emails requested from an ip
+	emailIPAttemptsKey = "auth:email:ip:%s"
+	// emailAddressAttemptsKey is a sorted set of the verification and reset emails requested for an address
+	emailAddressAttemptsKey = "auth:email:address:%s"
+)
+
+const (
+	loginAttemptsMessage = "too many login attempts, try again later"
+	emailAttemptsMessage = "too many emails requested, try again later"
+)
+
+// slidingWindowScript drops the attempts that left the window and records a new one if the limit allows it.
+// Returns 0 when the attempt was recorded, otherwise the milliseconds until the oldest attempt leaves the window.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return math.max(tonumber(oldest[2]) + window - now, 1)
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return 0
+`)
+
+// RateLimitError is returned while a caller has to wait before trying again
+type RateLimitError struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Message
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+type LoginLimiter struct {
+	Redis    *redis.Client
+	logger   *zap.Logger
+	settings LoginLimiterSettings
+}
+
+// LoginLimiterSettings holds the sliding window limits and the lockout policy of logins.
+// Once an account reaches LockoutThreshold consecutive failures it's locked for LockoutBase,
+// every further failure doubles the lockout up to LockoutMax. Failures are forgotten after FailureTTL.
+// Verification and reset emails are limited per ip and per address in a sliding window of EmailWindow.
+type LoginLimiterSettings struct {
+	Window            time.Duration
+	IPLimit           int
+	AccountLimit      int
+	LockoutThreshold  int
+	LockoutBase       time.Duration
+	LockoutMax        time.Duration
+	FailureTTL        time.Duration
+	EmailWindow       time.Duration
+	EmailIPLimit      int
+	EmailAddressLimit int
+}
+
+type ILoginLimiter interface {
+	Allow(ctx context.Context, ip, username string) error
+	RecordFailure(ctx context.Context, username string) error
+	RecordSuccess(ctx context.Context, username string) error
+	AllowEmail(ctx context.Context, ip, email string) error
+}
+
+func NewLoginLimiter(redisClient *redis.Client, logger *zap.Logger, settings LoginLimiterSettings) *LoginLimiter {
+	return &LoginLimiter{
+		Redis:    redisClient,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// Allow records a login attempt, failing with a RateLimitError when the account is locked
+// or the ip or account used up their attempts in the current window
+func (limiter *LoginLimiter) Allow(ctx context.Context, ip, username string) error {
+
+	username = normaliseUsername(username)
+
+	locked, err := limiter.Redis.PTTL(ctx, fmt.Sprintf(loginLockoutKey, username)).Result()
+	if err != nil {
+		limiter.logger.Error("failed to check login lockout", zap.Error(err))
+		return err
+	}
+
+	if locked > 0 {
+		return &RateLimitError{Code: "account_locked", Message: "too many failed logins, try again later", RetryAfter: locked}
+	}
+
+	if err = limiter.attempt(ctx, fmt.Sprintf(loginIPAttemptsKey, ip), limiter.settings.Window, limiter.settings.IPLimit, loginAttemptsMessage); err != nil {
+		return err
+	}
+
+	return limiter.attempt(ctx, fmt.Sprintf(loginAccountAttemptsKey, username), limiter.settings.Window, limiter.settings.AccountLimit, loginAttemptsMessage)
+}
+
+// AllowEmail records a request for a verification or reset email, failing with a RateLimitError when the ip
+// or the address used up their requests in the current window. It's counted whether the address is registered
+// or not so the answer doesn't give registered addresses away.
+func (limiter *LoginLimiter) AllowEmail(ctx context.Context, ip, email string) error {
+
+	if err := limiter.attempt(ctx, fmt.Sprintf(emailIPAttemptsKey, ip), limiter.settings.EmailWindow, limiter.settings.EmailIPLimit, emailAttemptsMessage); err != nil {
+		return err
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	return limiter.attempt(ctx, fmt.Sprintf(emailAddressAttemptsKey, email), limiter.settings.EmailWindow, limiter.settings.EmailAddressLimit, emailAttemptsMessage)
+}
+
+// RecordFailure counts a failed login and locks the account once it crossed the threshold
+func (limiter *LoginLimiter) RecordFailure(ctx context.Context, username string) error {
+
+	username = normaliseUsername(username)
+	failuresKey := fmt.Sprintf(loginFailuresKey, username)
+
+	var incr *redis.IntCmd
+
+	_, err := limiter.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, failuresKey)
+		pipe.PExpire(ctx, failuresKey, limiter.settings.FailureTTL)
+		return nil
+	})
+	if err != nil {
+		limiter.logger.Error("failed to record login failure", zap.Error(err))
+		return err
+	}
+
+	failures := int(incr.Val())
+	if failures < limiter.settings.LockoutThreshold {
+		return nil
+	}
+
+	lockout := limiter.settings.LockoutBase
+	for i := limiter.settings.LockoutThreshold; i < failures && lockout < limiter.settings.LockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > limiter.settings.LockoutMax {
+		lockout = limiter.settings.LockoutMax
+	}
+
+	limiter.logger.Warn("locking account after failed logins", zap.String("username", username), zap.Int("failures", failures), zap.Duration("lockout", lockout))
+
+	if err = limiter.Redis.Set(ctx, fmt.Sprintf(loginLockoutKey, username), failures, lockout).Err(); err != nil {
+		limiter.logger.Error("failed to lock account", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// RecordSuccess forgets the failures of the account
+func (limiter *LoginLimiter) RecordSuccess(ctx context.Context, username string) error {
+
+	if err := limiter.Redis.Del(ctx, fmt.Sprintf(loginFailuresKey, normaliseUsername(username))).Err(); err != nil {
+		limiter.logger.Error("failed to clear login failures", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (limiter *LoginLimiter) attempt(ctx context.Context, key string, window time.Duration, limit int, message string) error {
+
+	member, err := utils.RandomToken(8)
+	if err != nil {
+		return err
+	}
+
+	wait, err := slidingWindowScript.Run(ctx, limiter.Redis, []string{key},
+		time.Now().UnixMilli(), window.Milliseconds(), limit, member,
+	).Int64()
+	if err != nil {
+		limiter.logger.Error("failed to record attempt", zap.String("key", key), zap.Error(err))
+		return err
+	}
+
+	if wait > 0 {
+		return &RateLimitError{Code: "too_many_attempts", Message: message, RetryAfter: time.Duration(wait) * time.Millisecond}
+	}
+
+	return nil
+}
+
+// normaliseUsername keys limits like the case insensitive collation of the username column
+func normaliseUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
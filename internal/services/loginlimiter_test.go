@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLimiter_Allow(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("account attempts are limited per window", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			require.NoError(t, loginLimiter.Allow(ctx, "10.0.0.1", "windowed"))
+		}
+
+		err := loginLimiter.Allow(ctx, "10.0.0.2", "Windowed")
+		require.ErrorIs(t, err, ErrRateLimited)
+
+		var rateLimitErr *RateLimitError
+		require.True(t, errors.As(err, &rateLimitErr))
+		require.Equal(t, "too_many_attempts", rateLimitErr.Code)
+		require.True(t, rateLimitErr.RetryAfter > 0 && rateLimitErr.RetryAfter <= time.Minute)
+	})
+
+	t.Run("ip attempts are limited across accounts", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, loginLimiter.Allow(ctx, "10.0.0.3", "spray"+string(rune('a'+i))))
+		}
+
+		require.ErrorIs(t, loginLimiter.Allow(ctx, "10.0.0.3", "sprayz"), ErrRateLimited)
+		require.NoError(t, loginLimiter.Allow(ctx, "10.0.0.4", "sprayz"))
+	})
+}
+
+func TestLoginLimiter_AllowEmail(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("emails are limited per address", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			require.NoError(t, loginLimiter.AllowEmail(ctx, "10.0.3.1", "flood@example.com"))
+		}
+
+		err := loginLimiter.AllowEmail(ctx, "10.0.3.2", " Flood@Example.com")
+		require.ErrorIs(t, err, ErrRateLimited)
+
+		var rateLimitErr *RateLimitError
+		require.True(t, errors.As(err, &rateLimitErr))
+		require.Equal(t, "too_many_attempts", rateLimitErr.Code)
+		require.True(t, rateLimitErr.RetryAfter > time.Minute && rateLimitErr.RetryAfter <= time.Hour)
+	})
+
+	t.Run("emails are limited per ip across addresses", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, loginLimiter.AllowEmail(ctx, "10.0.3.3", "spray"+string(rune('a'+i))+"@example.com"))
+		}
+
+		require.ErrorIs(t, loginLimiter.AllowEmail(ctx, "10.0.3.3", "sprayz@example.com"), ErrRateLimited)
+		require.NoError(t, loginLimiter.AllowEmail(ctx, "10.0.3.4", "sprayz@example.com"))
+	})
+}
+
+func TestLoginLimiter_RecordFailure(t *testing.T) {
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, loginLimiter.RecordFailure(ctx, "guessed"))
+	}
+	require.NoError(t, loginLimiter.Allow(ctx, "10.0.1.1", "guessed"))
+
+	t.Run("account is locked at the threshold", func(t *testing.T) {
+		require.NoError(t, loginLimiter.RecordFailure(ctx, "guessed"))
+
+		var rateLimitErr *RateLimitError
+		require.True(t, errors.As(loginLimiter.Allow(ctx, "10.0.1.1", "guessed"), &rateLimitErr))
+		require.Equal(t, "account_locked", rateLimitErr.Code)
+		require.Equal(t, time.Minute, rateLimitErr.RetryAfter)
+	})
+
+	t.Run("lockout doubles up to the max", func(t *testing.T) {
+		for _, expected := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+			require.NoError(t, loginLimiter.RecordFailure(ctx, "guessed"))
+			require.Equal(t, expected, redisServer.TTL("auth:login:lockout:guessed"))
+		}
+	})
+
+	t.Run("success forgets the failures", func(t *testing.T) {
+		require.NoError(t, loginLimiter.RecordSuccess(ctx, "guessed"))
+		require.False(t, redisServer.Exists("auth:login:failures:guessed"))
+	})
+}
@@ -7,10 +7,14 @@ import (
 	"time"
 
 	"github.com/knave-de-coeur/user-api-service/internal/config"
+	"github.com/knave-de-coeur/user-api-service/internal/mailer"
 	"github.com/knave-de-coeur/user-api-service/internal/utils"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
@@ -24,7 +28,19 @@ var (
 
 	err error
 
-	userService *UserService
+	redisServer         *miniredis.Miniredis
+	tokenService        *TokenService
+	testMailer          *mailer.LogMailer
+	verificationService *VerificationService
+	loginLimiter        *LoginLimiter
+	mfaService          *MFAService
+	webAuthnService     *WebAuthnService
+	oauthService        *OAuthService
+	identityIssuer      *stubIssuer
+	identityService     *IdentityService
+	personalTokens      *PersonalTokenService
+	sessionService      *SessionService
+	userService         *UserService
 )
 
 func TestMain(m *testing.M) {
@@ -57,9 +73,102 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 
-	userService = NewUserService(gormDB, nil, log, UserServiceSettings{
-		Port:     0,
-		Hostname: config.CurrentConfigs.Host,
+	redisServer, err = miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer redisServer.Close()
+
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	tokenService = NewTokenService(redisClient, NewHMACKeySet("testsecret"), log, TokenServiceSettings{
+		RefreshSecret:   "testrefreshsecret",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+
+	testMailer = mailer.NewLogMailer("", log)
+
+	verificationService = NewVerificationService(redisClient, testMailer, log, VerificationServiceSettings{
+		Secret:   "testemailsecret",
+		TTL:      time.Hour,
+		ResetTTL: time.Hour,
+		BaseURL:  "http://localhost:8080",
+	})
+
+	loginLimiter = NewLoginLimiter(redisClient, log, LoginLimiterSettings{
+		Window:            time.Minute,
+		IPLimit:           10,
+		AccountLimit:      5,
+		LockoutThreshold:  3,
+		LockoutBase:       time.Minute,
+		LockoutMax:        4 * time.Minute,
+		FailureTTL:        time.Hour,
+		EmailWindow:       time.Hour,
+		EmailIPLimit:      10,
+		EmailAddressLimit: 3,
+	})
+
+	mfaService = NewMFAService(gormDB, redisClient, log, MFAServiceSettings{
+		Issuer:               "user-api-service",
+		ChallengeTTL:         5 * time.Minute,
+		MaxChallengeAttempts: 3,
+		RecoveryCodes:        4,
+	})
+
+	webAuthnService, err = NewWebAuthnService(gormDB, redisClient, log, WebAuthnServiceSettings{
+		RPID:         "localhost",
+		RPName:       "Quiz",
+		RPOrigins:    []string{"http://localhost:8080"},
+		ChallengeTTL: 5 * time.Minute,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	oauthService = NewOAuthService(gormDB, redisClient, tokenService, tokenService.Keys, log, OAuthServiceSettings{
+		Issuer:         "http://localhost:8080",
+		Scopes:         []string{ScopeOpenID, ScopeProfile, ScopeEmail, "quiz.read"},
+		CodeTTL:        time.Minute,
+		AccessTokenTTL: time.Minute,
+	})
+
+	identityIssuer = newStubIssuer("quiz-api", "stubsecret")
+	defer identityIssuer.Close()
+
+	identityService = NewIdentityService(gormDB, redisClient, log, IdentityServiceSettings{
+		Provider:     "stub",
+		Issuer:       identityIssuer.URL,
+		ClientID:     "quiz-api",
+		ClientSecret: "stubsecret",
+		RedirectURL:  "http://localhost:8080/login/callback",
+		Scopes:       []string{"openid", "profile", "email"},
+		StateTTL:     5 * time.Minute,
+	})
+
+	personalTokens = NewPersonalTokenService(gormDB, log, PersonalTokenServiceSettings{MaxTTL: 90 * 24 * time.Hour})
+
+	sessionService = NewSessionService(gormDB, redisClient, log, SessionServiceSettings{TTL: time.Hour})
+
+	passwordPolicy := &utils.PasswordPolicy{
+		MinLength:        10,
+		MaxLength:        128,
+		MinCharClasses:   2,
+		MinScore:         3,
+		DisallowPersonal: true,
+		Breached:         utils.NewPrefixFileChecker("testdata/breached", 1),
+	}
+
+	hasher := &utils.BcryptHasher{Cost: bcrypt.MinCost}
+
+	userService = NewUserService(gormDB, tokenService, verificationService, loginLimiter, hasher, passwordPolicy, mfaService, webAuthnService, identityService, sessionService, personalTokens, NewAuthClient(nil, hasher, log, AuthClientSettings{}), log, UserServiceSettings{
+		Port:                     0,
+		Hostname:                 config.CurrentConfigs.Host,
+		RequireEmailVerification: true,
+		PasswordHistorySize:      3,
+		PasswordMaxAge:           90 * 24 * time.Hour,
+		DeletionGracePeriod:      30 * 24 * time.Hour,
+		PurgeBatchSize:           2,
 	})
 
 	m.Run()
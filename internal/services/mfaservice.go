@@ -0,0 +1,373 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+const (
+	// mfaChallengeKey is a hash holding the user a login challenge was issued to and the attempts made at it, keyed by the sha256 of the token
+	mfaChallengeKey = "auth:mfa:challenge:%s"
+
+	// totpSkew accepts the codes of the steps either side of the current one to make up for clock drift
+	totpSkew = 1
+)
+
+// mfaAttemptScript counts an attempt at a login challenge before its code is checked, so parallel guesses can't
+// all get in under the limit. Returns the user the challenge was issued to and the attempts made, nil when it's gone.
+var mfaAttemptScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local attempts = redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+return {redis.call('HGET', KEYS[1], 'user_id'), attempts}
+`)
+
+var (
+	ErrMFAAlreadyEnabled   = &Error{Kind: ErrConflict, Code: "mfa_already_enabled", Message: "two factor authentication is already enabled"}
+	ErrMFANotEnrolled      = &Error{Kind: ErrNotFound, Code: "mfa_not_enrolled", Message: "two factor authentication isn't set up"}
+	ErrInvalidMFACode      = &Error{Kind: ErrInvalidCredentials, Code: "invalid_mfa_code", Message: "invalid two factor code", Field: "code"}
+	ErrInvalidMFAChallenge = &Error{Kind: ErrInvalidCredentials, Code: "invalid_mfa_token", Message: "invalid or expired mfa token", Field: "mfa_token"}
+)
+
+type MFAService struct {
+	DBConn   *gorm.DB
+	Redis    *redis.Client
+	logger   *zap.Logger
+	settings MFAServiceSettings
+}
+
+// MFAServiceSettings holds how TOTP secrets are labelled in authenticator apps and how login challenges behave
+type MFAServiceSettings struct {
+	Issuer               string
+	ChallengeTTL         time.Duration
+	MaxChallengeAttempts int
+	RecoveryCodes        int
+}
+
+type IMFAService interface {
+	EnrolTOTP(userID uint) (*api.TOTPEnrolment, error)
+	ConfirmTOTP(req api.ConfirmTOTPRequest) (*api.RecoveryCodesResponse, error)
+	DisableTOTP(req api.DisableTOTPRequest) error
+	TOTPEnabled(userID uint) (bool, error)
+	CreateChallenge(ctx context.Context, userID uint) (string, error)
+	VerifyChallenge(ctx context.Context, req api.MFALoginRequest) (uint, error)
+	verifySecondFactor(userID uint, code, recoveryCode string) error
+}
+
+func NewMFAService(dbConn *gorm.DB, redisClient *redis.Client, logger *zap.Logger, settings MFAServiceSettings) *MFAService {
+	return &MFAService{
+		DBConn:   dbConn,
+		Redis:    redisClient,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// EnrolTOTP generates a new TOTP secret for the user, it doesn't guard logins until confirmed with ConfirmTOTP.
+// Enrolling again before confirming replaces the secret.
+func (service *MFAService) EnrolTOTP(userID uint) (*api.TOTPEnrolment, error) {
+
+	var user pkg.User
+
+	res := service.DBConn.Select("id", "username").Where("id = ?", userID).First(&user)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting user", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	existing, err := service.getTOTP(userID)
+	if err != nil && !errors.Is(err, ErrMFANotEnrolled) {
+		return nil, err
+	} else if existing != nil && existing.ConfirmedAt.Valid {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		service.logger.Error("failed to generate totp secret", zap.Error(err))
+		return nil, err
+	}
+
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", userID).Delete(&pkg.UserTOTP{}); res.Error != nil {
+			return res.Error
+		}
+
+		return tx.Create(&pkg.UserTOTP{UserID: userID, Secret: secret}).Error
+	})
+	if err != nil {
+		service.logger.Error("something went wrong storing totp secret", zap.Uint("userID", userID), zap.Error(err))
+		return nil, err
+	}
+
+	uri := utils.TOTPURI(service.settings.Issuer, user.Username, secret)
+
+	png, err := utils.QRCodePNG(uri, 256)
+	if err != nil {
+		service.logger.Error("failed to render totp qr code", zap.Error(err))
+		return nil, err
+	}
+
+	return &api.TOTPEnrolment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// ConfirmTOTP turns two factor authentication on once the user proves their app generates the right codes,
+// the recovery codes returned replace any issued before
+func (service *MFAService) ConfirmTOTP(req api.ConfirmTOTPRequest) (*api.RecoveryCodesResponse, error) {
+
+	totp, err := service.getTOTP(req.UserID)
+	if err != nil {
+		return nil, err
+	} else if totp.ConfirmedAt.Valid {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, ok := utils.ValidateTOTP(totp.Secret, req.Code, service.DBConn.NowFunc(), totpSkew)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashed, err := service.generateRecoveryCodes(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&pkg.UserTOTP{}).
+			Where("user_id = ? AND confirmed_at IS NULL", req.UserID).
+			Updates(map[string]interface{}{"confirmed_at": service.DBConn.NowFunc(), "last_used_step": step})
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return ErrMFAAlreadyEnabled
+		}
+
+		if res = tx.Where("user_id = ?", req.UserID).Delete(&pkg.RecoveryCode{}); res.Error != nil {
+			return res.Error
+		}
+
+		return tx.Create(&hashed).Error
+	})
+	if err != nil {
+		service.logger.Error("something went wrong confirming totp", zap.Uint("userID", req.UserID), zap.Error(err))
+		return nil, err
+	}
+
+	return &api.RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+// DisableTOTP turns two factor authentication off, the user has to pass a code to do so
+func (service *MFAService) DisableTOTP(req api.DisableTOTPRequest) error {
+
+	if err := service.verifySecondFactor(req.UserID, req.Code, req.RecoveryCode); err != nil {
+		return err
+	}
+
+	err := service.DBConn.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", req.UserID).Delete(&pkg.RecoveryCode{}); res.Error != nil {
+			return res.Error
+		}
+
+		return tx.Where("user_id = ?", req.UserID).Delete(&pkg.UserTOTP{}).Error
+	})
+	if err != nil {
+		service.logger.Error("something went wrong disabling totp", zap.Uint("userID", req.UserID), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// TOTPEnabled reports whether logins of the user need a second factor
+func (service *MFAService) TOTPEnabled(userID uint) (bool, error) {
+
+	totp, err := service.getTOTP(userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return totp.ConfirmedAt.Valid, nil
+}
+
+// CreateChallenge returns a short lived token standing for a login that passed the password check and still needs a second factor
+func (service *MFAService) CreateChallenge(ctx context.Context, userID uint) (string, error) {
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		service.logger.Error("failed to generate mfa token", zap.Error(err))
+		return "", err
+	}
+
+	key := fmt.Sprintf(mfaChallengeKey, hashToken(token))
+
+	_, err = service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "user_id", userID, "attempts", 0)
+		pipe.Expire(ctx, key, service.settings.ChallengeTTL)
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to store mfa challenge", zap.Uint("userID", userID), zap.Error(err))
+		return "", err
+	}
+
+	return token, nil
+}
+
+// VerifyChallenge checks the second factor sent for a login challenge and redeems it, returning the user logging in.
+// Every attempt is counted before the code is checked and the challenge is dropped once MaxChallengeAttempts are
+// used up, so the password has to be sent again. Wrong codes return the user too, so the failure can count
+// against their login lockout.
+func (service *MFAService) VerifyChallenge(ctx context.Context, req api.MFALoginRequest) (uint, error) {
+
+	key := fmt.Sprintf(mfaChallengeKey, hashToken(req.MFAToken))
+
+	res, err := mfaAttemptScript.Run(ctx, service.Redis, []string{key}).Slice()
+	if err == redis.Nil {
+		return 0, ErrInvalidMFAChallenge
+	} else if err != nil {
+		service.logger.Error("failed to get mfa challenge", zap.Error(err))
+		return 0, err
+	}
+
+	userID, err := strconv.ParseUint(fmt.Sprint(res[0]), 10, 64)
+	if err != nil {
+		service.logger.Error("malformed mfa challenge", zap.Error(err))
+		return 0, ErrInvalidMFAChallenge
+	}
+
+	attempts, _ := res[1].(int64)
+	if attempts > int64(service.settings.MaxChallengeAttempts) {
+		service.Redis.Del(ctx, key)
+		return 0, ErrInvalidMFAChallenge
+	}
+
+	if err = service.verifySecondFactor(uint(userID), req.Code, req.RecoveryCode); err != nil {
+		if !errors.Is(err, ErrInvalidMFACode) {
+			return 0, err
+		}
+
+		if attempts >= int64(service.settings.MaxChallengeAttempts) {
+			service.Redis.Del(ctx, key)
+		}
+
+		return uint(userID), err
+	}
+
+	// whoever deletes the challenge first gets to log in
+	deleted, err := service.Redis.Del(ctx, key).Result()
+	if err != nil {
+		service.logger.Error("failed to redeem mfa challenge", zap.Error(err))
+		return 0, err
+	} else if deleted == 0 {
+		return 0, ErrInvalidMFAChallenge
+	}
+
+	return uint(userID), nil
+}
+
+// verifySecondFactor accepts a TOTP code, which can't be replayed, or an unused recovery code, which is used up
+func (service *MFAService) verifySecondFactor(userID uint, code, recoveryCode string) error {
+
+	totp, err := service.getTOTP(userID)
+	if err != nil {
+		return err
+	} else if !totp.ConfirmedAt.Valid {
+		return ErrMFANotEnrolled
+	}
+
+	if code != "" {
+		step, ok := utils.ValidateTOTP(totp.Secret, code, service.DBConn.NowFunc(), totpSkew)
+		if !ok {
+			return ErrInvalidMFACode
+		}
+
+		res := service.DBConn.Model(&pkg.UserTOTP{}).
+			Where("user_id = ? AND last_used_step < ?", userID, step).
+			Update("last_used_step", step)
+		if res.Error != nil {
+			service.logger.Error("something went wrong recording totp step", zap.Uint("userID", userID), zap.Error(res.Error))
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			// the code, or a later one, was already used
+			return ErrInvalidMFACode
+		}
+
+		return nil
+	}
+
+	res := service.DBConn.Model(&pkg.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normaliseRecoveryCode(recoveryCode))).
+		Update("used_at", service.DBConn.NowFunc())
+	if res.Error != nil {
+		service.logger.Error("something went wrong using recovery code", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	} else if res.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+
+	service.logger.Info("recovery code used", zap.Uint("userID", userID))
+
+	return nil
+}
+
+func (service *MFAService) getTOTP(userID uint) (*pkg.UserTOTP, error) {
+
+	var totp pkg.UserTOTP
+
+	res := service.DBConn.Where("user_id = ?", userID).First(&totp)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrMFANotEnrolled
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting totp", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return &totp, nil
+}
+
+// generateRecoveryCodes returns the codes to show the user along with the rows to store, formatted as xxxxx-xxxxx
+func (service *MFAService) generateRecoveryCodes(userID uint) ([]string, []pkg.RecoveryCode, error) {
+
+	codes := make([]string, 0, service.settings.RecoveryCodes)
+	hashed := make([]pkg.RecoveryCode, 0, service.settings.RecoveryCodes)
+
+	for i := 0; i < service.settings.RecoveryCodes; i++ {
+		raw, err := utils.RandomToken(5)
+		if err != nil {
+			service.logger.Error("failed to generate recovery code", zap.Error(err))
+			return nil, nil, err
+		}
+
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashed = append(hashed, pkg.RecoveryCode{UserID: userID, CodeHash: hashToken(raw)})
+	}
+
+	return codes, hashed, nil
+}
+
+// normaliseRecoveryCode forgives the dash, spaces and case of a typed in recovery code
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// expectTOTP returns the totp row of the user from the mocked db
+func expectTOTP(userID uint, secret string, confirmed bool) {
+	row := sqlmock.NewRows([]string{"user_id", "secret", "confirmed_at", "last_used_step"})
+	if confirmed {
+		row.AddRow(userID, secret, time.Now(), 0)
+	} else {
+		row.AddRow(userID, secret, nil, 0)
+	}
+
+	sqlMock.ExpectQuery("SELECT \\* FROM `user_totp` WHERE user_id = \\?").
+		WithArgs(userID).
+		WillReturnRows(row)
+}
+
+func currentTOTPCode(t *testing.T, secret string) string {
+	code, err := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+	require.NoError(t, err)
+
+	return code
+}
+
+func TestMFAService_ConfirmTOTP(t *testing.T) {
+	secret, err := utils.GenerateTOTPSecret()
+	require.NoError(t, err)
+
+	t.Run("wrong code", func(t *testing.T) {
+		expectTOTP(50, secret, false)
+
+		_, err := mfaService.ConfirmTOTP(api.ConfirmTOTPRequest{UserID: 50, Code: "000000"})
+		if currentTOTPCode(t, secret) != "000000" {
+			require.ErrorIs(t, err, ErrInvalidMFACode)
+		}
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("issues recovery codes", func(t *testing.T) {
+		expectTOTP(50, secret, false)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `user_totp` SET `confirmed_at`=\\?,`last_used_step`=\\? WHERE user_id = \\? AND confirmed_at IS NULL").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec("DELETE FROM `mfa_recovery_codes` WHERE user_id = \\?").
+			WithArgs(50).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectExec("INSERT INTO `mfa_recovery_codes`").
+			WillReturnResult(sqlmock.NewResult(1, 4))
+		sqlMock.ExpectCommit()
+
+		res, err := mfaService.ConfirmTOTP(api.ConfirmTOTPRequest{UserID: 50, Code: currentTOTPCode(t, secret)})
+		require.NoError(t, err)
+		require.Len(t, res.RecoveryCodes, 4)
+		require.Regexp(t, "^[0-9a-f]{5}-[0-9a-f]{5}$", res.RecoveryCodes[0])
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("already confirmed", func(t *testing.T) {
+		expectTOTP(50, secret, true)
+
+		_, err := mfaService.ConfirmTOTP(api.ConfirmTOTPRequest{UserID: 50, Code: currentTOTPCode(t, secret)})
+		require.ErrorIs(t, err, ErrMFAAlreadyEnabled)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestMFAService_VerifyChallenge(t *testing.T) {
+	ctx := context.Background()
+
+	secret, err := utils.GenerateTOTPSecret()
+	require.NoError(t, err)
+
+	t.Run("code is accepted once", func(t *testing.T) {
+		token, err := mfaService.CreateChallenge(ctx, 51)
+		require.NoError(t, err)
+
+		expectTOTP(51, secret, true)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `user_totp` SET `last_used_step`=\\? WHERE user_id = \\? AND last_used_step < \\?").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		userID, err := mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, Code: currentTOTPCode(t, secret)})
+		require.NoError(t, err)
+		require.Equal(t, uint(51), userID)
+
+		_, err = mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, Code: currentTOTPCode(t, secret)})
+		require.ErrorIs(t, err, ErrInvalidMFAChallenge)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("replayed code is rejected", func(t *testing.T) {
+		token, err := mfaService.CreateChallenge(ctx, 51)
+		require.NoError(t, err)
+
+		expectTOTP(51, secret, true)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `user_totp` SET `last_used_step`=\\? WHERE user_id = \\? AND last_used_step < \\?").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectCommit()
+
+		_, err = mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, Code: currentTOTPCode(t, secret)})
+		require.ErrorIs(t, err, ErrInvalidMFACode)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("recovery code", func(t *testing.T) {
+		token, err := mfaService.CreateChallenge(ctx, 51)
+		require.NoError(t, err)
+
+		expectTOTP(51, secret, true)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `mfa_recovery_codes` SET `used_at`=\\? WHERE user_id = \\? AND code_hash = \\? AND used_at IS NULL").
+			WithArgs(sqlmock.AnyArg(), 51, hashToken("abcde12345")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		userID, err := mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, RecoveryCode: "ABCDE-12345"})
+		require.NoError(t, err)
+		require.Equal(t, uint(51), userID)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("challenge is dropped after too many wrong codes", func(t *testing.T) {
+		token, err := mfaService.CreateChallenge(ctx, 51)
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			expectTOTP(51, secret, true)
+			sqlMock.ExpectBegin()
+			sqlMock.ExpectExec("UPDATE `mfa_recovery_codes` SET `used_at`=\\?").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			sqlMock.ExpectCommit()
+
+			_, err = mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, RecoveryCode: "wrong-code"})
+			require.ErrorIs(t, err, ErrInvalidMFACode)
+		}
+
+		_, err = mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, Code: currentTOTPCode(t, secret)})
+		require.ErrorIs(t, err, ErrInvalidMFAChallenge)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("attempts are counted before the code is checked", func(t *testing.T) {
+		token, err := mfaService.CreateChallenge(ctx, 51)
+		require.NoError(t, err)
+
+		// parallel guesses already used up the attempts, the right code doesn't get looked at
+		redisServer.HSet(fmt.Sprintf(mfaChallengeKey, hashToken(token)), "attempts", "3")
+
+		_, err = mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: token, Code: currentTOTPCode(t, secret)})
+		require.ErrorIs(t, err, ErrInvalidMFAChallenge)
+		require.False(t, redisServer.Exists(fmt.Sprintf(mfaChallengeKey, hashToken(token))))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		_, err := mfaService.VerifyChallenge(ctx, api.MFALoginRequest{MFAToken: "nope", Code: "123456"})
+		require.ErrorIs(t, err, ErrInvalidMFAChallenge)
+		require.False(t, redisServer.Exists(fmt.Sprintf(mfaChallengeKey, hashToken("nope"))))
+	})
+}
+
+func TestUserService_Login_RequiresMFA(t *testing.T) {
+	hash, err := userService.Hasher.Hash([]byte("correct horse"))
+	require.NoError(t, err)
+
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE username = \\?").
+		WithArgs("twofactor").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "email_verified_at"}).
+			AddRow(52, "twofactor", hash, time.Now()))
+	expectTOTP(52, "JBSWY3DPEHPK3PXP", true)
+
+	// failures are only forgotten once the second factor checks out too
+	require.NoError(t, redisServer.Set(fmt.Sprintf(loginFailuresKey, "twofactor"), "2"))
+	defer redisServer.Del(fmt.Sprintf(loginFailuresKey, "twofactor"))
+
+	res, err := userService.Login(api.LoginRequest{Username: "twofactor", Password: "correct horse", IP: "10.0.2.3"})
+	require.NoError(t, err)
+	require.True(t, res.MFARequired)
+	require.NotEmpty(t, res.MFAToken)
+	require.Empty(t, res.Token)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+
+	failures, err := redisServer.Get(fmt.Sprintf(loginFailuresKey, "twofactor"))
+	require.NoError(t, err)
+	require.Equal(t, "2", failures)
+}
+
+func TestUserService_CompleteMFALogin_WrongCode(t *testing.T) {
+	ctx := context.Background()
+	failuresKey := fmt.Sprintf(loginFailuresKey, "twofactor")
+	defer redisServer.Del(failuresKey)
+
+	token, err := mfaService.CreateChallenge(ctx, 52)
+	require.NoError(t, err)
+
+	expectTOTP(52, "JBSWY3DPEHPK3PXP", true)
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `mfa_recovery_codes` SET `used_at`=\\?").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectCommit()
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE id = \\?").
+		WithArgs(52).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(52, "twofactor"))
+
+	_, err = userService.CompleteMFALogin(api.MFALoginRequest{MFAToken: token, RecoveryCode: "wrong-code"})
+	require.ErrorIs(t, err, ErrInvalidMFACode)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+
+	failures, err := redisServer.Get(failuresKey)
+	require.NoError(t, err)
+	require.Equal(t, "1", failures)
+}
@@ -0,0 +1,792 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// oauthCodeKey holds the grant an authorization code was issued for until it's exchanged, keyed by the hash of the code
+const oauthCodeKey = "auth:oauth:code:%s"
+
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+
+	pkceMethodS256 = "S256"
+	authMethodNone = "none"
+)
+
+// Errors of the protocol endpoints, their codes are the RFC 6749 error codes so they can be sent to clients as is
+var (
+	ErrOAuthClientNotFound     = &Error{Kind: ErrNotFound, Code: "oauth_client_not_found", Message: "oauth client not found"}
+	ErrOAuthConsentNotFound    = &Error{Kind: ErrNotFound, Code: "oauth_consent_not_found", Message: "no consent given to the client"}
+	ErrInvalidRedirectURI      = &Error{Kind: ErrValidation, Code: "invalid_request", Message: "redirect_uri isn't registered for the client", Field: "redirect_uri"}
+	ErrInvalidClient           = &Error{Kind: ErrInvalidCredentials, Code: "invalid_client", Message: "client authentication failed"}
+	ErrInvalidGrant            = &Error{Kind: ErrValidation, Code: "invalid_grant", Message: "authorization code is invalid, expired or was issued to another client"}
+	ErrUnauthorizedClient      = &Error{Kind: ErrValidation, Code: "unauthorized_client", Message: "client isn't allowed to use this grant type"}
+	ErrUnsupportedGrantType    = &Error{Kind: ErrValidation, Code: "unsupported_grant_type", Message: "grant type isn't supported"}
+	ErrUnsupportedResponseType = &Error{Kind: ErrValidation, Code: "unsupported_response_type", Message: "only the code response type is supported"}
+	ErrInvalidScope            = &Error{Kind: ErrValidation, Code: "invalid_scope", Message: "scope isn't allowed for the client"}
+	ErrPKCERequired            = &Error{Kind: ErrValidation, Code: "invalid_request", Message: "a code_challenge using the S256 method is required"}
+	ErrInvalidTokenRequest     = &Error{Kind: ErrValidation, Code: "invalid_request", Message: "code, redirect_uri and code_verifier are required"}
+)
+
+type OAuthService struct {
+	DBConn   *gorm.DB
+	Redis    *redis.Client
+	Tokens   ITokenService
+	Keys     *KeySet
+	logger   *zap.Logger
+	settings OAuthServiceSettings
+}
+
+// OAuthServiceSettings holds the issuer tokens are minted as, the scopes clients may be registered with
+// and the lifetimes of authorization codes and access tokens
+type OAuthServiceSettings struct {
+	Issuer         string
+	Scopes         []string
+	CodeTTL        time.Duration
+	AccessTokenTTL time.Duration
+}
+
+type IOAuthService interface {
+	RegisterClient(req api.RegisterOAuthClientRequest) (*api.OAuthClient, error)
+	ListClients() ([]api.OAuthClient, error)
+	DeleteClient(clientID string) error
+	Authorize(ctx context.Context, req api.AuthorizeRequest) (*api.AuthorizeResponse, error)
+	Exchange(ctx context.Context, req api.TokenRequest) (*api.TokenResponse, error)
+	UserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error)
+	ListConsents(userID uint) ([]api.OAuthConsent, error)
+	RevokeConsent(userID uint, clientID string) error
+	Discovery() api.OpenIDConfiguration
+}
+
+// authorizationGrant is what an authorization code stands for until it's exchanged
+type authorizationGrant struct {
+	ClientID      string `json:"client_id"`
+	UserID        uint   `json:"user_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"code_challenge"`
+}
+
+func NewOAuthService(dbConn *gorm.DB, redisClient *redis.Client, tokens ITokenService, keys *KeySet, logger *zap.Logger, settings OAuthServiceSettings) *OAuthService {
+	return &OAuthService{
+		DBConn:   dbConn,
+		Redis:    redisClient,
+		Tokens:   tokens,
+		Keys:     keys,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// RegisterClient stores a new client, the secret of a confidential client is returned once and only its hash is kept
+func (service *OAuthService) RegisterClient(req api.RegisterOAuthClientRequest) (*api.OAuthClient, error) {
+
+	public := req.TokenEndpointAuthMethod == authMethodNone
+
+	if err := service.validateClient(req, public); err != nil {
+		return nil, err
+	}
+
+	clientID, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate client id", zap.Error(err))
+		return nil, err
+	}
+
+	client := &pkg.OAuthClient{
+		ClientID:     clientID,
+		Name:         req.Name,
+		RedirectURIs: strings.Join(req.RedirectURIs, " "),
+		GrantTypes:   strings.Join(req.GrantTypes, " "),
+		Scopes:       strings.Join(strings.Fields(req.Scope), " "),
+	}
+
+	var secret string
+	if !public {
+		if secret, err = utils.RandomToken(32); err != nil {
+			service.logger.Error("failed to generate client secret", zap.Error(err))
+			return nil, err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	if res := service.DBConn.Create(client); res.Error != nil {
+		service.logger.Error("something went wrong storing oauth client", zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	service.logger.Info("registered oauth client", zap.String("clientID", clientID), zap.String("name", req.Name))
+
+	response := toAPIOAuthClient(*client)
+	response.ClientSecret = secret
+
+	return &response, nil
+}
+
+// ListClients returns every registered client, oldest first
+func (service *OAuthService) ListClients() ([]api.OAuthClient, error) {
+
+	var rows []pkg.OAuthClient
+
+	if res := service.DBConn.Order("id").Find(&rows); res.Error != nil {
+		service.logger.Error("something went wrong listing oauth clients", zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	clients := make([]api.OAuthClient, 0, len(rows))
+	for _, row := range rows {
+		clients = append(clients, toAPIOAuthClient(row))
+	}
+
+	return clients, nil
+}
+
+// DeleteClient removes a client along with the consents given to it, tokens already issued live out their expiry
+func (service *OAuthService) DeleteClient(clientID string) error {
+
+	res := service.DBConn.Where("client_id = ?", clientID).Delete(&pkg.OAuthClient{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong deleting oauth client", zap.String("clientID", clientID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrOAuthClientNotFound
+	}
+
+	return nil
+}
+
+// Authorize runs the authorization endpoint for the logged-in user. An unknown client or redirect_uri is returned as an
+// error as the user agent mustn't be sent anywhere, every other outcome is a redirect back to the client. When the user
+// hasn't consented to every scope asked for yet a consent prompt is returned, answered by sending the request back with Consent set.
+func (service *OAuthService) Authorize(ctx context.Context, req api.AuthorizeRequest) (*api.AuthorizeResponse, error) {
+
+	client, err := service.getClient(req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.RedirectURI == "" || !hasField(client.RedirectURIs, req.RedirectURI) {
+		return nil, ErrInvalidRedirectURI
+	}
+
+	if req.ResponseType != "code" {
+		return service.redirectError(req, ErrUnsupportedResponseType)
+	}
+
+	if !hasField(client.GrantTypes, GrantAuthorizationCode) {
+		return service.redirectError(req, ErrUnauthorizedClient)
+	}
+
+	// the challenge is the unpadded base64url of a sha256 digest
+	if req.CodeChallengeMethod != pkceMethodS256 || len(req.CodeChallenge) != 43 {
+		return service.redirectError(req, ErrPKCERequired)
+	}
+
+	scopes, err := grantedScopes(client, req.Scope)
+	if err != nil {
+		return service.redirectError(req, ErrInvalidScope)
+	}
+
+	switch req.Consent {
+	case "deny":
+		return service.redirect(req, url.Values{"error": {"access_denied"}, "error_description": {"user denied access"}})
+	case "approve":
+		if err = service.saveConsent(req.UserID, client.ClientID, scopes); err != nil {
+			return nil, err
+		}
+	default:
+		consented, err := service.hasConsent(req.UserID, client.ClientID, scopes)
+		if err != nil {
+			return nil, err
+		}
+		if !consented {
+			return &api.AuthorizeResponse{ConsentRequired: true, ClientName: client.Name, Scopes: scopes}, nil
+		}
+	}
+
+	code, err := utils.RandomToken(32)
+	if err != nil {
+		service.logger.Error("failed to generate authorization code", zap.Error(err))
+		return nil, err
+	}
+
+	grant, err := json.Marshal(authorizationGrant{
+		ClientID:      client.ClientID,
+		UserID:        req.UserID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = service.Redis.Set(ctx, fmt.Sprintf(oauthCodeKey, hashToken(code)), grant, service.settings.CodeTTL).Err(); err != nil {
+		service.logger.Error("failed to store authorization code", zap.Error(err))
+		return nil, err
+	}
+
+	return service.redirect(req, url.Values{"code": {code}})
+}
+
+// Exchange runs the token endpoint for the authorization code and client credentials grants
+func (service *OAuthService) Exchange(ctx context.Context, req api.TokenRequest) (*api.TokenResponse, error) {
+
+	switch req.GrantType {
+	case GrantAuthorizationCode:
+		return service.exchangeCode(ctx, req)
+	case GrantClientCredentials:
+		return service.exchangeClientCredentials(req)
+	}
+
+	return nil, ErrUnsupportedGrantType
+}
+
+// UserInfo returns the claims of the user an access token was issued for, limited to the scopes it was granted
+func (service *OAuthService) UserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+
+	token, err := jwt.Parse(accessToken, service.Keys.Keyfunc)
+	if err != nil {
+		service.logger.Debug("failed to parse oauth access token", zap.Error(err))
+		return nil, ErrInvalidAccessToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !claims.VerifyIssuer(service.settings.Issuer, true) || claims["client_id"] == nil {
+		return nil, ErrInvalidAccessToken
+	}
+
+	jti, _ := claims["jti"].(string)
+	sub, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+	userID, err := strconv.ParseUint(sub, 10, 64)
+	if jti == "" || err != nil || !hasField(scope, ScopeOpenID) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	revoked, err := service.Tokens.IsRevoked(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	user, err := service.getUser(uint(userID))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidAccessToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	return userClaims(user, scope), nil
+}
+
+// ListConsents returns the clients the user has granted access to
+func (service *OAuthService) ListConsents(userID uint) ([]api.OAuthConsent, error) {
+
+	var rows []struct {
+		pkg.OAuthConsent
+		Name string
+	}
+
+	res := service.DBConn.
+		Table("oauth_consents").
+		Select("oauth_consents.*, oauth_clients.name").
+		Joins("JOIN oauth_clients ON oauth_clients.client_id = oauth_consents.client_id").
+		Where("oauth_consents.user_id = ?", userID).
+		Order("oauth_consents.created_at").
+		Find(&rows)
+	if res.Error != nil {
+		service.logger.Error("something went wrong listing oauth consents", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	consents := make([]api.OAuthConsent, 0, len(rows))
+	for _, row := range rows {
+		consents = append(consents, api.OAuthConsent{
+			ClientID:   row.ClientID,
+			ClientName: row.Name,
+			Scopes:     strings.Fields(row.Scopes),
+			GrantedAT:  row.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return consents, nil
+}
+
+// RevokeConsent forgets the consent given to a client so the user is asked again next time, tokens already issued live out their expiry
+func (service *OAuthService) RevokeConsent(userID uint, clientID string) error {
+
+	res := service.DBConn.Where("user_id = ? AND client_id = ?", userID, clientID).Delete(&pkg.OAuthConsent{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong revoking oauth consent", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrOAuthConsentNotFound
+	}
+
+	return nil
+}
+
+// Discovery returns the OpenID Connect discovery document of the provider
+func (service *OAuthService) Discovery() api.OpenIDConfiguration {
+
+	issuer := strings.TrimSuffix(service.settings.Issuer, "/")
+
+	return api.OpenIDConfiguration{
+		Issuer:                            service.settings.Issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/oauth/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   service.settings.Scopes,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{GrantAuthorizationCode, GrantClientCredentials},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{service.Keys.SigningAlg()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", authMethodNone},
+		CodeChallengeMethodsSupported:     []string{pkceMethodS256},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce", "name", "given_name", "family_name",
+			"preferred_username", "updated_at", "email", "email_verified",
+		},
+		AuthorizationResponseISSSupported: true,
+	}
+}
+
+func (service *OAuthService) exchangeCode(ctx context.Context, req api.TokenRequest) (*api.TokenResponse, error) {
+
+	client, err := service.authenticateClient(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasField(client.GrantTypes, GrantAuthorizationCode) {
+		return nil, ErrUnauthorizedClient
+	}
+
+	if req.Code == "" || req.RedirectURI == "" || req.CodeVerifier == "" {
+		return nil, ErrInvalidTokenRequest
+	}
+
+	// codes are redeemed before anything else is checked so each one can only ever be tried once
+	data, err := takeKeyScript.Run(ctx, service.Redis, []string{fmt.Sprintf(oauthCodeKey, hashToken(req.Code))}).Text()
+	if err == redis.Nil {
+		return nil, ErrInvalidGrant
+	} else if err != nil {
+		service.logger.Error("failed to redeem authorization code", zap.Error(err))
+		return nil, err
+	}
+
+	var grant authorizationGrant
+	if err = json.Unmarshal([]byte(data), &grant); err != nil {
+		service.logger.Error("something went wrong unmarshalling authorization code", zap.Error(err))
+		return nil, err
+	}
+
+	if grant.ClientID != client.ClientID || grant.RedirectURI != req.RedirectURI || !verifyPKCE(req.CodeVerifier, grant.CodeChallenge) {
+		service.logger.Info("authorization code rejected", zap.String("clientID", client.ClientID), zap.Uint("userID", grant.UserID))
+		return nil, ErrInvalidGrant
+	}
+
+	user, err := service.getUser(grant.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidGrant
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(service.settings.AccessTokenTTL)
+	sub := strconv.FormatUint(uint64(user.ID), 10)
+
+	accessToken, jti, err := service.signAccessToken(sub, client.ClientID, grant.Scope, now, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = service.Tokens.TrackAccessToken(ctx, user.ID, jti, expiry); err != nil {
+		return nil, err
+	}
+
+	response := &api.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(service.settings.AccessTokenTTL.Seconds()),
+		Scope:       grant.Scope,
+	}
+
+	if hasField(grant.Scope, ScopeOpenID) {
+		claims := jwt.MapClaims(userClaims(user, grant.Scope))
+		claims["iss"] = service.settings.Issuer
+		claims["aud"] = client.ClientID
+		claims["iat"] = now.Unix()
+		claims["exp"] = expiry.Unix()
+		if grant.Nonce != "" {
+			claims["nonce"] = grant.Nonce
+		}
+
+		if response.IDToken, err = service.Keys.Sign(claims); err != nil {
+			service.logger.Error("failed to create id token", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// exchangeClientCredentials issues a token for the client itself, there's no user so it's never given an id token
+func (service *OAuthService) exchangeClientCredentials(req api.TokenRequest) (*api.TokenResponse, error) {
+
+	client, err := service.authenticateClient(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public() || !hasField(client.GrantTypes, GrantClientCredentials) {
+		return nil, ErrUnauthorizedClient
+	}
+
+	scopes, err := grantedScopes(client, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	// the identity scopes are about a user, when none were asked for they're left out rather than refused
+	clientScopes := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if scope == ScopeOpenID || scope == ScopeProfile || scope == ScopeEmail {
+			if req.Scope != "" {
+				return nil, ErrInvalidScope
+			}
+			continue
+		}
+		clientScopes = append(clientScopes, scope)
+	}
+
+	now := time.Now()
+	scope := strings.Join(clientScopes, " ")
+
+	accessToken, _, err := service.signAccessToken(client.ClientID, client.ClientID, scope, now, now.Add(service.settings.AccessTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(service.settings.AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// signAccessToken mints an RFC 9068 style access token, the sub is a string which keeps it from being accepted as a first party token
+func (service *OAuthService) signAccessToken(sub, clientID, scope string, now, expiry time.Time) (string, string, error) {
+
+	jti, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate access token id", zap.Error(err))
+		return "", "", err
+	}
+
+	token, err := service.Keys.Sign(jwt.MapClaims{
+		"iss":       service.settings.Issuer,
+		"aud":       service.settings.Issuer,
+		"sub":       sub,
+		"client_id": clientID,
+		"scope":     scope,
+		"jti":       jti,
+		"iat":       now.Unix(),
+		"exp":       expiry.Unix(),
+	})
+	if err != nil {
+		service.logger.Error("failed to create oauth access token", zap.Error(err))
+		return "", "", err
+	}
+
+	return token, jti, nil
+}
+
+// authenticateClient checks the secret of a confidential client, public clients mustn't send one
+func (service *OAuthService) authenticateClient(req api.TokenRequest) (*pkg.OAuthClient, error) {
+
+	client, err := service.getClient(req.ClientID)
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, ErrInvalidClient
+	} else if err != nil {
+		return nil, err
+	}
+
+	if client.Public() {
+		if req.ClientSecret != "" {
+			return nil, ErrInvalidClient
+		}
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(req.ClientSecret)), []byte(client.SecretHash)) != 1 {
+		service.logger.Info("oauth client authentication failed", zap.String("clientID", client.ClientID))
+		return nil, ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+func (service *OAuthService) validateClient(req api.RegisterOAuthClientRequest, public bool) error {
+
+	for _, scope := range strings.Fields(req.Scope) {
+		supported := false
+		for _, allowed := range service.settings.Scopes {
+			supported = supported || scope == allowed
+		}
+		if !supported {
+			return NewFieldError("scope", fmt.Sprintf("%s isn't a supported scope", scope))
+		}
+	}
+
+	for _, grantType := range req.GrantTypes {
+		switch {
+		case grantType == GrantAuthorizationCode && len(req.RedirectURIs) == 0:
+			return NewFieldError("redirect_uris", "at least one is required for the authorization_code grant")
+		case grantType == GrantClientCredentials && public:
+			return NewFieldError("grant_types", "public clients can't use the client_credentials grant")
+		}
+	}
+
+	for _, redirectURI := range req.RedirectURIs {
+		if !validRedirectURI(redirectURI) {
+			return NewFieldError("redirect_uris", fmt.Sprintf("%s must be an https url without a fragment, http is only allowed for localhost", redirectURI))
+		}
+	}
+
+	return nil
+}
+
+func (service *OAuthService) getClient(clientID string) (*pkg.OAuthClient, error) {
+
+	if clientID == "" {
+		return nil, ErrOAuthClientNotFound
+	}
+
+	var client pkg.OAuthClient
+
+	res := service.DBConn.Where("client_id = ?", clientID).First(&client)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrOAuthClientNotFound
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting oauth client", zap.String("clientID", clientID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return &client, nil
+}
+
+func (service *OAuthService) getUser(userID uint) (*pkg.User, error) {
+
+	var user pkg.User
+
+	res := service.DBConn.Where("id = ?", userID).First(&user)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting user", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return &user, nil
+}
+
+// hasConsent reports whether the user already granted the client every scope passed
+func (service *OAuthService) hasConsent(userID uint, clientID string, scopes []string) (bool, error) {
+
+	var consent pkg.OAuthConsent
+
+	res := service.DBConn.Where("user_id = ? AND client_id = ?", userID, clientID).Take(&consent)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting oauth consent", zap.Uint("userID", userID), zap.Error(res.Error))
+		return false, res.Error
+	}
+
+	for _, scope := range scopes {
+		if !hasField(consent.Scopes, scope) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// saveConsent records the scopes granted to the client, replacing what was granted before
+func (service *OAuthService) saveConsent(userID uint, clientID string, scopes []string) error {
+
+	res := service.DBConn.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"scopes", "updated_at"}),
+	}).Create(&pkg.OAuthConsent{UserID: userID, ClientID: clientID, Scopes: strings.Join(scopes, " ")})
+	if res.Error != nil {
+		service.logger.Error("something went wrong saving oauth consent", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	return nil
+}
+
+func (service *OAuthService) redirectError(req api.AuthorizeRequest, err *Error) (*api.AuthorizeResponse, error) {
+	return service.redirect(req, url.Values{"error": {err.Code}, "error_description": {err.Message}})
+}
+
+// redirect builds the url the user agent is sent back to the client with, the state is echoed and the issuer
+// is added as per RFC 9207 so clients talking to several providers can tell which one answered
+func (service *OAuthService) redirect(req api.AuthorizeRequest, params url.Values) (*api.AuthorizeResponse, error) {
+
+	redirectTo, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return nil, ErrInvalidRedirectURI
+	}
+
+	query := redirectTo.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	query.Set("iss", service.settings.Issuer)
+
+	redirectTo.RawQuery = query.Encode()
+
+	return &api.AuthorizeResponse{RedirectTo: redirectTo.String()}, nil
+}
+
+// grantedScopes checks the requested scopes against the ones the client was registered with, defaulting to all of them
+func grantedScopes(client *pkg.OAuthClient, requested string) ([]string, error) {
+
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return strings.Fields(client.Scopes), nil
+	}
+
+	for _, scope := range scopes {
+		if !hasField(client.Scopes, scope) {
+			return nil, ErrInvalidScope
+		}
+	}
+
+	return scopes, nil
+}
+
+// userClaims returns the standard claims of the user that the scopes passed give access to
+func userClaims(user *pkg.User, scope string) map[string]interface{} {
+
+	claims := map[string]interface{}{"sub": strconv.FormatUint(uint64(user.ID), 10)}
+
+	if hasField(scope, ScopeProfile) {
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+		claims["preferred_username"] = user.Username
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+
+	if hasField(scope, ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerifiedAt.Valid
+	}
+
+	return claims
+}
+
+// verifyPKCE checks the verifier hashes to the challenge the authorization code was issued with, RFC 7636 section 4.6
+func verifyPKCE(verifier, challenge string) bool {
+
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// validRedirectURI follows OAuth 2.1, redirect uris are absolute, have no fragment and only use http on the loopback
+func validRedirectURI(redirectURI string) bool {
+
+	parsed, err := url.Parse(redirectURI)
+	if err != nil || parsed.Host == "" || parsed.Fragment != "" {
+		return false
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := parsed.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+
+	return false
+}
+
+// hasField reports whether value is one of the space separated values passed
+func hasField(values, value string) bool {
+	for _, field := range strings.Fields(values) {
+		if field == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func toAPIOAuthClient(client pkg.OAuthClient) api.OAuthClient {
+
+	authMethod := "client_secret_basic"
+	if client.Public() {
+		authMethod = authMethodNone
+	}
+
+	return api.OAuthClient{
+		ClientID:                client.ClientID,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		Name:                    client.Name,
+		RedirectURIs:            strings.Fields(client.RedirectURIs),
+		GrantTypes:              strings.Fields(client.GrantTypes),
+		Scope:                   client.Scopes,
+		TokenEndpointAuthMethod: authMethod,
+	}
+}
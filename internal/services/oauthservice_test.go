@@ -0,0 +1,311 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+)
+
+const (
+	testClientSecret = "client-secret"
+	testRedirectURI  = "https://app.example.com/callback"
+	testVerifier     = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// expectOAuthClient returns the client from the mocked db, public clients have no secret
+func expectOAuthClient(clientID string, public bool, grantTypes string) {
+
+	secretHash := hashToken(testClientSecret)
+	if public {
+		secretHash = ""
+	}
+
+	sqlMock.ExpectQuery("SELECT \\* FROM `oauth_clients` WHERE client_id = \\?").
+		WithArgs(clientID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "secret_hash", "name", "redirect_uris", "grant_types", "scopes"}).
+			AddRow(1, clientID, secretHash, "Quiz Companion", testRedirectURI, grantTypes, "openid profile email quiz.read"))
+}
+
+func expectOAuthUser(userID uint) {
+	sqlMock.ExpectQuery("SELECT \\* FROM `users` WHERE id = \\?").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "username", "email_verified_at", "updated_at"}).
+			AddRow(userID, "Ada", "Lovelace", "ada@example.com", "ada", time.Now(), time.Now()))
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestOAuthService_RegisterClient(t *testing.T) {
+
+	t.Run("public client can't use client credentials", func(t *testing.T) {
+		_, err := oauthService.RegisterClient(api.RegisterOAuthClientRequest{
+			Name:                    "cli",
+			GrantTypes:              []string{GrantClientCredentials},
+			Scope:                   "quiz.read",
+			TokenEndpointAuthMethod: "none",
+		})
+		require.ErrorIs(t, err, ErrValidation)
+	})
+
+	t.Run("plain http redirect outside the loopback", func(t *testing.T) {
+		_, err := oauthService.RegisterClient(api.RegisterOAuthClientRequest{
+			Name:         "web",
+			RedirectURIs: []string{"http://app.example.com/callback"},
+			GrantTypes:   []string{GrantAuthorizationCode},
+			Scope:        "openid",
+		})
+		require.ErrorIs(t, err, ErrValidation)
+	})
+
+	t.Run("unsupported scope", func(t *testing.T) {
+		_, err := oauthService.RegisterClient(api.RegisterOAuthClientRequest{
+			Name:         "web",
+			RedirectURIs: []string{testRedirectURI},
+			GrantTypes:   []string{GrantAuthorizationCode},
+			Scope:        "openid admin",
+		})
+		require.ErrorIs(t, err, ErrValidation)
+	})
+
+	t.Run("confidential client gets a secret", func(t *testing.T) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("INSERT INTO `oauth_clients`").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		sqlMock.ExpectCommit()
+
+		client, err := oauthService.RegisterClient(api.RegisterOAuthClientRequest{
+			Name:         "web",
+			RedirectURIs: []string{testRedirectURI, "http://127.0.0.1:3000/callback"},
+			GrantTypes:   []string{GrantAuthorizationCode},
+			Scope:        "openid email",
+		})
+		require.NoError(t, err)
+		require.Len(t, client.ClientID, 32)
+		require.Len(t, client.ClientSecret, 64)
+		require.Equal(t, "client_secret_basic", client.TokenEndpointAuthMethod)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestOAuthService_AuthorizationCode(t *testing.T) {
+	ctx := context.Background()
+
+	authReq := api.AuthorizeRequest{
+		UserID:              60,
+		ResponseType:        "code",
+		ClientID:            "webclient",
+		RedirectURI:         testRedirectURI,
+		Scope:               "openid email",
+		State:               "xyz",
+		Nonce:               "n-0S6_WzA2Mj",
+		CodeChallenge:       pkceChallenge(testVerifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	t.Run("unregistered redirect uri isn't redirected to", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+
+		req := authReq
+		req.RedirectURI = "https://evil.example.com/callback"
+
+		_, err := oauthService.Authorize(ctx, req)
+		require.ErrorIs(t, err, ErrInvalidRedirectURI)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("missing pkce is sent back to the client", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+
+		req := authReq
+		req.CodeChallenge = ""
+
+		res, err := oauthService.Authorize(ctx, req)
+		require.NoError(t, err)
+
+		redirect, err := url.Parse(res.RedirectTo)
+		require.NoError(t, err)
+		require.Equal(t, "invalid_request", redirect.Query().Get("error"))
+		require.Equal(t, "xyz", redirect.Query().Get("state"))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("consent is asked for", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+		sqlMock.ExpectQuery("SELECT \\* FROM `oauth_consents` WHERE user_id = \\? AND client_id = \\?").
+			WithArgs(60, "webclient").
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "client_id", "scopes"}).AddRow(60, "webclient", "openid"))
+
+		res, err := oauthService.Authorize(ctx, authReq)
+		require.NoError(t, err)
+		require.True(t, res.ConsentRequired)
+		require.Equal(t, []string{"openid", "email"}, res.Scopes)
+		require.Empty(t, res.RedirectTo)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	var code string
+
+	t.Run("approving issues a code", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("INSERT INTO `oauth_consents` .* ON DUPLICATE KEY UPDATE `scopes`=VALUES\\(`scopes`\\),`updated_at`=VALUES\\(`updated_at`\\)").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		req := authReq
+		req.Consent = "approve"
+
+		res, err := oauthService.Authorize(ctx, req)
+		require.NoError(t, err)
+
+		redirect, err := url.Parse(res.RedirectTo)
+		require.NoError(t, err)
+		require.Equal(t, "xyz", redirect.Query().Get("state"))
+		require.Equal(t, "http://localhost:8080", redirect.Query().Get("iss"))
+
+		code = redirect.Query().Get("code")
+		require.NotEmpty(t, code)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	var accessToken string
+
+	t.Run("code is exchanged for tokens", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+		expectOAuthUser(60)
+
+		res, err := oauthService.Exchange(ctx, api.TokenRequest{
+			GrantType:    GrantAuthorizationCode,
+			Code:         code,
+			RedirectURI:  testRedirectURI,
+			CodeVerifier: testVerifier,
+			ClientID:     "webclient",
+			ClientSecret: testClientSecret,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Bearer", res.TokenType)
+		require.Equal(t, "openid email", res.Scope)
+
+		idToken, err := jwt.Parse(res.IDToken, oauthService.Keys.Keyfunc)
+		require.NoError(t, err)
+
+		claims := idToken.Claims.(jwt.MapClaims)
+		require.Equal(t, "60", claims["sub"])
+		require.Equal(t, "webclient", claims["aud"])
+		require.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+		require.Equal(t, "ada@example.com", claims["email"])
+		require.NotContains(t, claims, "preferred_username")
+
+		accessToken = res.AccessToken
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("code is only exchanged once", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+
+		_, err := oauthService.Exchange(ctx, api.TokenRequest{
+			GrantType:    GrantAuthorizationCode,
+			Code:         code,
+			RedirectURI:  testRedirectURI,
+			CodeVerifier: testVerifier,
+			ClientID:     "webclient",
+			ClientSecret: testClientSecret,
+		})
+		require.ErrorIs(t, err, ErrInvalidGrant)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("access token isn't a first party token", func(t *testing.T) {
+		_, err := tokenService.ValidateAccessToken(ctx, accessToken)
+		require.ErrorIs(t, err, ErrInvalidAccessToken)
+	})
+
+	t.Run("userinfo is limited to the granted scopes", func(t *testing.T) {
+		expectOAuthUser(60)
+
+		claims, err := oauthService.UserInfo(ctx, accessToken)
+		require.NoError(t, err)
+		require.Equal(t, "60", claims["sub"])
+		require.Equal(t, true, claims["email_verified"])
+		require.NotContains(t, claims, "name")
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("userinfo refuses tokens revoked with the user's", func(t *testing.T) {
+		require.NoError(t, tokenService.RevokeUserTokens(ctx, 60))
+
+		_, err := oauthService.UserInfo(ctx, accessToken)
+		require.ErrorIs(t, err, ErrTokenRevoked)
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+		sqlMock.ExpectQuery("SELECT \\* FROM `oauth_consents` WHERE user_id = \\? AND client_id = \\?").
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "client_id", "scopes"}).AddRow(60, "webclient", "openid email"))
+
+		res, err := oauthService.Authorize(ctx, authReq)
+		require.NoError(t, err)
+
+		redirect, err := url.Parse(res.RedirectTo)
+		require.NoError(t, err)
+
+		expectOAuthClient("webclient", false, GrantAuthorizationCode)
+
+		_, err = oauthService.Exchange(ctx, api.TokenRequest{
+			GrantType:    GrantAuthorizationCode,
+			Code:         redirect.Query().Get("code"),
+			RedirectURI:  testRedirectURI,
+			CodeVerifier: "not-the-verifier-the-challenge-was-made-from-at-all",
+			ClientID:     "webclient",
+			ClientSecret: testClientSecret,
+		})
+		require.ErrorIs(t, err, ErrInvalidGrant)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestOAuthService_ClientCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("wrong secret", func(t *testing.T) {
+		expectOAuthClient("service", false, GrantClientCredentials)
+
+		_, err := oauthService.Exchange(ctx, api.TokenRequest{GrantType: GrantClientCredentials, ClientID: "service", ClientSecret: "nope"})
+		require.ErrorIs(t, err, ErrInvalidClient)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("identity scopes are left out", func(t *testing.T) {
+		expectOAuthClient("service", false, GrantClientCredentials)
+
+		res, err := oauthService.Exchange(ctx, api.TokenRequest{GrantType: GrantClientCredentials, ClientID: "service", ClientSecret: testClientSecret})
+		require.NoError(t, err)
+		require.Equal(t, "quiz.read", res.Scope)
+		require.Empty(t, res.IDToken)
+
+		token, err := jwt.Parse(res.AccessToken, oauthService.Keys.Keyfunc)
+		require.NoError(t, err)
+		require.Equal(t, "service", token.Claims.(jwt.MapClaims)["sub"])
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("public clients can't use the grant", func(t *testing.T) {
+		expectOAuthClient("spa", true, GrantClientCredentials)
+
+		_, err := oauthService.Exchange(ctx, api.TokenRequest{GrantType: GrantClientCredentials, ClientID: "spa"})
+		require.ErrorIs(t, err, ErrUnauthorizedClient)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
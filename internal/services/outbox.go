@@ -0,0 +1,318 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+// outboxDuplicateWindow is how long jetstream remembers the id of an event, an event relayed twice within it is
+// only stored once. It has to outlast the time between publishing an event and marking it published.
+const outboxDuplicateWindow = 10 * time.Minute
+
+const defaultOutboxBatchSize = 100
+
+const defaultOutboxMaxAttempts = 10
+
+// enqueueEvent writes an event to the outbox in the transaction of the change it describes, so it's relayed
+// if and only if the change is committed. It's stored as a structured cloudevent, data not matching the schema
+// of the subject fails the change.
+func enqueueEvent(tx *gorm.DB, subject string, data interface{}) error {
+
+	event, err := events.New(events.TypeOf(subject), data)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// every user event carries the user_id, kept alongside so the events of a purged user can be dropped
+	var about struct {
+		UserID uint `json:"user_id"`
+	}
+	if err = event.DataAs(&about); err != nil {
+		return err
+	}
+
+	return tx.Create(&pkg.OutboxEvent{EventID: event.ID, Subject: subject, UserID: about.UserID, Payload: payload}).Error
+}
+
+// dropUserEvents deletes every event about the user from the outbox, relayed or not, so the personal data they
+// carry doesn't outlive the user. The user.purged event written afterwards tells consumers to drop theirs.
+func dropUserEvents(tx *gorm.DB, userID uint) error {
+	return tx.Where("user_id = ?", userID).Delete(&pkg.OutboxEvent{}).Error
+}
+
+// OutboxRelay publishes the events waiting in the outbox to jetstream in the order they were written. Delivery is
+// at least once: an event is published again when marking it failed, and every instance may relay at the same time,
+// jetstream drops the copies by their event id.
+type OutboxRelay struct {
+	DBConn    *gorm.DB
+	JetStream nats.JetStreamContext
+	logger    *zap.Logger
+	settings  OutboxRelaySettings
+}
+
+// OutboxRelaySettings holds how often the outbox is relayed and how long published events are kept for replays,
+// Mode is the cloudevents mode events are published in and MaxAttempts how often an event may fail before it's parked
+type OutboxRelaySettings struct {
+	Stream      string
+	Interval    time.Duration
+	BatchSize   int
+	MaxAttempts int
+	Retention   time.Duration
+	Mode        string
+}
+
+type IOutboxRelay interface {
+	EnsureStream() error
+	Relay(ctx context.Context) (int, error)
+	Requeue(ctx context.Context, since time.Time, subject string) (int64, error)
+	Cleanup(ctx context.Context) (int64, error)
+}
+
+func NewOutboxRelay(dbConn *gorm.DB, js nats.JetStreamContext, logger *zap.Logger, settings OutboxRelaySettings) *OutboxRelay {
+	return &OutboxRelay{
+		DBConn:    dbConn,
+		JetStream: js,
+		logger:    logger,
+		settings:  settings,
+	}
+}
+
+// EnsureStream creates the stream the events are relayed to, or brings its subjects up to date. Events are kept
+// in it as long as in the outbox so the personal data they carry doesn't stay in the stream for good.
+func (relay *OutboxRelay) EnsureStream() error {
+
+	cfg := &nats.StreamConfig{
+		Name:       relay.settings.Stream,
+		Subjects:   pkg.UserEventSubjects,
+		Storage:    nats.FileStorage,
+		Duplicates: outboxDuplicateWindow,
+	}
+
+	if relay.settings.Retention > 0 {
+		cfg.MaxAge = relay.settings.Retention
+	}
+
+	_, err := relay.JetStream.StreamInfo(cfg.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = relay.JetStream.AddStream(cfg)
+	case err == nil:
+		_, err = relay.JetStream.UpdateStream(cfg)
+	}
+	if err != nil {
+		relay.logger.Error("failed to set up jetstream stream", zap.String("stream", cfg.Name), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// Relay publishes the pending events until none are left and returns how many were published.
+// It stops at the first event that can't be published so events are never relayed out of order, unless the event
+// failed MaxAttempts times: it's parked then, left for a replay, and the events after it are relayed.
+func (relay *OutboxRelay) Relay(ctx context.Context) (int, error) {
+
+	batchSize := relay.settings.BatchSize
+	if batchSize < 1 {
+		batchSize = defaultOutboxBatchSize
+	}
+
+	published := 0
+
+	for {
+		var pending []pkg.OutboxEvent
+
+		res := relay.DBConn.WithContext(ctx).
+			Where("published_at IS NULL AND parked_at IS NULL").
+			Order("id").
+			Limit(batchSize).
+			Find(&pending)
+		if res.Error != nil {
+			relay.logger.Error("something went wrong getting pending events", zap.Error(res.Error))
+			return published, res.Error
+		}
+
+		for _, event := range pending {
+			if err := relay.publish(ctx, event); err != nil {
+				relay.logger.Warn("failed to publish event", zap.String("subject", event.Subject), zap.String("eventID", event.EventID), zap.Error(err))
+				if parked := relay.recordFailure(ctx, event, err); !parked {
+					return published, err
+				}
+				continue
+			}
+
+			res = relay.DBConn.WithContext(ctx).
+				Model(&pkg.OutboxEvent{}).
+				Where("id = ?", event.ID).
+				Update("published_at", relay.DBConn.NowFunc())
+			if res.Error != nil {
+				relay.logger.Error("something went wrong marking event published", zap.String("eventID", event.EventID), zap.Error(res.Error))
+				return published, res.Error
+			}
+
+			published++
+		}
+
+		if len(pending) < batchSize {
+			return published, nil
+		}
+	}
+}
+
+// publish sends an event to jetstream in the configured mode, events written to the outbox before they were
+// wrapped in cloudevents are wrapped on the way out
+func (relay *OutboxRelay) publish(ctx context.Context, event pkg.OutboxEvent) error {
+
+	stored, err := events.Unmarshal(event.Payload)
+	if err != nil {
+		if stored, err = events.New(events.TypeOf(event.Subject), json.RawMessage(event.Payload)); err != nil {
+			return err
+		}
+		stored.ID = event.EventID
+	}
+
+	msg, err := stored.Message(event.Subject, relay.settings.Mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = relay.JetStream.PublishMsg(msg, nats.MsgId(event.EventID), nats.Context(ctx))
+
+	return err
+}
+
+// recordFailure keeps track of why an event is stuck and parks it once it failed MaxAttempts times, failing to
+// record it isn't worth more than a log line. Failures of nats or jetstream being unreachable aren't the event's
+// fault and aren't counted, an outage doesn't park every event it holds up.
+func (relay *OutboxRelay) recordFailure(ctx context.Context, event pkg.OutboxEvent, cause error) bool {
+
+	maxAttempts := relay.settings.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultOutboxMaxAttempts
+	}
+
+	lastError := cause.Error()
+	if len(lastError) > 512 {
+		lastError = lastError[:512]
+	}
+
+	updates := map[string]interface{}{"last_error": lastError}
+
+	parked := false
+	if !isNatsOutage(cause) {
+		updates["attempts"] = gorm.Expr("attempts + 1")
+		parked = event.Attempts+1 >= maxAttempts
+	}
+	if parked {
+		updates["parked_at"] = relay.DBConn.NowFunc()
+	}
+
+	res := relay.DBConn.WithContext(ctx).
+		Model(&pkg.OutboxEvent{}).
+		Where("id = ?", event.ID).
+		Updates(updates)
+	if res.Error != nil {
+		relay.logger.Warn("failed to record event failure", zap.String("eventID", event.EventID), zap.Error(res.Error))
+		return false
+	}
+
+	if parked {
+		relay.logger.Error("parked event that keeps failing to publish", zap.String("subject", event.Subject), zap.String("eventID", event.EventID), zap.Int("attempts", event.Attempts+1), zap.Error(cause))
+	}
+
+	return parked
+}
+
+// isNatsOutage tells whether publishing failed because nats or the stream couldn't be reached
+func isNatsOutage(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, nats.ErrNoStreamResponse) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrConnectionClosed) ||
+		errors.Is(err, nats.ErrConnectionDraining) ||
+		errors.Is(err, nats.ErrConnectionReconnecting) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+// Requeue marks the events written since the time passed, of one subject or all of them when it's empty, to be
+// relayed again, parked events included. Their ids don't change so events still in the duplicate window aren't
+// stored twice.
+func (relay *OutboxRelay) Requeue(ctx context.Context, since time.Time, subject string) (int64, error) {
+
+	tx := relay.DBConn.WithContext(ctx).
+		Model(&pkg.OutboxEvent{}).
+		Where("created_at >= ? AND (published_at IS NOT NULL OR parked_at IS NOT NULL)", since)
+
+	if subject != "" {
+		tx = tx.Where("subject = ?", subject)
+	}
+
+	res := tx.Updates(map[string]interface{}{"published_at": nil, "parked_at": nil, "attempts": 0, "last_error": ""})
+	if res.Error != nil {
+		relay.logger.Error("something went wrong requeueing events", zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	return res.RowsAffected, nil
+}
+
+// Cleanup deletes the events published longer ago than the retention, they can't be replayed anymore
+func (relay *OutboxRelay) Cleanup(ctx context.Context) (int64, error) {
+
+	if relay.settings.Retention <= 0 {
+		return 0, nil
+	}
+
+	res := relay.DBConn.WithContext(ctx).
+		Where("published_at < ?", relay.DBConn.NowFunc().Add(-relay.settings.Retention)).
+		Delete(&pkg.OutboxEvent{})
+	if res.Error != nil {
+		relay.logger.Error("something went wrong cleaning up the outbox", zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	return res.RowsAffected, nil
+}
+
+// Run relays the outbox every interval until ctx is done, published events past the retention are cleaned up hourly
+func (relay *OutboxRelay) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(relay.settings.Interval)
+	defer ticker.Stop()
+
+	var cleanedUp time.Time
+
+	for {
+		if published, err := relay.Relay(ctx); err != nil {
+			relay.logger.Warn("outbox relay stopped early, retrying next tick", zap.Int("published", published), zap.Error(err))
+		}
+
+		if time.Since(cleanedUp) >= time.Hour {
+			if deleted, err := relay.Cleanup(ctx); err == nil && deleted > 0 {
+				relay.logger.Info("cleaned up published events", zap.Int64("events", deleted))
+			}
+			cleanedUp = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
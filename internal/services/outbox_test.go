@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/events"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// expectOutboxEvent expects an event to be written to the outbox in the transaction under way
+func expectOutboxEvent(subject string) {
+	sqlMock.ExpectExec("INSERT INTO `outbox_events`").
+		WithArgs(sqlmock.AnyArg(), subject, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 0, "", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// eventData matches the payload of an outbox event whose data passes the check
+type eventData func(data map[string]interface{}) bool
+
+func (check eventData) Match(value driver.Value) bool {
+	payload, ok := value.([]byte)
+	if !ok {
+		return false
+	}
+
+	event, err := events.Unmarshal(payload)
+	if err != nil {
+		return false
+	}
+
+	var data map[string]interface{}
+	if err = event.DataAs(&data); err != nil {
+		return false
+	}
+
+	return check(data)
+}
+
+// runJetStream starts an in-process nats server with jetstream and returns a connection to it
+func runJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	ns, err := utils.StartNatsServer(utils.NatsServerSettings{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()}, log)
+	require.NoError(t, err)
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+// storedEvent is the payload of an event as enqueueEvent writes it to the outbox
+func storedEvent(t *testing.T, subject string, data interface{}) []byte {
+	t.Helper()
+
+	event, err := events.New(events.TypeOf(subject), data)
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	return payload
+}
+
+func outboxRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "event_id", "subject", "payload", "created_at", "published_at", "attempts", "last_error", "parked_at"})
+}
+
+func TestOutboxRelay_Relay(t *testing.T) {
+	ctx := context.Background()
+
+	js, err := runJetStream(t).JetStream()
+	require.NoError(t, err)
+
+	relay := NewOutboxRelay(gormDB, js, log, OutboxRelaySettings{Stream: pkg.UserEventsStream, Interval: time.Second, BatchSize: 2})
+	require.NoError(t, relay.EnsureStream())
+	// a second instance starting up finds the stream already there
+	require.NoError(t, relay.EnsureStream())
+
+	expectPublished := func(id int) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `outbox_events` SET `published_at`=\\? WHERE id = \\?").
+			WithArgs(sqlmock.AnyArg(), id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+	}
+
+	created := storedEvent(t, pkg.UserCreated, api.UserCreatedEvent{UserID: 1, Username: "alexm1496", Email: "alexanderm1496@gmail.com", CreatedAt: time.Now()})
+	loggedIn := storedEvent(t, pkg.UserLoggedIn, api.UserLoggedInEvent{UserID: 1, SessionID: "session-1", LoggedInAt: time.Now()})
+
+	t.Run("events are published in order and copies are dropped", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(1, "event-1", pkg.UserCreated, created, time.Now(), nil, 0, "", nil).
+				AddRow(2, "event-2", pkg.UserLoggedIn, loggedIn, time.Now(), nil, 0, "", nil))
+		expectPublished(1)
+		expectPublished(2)
+		// relayed again by another instance before it was marked published
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(2, "event-2", pkg.UserLoggedIn, loggedIn, time.Now(), nil, 0, "", nil))
+		expectPublished(2)
+
+		published, err := relay.Relay(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 3, published)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		info, err := js.StreamInfo(pkg.UserEventsStream)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), info.State.Msgs)
+
+		msg, err := js.GetMsg(pkg.UserEventsStream, 1)
+		require.NoError(t, err)
+		require.Equal(t, pkg.UserCreated, msg.Subject)
+		require.Equal(t, "event-1", msg.Header.Get(nats.MsgIdHdr))
+		require.Equal(t, events.ContentTypeStructured, msg.Header.Get("Content-Type"))
+		require.JSONEq(t, string(created), string(msg.Data))
+	})
+
+	t.Run("binary mode sends the attributes as headers", func(t *testing.T) {
+		binaryRelay := NewOutboxRelay(gormDB, js, log, OutboxRelaySettings{Stream: pkg.UserEventsStream, BatchSize: 2, Mode: events.ModeBinary})
+		stored, err := events.Unmarshal(created)
+		require.NoError(t, err)
+
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(5, "event-5", pkg.UserCreated, created, time.Now(), nil, 0, "", nil))
+		expectPublished(5)
+
+		published, err := binaryRelay.Relay(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, published)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		msg, err := js.GetLastMsg(pkg.UserEventsStream, pkg.UserCreated)
+		require.NoError(t, err)
+		require.Equal(t, "user.created.v1", msg.Header.Get("ce-type"))
+		require.Equal(t, stored.ID, msg.Header.Get("ce-id"))
+		require.JSONEq(t, string(stored.Data), string(msg.Data))
+	})
+
+	t.Run("events written before cloudevents are wrapped", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(6, "event-6", pkg.UserPurged, []byte(`{"user_id":1,"purged_at":"2026-10-18T10:00:00Z"}`), time.Now(), nil, 0, "", nil))
+		expectPublished(6)
+
+		published, err := relay.Relay(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, published)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		msg, err := js.GetLastMsg(pkg.UserEventsStream, pkg.UserPurged)
+		require.NoError(t, err)
+
+		event, err := events.Unmarshal(msg.Data)
+		require.NoError(t, err)
+		require.Equal(t, "event-6", event.ID)
+		require.Equal(t, "user.purged.v1", event.Type)
+	})
+
+	t.Run("relaying stops at an event that can't be published", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(3, "event-3", "user.unknown", []byte(`{}`), time.Now(), nil, 0, "", nil).
+				AddRow(4, "event-4", pkg.UserUpdated, []byte(`{}`), time.Now(), nil, 0, "", nil))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `outbox_events` SET `attempts`=attempts \\+ 1,`last_error`=\\? WHERE id = \\?").
+			WithArgs(sqlmock.AnyArg(), 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		published, err := relay.Relay(ctx)
+		require.Error(t, err)
+		require.Equal(t, 0, published)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("an event failing its last attempt is parked and the next ones are relayed", func(t *testing.T) {
+		cappedRelay := NewOutboxRelay(gormDB, js, log, OutboxRelaySettings{Stream: pkg.UserEventsStream, BatchSize: 2, MaxAttempts: 3})
+
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(3, "event-3", "user.unknown", []byte(`{}`), time.Now(), nil, 2, "unknown type", nil).
+				AddRow(7, "event-7", pkg.UserCreated, created, time.Now(), nil, 0, "", nil))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `outbox_events` SET `attempts`=attempts \\+ 1,`last_error`=\\?,`parked_at`=\\? WHERE id = \\?").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 3).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+		expectPublished(7)
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows())
+
+		published, err := cappedRelay.Relay(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, published)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("failures of an outage aren't counted", func(t *testing.T) {
+		nc := runJetStream(t)
+		unreachable, err := nc.JetStream()
+		require.NoError(t, err)
+		nc.Close()
+
+		cappedRelay := NewOutboxRelay(gormDB, unreachable, log, OutboxRelaySettings{Stream: pkg.UserEventsStream, BatchSize: 2, MaxAttempts: 1})
+
+		sqlMock.ExpectQuery("SELECT \\* FROM `outbox_events` WHERE published_at IS NULL AND parked_at IS NULL ORDER BY id LIMIT 2").
+			WillReturnRows(outboxRows().
+				AddRow(8, "event-8", pkg.UserCreated, created, time.Now(), nil, 0, "", nil))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `outbox_events` SET `last_error`=\\? WHERE id = \\?").
+			WithArgs(sqlmock.AnyArg(), 8).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		published, err := cappedRelay.Relay(ctx)
+		require.ErrorIs(t, err, nats.ErrConnectionClosed)
+		require.Equal(t, 0, published)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestOutboxRelay_EnsureStream(t *testing.T) {
+	js, err := runJetStream(t).JetStream()
+	require.NoError(t, err)
+
+	relay := NewOutboxRelay(gormDB, js, log, OutboxRelaySettings{Stream: pkg.UserEventsStream, Retention: 7 * 24 * time.Hour})
+	require.NoError(t, relay.EnsureStream())
+
+	info, err := js.StreamInfo(pkg.UserEventsStream)
+	require.NoError(t, err)
+	require.Equal(t, 7*24*time.Hour, info.Config.MaxAge)
+	require.Equal(t, pkg.UserEventSubjects, info.Config.Subjects)
+
+	// a shorter retention is applied to the stream already there
+	relay.settings.Retention = 24 * time.Hour
+	require.NoError(t, relay.EnsureStream())
+
+	info, err = js.StreamInfo(pkg.UserEventsStream)
+	require.NoError(t, err)
+	require.Equal(t, 24*time.Hour, info.Config.MaxAge)
+}
+
+func TestOutboxRelay_Requeue(t *testing.T) {
+	relay := NewOutboxRelay(gormDB, nil, log, OutboxRelaySettings{Stream: pkg.UserEventsStream})
+	since := time.Now().Add(-time.Hour)
+
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `outbox_events` SET `attempts`=\\?,`last_error`=\\?,`parked_at`=\\?,`published_at`=\\? WHERE \\(created_at >= \\? AND \\(published_at IS NOT NULL OR parked_at IS NOT NULL\\)\\) AND subject = \\?").
+		WithArgs(0, "", nil, nil, since, pkg.UserDeleted).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	sqlMock.ExpectCommit()
+
+	requeued, err := relay.Requeue(context.Background(), since, pkg.UserDeleted)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), requeued)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestEnqueueEvent(t *testing.T) {
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("INSERT INTO `outbox_events`").
+		WithArgs(sqlmock.AnyArg(), pkg.UserRestored, 42, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 0, "", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlMock.ExpectCommit()
+
+	err := gormDB.Transaction(func(tx *gorm.DB) error {
+		return enqueueEvent(tx, pkg.UserRestored, api.UserRestoredEvent{UserID: 42, RestoredAt: time.Now()})
+	})
+	require.NoError(t, err)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+var ErrPasswordReused = &Error{Kind: ErrValidation, Code: "password_reused", Message: "password was used recently, choose another", Field: "password"}
+
+// checkPasswordReuse rejects the password if it matches the current one or any of the last passwords in the user's history
+func (service *UserService) checkPasswordReuse(user *pkg.User, pwd string) error {
+
+	if service.settings.PasswordHistorySize < 1 {
+		return nil
+	}
+
+	var hashes []string
+
+	res := service.DBConn.
+		Model(&pkg.PasswordHistory{}).
+		Where("user_id = ?", user.ID).
+		Order("id DESC").
+		Limit(service.settings.PasswordHistorySize).
+		Pluck("password", &hashes)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting password history", zap.Uint("userID", user.ID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	// users from before the history was kept may only have their current password, users provisioned
+	// by an external provider may have none
+	if user.Password != "" && (len(hashes) == 0 || hashes[0] != user.Password) {
+		hashes = append([]string{user.Password}, hashes...)
+	}
+
+	for _, hash := range hashes {
+		same, err := utils.ComparePasswords(hash, []byte(pwd))
+		if err != nil {
+			// a hash we can't read can't be matched either, it shouldn't stop the user from changing password
+			service.logger.Warn("unreadable password hash in history", zap.Uint("userID", user.ID), zap.Error(err))
+			continue
+		}
+
+		if same {
+			return ErrPasswordReused
+		}
+	}
+
+	return nil
+}
+
+// recordPassword adds the hash to the user's history, dropping the entries beyond the history size
+func (service *UserService) recordPassword(tx *gorm.DB, userID uint, hash string) error {
+
+	if service.settings.PasswordHistorySize < 1 {
+		return nil
+	}
+
+	if res := tx.Create(&pkg.PasswordHistory{UserID: userID, Password: hash}); res.Error != nil {
+		service.logger.Error("something went wrong recording password history", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	var keep []uint
+
+	res := tx.
+		Model(&pkg.PasswordHistory{}).
+		Where("user_id = ?", userID).
+		Order("id DESC").
+		Limit(service.settings.PasswordHistorySize).
+		Pluck("id", &keep)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting password history", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	res = tx.Where("user_id = ? AND id NOT IN ?", userID, keep).Delete(&pkg.PasswordHistory{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong pruning password history", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	return nil
+}
+
+// passwordExpired reports whether the password of the user is older than the max password age
+func (service *UserService) passwordExpired(user *pkg.User) bool {
+
+	// users who only sign in through an external provider have no password to expire
+	if service.settings.PasswordMaxAge <= 0 || user.Password == "" {
+		return false
+	}
+
+	changedAt := user.CreatedAt
+	if user.PasswordChangedAt.Valid {
+		changedAt = user.PasswordChangedAt.Time
+	}
+
+	return service.DBConn.NowFunc().Sub(changedAt) > service.settings.PasswordMaxAge
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+func TestUserService_CheckPasswordReuse(t *testing.T) {
+	current, err := userService.Hasher.Hash([]byte("Current-Lantern-84"))
+	require.NoError(t, err)
+	previous, err := userService.Hasher.Hash([]byte("Previous-Lantern-84"))
+	require.NoError(t, err)
+
+	user := &pkg.User{Password: current}
+	user.ID = 40
+
+	testCases := []struct {
+		Name        string
+		Input       string
+		ExpectedErr error
+	}{
+		{Name: "Current password", Input: "Current-Lantern-84", ExpectedErr: ErrPasswordReused},
+		{Name: "Password from the history", Input: "Previous-Lantern-84", ExpectedErr: ErrPasswordReused},
+		{Name: "New password", Input: "Brand-New-Lantern-84"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			sqlMock.ExpectQuery("SELECT `password` FROM `password_history` WHERE user_id = \\? ORDER BY id DESC LIMIT 3").
+				WithArgs(40).
+				WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(current).AddRow(previous))
+
+			err := userService.checkPasswordReuse(user, test.Input)
+			if test.ExpectedErr != nil {
+				require.ErrorIs(t, err, test.ExpectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.NoError(t, sqlMock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUserService_PasswordExpired(t *testing.T) {
+	now := time.Now()
+
+	require.False(t, userService.passwordExpired(&pkg.User{
+		Password:          "hash",
+		PasswordChangedAt: sql.NullTime{Time: now.Add(-24 * time.Hour), Valid: true},
+	}))
+	require.True(t, userService.passwordExpired(&pkg.User{
+		Password:          "hash",
+		PasswordChangedAt: sql.NullTime{Time: now.Add(-91 * 24 * time.Hour), Valid: true},
+	}))
+
+	// passwords that were never changed are as old as the account
+	old := &pkg.User{Password: "hash"}
+	old.CreatedAt = now.Add(-100 * 24 * time.Hour)
+	require.True(t, userService.passwordExpired(old))
+
+	// users provisioned by an external provider have no password to expire
+	external := &pkg.User{}
+	external.CreatedAt = now.Add(-100 * 24 * time.Hour)
+	require.False(t, userService.passwordExpired(external))
+}
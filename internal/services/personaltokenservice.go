@@ -0,0 +1,259 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+// personalTokenUsageInterval is how stale the recorded last use of a token may get before it's written again,
+// so a pipeline firing requests doesn't turn every one of them into a write
+const personalTokenUsageInterval = time.Minute
+
+var (
+	ErrPersonalTokenNotFound = &Error{Kind: ErrNotFound, Code: "personal_token_not_found", Message: "personal access token not found"}
+	ErrPersonalTokenExpired  = &Error{Kind: ErrInvalidCredentials, Code: "personal_token_expired", Message: "personal access token has expired"}
+	ErrPersonalTokenScope    = &Error{Kind: ErrValidation, Code: "personal_token_scope", Message: "tokens can only be scoped to roles the user holds", Field: "scopes"}
+)
+
+type PersonalTokenService struct {
+	DBConn   *gorm.DB
+	logger   *zap.Logger
+	settings PersonalTokenServiceSettings
+}
+
+// PersonalTokenServiceSettings caps how long a personal access token can be created for
+type PersonalTokenServiceSettings struct {
+	MaxTTL time.Duration
+}
+
+type IPersonalTokenService interface {
+	CreateToken(req api.NewPersonalTokenRequest) (*api.PersonalToken, error)
+	ListTokens(userID uint) ([]api.PersonalToken, error)
+	RevokeToken(req api.RevokePersonalTokenRequest) error
+	RevokeUserTokens(ctx context.Context, userID uint) error
+	ValidateToken(ctx context.Context, token, ip string) (*AccessClaims, error)
+}
+
+func NewPersonalTokenService(dbConn *gorm.DB, logger *zap.Logger, settings PersonalTokenServiceSettings) *PersonalTokenService {
+	return &PersonalTokenService{
+		DBConn:   dbConn,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// CreateToken creates a personal access token acting with some of the user's roles, the token itself is only returned here
+func (service *PersonalTokenService) CreateToken(req api.NewPersonalTokenRequest) (*api.PersonalToken, error) {
+
+	ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	if service.settings.MaxTTL > 0 && ttl > service.settings.MaxTTL {
+		return nil, NewFieldError("expires_in_days", fmt.Sprintf("must be at most %d", int(service.settings.MaxTTL.Hours()/24)))
+	}
+
+	held, err := service.userRoles(req.UserID, req.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(held) != len(req.Scopes) {
+		return nil, ErrPersonalTokenScope
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	token := pkg.PersonalAccessTokenPrefix + secret
+
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		scopes = append(scopes, string(scope))
+	}
+
+	row := &pkg.PersonalAccessToken{
+		UserID:      req.UserID,
+		Name:        req.Name,
+		TokenHash:   hashToken(token),
+		TokenPrefix: token[:len(pkg.PersonalAccessTokenPrefix)+6],
+		Scopes:      strings.Join(scopes, " "),
+		ExpiresAt:   service.DBConn.NowFunc().Add(ttl),
+	}
+
+	if res := service.DBConn.Create(row); res.Error != nil {
+		service.logger.Error("something went wrong creating personal access token", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	service.logger.Info("personal access token created", zap.Uint("userID", req.UserID), zap.Uint("tokenID", row.ID))
+
+	response := toAPIPersonalToken(*row)
+	response.Token = token
+
+	return &response, nil
+}
+
+// ListTokens returns the personal access tokens of the user, expired ones included, newest first
+func (service *PersonalTokenService) ListTokens(userID uint) ([]api.PersonalToken, error) {
+
+	var rows []pkg.PersonalAccessToken
+
+	res := service.DBConn.Where("user_id = ?", userID).Order("id DESC").Find(&rows)
+	if res.Error != nil {
+		service.logger.Error("something went wrong listing personal access tokens", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	tokens := make([]api.PersonalToken, 0, len(rows))
+	for _, row := range rows {
+		tokens = append(tokens, toAPIPersonalToken(row))
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken deletes a personal access token of the user, it stops working straight away
+func (service *PersonalTokenService) RevokeToken(req api.RevokePersonalTokenRequest) error {
+
+	res := service.DBConn.Where("id = ? AND user_id = ?", req.TokenID, req.UserID).Delete(&pkg.PersonalAccessToken{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong revoking personal access token", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrPersonalTokenNotFound
+	}
+
+	service.logger.Info("personal access token revoked", zap.Uint("userID", req.UserID), zap.Uint("tokenID", req.TokenID))
+
+	return nil
+}
+
+// RevokeUserTokens deletes every personal access token of the user, for when their password changes or they're deleted
+func (service *PersonalTokenService) RevokeUserTokens(ctx context.Context, userID uint) error {
+
+	res := service.DBConn.WithContext(ctx).Where("user_id = ?", userID).Delete(&pkg.PersonalAccessToken{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong revoking personal access tokens", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected > 0 {
+		service.logger.Info("personal access tokens revoked", zap.Uint("userID", userID), zap.Int64("tokens", res.RowsAffected))
+	}
+
+	return nil
+}
+
+// ValidateToken returns the claims a personal access token acts with and records where it was used from.
+// The token only keeps the roles of its scopes the user still holds, and stops working once the user is deleted.
+func (service *PersonalTokenService) ValidateToken(ctx context.Context, token, ip string) (*AccessClaims, error) {
+
+	if !strings.HasPrefix(token, pkg.PersonalAccessTokenPrefix) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	var row pkg.PersonalAccessToken
+
+	res := service.DBConn.WithContext(ctx).
+		Select("personal_access_tokens.*").
+		Joins("JOIN users ON users.id = personal_access_tokens.user_id AND users.deleted_at IS NULL").
+		Where("personal_access_tokens.token_hash = ?", hashToken(token)).
+		Take(&row)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAccessToken
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting personal access token", zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	now := service.DBConn.NowFunc()
+	if !now.Before(row.ExpiresAt) {
+		return nil, ErrPersonalTokenExpired
+	}
+
+	var scopes []pkg.Role
+	for _, scope := range strings.Fields(row.Scopes) {
+		scopes = append(scopes, pkg.Role(scope))
+	}
+
+	roles, err := service.userRoles(row.UserID, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	if !row.LastUsedAt.Valid || now.Sub(row.LastUsedAt.Time) >= personalTokenUsageInterval || row.LastUsedIP != ip {
+		service.recordUsage(ctx, row.ID, now, ip)
+	}
+
+	return &AccessClaims{
+		UserID:    row.UserID,
+		Roles:     roles,
+		ExpiresAt: row.ExpiresAt.Unix(),
+		TokenID:   row.ID,
+	}, nil
+}
+
+// recordUsage stores when and where the token was last used, failing to isn't worth failing the request over
+func (service *PersonalTokenService) recordUsage(ctx context.Context, tokenID uint, usedAt time.Time, ip string) {
+
+	res := service.DBConn.WithContext(ctx).
+		Model(&pkg.PersonalAccessToken{}).
+		Where("id = ?", tokenID).
+		Updates(map[string]interface{}{"last_used_at": usedAt, "last_used_ip": ip})
+	if res.Error != nil {
+		service.logger.Warn("failed to record personal access token usage", zap.Uint("tokenID", tokenID), zap.Error(res.Error))
+	}
+}
+
+// userRoles returns which of the roles passed the user holds
+func (service *PersonalTokenService) userRoles(userID uint, roles []pkg.Role) ([]pkg.Role, error) {
+
+	var held []pkg.Role
+
+	res := service.DBConn.
+		Model(&pkg.UserRole{}).
+		Where("user_id = ? AND role IN ?", userID, roles).
+		Order("role").
+		Pluck("role", &held)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting user roles", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return held, nil
+}
+
+func toAPIPersonalToken(row pkg.PersonalAccessToken) api.PersonalToken {
+
+	response := api.PersonalToken{
+		ID:          row.ID,
+		Name:        row.Name,
+		TokenPrefix: row.TokenPrefix,
+		Scopes:      []pkg.Role{},
+		ExpiresAT:   row.ExpiresAt.Format(time.RFC3339),
+		LastUsedIP:  row.LastUsedIP,
+		CreatedAT:   row.CreatedAt.Format(time.RFC3339),
+	}
+
+	for _, scope := range strings.Fields(row.Scopes) {
+		response.Scopes = append(response.Scopes, pkg.Role(scope))
+	}
+
+	if row.LastUsedAt.Valid {
+		response.LastUsedAT = row.LastUsedAt.Time.Format(time.RFC3339)
+	}
+
+	return response
+}
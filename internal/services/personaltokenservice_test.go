@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+func personalTokenRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "name", "token_hash", "token_prefix", "scopes", "expires_at", "last_used_at", "last_used_ip", "created_at"})
+}
+
+func TestPersonalTokenService_CreateToken(t *testing.T) {
+
+	t.Run("token is returned once and stored hashed", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\? AND role IN \\(\\?\\) ORDER BY role").
+			WithArgs(90, "quiz_author").
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("quiz_author"))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("INSERT INTO `personal_access_tokens`").
+			WithArgs(90, "ci seeder", sqlmock.AnyArg(), sqlmock.AnyArg(), "quiz_author", sqlmock.AnyArg(), sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(4, 1))
+		sqlMock.ExpectCommit()
+
+		token, err := personalTokens.CreateToken(api.NewPersonalTokenRequest{
+			UserID:        90,
+			Name:          "ci seeder",
+			Scopes:        []pkg.Role{pkg.RoleQuizAuthor},
+			ExpiresInDays: 30,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint(4), token.ID)
+		require.True(t, strings.HasPrefix(token.Token, pkg.PersonalAccessTokenPrefix))
+		require.True(t, strings.HasPrefix(token.Token, token.TokenPrefix))
+		require.Equal(t, []pkg.Role{pkg.RoleQuizAuthor}, token.Scopes)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("roles the user doesn't hold are refused", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\? AND role IN \\(\\?,\\?\\) ORDER BY role").
+			WithArgs(90, "user", "admin").
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+
+		_, err := personalTokens.CreateToken(api.NewPersonalTokenRequest{
+			UserID:        90,
+			Name:          "escalate",
+			Scopes:        []pkg.Role{pkg.RoleUser, pkg.RoleAdmin},
+			ExpiresInDays: 30,
+		})
+		require.ErrorIs(t, err, ErrPersonalTokenScope)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("expiry is capped", func(t *testing.T) {
+		_, err := personalTokens.CreateToken(api.NewPersonalTokenRequest{
+			UserID:        90,
+			Name:          "forever",
+			Scopes:        []pkg.Role{pkg.RoleUser},
+			ExpiresInDays: 91,
+		})
+		require.ErrorIs(t, err, ErrValidation)
+	})
+}
+
+func TestPersonalTokenService_ValidateToken(t *testing.T) {
+	ctx := context.Background()
+	token := pkg.PersonalAccessTokenPrefix + strings.Repeat("ab", 32)
+
+	expectToken := func(rows *sqlmock.Rows) {
+		sqlMock.ExpectQuery("SELECT personal_access_tokens.\\* FROM `personal_access_tokens` JOIN users ON users.id = personal_access_tokens.user_id AND users.deleted_at IS NULL WHERE personal_access_tokens.token_hash = \\? LIMIT 1").
+			WithArgs(hashToken(token)).
+			WillReturnRows(rows)
+	}
+
+	t.Run("token acts with the scopes the user still holds", func(t *testing.T) {
+		expectToken(personalTokenRows().AddRow(4, 90, "ci seeder", hashToken(token), token[:11], "quiz_author admin", time.Now().Add(time.Hour), nil, "", time.Now()))
+		sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\? AND role IN \\(\\?,\\?\\) ORDER BY role").
+			WithArgs(90, "quiz_author", "admin").
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("quiz_author"))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `personal_access_tokens` SET `last_used_at`=\\?,`last_used_ip`=\\? WHERE id = \\?").
+			WithArgs(sqlmock.AnyArg(), "10.0.4.1", 4).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		claims, err := personalTokens.ValidateToken(ctx, token, "10.0.4.1")
+		require.NoError(t, err)
+		require.Equal(t, uint(90), claims.UserID)
+		require.Equal(t, uint(4), claims.TokenID)
+		require.Equal(t, []pkg.Role{pkg.RoleQuizAuthor}, claims.Roles)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("recent use from the same ip isn't written again", func(t *testing.T) {
+		expectToken(personalTokenRows().AddRow(4, 90, "ci seeder", hashToken(token), token[:11], "quiz_author", time.Now().Add(time.Hour), time.Now(), "10.0.4.1", time.Now()))
+		sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\? AND role IN \\(\\?\\) ORDER BY role").
+			WithArgs(90, "quiz_author").
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("quiz_author"))
+
+		_, err := personalTokens.ValidateToken(ctx, token, "10.0.4.1")
+		require.NoError(t, err)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("expired token is refused", func(t *testing.T) {
+		expectToken(personalTokenRows().AddRow(4, 90, "ci seeder", hashToken(token), token[:11], "quiz_author", time.Now().Add(-time.Hour), nil, "", time.Now()))
+
+		_, err := personalTokens.ValidateToken(ctx, token, "10.0.4.1")
+		require.ErrorIs(t, err, ErrPersonalTokenExpired)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("revoked token or deleted user is refused", func(t *testing.T) {
+		expectToken(personalTokenRows())
+
+		_, err := personalTokens.ValidateToken(ctx, token, "10.0.4.1")
+		require.ErrorIs(t, err, ErrInvalidAccessToken)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("jwt isn't looked up", func(t *testing.T) {
+		_, err := personalTokens.ValidateToken(ctx, "eyJhbGciOiJIUzI1NiJ9.e30.sig", "10.0.4.1")
+		require.ErrorIs(t, err, ErrInvalidAccessToken)
+	})
+}
+
+func TestPersonalTokenService_RevokeToken(t *testing.T) {
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("DELETE FROM `personal_access_tokens` WHERE id = \\? AND user_id = \\?").
+		WithArgs(4, 91).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectCommit()
+
+	err := personalTokens.RevokeToken(api.RevokePersonalTokenRequest{UserID: 91, TokenID: 4})
+	require.ErrorIs(t, err, ErrPersonalTokenNotFound)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
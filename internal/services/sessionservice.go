@@ -0,0 +1,326 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+const (
+	// sessionKey caches the user an active session belongs to, or revokedSession once it's signed out. The sessions
+	// table stays the source of truth and is read whenever the key is missing or redis can't be reached.
+	sessionKey = "auth:session:%s"
+	// revokedSession marks a signed out session so a database read racing the revocation can't cache it as active again
+	revokedSession = "revoked"
+)
+
+var (
+	ErrSessionNotFound = &Error{Kind: ErrNotFound, Code: "session_not_found", Message: "session not found"}
+	ErrSessionRevoked  = &Error{Kind: ErrInvalidCredentials, Code: "session_revoked", Message: "session has been signed out, log in again"}
+)
+
+type SessionService struct {
+	DBConn   *gorm.DB
+	Redis    *redis.Client
+	logger   *zap.Logger
+	settings SessionServiceSettings
+}
+
+// SessionServiceSettings holds how long a session lasts without being refreshed, the same as a refresh token
+type SessionServiceSettings struct {
+	TTL time.Duration
+}
+
+type ISessionService interface {
+	CreateSession(ctx context.Context, userID uint, sessionID string, client api.ClientInfo) error
+	TouchSession(ctx context.Context, sessionID string) error
+	IsActive(ctx context.Context, userID uint, sessionID string) (bool, error)
+	ListSessions(userID uint, currentID string) ([]api.Session, error)
+	RevokeSession(ctx context.Context, req api.RevokeSessionRequest) error
+	EndSession(ctx context.Context, sessionID string) error
+	RevokeSessions(ctx context.Context, userID uint, exceptID string) (int, error)
+}
+
+func NewSessionService(dbConn *gorm.DB, redisClient *redis.Client, logger *zap.Logger, settings SessionServiceSettings) *SessionService {
+	return &SessionService{
+		DBConn:   dbConn,
+		Redis:    redisClient,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// CreateSession records the login that started the refresh family sessionID
+func (service *SessionService) CreateSession(ctx context.Context, userID uint, sessionID string, client api.ClientInfo) error {
+
+	userAgent := client.UserAgent
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	session := &pkg.Session{
+		ID:        sessionID,
+		UserID:    userID,
+		Device:    describeDevice(userAgent),
+		UserAgent: userAgent,
+		IP:        client.IP,
+		ExpiresAt: service.DBConn.NowFunc().Add(service.settings.TTL),
+	}
+
+	if res := service.DBConn.WithContext(ctx).Create(session); res.Error != nil {
+		service.logger.Error("something went wrong creating session", zap.Uint("userID", userID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	service.cache(ctx, session.ID, userID, service.settings.TTL)
+
+	return nil
+}
+
+// TouchSession extends the session along with its refresh family when the refresh token is rotated,
+// ErrSessionRevoked when it was signed out in the meantime
+func (service *SessionService) TouchSession(ctx context.Context, sessionID string) error {
+
+	now := service.DBConn.NowFunc()
+
+	res := service.DBConn.WithContext(ctx).
+		Model(&pkg.Session{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, now).
+		Updates(map[string]interface{}{"last_seen_at": now, "expires_at": now.Add(service.settings.TTL)})
+	if res.Error != nil {
+		service.logger.Error("something went wrong touching session", zap.String("sessionID", sessionID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrSessionRevoked
+	}
+
+	if err := service.Redis.Expire(ctx, fmt.Sprintf(sessionKey, sessionID), service.settings.TTL).Err(); err != nil {
+		service.logger.Warn("failed to extend cached session", zap.String("sessionID", sessionID), zap.Error(err))
+	}
+
+	return nil
+}
+
+// IsActive reports whether the session of an access token is still signed in, it's checked on every request
+// so redis answers unless the session isn't cached or redis is unavailable
+func (service *SessionService) IsActive(ctx context.Context, userID uint, sessionID string) (bool, error) {
+
+	cached, err := service.Redis.Get(ctx, fmt.Sprintf(sessionKey, sessionID)).Result()
+	switch {
+	case err == nil:
+		return cached == strconv.FormatUint(uint64(userID), 10), nil
+	case err != redis.Nil:
+		service.logger.Warn("couldn't check session in redis, falling back to the database", zap.Error(err))
+	}
+
+	var session pkg.Session
+
+	res := service.DBConn.WithContext(ctx).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, userID, service.DBConn.NowFunc()).
+		Take(&session)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting session", zap.String("sessionID", sessionID), zap.Error(res.Error))
+		return false, res.Error
+	}
+
+	if err == redis.Nil {
+		service.cache(ctx, session.ID, session.UserID, time.Until(session.ExpiresAt))
+	}
+
+	return true, nil
+}
+
+// ListSessions returns the sessions the user is signed in on, most recent first
+func (service *SessionService) ListSessions(userID uint, currentID string) ([]api.Session, error) {
+
+	var rows []pkg.Session
+
+	res := service.DBConn.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, service.DBConn.NowFunc()).
+		Order("created_at DESC").
+		Find(&rows)
+	if res.Error != nil {
+		service.logger.Error("something went wrong listing sessions", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	sessions := make([]api.Session, 0, len(rows))
+	for _, row := range rows {
+		session := toAPISession(row)
+		session.Current = row.ID == currentID
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession signs the user out of one session, its access tokens are refused straight away
+func (service *SessionService) RevokeSession(ctx context.Context, req api.RevokeSessionRequest) error {
+
+	res := service.DBConn.WithContext(ctx).
+		Model(&pkg.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", req.SessionID, req.UserID).
+		Update("revoked_at", service.DBConn.NowFunc())
+	if res.Error != nil {
+		service.logger.Error("something went wrong revoking session", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+
+	return service.uncache(ctx, []string{req.SessionID})
+}
+
+// EndSession marks the session signed out when the user logs out of it, sessions already gone are ignored
+func (service *SessionService) EndSession(ctx context.Context, sessionID string) error {
+
+	res := service.DBConn.WithContext(ctx).
+		Model(&pkg.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", service.DBConn.NowFunc())
+	if res.Error != nil {
+		service.logger.Error("something went wrong ending session", zap.String("sessionID", sessionID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	return service.uncache(ctx, []string{sessionID})
+}
+
+// RevokeSessions signs the user out of every session but exceptID, which may be empty to sign out everywhere,
+// and returns how many were signed out
+func (service *SessionService) RevokeSessions(ctx context.Context, userID uint, exceptID string) (int, error) {
+
+	var ids []string
+
+	res := service.DBConn.WithContext(ctx).
+		Model(&pkg.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, exceptID).
+		Pluck("id", &ids)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting sessions", zap.Uint("userID", userID), zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res = service.DBConn.WithContext(ctx).
+		Model(&pkg.Session{}).
+		Where("id IN ?", ids).
+		Update("revoked_at", service.DBConn.NowFunc())
+	if res.Error != nil {
+		service.logger.Error("something went wrong revoking sessions", zap.Uint("userID", userID), zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	service.logger.Info("revoked sessions", zap.Uint("userID", userID), zap.Int("sessions", len(ids)))
+
+	return len(ids), service.uncache(ctx, ids)
+}
+
+// cache stores the session for IsActive unless it was revoked in the meantime, failing to only costs a database read later
+func (service *SessionService) cache(ctx context.Context, sessionID string, userID uint, ttl time.Duration) {
+	if err := service.Redis.SetNX(ctx, fmt.Sprintf(sessionKey, sessionID), userID, ttl).Err(); err != nil {
+		service.logger.Warn("failed to cache session", zap.String("sessionID", sessionID), zap.Error(err))
+	}
+}
+
+// uncache marks revoked sessions in redis and drops their refresh families so they can't be refreshed either.
+// The mark lasts as long as a session could, by then the session has expired in the database too.
+func (service *SessionService) uncache(ctx context.Context, sessionIDs []string) error {
+
+	_, err := service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range sessionIDs {
+			pipe.Set(ctx, fmt.Sprintf(sessionKey, id), revokedSession, service.settings.TTL)
+			pipe.Del(ctx, fmt.Sprintf(refreshFamilyKey, id))
+		}
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to mark revoked sessions in redis", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// describeDevice sums up a user agent as the browser and operating system it names, or its first product
+// for clients that aren't browsers such as curl
+func describeDevice(userAgent string) string {
+
+	var browser, os string
+
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			os = candidate.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return "Unknown device"
+	}
+
+	product, _, _ := strings.Cut(fields[0], "/")
+	if len(product) > 100 {
+		product = product[:100]
+	}
+
+	return product
+}
+
+func toAPISession(session pkg.Session) api.Session {
+
+	response := api.Session{
+		ID:        session.ID,
+		Device:    session.Device,
+		UserAgent: session.UserAgent,
+		IP:        session.IP,
+		IssuedAT:  session.CreatedAt.Format(time.RFC3339),
+		ExpiresAT: session.ExpiresAt.Format(time.RFC3339),
+	}
+
+	if session.LastSeenAt.Valid {
+		response.LastSeenAT = session.LastSeenAt.Time.Format(time.RFC3339)
+	}
+
+	return response
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+)
+
+const firefoxUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+// expectSessionCreated expects the session row a login writes once its tokens are issued
+func expectSessionCreated(userID interface{}) {
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("INSERT INTO `sessions`").
+		WithArgs(sqlmock.AnyArg(), userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectCommit()
+}
+
+// requireRevoked checks the session is marked signed out in redis and answers as such without the database
+func requireRevoked(t *testing.T, sessionID string) {
+	t.Helper()
+
+	cached, err := redisServer.Get(fmt.Sprintf(sessionKey, sessionID))
+	require.NoError(t, err)
+	require.Equal(t, revokedSession, cached)
+
+	active, err := sessionService.IsActive(context.Background(), 104, sessionID)
+	require.NoError(t, err)
+	require.False(t, active)
+}
+
+func sessionRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "device", "user_agent", "ip", "created_at", "last_seen_at", "expires_at", "revoked_at"})
+}
+
+func TestSessionService_CreateSession(t *testing.T) {
+	ctx := context.Background()
+
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("INSERT INTO `sessions`").
+		WithArgs("session-create", 100, "Firefox on Linux", firefoxUserAgent, "10.0.9.1", sqlmock.AnyArg(), nil, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectCommit()
+
+	err := sessionService.CreateSession(ctx, 100, "session-create", api.ClientInfo{IP: "10.0.9.1", UserAgent: firefoxUserAgent})
+	require.NoError(t, err)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+
+	// the cached session answers without touching the database
+	active, err := sessionService.IsActive(ctx, 100, "session-create")
+	require.NoError(t, err)
+	require.True(t, active)
+
+	active, err = sessionService.IsActive(ctx, 101, "session-create")
+	require.NoError(t, err)
+	require.False(t, active)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestSessionService_IsActive(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("uncached session falls back to the database and is cached again", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT \\* FROM `sessions` WHERE id = \\? AND user_id = \\? AND revoked_at IS NULL AND expires_at > \\? LIMIT 1").
+			WithArgs("session-evicted", 100, sqlmock.AnyArg()).
+			WillReturnRows(sessionRows().AddRow("session-evicted", 100, "curl", "curl/8.5.0", "10.0.9.2", time.Now(), nil, time.Now().Add(time.Hour), nil))
+
+		active, err := sessionService.IsActive(ctx, 100, "session-evicted")
+		require.NoError(t, err)
+		require.True(t, active)
+		require.True(t, redisServer.Exists(fmt.Sprintf(sessionKey, "session-evicted")))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("a database read racing a revocation doesn't cache the session again", func(t *testing.T) {
+		require.NoError(t, sessionService.uncache(ctx, []string{"session-raced"}))
+
+		// what IsActive does with the row it read just before the session was revoked
+		sessionService.cache(ctx, "session-raced", 100, time.Hour)
+
+		requireRevoked(t, "session-raced")
+	})
+
+	t.Run("revoked session", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT \\* FROM `sessions` WHERE id = \\? AND user_id = \\?").
+			WithArgs("session-gone", 100, sqlmock.AnyArg()).
+			WillReturnRows(sessionRows())
+
+		active, err := sessionService.IsActive(ctx, 100, "session-gone")
+		require.NoError(t, err)
+		require.False(t, active)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestSessionService_RevokeSession(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, redisServer.Set(fmt.Sprintf(sessionKey, "session-revoke"), "102"))
+	require.NoError(t, redisServer.Set(fmt.Sprintf(refreshFamilyKey, "session-revoke"), "jti"))
+
+	t.Run("another user's session", func(t *testing.T) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `sessions` SET `revoked_at`=\\? WHERE id = \\? AND user_id = \\? AND revoked_at IS NULL").
+			WithArgs(sqlmock.AnyArg(), "session-revoke", 103).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectCommit()
+
+		err := sessionService.RevokeSession(ctx, api.RevokeSessionRequest{UserID: 103, SessionID: "session-revoke"})
+		require.ErrorIs(t, err, ErrSessionNotFound)
+		require.True(t, redisServer.Exists(fmt.Sprintf(sessionKey, "session-revoke")))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("session and its refresh family are dropped", func(t *testing.T) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `sessions` SET `revoked_at`=\\? WHERE id = \\? AND user_id = \\? AND revoked_at IS NULL").
+			WithArgs(sqlmock.AnyArg(), "session-revoke", 102).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+
+		err := sessionService.RevokeSession(ctx, api.RevokeSessionRequest{UserID: 102, SessionID: "session-revoke"})
+		require.NoError(t, err)
+		requireRevoked(t, "session-revoke")
+		require.False(t, redisServer.Exists(fmt.Sprintf(refreshFamilyKey, "session-revoke")))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestSessionService_RevokeSessions(t *testing.T) {
+	ctx := context.Background()
+
+	for _, id := range []string{"session-a", "session-b", "session-current"} {
+		require.NoError(t, redisServer.Set(fmt.Sprintf(sessionKey, id), "104"))
+	}
+
+	sqlMock.ExpectQuery("SELECT `id` FROM `sessions` WHERE user_id = \\? AND id <> \\? AND revoked_at IS NULL").
+		WithArgs(104, "session-current").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("session-a").AddRow("session-b"))
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `sessions` SET `revoked_at`=\\? WHERE id IN \\(\\?,\\?\\)").
+		WithArgs(sqlmock.AnyArg(), "session-a", "session-b").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	sqlMock.ExpectCommit()
+
+	revoked, err := sessionService.RevokeSessions(ctx, 104, "session-current")
+	require.NoError(t, err)
+	require.Equal(t, 2, revoked)
+	requireRevoked(t, "session-a")
+	requireRevoked(t, "session-b")
+	current, err := redisServer.Get(fmt.Sprintf(sessionKey, "session-current"))
+	require.NoError(t, err)
+	require.Equal(t, "104", current)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestSessionService_TouchSession(t *testing.T) {
+	ctx := context.Background()
+
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `sessions` SET `expires_at`=\\?,`last_seen_at`=\\? WHERE id = \\? AND revoked_at IS NULL AND expires_at > \\?").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "session-signed-out", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectCommit()
+
+	require.ErrorIs(t, sessionService.TouchSession(ctx, "session-signed-out"), ErrSessionRevoked)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestDescribeDevice(t *testing.T) {
+	testCases := []struct {
+		UserAgent string
+		Expected  string
+	}{
+		{UserAgent: firefoxUserAgent, Expected: "Firefox on Linux"},
+		{UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.0.0", Expected: "Edge on Windows"},
+		{UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1", Expected: "Safari on iOS"},
+		{UserAgent: "curl/8.5.0", Expected: "curl"},
+		{UserAgent: "", Expected: "Unknown device"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Expected, func(t *testing.T) {
+			require.Equal(t, test.Expected, describeDevice(test.UserAgent))
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+const (
+	// refreshFamilyKey holds the jti of the only refresh token currently valid for a login family
+	refreshFamilyKey = "auth:refresh:family:%s"
+	// userFamiliesKey is the set of refresh families started by a user
+	userFamiliesKey = "auth:user:%d:families"
+	// userAccessKey is a sorted set of access token jtis issued to a user scored by their expiry
+	userAccessKey = "auth:user:%d:access"
+	// denylistKey marks an access token jti as revoked until the token expires
+	denylistKey = "auth:denylist:%s"
+
+	refreshTokenType = "refresh"
+)
+
+var (
+	ErrInvalidRefreshToken = &Error{Kind: ErrInvalidCredentials, Code: "invalid_refresh_token", Message: "invalid refresh token"}
+	ErrRefreshTokenReused  = &Error{Kind: ErrInvalidCredentials, Code: "refresh_token_reused", Message: "refresh token has already been used"}
+	ErrInvalidAccessToken  = &Error{Kind: ErrInvalidCredentials, Code: "invalid_token", Message: "invalid token"}
+	ErrTokenRevoked        = &Error{Kind: ErrInvalidCredentials, Code: "token_revoked", Message: "token has been revoked"}
+)
+
+// rotateRefreshScript atomically swaps the current jti of a family for a new one.
+// Returns 1 when rotated, 0 when the family no longer exists and -1 when an old
+// token was replayed, in which case the whole family is revoked.
+var rotateRefreshScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	return -1
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// trackAccessScript adds a jti to the access tokens of a user, dropping the expired ones. The set is only ever
+// given a longer ttl so tokens minted with a shorter lifetime don't cut the tracking of the others short.
+var trackAccessScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return 1
+`)
+
+type TokenService struct {
+	Redis    *redis.Client
+	Keys     *KeySet
+	logger   *zap.Logger
+	settings TokenServiceSettings
+}
+
+// TokenServiceSettings holds the refresh secret and lifetimes of issued tokens
+type TokenServiceSettings struct {
+	RefreshSecret   string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+// AccessClaims are the claims of a validated access token
+type AccessClaims struct {
+	UserID    uint
+	Roles     []pkg.Role
+	JTI       string
+	ExpiresAt int64
+	// SessionID is the login session the token was issued in, empty for personal access tokens
+	SessionID string
+	// TokenID is set when the request was authenticated with a personal access token instead of a JWT
+	TokenID uint
+}
+
+// HasRole reports whether the token was issued with any of the roles passed
+func (claims *AccessClaims) HasRole(roles ...pkg.Role) bool {
+	for _, held := range claims.Roles {
+		for _, role := range roles {
+			if held == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// TokenSubject is the user a token pair is minted for
+type TokenSubject struct {
+	UserID uint
+	Roles  []pkg.Role
+}
+
+// SubjectLoader looks up the current state of a user when their refresh token is rotated
+type SubjectLoader func(userID uint) (*TokenSubject, error)
+
+type ITokenService interface {
+	IssueTokenPair(ctx context.Context, subject TokenSubject) (*api.LoginResponse, error)
+	RotateRefreshToken(ctx context.Context, refreshToken string, loadSubject SubjectLoader) (*api.LoginResponse, error)
+	RevokeRefreshFamily(ctx context.Context, refreshToken string) (string, error)
+	ValidateAccessToken(ctx context.Context, accessToken string) (*AccessClaims, error)
+	RevokeUserTokens(ctx context.Context, userID uint) error
+	TrackAccessToken(ctx context.Context, userID uint, jti string, expiry time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+func NewTokenService(redisClient *redis.Client, keys *KeySet, logger *zap.Logger, settings TokenServiceSettings) *TokenService {
+	return &TokenService{
+		Redis:    redisClient,
+		Keys:     keys,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// IssueTokenPair starts a new refresh family for the user and returns the first access/refresh pair in it.
+func (service *TokenService) IssueTokenPair(ctx context.Context, subject TokenSubject) (*api.LoginResponse, error) {
+
+	family, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate refresh family", zap.Error(err))
+		return nil, err
+	}
+
+	jti, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate refresh token id", zap.Error(err))
+		return nil, err
+	}
+
+	_, err = service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf(refreshFamilyKey, family), jti, service.settings.RefreshTokenTTL)
+		pipe.SAdd(ctx, fmt.Sprintf(userFamiliesKey, subject.UserID), family)
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to store refresh family", zap.Error(err))
+		return nil, err
+	}
+
+	return service.signTokenPair(ctx, subject, family, jti)
+}
+
+// RotateRefreshToken exchanges a valid refresh token for a new pair in the same family.
+// Presenting a refresh token that was already rotated revokes the whole family.
+// The subject is reloaded so role changes are picked up by the new access token.
+func (service *TokenService) RotateRefreshToken(ctx context.Context, refreshToken string, loadSubject SubjectLoader) (*api.LoginResponse, error) {
+
+	userID, family, jti, err := service.parseRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	newJTI, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate refresh token id", zap.Error(err))
+		return nil, err
+	}
+
+	result, err := rotateRefreshScript.Run(
+		ctx,
+		service.Redis,
+		[]string{fmt.Sprintf(refreshFamilyKey, family)},
+		jti, newJTI, service.settings.RefreshTokenTTL.Milliseconds(),
+	).Int()
+	if err != nil {
+		service.logger.Error("failed to rotate refresh token", zap.Error(err))
+		return nil, err
+	}
+
+	switch result {
+	case 0:
+		return nil, ErrInvalidRefreshToken
+	case -1:
+		service.logger.Warn("refresh token reuse detected, family revoked", zap.Uint("userID", userID), zap.String("family", family))
+		return nil, ErrRefreshTokenReused
+	}
+
+	subject, err := loadSubject(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.signTokenPair(ctx, *subject, family, newJTI)
+}
+
+// RevokeRefreshFamily removes the family of the refresh token so no token in it can be rotated again,
+// the family is returned as it's also the id of the login session.
+func (service *TokenService) RevokeRefreshFamily(ctx context.Context, refreshToken string) (string, error) {
+
+	_, family, _, err := service.parseRefreshToken(refreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	if res := service.Redis.Del(ctx, fmt.Sprintf(refreshFamilyKey, family)); res.Err() != nil {
+		service.logger.Error("failed to revoke refresh family", zap.Error(res.Err()))
+		return "", res.Err()
+	}
+
+	return family, nil
+}
+
+// ValidateAccessToken checks the signature and expiry of the access token and that it hasn't been denylisted
+func (service *TokenService) ValidateAccessToken(ctx context.Context, accessToken string) (*AccessClaims, error) {
+
+	token, err := jwt.Parse(accessToken, service.Keys.Keyfunc)
+	if err != nil {
+		service.logger.Debug("failed to parse access token", zap.Error(err))
+		return nil, ErrInvalidAccessToken
+	}
+
+	// tokens minted for oauth clients carry a client_id and only grant the scopes the user consented to
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["typ"] == refreshTokenType || claims["client_id"] != nil {
+		return nil, ErrInvalidAccessToken
+	}
+
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	sub, subOK := claims["sub"].(float64)
+	exp, expOK := claims["exp"].(float64)
+	if jti == "" || !subOK || !expOK || sub < 1 {
+		return nil, ErrInvalidAccessToken
+	}
+
+	denied, err := service.IsRevoked(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+
+	if denied {
+		return nil, ErrTokenRevoked
+	}
+
+	var roles []pkg.Role
+	if claimRoles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range claimRoles {
+			if r, ok := role.(string); ok {
+				roles = append(roles, pkg.Role(r))
+			}
+		}
+	}
+
+	return &AccessClaims{
+		UserID:    uint(sub),
+		Roles:     roles,
+		JTI:       jti,
+		ExpiresAt: int64(exp),
+		SessionID: sid,
+	}, nil
+}
+
+// IsRevoked reports whether the access token with the jti passed has been denylisted
+func (service *TokenService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+
+	denied, err := service.Redis.Exists(ctx, fmt.Sprintf(denylistKey, jti)).Result()
+	if err != nil {
+		service.logger.Error("failed to check token denylist", zap.Error(err))
+		return false, err
+	}
+
+	return denied > 0, nil
+}
+
+// TrackAccessToken records an access token minted outside of a token pair so RevokeUserTokens denylists it too
+func (service *TokenService) TrackAccessToken(ctx context.Context, userID uint, jti string, expiry time.Time) error {
+
+	_, err := service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		trackAccessToken(ctx, pipe, userID, jti, expiry)
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to track access token", zap.Uint("userID", userID), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserTokens denylists every unexpired access token issued to the user and revokes all of their refresh families
+func (service *TokenService) RevokeUserTokens(ctx context.Context, userID uint) error {
+
+	accessKey := fmt.Sprintf(userAccessKey, userID)
+	familiesKey := fmt.Sprintf(userFamiliesKey, userID)
+	now := time.Now().Unix()
+
+	issued, err := service.Redis.ZRangeByScoreWithScores(ctx, accessKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(now+1, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		service.logger.Error("failed to get issued access tokens", zap.Uint("userID", userID), zap.Error(err))
+		return err
+	}
+
+	families, err := service.Redis.SMembers(ctx, familiesKey).Result()
+	if err != nil {
+		service.logger.Error("failed to get refresh families", zap.Uint("userID", userID), zap.Error(err))
+		return err
+	}
+
+	_, err = service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, token := range issued {
+			ttl := time.Duration(int64(token.Score)-now) * time.Second
+			pipe.Set(ctx, fmt.Sprintf(denylistKey, token.Member), userID, ttl)
+		}
+		for _, family := range families {
+			pipe.Del(ctx, fmt.Sprintf(refreshFamilyKey, family))
+		}
+		pipe.Del(ctx, accessKey, familiesKey)
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to revoke user tokens", zap.Uint("userID", userID), zap.Error(err))
+		return err
+	}
+
+	service.logger.Info("revoked user tokens", zap.Uint("userID", userID), zap.Int("accessTokens", len(issued)), zap.Int("families", len(families)))
+
+	return nil
+}
+
+func (service *TokenService) signTokenPair(ctx context.Context, subject TokenSubject, family, jti string) (*api.LoginResponse, error) {
+
+	userID := subject.UserID
+
+	now := time.Now()
+	accessExpiry := now.Add(service.settings.AccessTokenTTL)
+
+	accessJTI, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate access token id", zap.Error(err))
+		return nil, err
+	}
+
+	// save userID in jwt token for requests, the family doubles as the id of the login session
+	accessString, err := service.Keys.Sign(jwt.MapClaims{
+		"sub":   userID,
+		"roles": subject.Roles,
+		"jti":   accessJTI,
+		"sid":   family,
+		"iat":   now.Unix(),
+		"exp":   accessExpiry.Unix(),
+	})
+	if err != nil {
+		service.logger.Error("failed to create token", zap.Error(err))
+		return nil, err
+	}
+
+	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": userID,
+		"jti": jti,
+		"fam": family,
+		"typ": refreshTokenType,
+		"iat": now.Unix(),
+		"exp": now.Add(service.settings.RefreshTokenTTL).Unix(),
+	})
+
+	refreshString, err := refreshToken.SignedString([]byte(service.settings.RefreshSecret))
+	if err != nil {
+		service.logger.Error("failed to create refresh token", zap.Error(err))
+		return nil, err
+	}
+
+	_, err = service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		trackAccessToken(ctx, pipe, userID, accessJTI, accessExpiry)
+		pipe.Expire(ctx, fmt.Sprintf(userFamiliesKey, userID), service.settings.RefreshTokenTTL)
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to track access token", zap.Error(err))
+		return nil, err
+	}
+
+	return &api.LoginResponse{
+		Token:        accessString,
+		RefreshToken: refreshString,
+		ExpiresIn:    int64(service.settings.AccessTokenTTL.Seconds()),
+		SessionID:    family,
+	}, nil
+}
+
+// trackAccessToken keeps track of the access tokens issued so they can all be denylisted if the user is revoked
+func trackAccessToken(ctx context.Context, pipe redis.Pipeliner, userID uint, jti string, expiry time.Time) {
+	trackAccessScript.Eval(
+		ctx,
+		pipe,
+		[]string{fmt.Sprintf(userAccessKey, userID)},
+		time.Now().Unix(), expiry.Unix(), jti, time.Until(expiry).Milliseconds(),
+	)
+}
+
+// parseRefreshToken validates the signature and expiry of the refresh token and returns its claims
+func (service *TokenService) parseRefreshToken(refreshToken string) (userID uint, family, jti string, err error) {
+
+	token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected method: %s", token.Header["alg"])
+		}
+		return []byte(service.settings.RefreshSecret), nil
+	})
+	if err != nil {
+		service.logger.Debug("failed to parse refresh token", zap.Error(err))
+		return 0, "", "", ErrInvalidRefreshToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["typ"] != refreshTokenType {
+		return 0, "", "", ErrInvalidRefreshToken
+	}
+
+	family, _ = claims["fam"].(string)
+	jti, _ = claims["jti"].(string)
+	sub, ok := claims["sub"].(float64)
+	if family == "" || jti == "" || !ok || sub < 1 {
+		return 0, "", "", ErrInvalidRefreshToken
+	}
+
+	return uint(sub), family, jti, nil
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+func staticSubject(userID uint) (*TokenSubject, error) {
+	return &TokenSubject{UserID: userID, Roles: []pkg.Role{pkg.RoleUser}}, nil
+}
+
+func TestTokenService_RotateRefreshToken(t *testing.T) {
+	ctx := context.Background()
+
+	pair, err := tokenService.IssueTokenPair(ctx, TokenSubject{UserID: 1})
+	require.NoError(t, err)
+	require.NotEmpty(t, pair.Token)
+	require.NotEmpty(t, pair.RefreshToken)
+
+	t.Run("valid refresh token is rotated", func(t *testing.T) {
+		rotated, err := tokenService.RotateRefreshToken(ctx, pair.RefreshToken, staticSubject)
+		require.NoError(t, err)
+		require.NotEqual(t, pair.RefreshToken, rotated.RefreshToken)
+
+		claims, err := tokenService.ValidateAccessToken(ctx, rotated.Token)
+		require.NoError(t, err)
+		require.Equal(t, []pkg.Role{pkg.RoleUser}, claims.Roles)
+
+		t.Run("replaying the old token revokes the family", func(t *testing.T) {
+			_, err = tokenService.RotateRefreshToken(ctx, pair.RefreshToken, staticSubject)
+			require.ErrorIs(t, err, ErrRefreshTokenReused)
+
+			_, err = tokenService.RotateRefreshToken(ctx, rotated.RefreshToken, staticSubject)
+			require.ErrorIs(t, err, ErrInvalidRefreshToken)
+		})
+	})
+
+	t.Run("garbage token is rejected", func(t *testing.T) {
+		_, err := tokenService.RotateRefreshToken(ctx, "not.a.token", staticSubject)
+		require.ErrorIs(t, err, ErrInvalidRefreshToken)
+	})
+
+	t.Run("access token is not accepted as refresh token", func(t *testing.T) {
+		_, err := tokenService.RotateRefreshToken(ctx, pair.Token, staticSubject)
+		require.ErrorIs(t, err, ErrInvalidRefreshToken)
+	})
+}
+
+func TestTokenService_RevokeRefreshFamily(t *testing.T) {
+	ctx := context.Background()
+
+	pair, err := tokenService.IssueTokenPair(ctx, TokenSubject{UserID: 2})
+	require.NoError(t, err)
+
+	family, err := tokenService.RevokeRefreshFamily(ctx, pair.RefreshToken)
+	require.NoError(t, err)
+	require.Equal(t, pair.SessionID, family)
+
+	_, err = tokenService.RotateRefreshToken(ctx, pair.RefreshToken, staticSubject)
+	require.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestTokenService_RevokeUserTokens(t *testing.T) {
+	ctx := context.Background()
+
+	pair, err := tokenService.IssueTokenPair(ctx, TokenSubject{UserID: 3, Roles: []pkg.Role{pkg.RoleAdmin}})
+	require.NoError(t, err)
+
+	other, err := tokenService.IssueTokenPair(ctx, TokenSubject{UserID: 4})
+	require.NoError(t, err)
+
+	claims, err := tokenService.ValidateAccessToken(ctx, pair.Token)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), claims.UserID)
+	require.NotEmpty(t, claims.JTI)
+	require.True(t, claims.HasRole(pkg.RoleAdmin))
+	require.False(t, claims.HasRole(pkg.RoleQuizAuthor))
+
+	require.NoError(t, tokenService.RevokeUserTokens(ctx, 3))
+
+	_, err = tokenService.ValidateAccessToken(ctx, pair.Token)
+	require.ErrorIs(t, err, ErrTokenRevoked)
+
+	_, err = tokenService.RotateRefreshToken(ctx, pair.RefreshToken, staticSubject)
+	require.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// other users are unaffected
+	_, err = tokenService.ValidateAccessToken(ctx, other.Token)
+	require.NoError(t, err)
+}
+
+func TestTokenService_ValidateAccessToken(t *testing.T) {
+	ctx := context.Background()
+
+	pair, err := tokenService.IssueTokenPair(ctx, TokenSubject{UserID: 5})
+	require.NoError(t, err)
+
+	_, err = tokenService.ValidateAccessToken(ctx, pair.RefreshToken)
+	require.ErrorIs(t, err, ErrInvalidAccessToken)
+
+	claims, err := tokenService.ValidateAccessToken(ctx, pair.Token)
+	require.NoError(t, err)
+	require.Equal(t, uint(5), claims.UserID)
+
+	require.NoError(t, tokenService.RevokeUserTokens(ctx, 5))
+
+	_, err = tokenService.ValidateAccessToken(ctx, pair.Token)
+	require.ErrorIs(t, err, ErrTokenRevoked)
+}
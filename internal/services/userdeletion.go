@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+const defaultPurgeBatchSize = 100
+
+// RestoreUser undoes the soft delete of a user that wasn't purged yet, the user has to log in again
+func (service *UserService) RestoreUser(req api.RestoreUserRequest) error {
+
+	restoredAt := service.DBConn.NowFunc()
+
+	err := service.DBConn.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Unscoped().
+			Model(&pkg.User{}).
+			Where("id = ? AND deleted_at IS NOT NULL", req.ID).
+			Update("deleted_at", nil)
+		if res.Error != nil {
+			service.logger.Error("something went wrong restoring user", zap.Uint("userID", req.ID), zap.Error(res.Error))
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+
+		return enqueueEvent(tx, pkg.UserRestored, api.UserRestoredEvent{UserID: req.ID, RestoredAt: restoredAt})
+	})
+	if err != nil {
+		return err
+	}
+
+	service.logger.Info("user restored", zap.Uint("userID", req.ID))
+
+	return nil
+}
+
+// PurgeDeletedUsers hard deletes the users soft deleted longer ago than the grace period, their roles, credentials,
+// sessions, tokens and outbox events go with them. It returns how many were purged and does nothing without a grace period.
+func (service *UserService) PurgeDeletedUsers(ctx context.Context) (int, error) {
+
+	if service.settings.DeletionGracePeriod <= 0 {
+		return 0, nil
+	}
+
+	batchSize := service.settings.PurgeBatchSize
+	if batchSize < 1 {
+		batchSize = defaultPurgeBatchSize
+	}
+
+	cutoff := service.DBConn.NowFunc().Add(-service.settings.DeletionGracePeriod)
+	purged := 0
+
+	for {
+		var ids []uint
+
+		res := service.DBConn.WithContext(ctx).
+			Unscoped().
+			Model(&pkg.User{}).
+			Where("deleted_at < ?", cutoff).
+			Order("id").
+			Limit(batchSize).
+			Pluck("id", &ids)
+		if res.Error != nil {
+			service.logger.Error("something went wrong getting users to purge", zap.Error(res.Error))
+			return purged, res.Error
+		}
+
+		for _, id := range ids {
+			ok, err := service.purgeUser(ctx, id, cutoff)
+			if err != nil {
+				return purged, err
+			}
+
+			if ok {
+				purged++
+			}
+		}
+
+		if len(ids) < batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// purgeUser hard deletes a user deleted before cutoff, deleted_at is checked again in case the user was restored
+// since it was picked or purged by another instance
+func (service *UserService) purgeUser(ctx context.Context, userID uint, cutoff time.Time) (bool, error) {
+
+	purged := false
+
+	err := service.DBConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Unscoped().
+			Where("id = ? AND deleted_at < ?", userID, cutoff).
+			Delete(&pkg.User{})
+		if res.Error != nil {
+			service.logger.Error("something went wrong purging user", zap.Uint("userID", userID), zap.Error(res.Error))
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return nil
+		}
+
+		purged = true
+
+		if err := dropUserEvents(tx, userID); err != nil {
+			service.logger.Error("something went wrong dropping events of purged user", zap.Uint("userID", userID), zap.Error(err))
+			return err
+		}
+
+		return enqueueEvent(tx, pkg.UserPurged, api.UserPurgedEvent{UserID: userID, PurgedAt: service.DBConn.NowFunc()})
+	})
+
+	return purged, err
+}
+
+// RunPurgeJob purges deleted users every interval until ctx is done, it's safe to run on every instance
+func (service *UserService) RunPurgeJob(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := service.PurgeDeletedUsers(ctx)
+		if err != nil {
+			service.logger.Error("failed to purge deleted users", zap.Error(err))
+		} else if purged > 0 {
+			service.logger.Info("purged deleted users", zap.Int("users", purged))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+// expectPersonalTokensRevoked expects every personal access token of the user to be deleted
+func expectPersonalTokensRevoked(userID int) {
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("DELETE FROM `personal_access_tokens` WHERE user_id = \\?").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectCommit()
+}
+
+func TestUserService_DeleteUser(t *testing.T) {
+
+	t.Run("soft delete signs the user out and revokes their personal access tokens", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT `id` FROM `sessions` WHERE user_id = \\? AND id <> \\? AND revoked_at IS NULL").
+			WithArgs(110, "").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		expectPersonalTokensRevoked(110)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET `deleted_at`=\\? WHERE id = \\? AND `users`.`id` = \\? AND `users`.`deleted_at` IS NULL").
+			WithArgs(sqlmock.AnyArg(), 110, 110).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec("INSERT INTO `outbox_events`").
+			WithArgs(sqlmock.AnyArg(), pkg.UserDeleted, 110, eventData(func(data map[string]interface{}) bool {
+				return data["purge_at"] != nil
+			}), sqlmock.AnyArg(), nil, 0, "", nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		sqlMock.ExpectCommit()
+
+		require.NoError(t, userService.DeleteUser(api.DeleteUserRequest{ID: 110}))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("without a grace period there's no purge to announce", func(t *testing.T) {
+		service := *userService
+		service.settings.DeletionGracePeriod = 0
+
+		sqlMock.ExpectQuery("SELECT `id` FROM `sessions` WHERE user_id = \\?").
+			WithArgs(117, "").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		expectPersonalTokensRevoked(117)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET `deleted_at`=\\?").
+			WithArgs(sqlmock.AnyArg(), 117, 117).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec("INSERT INTO `outbox_events`").
+			WithArgs(sqlmock.AnyArg(), pkg.UserDeleted, 117, eventData(func(data map[string]interface{}) bool {
+				_, ok := data["purge_at"]
+				return !ok
+			}), sqlmock.AnyArg(), nil, 0, "", nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		sqlMock.ExpectCommit()
+
+		require.NoError(t, service.DeleteUser(api.DeleteUserRequest{ID: 117}))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("hard delete drops the events of the user", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT `id` FROM `sessions` WHERE user_id = \\?").
+			WithArgs(118, "").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		expectPersonalTokensRevoked(118)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("DELETE FROM `users` WHERE id = \\? AND `users`.`id` = \\?").
+			WithArgs(118, 118).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectExec("DELETE FROM `outbox_events` WHERE user_id = \\?").
+			WithArgs(118).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		expectOutboxEvent(pkg.UserPurged)
+		sqlMock.ExpectCommit()
+
+		require.NoError(t, userService.DeleteUser(api.DeleteUserRequest{ID: 118, HardDelete: true}))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT `id` FROM `sessions` WHERE user_id = \\?").
+			WithArgs(111, "").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		expectPersonalTokensRevoked(111)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("DELETE FROM `users` WHERE id = \\? AND `users`.`id` = \\?").
+			WithArgs(111, 111).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectRollback()
+
+		err := userService.DeleteUser(api.DeleteUserRequest{ID: 111, HardDelete: true})
+		require.ErrorIs(t, err, ErrUserNotFound)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestUserService_RestoreUser(t *testing.T) {
+
+	t.Run("soft deleted user", func(t *testing.T) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET `deleted_at`=\\?,`updated_at`=\\? WHERE id = \\? AND deleted_at IS NOT NULL").
+			WithArgs(nil, sqlmock.AnyArg(), 112).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectOutboxEvent(pkg.UserRestored)
+		sqlMock.ExpectCommit()
+
+		require.NoError(t, userService.RestoreUser(api.RestoreUserRequest{ID: 112}))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("user that isn't deleted or was purged", func(t *testing.T) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET `deleted_at`=\\?,`updated_at`=\\? WHERE id = \\? AND deleted_at IS NOT NULL").
+			WithArgs(nil, sqlmock.AnyArg(), 113).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectRollback()
+
+		err := userService.RestoreUser(api.RestoreUserRequest{ID: 113})
+		require.ErrorIs(t, err, ErrUserNotFound)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestUserService_PurgeDeletedUsers(t *testing.T) {
+
+	expectPurge := func(id int, rows int64) {
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("DELETE FROM `users` WHERE id = \\? AND deleted_at < \\?").
+			WithArgs(id, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, rows))
+		if rows > 0 {
+			sqlMock.ExpectExec("DELETE FROM `outbox_events` WHERE user_id = \\?").
+				WithArgs(id).
+				WillReturnResult(sqlmock.NewResult(0, 3))
+			expectOutboxEvent(pkg.UserPurged)
+		}
+		sqlMock.ExpectCommit()
+	}
+
+	// full batches are followed by another until one comes back short
+	sqlMock.ExpectQuery("SELECT `id` FROM `users` WHERE deleted_at < \\? ORDER BY id LIMIT 2").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(114).AddRow(115))
+	expectPurge(114, 1)
+	// restored between the two queries
+	expectPurge(115, 0)
+	sqlMock.ExpectQuery("SELECT `id` FROM `users` WHERE deleted_at < \\? ORDER BY id LIMIT 2").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(116))
+	expectPurge(116, 1)
+
+	purged, err := userService.PurgeDeletedUsers(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
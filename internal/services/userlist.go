@@ -0,0 +1,260 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+const (
+	defaultUsersPageSize = 20
+	defaultUsersSort     = "id"
+)
+
+var ErrInvalidCursor = &Error{Kind: ErrValidation, Code: "invalid_cursor", Message: "invalid cursor", Field: "cursor"}
+
+type sortKind int
+
+const (
+	sortInt sortKind = iota
+	sortString
+	sortTime
+)
+
+// userSortKey is a column users can be ordered by, ties are always broken by id
+type userSortKey struct {
+	column string
+	kind   sortKind
+	value  func(user pkg.User) string
+}
+
+var userSortKeys = map[string]userSortKey{
+	"id": {"id", sortInt, func(user pkg.User) string {
+		return strconv.FormatUint(uint64(user.ID), 10)
+	}},
+	"username": {"username", sortString, func(user pkg.User) string {
+		return user.Username
+	}},
+	"email": {"email", sortString, func(user pkg.User) string {
+		return user.Email
+	}},
+	"age": {"age", sortInt, func(user pkg.User) string {
+		return strconv.Itoa(int(user.Age))
+	}},
+	"created_at": {"created_at", sortTime, func(user pkg.User) string {
+		return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}},
+	// users that never logged in sort as if they last logged in at the epoch so the keyset comparison stays total
+	"last_login_time_stamp": {"COALESCE(last_login_time_stamp, '1970-01-01 00:00:00')", sortTime, func(user pkg.User) string {
+		if !user.LastLoginTimeStamp.Valid {
+			return time.Unix(0, 0).UTC().Format(time.RFC3339Nano)
+		}
+		return user.LastLoginTimeStamp.Time.UTC().Format(time.RFC3339Nano)
+	}},
+}
+
+// usersCursor marks the last row of a page, the sort is kept so a cursor can't be replayed against another ordering
+type usersCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+// ListUsers returns a single page of users matching the filters passed along with the cursor of the next page
+func (service *UserService) ListUsers(req api.ListUsersRequest) ([]api.User, *api.Pagination, error) {
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultUsersPageSize
+	}
+
+	sort := req.Sort
+	if sort == "" {
+		sort = defaultUsersSort
+	}
+
+	descending := strings.HasPrefix(sort, "-")
+	key, ok := userSortKeys[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown sort key %s", sort)
+	}
+
+	// a bad cursor is turned away before it costs a count
+	var (
+		cursor *usersCursor
+		value  interface{}
+		err    error
+	)
+	if req.Cursor != "" {
+		if cursor, value, err = decodeUsersCursor(req.Cursor, sort, key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	query := service.filterUsers(req).Session(&gorm.Session{})
+
+	var total int64
+	if res := query.Count(&total); res.Error != nil {
+		service.logger.Error("something went wrong counting users", zap.Error(res.Error))
+		return nil, nil, res.Error
+	}
+
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	page := query
+	if cursor != nil {
+		page = page.Where(
+			fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND id %[2]s ?)", key.column, comparison),
+			value, value, cursor.ID,
+		)
+	}
+
+	var users []pkg.User
+
+	res := page.
+		Select("id", "first_name", "last_name", "email", "age", "username", "created_at", "updated_at", "deleted_at", "last_login_time_stamp").
+		Order(fmt.Sprintf("%s %s, id %s", key.column, direction, direction)).
+		Limit(limit + 1).
+		Find(&users)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting users", zap.Error(res.Error))
+		return nil, nil, res.Error
+	}
+
+	pagination := &api.Pagination{
+		Limit: limit,
+		Total: total,
+	}
+
+	// the extra row only tells us there's another page
+	if len(users) > limit {
+		users = users[:limit]
+		last := users[limit-1]
+		pagination.NextCursor = encodeUsersCursor(usersCursor{Sort: sort, Value: key.value(last), ID: last.ID})
+	}
+
+	response := make([]api.User, 0, len(users))
+	for _, user := range users {
+		response = append(response, toAPIUser(user))
+	}
+
+	service.logger.Debug("users grabbed", zap.Int("number", len(response)), zap.Int64("total", total))
+
+	return response, pagination, nil
+}
+
+// filterUsers applies every filter of the request except the cursor
+func (service *UserService) filterUsers(req api.ListUsersRequest) *gorm.DB {
+
+	query := service.DBConn.Model(&pkg.User{})
+
+	switch req.Deleted {
+	case "include":
+		query = query.Unscoped()
+	case "only":
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+
+	if req.Username != "" {
+		query = query.Where("username LIKE ?", escapeLike(req.Username)+"%")
+	}
+	if req.Email != "" {
+		query = query.Where("email LIKE ?", escapeLike(req.Email)+"%")
+	}
+	if req.MinAge > 0 {
+		query = query.Where("age >= ?", req.MinAge)
+	}
+	if req.MaxAge > 0 {
+		query = query.Where("age <= ?", req.MaxAge)
+	}
+	if !req.CreatedAfter.IsZero() {
+		query = query.Where("created_at >= ?", req.CreatedAfter)
+	}
+	if !req.CreatedBefore.IsZero() {
+		query = query.Where("created_at < ?", req.CreatedBefore)
+	}
+	if !req.LastLoginAfter.IsZero() {
+		query = query.Where("last_login_time_stamp >= ?", req.LastLoginAfter)
+	}
+	if !req.LastLoginBefore.IsZero() {
+		query = query.Where("last_login_time_stamp < ?", req.LastLoginBefore)
+	}
+
+	return query
+}
+
+func encodeUsersCursor(cursor usersCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeUsersCursor parses the cursor and converts its value to the type of the sort column
+func decodeUsersCursor(encoded, sort string, key userSortKey) (*usersCursor, interface{}, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	var cursor usersCursor
+	if err = json.Unmarshal(raw, &cursor); err != nil || cursor.Sort != sort {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	var value interface{}
+
+	switch key.kind {
+	case sortInt:
+		value, err = strconv.ParseInt(cursor.Value, 10, 64)
+	case sortTime:
+		value, err = time.Parse(time.RFC3339Nano, cursor.Value)
+	default:
+		value = cursor.Value
+	}
+	if err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	return &cursor, value, nil
+}
+
+// escapeLike stops user input from being treated as LIKE wildcards
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// toAPIUser converts the db row to the user returned by the api, the password is never included
+func toAPIUser(user pkg.User) api.User {
+
+	response := api.User{
+		ID:        strconv.Itoa(int(user.ID)),
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Age:       user.Age,
+		Email:     user.Email,
+		Username:  user.Username,
+		CreatedAT: user.CreatedAt.Format(time.RFC3339),
+		UpdatedAT: user.UpdatedAt.Format(time.RFC3339),
+	}
+
+	if user.LastLoginTimeStamp.Valid {
+		response.LastLoginTimeStamp = user.LastLoginTimeStamp.Time.Format(time.RFC3339)
+	}
+	if user.DeletedAt.Valid {
+		response.DeletedAT = user.DeletedAt.Time.Format(time.RFC3339)
+	}
+
+	return response
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+)
+
+func TestUserService_ListUsers(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	columns := []string{"id", "first_name", "last_name", "email", "age", "username", "created_at", "updated_at", "deleted_at", "last_login_time_stamp"}
+
+	sqlMock.ExpectQuery("SELECT count\\(\\*\\) FROM `users` WHERE username LIKE \\? AND age >= \\? AND `users`.`deleted_at` IS NULL").
+		WithArgs("jo\\_%", 18).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE .* ORDER BY created_at DESC, id DESC LIMIT 3").
+		WithArgs("jo\\_%", 18).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, "Jo", "C", "c@x.com", 30, "jo_c", created, created, nil, nil).
+			AddRow(2, "Jo", "B", "b@x.com", 20, "jo_b", created, created, nil, nil).
+			AddRow(1, "Jo", "A", "a@x.com", 19, "jo_a", created.Add(-time.Hour), created, nil, nil))
+
+	users, pagination, err := userService.ListUsers(api.ListUsersRequest{
+		Limit:    2,
+		Sort:     "-created_at",
+		Username: "jo_",
+		MinAge:   18,
+	})
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, int64(3), pagination.Total)
+	require.NotEmpty(t, pagination.NextCursor)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+
+	sqlMock.ExpectQuery("SELECT count\\(\\*\\) FROM `users`").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE .* AND \\(\\(created_at < \\?\\) OR \\(created_at = \\? AND id < \\?\\)\\) .* ORDER BY created_at DESC, id DESC LIMIT 3").
+		WithArgs("jo\\_%", 18, created, created, 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, "Jo", "A", "a@x.com", 19, "jo_a", created.Add(-time.Hour), created, nil, nil))
+
+	users, pagination, err = userService.ListUsers(api.ListUsersRequest{
+		Cursor:   pagination.NextCursor,
+		Limit:    2,
+		Sort:     "-created_at",
+		Username: "jo_",
+		MinAge:   18,
+	})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Empty(t, pagination.NextCursor)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+
+	t.Run("cursor from another sort is rejected", func(t *testing.T) {
+		cursor := encodeUsersCursor(usersCursor{Sort: "username", Value: "jo_b", ID: 2})
+
+		_, _, err := userService.ListUsers(api.ListUsersRequest{Cursor: cursor, Sort: "-created_at"})
+		require.ErrorIs(t, err, ErrInvalidCursor)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("garbage cursor doesn't touch the db", func(t *testing.T) {
+		_, _, err := userService.ListUsers(api.ListUsersRequest{Cursor: "not-a-cursor!"})
+		require.ErrorIs(t, err, ErrInvalidCursor)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
@@ -1,15 +1,13 @@
 package services
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
 	"errors"
-	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
-
-	"github.com/nats-io/nats.go"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 
@@ -19,140 +17,199 @@ import (
 )
 
 type UserService struct {
-	DBConn   *gorm.DB
-	Nats     *nats.Conn
-	logger   *zap.Logger
-	settings UserServiceSettings
+	DBConn     *gorm.DB
+	Auth       IAuthClient
+	Tokens     ITokenService
+	Verifier   IVerificationService
+	Limiter    ILoginLimiter
+	Hasher     utils.PasswordHasher
+	Passwords  *utils.PasswordPolicy
+	MFA        IMFAService
+	Passkeys   IWebAuthnService
+	Identities IIdentityService
+	Sessions   ISessionService
+	// PersonalTokens are revoked along with the sessions of the user
+	PersonalTokens IPersonalTokenService
+	logger         *zap.Logger
+	settings       UserServiceSettings
+
+	// dummyHash is compared against when the username doesn't exist so unknown users take as long to reject as wrong passwords
+	dummyHash string
 }
 
 // UserServiceSettings used to affect code flow
 type UserServiceSettings struct {
-	Port      int
-	Hostname  string
-	JWTSecret string
+	Port                     int
+	Hostname                 string
+	RequireEmailVerification bool
+	PasswordHistorySize      int
+	PasswordMaxAge           time.Duration
+	DeletionGracePeriod      time.Duration
+	PurgeBatchSize           int
 }
 
 type IUserService interface {
 	InsertUser(user api.NewUserRequest) (*api.User, error)
 	UpdateUser(req api.UpdateUserRequest) error
 	DeleteUser(req api.DeleteUserRequest) error
-	checkDuplicatePasswords(currentPass string) error
-	GetBasicUserDataList() ([]api.User, error)
+	RestoreUser(req api.RestoreUserRequest) error
+	PurgeDeletedUsers(ctx context.Context) (int, error)
+	checkNewPassword(pwd, username, email string) error
+	ListUsers(req api.ListUsersRequest) ([]api.User, *api.Pagination, error)
 	GetUserByUsername(username string) (*pkg.User, error)
 	GetUserByID(uID uint) (*api.User, error)
 	Login(request api.LoginRequest) (*api.LoginResponse, error)
+	CompleteMFALogin(request api.MFALoginRequest) (*api.LoginResponse, error)
+	PasskeyLogin(request api.FinishPasskeyLoginRequest) (*api.LoginResponse, error)
+	ExternalLogin(request api.FinishExternalLoginRequest) (*api.LoginResponse, error)
+	RefreshToken(request api.RefreshTokenRequest) (*api.LoginResponse, error)
+	Logout(request api.LogoutRequest) error
+	SetUserRoles(req api.UpdateUserRolesRequest) error
+	VerifyEmail(req api.VerifyEmailRequest) error
+	ResendVerification(req api.ResendVerificationRequest) error
+	ForgotPassword(req api.ForgotPasswordRequest) error
+	ResetPassword(req api.ResetPasswordRequest) error
 	getDBUserByID(uID uint) (*pkg.User, error)
+	checkUserAvailability(email, username string, excludeID uint) error
+	getUserRoles(uID uint) ([]pkg.Role, error)
+	checkPasswordReuse(user *pkg.User, pwd string) error
+	recordPassword(tx *gorm.DB, userID uint, hash string) error
 }
 
-func NewUserService(dbConn *gorm.DB, nc *nats.Conn, logger *zap.Logger, settings UserServiceSettings) *UserService {
+func NewUserService(dbConn *gorm.DB, tokens ITokenService, verifier IVerificationService, limiter ILoginLimiter,
+	hasher utils.PasswordHasher, passwords *utils.PasswordPolicy, mfa IMFAService, passkeys IWebAuthnService, identities IIdentityService,
+	sessions ISessionService, personalTokens IPersonalTokenService, auth IAuthClient, logger *zap.Logger, settings UserServiceSettings) *UserService {
+
+	dummyHash, err := hasher.Hash([]byte("not-a-real-password"))
+	if err != nil {
+		logger.Error("failed to hash dummy password", zap.Error(err))
+	}
+
 	return &UserService{
-		Nats:     nc,
-		DBConn:   dbConn,
-		logger:   logger,
-		settings: settings,
+		Auth:           auth,
+		DBConn:         dbConn,
+		Tokens:         tokens,
+		Verifier:       verifier,
+		Limiter:        limiter,
+		Hasher:         hasher,
+		Passwords:      passwords,
+		MFA:            mfa,
+		Passkeys:       passkeys,
+		Identities:     identities,
+		Sessions:       sessions,
+		PersonalTokens: personalTokens,
+		logger:         logger,
+		settings:       settings,
+		dummyHash:      dummyHash,
 	}
 }
 
 // InsertUser inserts new user in users table from data passed in arg.
 func (service *UserService) InsertUser(req api.NewUserRequest) (*api.User, error) {
 
-	// todo: create new method that checks the username straight away, avoid for loop
-	users, err := service.GetBasicUserDataList()
-	if err != nil {
+	if err := service.checkUserAvailability(req.Email, req.Username, 0); err != nil {
 		return nil, err
 	}
 
-	for _, user := range users {
-		if user.Email == req.Email {
-			return nil, errors.New("email already registered")
-		}
-		if user.Username == req.Username {
-			return nil, errors.New("username taken")
-		}
+	if err := service.checkNewPassword(req.Password, req.Username, req.Email); err != nil {
+		return nil, err
 	}
 
-	var encryptedPass string
+	encryptedPass, err := service.Auth.HashPassword(context.Background(), api.GeneratePasswordRequest{
+		Username:  req.Username,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Age:       req.Age,
+		Email:     req.Email,
+		Password:  req.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	if service.Nats != nil {
-		jsonGPR, err := json.Marshal(&api.GeneratePasswordRequest{
-			Username:  req.Username,
-			FirstName: req.FirstName,
-			LastName:  req.LastName,
-			Age:       req.Age,
-			Email:     req.Email,
-			Password:  req.Password,
-		})
-		if err != nil {
-			service.logger.Error("something went wrong marshalling request", zap.Any("req", req), zap.Error(err))
-			return nil, err
-		}
+	user := &pkg.User{
+		FirstName:         req.FirstName,
+		LastName:          req.LastName,
+		Username:          req.Username,
+		Email:             req.Email,
+		Age:               req.Age,
+		Password:          encryptedPass,
+		PasswordChangedAt: sql.NullTime{Time: service.DBConn.NowFunc(), Valid: true},
+	}
 
-		msg, err := service.Nats.Request(pkg.AuthGeneratePass, jsonGPR, 10*time.Second)
-		if err != nil {
-			service.logger.Error("couldn't get a response from auth service", zap.Any("req", jsonGPR), zap.Error(err))
-			return nil, err
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Select("first_name", "last_name", "email", "age", "username", "password", "password_changed_at").
+			Create(user)
+		if res.Error != nil {
+			service.logger.Error("something went wrong inserting user", zap.Any("user", user), zap.Error(res.Error))
+			return translateDuplicateKey(res.Error)
 		}
 
-		var gpResponse api.GeneratePasswordResponse
+		service.logger.Debug("rows inserted", zap.Int64("rowsAffected", res.RowsAffected))
 
-		if err = json.Unmarshal(msg.Data, &gpResponse); err != nil {
-			service.logger.Error("something went wrong unmarshalling response from auth service", zap.Any("msg", msg), zap.Error(err))
-			return nil, err
+		// every new account starts off as a plain user
+		res = tx.Create(&pkg.UserRole{UserID: user.ID, Role: pkg.RoleUser})
+		if res.Error != nil {
+			service.logger.Error("something went wrong assigning default role", zap.Uint("userID", user.ID), zap.Error(res.Error))
+			return res.Error
 		}
 
-		if gpResponse.Password == "" {
-			err = errors.New("empty pass")
-			service.logger.Error("missing pass from response", zap.Any("res", gpResponse), zap.Error(err))
-			return nil, err
-		}
-	} else {
-		encryptedPass, err = utils.HashAndSalt([]byte(req.Password))
-		if err != nil {
-			service.logger.Error("failed to encrypt pass", zap.Any("request", req), zap.Error(err))
-			return nil, err
+		if err := service.recordPassword(tx, user.ID, encryptedPass); err != nil {
+			return err
 		}
-	}
 
-	user := &pkg.User{
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
-		Username:  req.Username,
-		Email:     req.Email,
-		Age:       req.Age,
-		Password:  encryptedPass,
+		return enqueueEvent(tx, pkg.UserCreated, api.UserCreatedEvent{
+			UserID:    user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			CreatedAt: user.CreatedAt,
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	res := service.DBConn.
-		Select("first_name", "last_name", "email", "age", "username", "password").
-		Create(user)
-	if res.Error != nil {
-		service.logger.Error("something went wrong inserting user", zap.Any("user", user), zap.Error(res.Error))
-		return nil, res.Error
+	// the account exists either way, the user can ask for another email if this one doesn't make it
+	if err = service.Verifier.SendVerification(context.Background(), user.ID, user.Email); err != nil {
+		service.logger.Warn("couldn't send verification email", zap.Uint("userID", user.ID), zap.Error(err))
 	}
 
-	service.logger.Debug("rows inserted", zap.Int64("rowsAffected", res.RowsAffected))
-
 	req.User.ID = strconv.Itoa(int(user.ID))
 
 	return req.User, nil
 }
 
-func (service *UserService) GetBasicUserDataList() ([]api.User, error) {
+// checkUserAvailability looks up whether the email or username is already held by another user, soft deleted users included.
+// The unique indexes still have the final say when two requests race each other.
+func (service *UserService) checkUserAvailability(email, username string, excludeID uint) error {
 
-	var users []api.User
+	var taken []pkg.User
 
-	// Get all records
 	res := service.DBConn.
-		Select("id", "first_name", "last_name", "email", "age", "username").
-		Find(&users)
+		Unscoped().
+		Select("email", "username").
+		Where("(email = ? OR username = ?) AND id <> ?", email, username, excludeID).
+		Limit(2).
+		Find(&taken)
 	if res.Error != nil {
-		service.logger.Error("something went wrong getting all users", zap.Error(res.Error))
-		return nil, res.Error
+		service.logger.Error("something went wrong checking user availability", zap.Error(res.Error))
+		return res.Error
 	}
 
-	service.logger.Debug("users grabbed", zap.Int64("number", res.RowsAffected))
+	// compared like the default case insensitive collation of the columns
+	for _, user := range taken {
+		if strings.EqualFold(user.Email, email) {
+			return ErrEmailTaken
+		}
+		if strings.EqualFold(user.Username, username) {
+			return ErrUsernameTaken
+		}
+	}
 
-	return users, nil
+	return nil
 }
 
 // GetUserByUsername attempts to retrieve a single row from the users table.
@@ -161,10 +218,12 @@ func (service *UserService) GetUserByUsername(username string) (*pkg.User, error
 	var user pkg.User
 	// Get all records
 	res := service.DBConn.
-		Select("id", "first_name", "last_name", "email", "age", "username", "password", "created_at", "updated_at", "last_login_time_stamp").
+		Select("id", "first_name", "last_name", "email", "age", "username", "password", "created_at", "updated_at", "last_login_time_stamp", "email_verified_at", "password_changed_at").
 		Where("username = ?", username).
 		First(&user)
-	if res.Error != nil {
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if res.Error != nil {
 		service.logger.Error("something went wrong getting user by username", zap.Error(res.Error), zap.String("username", username))
 		return nil, res.Error
 	}
@@ -179,10 +238,12 @@ func (service *UserService) getDBUserByID(uID uint) (*pkg.User, error) {
 	var user pkg.User
 	// Get all records
 	res := service.DBConn.
-		Select("id", "first_name", "last_name", "email", "age", "username", "password", "created_at", "updated_at", "last_login_time_stamp").
+		Select("id", "first_name", "last_name", "email", "age", "username", "password", "created_at", "updated_at", "last_login_time_stamp", "email_verified_at", "password_changed_at").
 		Where("id = ?", uID).
 		First(&user)
-	if res.Error != nil {
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if res.Error != nil {
 		service.logger.Error("something went wrong getting user by ID", zap.Error(res.Error))
 		return nil, res.Error
 	}
@@ -200,77 +261,569 @@ func (service *UserService) GetUserByID(uID uint) (*api.User, error) {
 		return nil, err
 	}
 
-	response := &api.User{
-		ID:                 strconv.Itoa(int(user.ID)),
-		FirstName:          user.FirstName,
-		LastName:           user.LastName,
-		Age:                user.Age,
-		Email:              user.Email,
-		Username:           user.Username,
-		CreatedAT:          user.CreatedAt.Format(time.RFC3339),
-		UpdatedAT:          user.UpdatedAt.Format(time.RFC3339),
-		LastLoginTimeStamp: user.LastLoginTimeStamp.Time.Format(time.RFC3339),
+	roles, err := service.getUserRoles(uID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := toAPIUser(*user)
+	response.Roles = roles
+
+	return &response, nil
+}
+
+// getUserRoles grabs all the roles assigned to a user
+func (service *UserService) getUserRoles(uID uint) ([]pkg.Role, error) {
+
+	var roles []pkg.Role
+
+	res := service.DBConn.
+		Model(&pkg.UserRole{}).
+		Where("user_id = ?", uID).
+		Order("role").
+		Pluck("role", &roles)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting user roles", zap.Uint("userID", uID), zap.Error(res.Error))
+		return nil, res.Error
 	}
 
-	return response, nil
+	return roles, nil
 }
 
-// Login is a wrapper for the GetUserByUsername that also validates the password
+// SetUserRoles replaces the roles of a user, tokens already issued are revoked so they can't carry stale roles
+func (service *UserService) SetUserRoles(req api.UpdateUserRolesRequest) error {
+
+	user, err := service.getDBUserByID(req.ID)
+	if err != nil {
+		return err
+	}
+
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", req.ID).Delete(&pkg.UserRole{}); res.Error != nil {
+			service.logger.Error("something went wrong clearing user roles", zap.Uint("userID", req.ID), zap.Error(res.Error))
+			return res.Error
+		}
+
+		userRoles := make([]pkg.UserRole, 0, len(req.Roles))
+		for _, role := range req.Roles {
+			userRoles = append(userRoles, pkg.UserRole{UserID: req.ID, Role: role})
+		}
+
+		if res := tx.Create(&userRoles); res.Error != nil {
+			service.logger.Error("something went wrong assigning user roles", zap.Uint("userID", req.ID), zap.Error(res.Error))
+			return res.Error
+		}
+
+		return enqueueEvent(tx, pkg.UserUpdated, api.UserUpdatedEvent{
+			UserID:    user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Age:       user.Age,
+			Roles:     req.Roles,
+			UpdatedAt: service.DBConn.NowFunc(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// personal access tokens only ever act with the roles the user still holds, so they're kept
+	return service.signOutUser(context.Background(), req.ID)
+}
+
+// tokenSubject loads what gets embedded in the tokens of a user, failing if the user no longer exists
+func (service *UserService) tokenSubject(uID uint) (*TokenSubject, error) {
+
+	if _, err := service.getDBUserByID(uID); err != nil {
+		return nil, err
+	}
+
+	roles, err := service.getUserRoles(uID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenSubject{UserID: uID, Roles: roles}, nil
+}
+
+// Login is a wrapper for the GetUserByUsername that also validates the password.
+// Unknown usernames and wrong passwords fail the same way and both count towards the lockout of the username.
 func (service *UserService) Login(request api.LoginRequest) (*api.LoginResponse, error) {
 
+	ctx := context.Background()
+
+	if err := service.Limiter.Allow(ctx, request.IP, request.Username); err != nil {
+		return nil, err
+	}
+
 	user, err := service.GetUserByUsername(request.Username)
-	if err != nil {
+	if errors.Is(err, ErrNotFound) {
+		_, _ = utils.ComparePasswords(service.dummyHash, []byte(request.Password))
+		return nil, service.loginFailed(ctx, request.Username)
+	} else if err != nil {
 		return nil, err
 	}
 
+	// accounts created through an external provider have no password until one is set with a reset
+	if user.Password == "" {
+		_, _ = utils.ComparePasswords(service.dummyHash, []byte(request.Password))
+		return nil, service.loginFailed(ctx, request.Username)
+	}
+
 	isSame, err := utils.ComparePasswords(user.Password, []byte(request.Password))
 	if err != nil {
 		service.logger.Error("something went wrong comparing the passwords", zap.Error(err))
 		return nil, err
 	} else if !isSame {
-		service.logger.Error("passwords don't match", zap.Any("req pass", request.Password))
-		return nil, fmt.Errorf("passwords don't match")
+		return nil, service.loginFailed(ctx, request.Username)
+	}
+
+	if service.Hasher.NeedsRehash(user.Password) {
+		service.rehashPassword(user, []byte(request.Password))
 	}
 
-	// save userID in jwt token for requests
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID,
-		"exp": time.Now().Add(time.Hour).Unix(),
+	res, err := service.finishLogin(ctx, user, api.ClientInfo{IP: request.IP, UserAgent: request.UserAgent})
+	if err != nil {
+		return nil, err
+	}
+
+	// a login held back for a second factor keeps its failures until CompleteMFALogin, so fresh challenges can't
+	// be used to guess codes without ever locking the account
+	if !res.MFARequired {
+		if err = service.Limiter.RecordSuccess(ctx, request.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// finishLogin holds back the tokens of a user whose first factor checked out until their email is verified
+// and, when they have two factor authentication on, until the second factor checks out too
+func (service *UserService) finishLogin(ctx context.Context, user *pkg.User, client api.ClientInfo) (*api.LoginResponse, error) {
+
+	if service.settings.RequireEmailVerification && !user.EmailVerifiedAt.Valid {
+		return nil, ErrEmailNotVerified
+	}
+
+	mfaEnabled, err := service.MFA.TOTPEnabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mfaEnabled {
+		mfaToken, err := service.MFA.CreateChallenge(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &api.LoginResponse{MFARequired: true, MFAToken: mfaToken}, nil
+	}
+
+	return service.issueLoginTokens(ctx, user, client)
+}
+
+// CompleteMFALogin finishes a login that Login held back for a second factor, wrong codes count towards the
+// lockout of the username like wrong passwords
+func (service *UserService) CompleteMFALogin(request api.MFALoginRequest) (*api.LoginResponse, error) {
+
+	ctx := context.Background()
+
+	userID, verifyErr := service.MFA.VerifyChallenge(ctx, request)
+	if verifyErr != nil && !errors.Is(verifyErr, ErrInvalidMFACode) {
+		return nil, verifyErr
+	}
+
+	user, err := service.getDBUserByID(userID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	} else if err != nil {
+		return nil, err
+	}
+
+	if verifyErr != nil {
+		service.logger.Info("failed mfa login", zap.String("username", user.Username))
+
+		if err = service.Limiter.RecordFailure(ctx, user.Username); err != nil {
+			return nil, err
+		}
+
+		return nil, verifyErr
+	}
+
+	if err = service.Limiter.RecordSuccess(ctx, user.Username); err != nil {
+		return nil, err
+	}
+
+	return service.issueLoginTokens(ctx, user, request.Client)
+}
+
+// PasskeyLogin logs in with a passkey instead of a password. The authenticator already verified the user
+// so no second factor is asked for, the email still has to be verified like in Login.
+func (service *UserService) PasskeyLogin(request api.FinishPasskeyLoginRequest) (*api.LoginResponse, error) {
+
+	ctx := context.Background()
+
+	userID, err := service.Passkeys.FinishLogin(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := service.getDBUserByID(userID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidPasskey
+	} else if err != nil {
+		return nil, err
+	}
+
+	if service.settings.RequireEmailVerification && !user.EmailVerifiedAt.Valid {
+		return nil, ErrEmailNotVerified
+	}
+
+	return service.issueLoginTokens(ctx, user, request.Client)
+}
+
+// ExternalLogin logs in with the external identity provider. The first login of an identity that isn't linked yet
+// creates the user for it, unless the email is already used by an account, which has to link the provider itself
+// so nobody takes over an account by registering its email with the provider. A second factor is still asked for.
+func (service *UserService) ExternalLogin(request api.FinishExternalLoginRequest) (*api.LoginResponse, error) {
+
+	ctx := context.Background()
+
+	// only a login can be finished here, linking goes through the identities of the logged-in user
+	request.UserID = 0
+
+	identity, err := service.Identities.Exchange(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := service.Identities.FindUser(identity)
+	if errors.Is(err, ErrIdentityNotFound) {
+		userID, err = service.provisionExternalUser(ctx, identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := service.getDBUserByID(userID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidExternalLogin
+	} else if err != nil {
+		return nil, err
+	}
+
+	return service.finishLogin(ctx, user, request.Client)
+}
+
+// provisionExternalUser creates a user without a password for an identity seen for the first time and links it
+func (service *UserService) provisionExternalUser(ctx context.Context, identity *ExternalIdentity) (uint, error) {
+
+	if identity.Email == "" {
+		return 0, ErrExternalEmailMissing
+	}
+
+	username, err := service.externalUsername(identity)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = service.checkUserAvailability(identity.Email, username, 0); errors.Is(err, ErrEmailTaken) {
+		return 0, ErrExternalEmailTaken
+	} else if err != nil {
+		return 0, err
+	}
+
+	user := &pkg.User{
+		FirstName: identity.GivenName,
+		LastName:  identity.FamilyName,
+		Username:  username,
+		Email:     identity.Email,
+	}
+
+	// the provider vouches for the email, there's no need to send a verification email
+	if identity.EmailVerified {
+		user.EmailVerifiedAt = sql.NullTime{Time: service.DBConn.NowFunc(), Valid: true}
+	}
+
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Select("first_name", "last_name", "email", "username", "password", "email_verified_at").
+			Create(user)
+		if res.Error != nil {
+			service.logger.Error("something went wrong inserting external user", zap.String("provider", identity.Provider), zap.Error(res.Error))
+			return translateDuplicateKey(res.Error)
+		}
+
+		res = tx.Create(&pkg.UserRole{UserID: user.ID, Role: pkg.RoleUser})
+		if res.Error != nil {
+			service.logger.Error("something went wrong assigning default role", zap.Uint("userID", user.ID), zap.Error(res.Error))
+			return res.Error
+		}
+
+		res = tx.Create(&pkg.Identity{
+			UserID:      user.ID,
+			Provider:    identity.Provider,
+			Subject:     identity.Subject,
+			Email:       identity.Email,
+			LastLoginAt: sql.NullTime{Time: service.DBConn.NowFunc(), Valid: true},
+		})
+		if res.Error != nil {
+			service.logger.Error("something went wrong linking identity", zap.Uint("userID", user.ID), zap.Error(res.Error))
+			return translateDuplicateKey(res.Error)
+		}
+
+		return enqueueEvent(tx, pkg.UserCreated, api.UserCreatedEvent{
+			UserID:    user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			CreatedAt: user.CreatedAt,
+		})
 	})
+	if errors.Is(err, ErrEmailTaken) {
+		return 0, ErrExternalEmailTaken
+	} else if err != nil {
+		return 0, err
+	}
+
+	service.logger.Info("provisioned user from external identity", zap.Uint("userID", user.ID), zap.String("provider", identity.Provider))
+
+	if !identity.EmailVerified {
+		if err = service.Verifier.SendVerification(ctx, user.ID, user.Email); err != nil {
+			service.logger.Warn("couldn't send verification email", zap.Uint("userID", user.ID), zap.Error(err))
+		}
+	}
+
+	return user.ID, nil
+}
+
+// externalUsername picks a free username for a provisioned user from their preferred username or the local part
+// of their email, a random suffix is added when it's taken
+func (service *UserService) externalUsername(identity *ExternalIdentity) (string, error) {
+
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	base = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "player"
+	}
+	if len(base) > 32 {
+		base = base[:32]
+	}
+
+	username := base
+	for i := 0; i < 5; i++ {
+		var taken int64
+
+		res := service.DBConn.Unscoped().Model(&pkg.User{}).Where("username = ?", username).Count(&taken)
+		if res.Error != nil {
+			service.logger.Error("something went wrong checking username", zap.Error(res.Error))
+			return "", res.Error
+		}
+
+		if taken == 0 {
+			return username, nil
+		}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(service.settings.JWTSecret))
+		suffix, err := utils.RandomToken(2)
+		if err != nil {
+			return "", err
+		}
+
+		username = base + "-" + suffix
+	}
+
+	return "", ErrUsernameTaken
+}
+
+// issueLoginTokens hands out the token pair of a user that got through every login check and records the login
+// along with the session it starts on the client
+func (service *UserService) issueLoginTokens(ctx context.Context, user *pkg.User, client api.ClientInfo) (*api.LoginResponse, error) {
+
+	roles, err := service.getUserRoles(user.ID)
 	if err != nil {
-		service.logger.Error("failed to create token", zap.Error(err))
 		return nil, err
 	}
 
+	tokens, err := service.Tokens.IssueTokenPair(ctx, TokenSubject{UserID: user.ID, Roles: roles})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = service.Sessions.CreateSession(ctx, user.ID, tokens.SessionID, client); err != nil {
+		// the tokens are never handed out, their family shouldn't linger either
+		if _, revokeErr := service.Tokens.RevokeRefreshFamily(ctx, tokens.RefreshToken); revokeErr != nil {
+			service.logger.Warn("failed to revoke refresh family of unrecorded session", zap.Error(revokeErr))
+		}
+		return nil, err
+	}
+
+	tokens.PasswordChangeRequired = service.passwordExpired(user)
+
 	unixCT := service.DBConn.NowFunc()
 
 	fieldsToUpdate := map[string]interface{}{"last_login_time_stamp": unixCT}
 
-	// update record with login timestamp
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		// update record with login timestamp
+		res := tx.
+			Table("users").
+			Where("id = ?", user.ID).
+			Updates(fieldsToUpdate)
+		if res.Error != nil {
+			service.logger.Error("something went wrong updating a user", zap.Error(res.Error))
+			return res.Error
+		}
+
+		return enqueueEvent(tx, pkg.UserLoggedIn, api.UserLoggedInEvent{
+			UserID:     user.ID,
+			SessionID:  tokens.SessionID,
+			IP:         client.IP,
+			LoggedInAt: unixCT,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// rehashPassword upgrades the stored hash to the current policy now that the plain password is known.
+// Failing to do so isn't worth failing the login over, it'll be tried again next time.
+func (service *UserService) rehashPassword(user *pkg.User, plainPwd []byte) {
+
+	encryptedPass, err := service.Hasher.Hash(plainPwd)
+	if err != nil {
+		service.logger.Error("failed to rehash password", zap.Uint("userID", user.ID), zap.Error(err))
+		return
+	}
+
+	// the password is only replaced if it wasn't changed in the meantime
 	res := service.DBConn.
 		Table("users").
-		Where("id = ?", user.ID).
-		Updates(fieldsToUpdate)
+		Where("id = ? AND password = ?", user.ID, user.Password).
+		Update("password", encryptedPass)
 	if res.Error != nil {
-		service.logger.Error("something went wrong updating a user", zap.Error(res.Error))
-		return nil, res.Error
+		service.logger.Error("failed to store rehashed password", zap.Uint("userID", user.ID), zap.Error(res.Error))
+		return
 	}
 
-	return &api.LoginResponse{
-		Token: tokenString,
-	}, nil
+	service.logger.Info("password rehashed", zap.Uint("userID", user.ID))
 }
 
-func (service *UserService) checkDuplicatePasswords(currentPass string) error {
+// loginFailed counts the failure against the username and returns the uniform login error
+func (service *UserService) loginFailed(ctx context.Context, username string) error {
 
-	res := service.DBConn.Select("password").Where("password = ?", currentPass)
+	service.logger.Info("failed login", zap.String("username", username))
 
-	if res.Error != nil && res.Error != gorm.ErrRecordNotFound {
-		service.logger.Error("something went wrong getting password", zap.Error(res.Error), zap.String("password", currentPass))
-		return res.Error
+	if err := service.Limiter.RecordFailure(ctx, username); err != nil {
+		return err
+	}
+
+	return ErrInvalidLogin
+}
+
+// RefreshToken rotates the refresh token passed and returns a new access/refresh pair, extending its session
+func (service *UserService) RefreshToken(request api.RefreshTokenRequest) (*api.LoginResponse, error) {
+
+	ctx := context.Background()
+
+	tokens, err := service.Tokens.RotateRefreshToken(ctx, request.RefreshToken, service.tokenSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = service.Sessions.TouchSession(ctx, tokens.SessionID); err != nil {
+		// the session was signed out while its family survived, it mustn't be refreshed again
+		if _, revokeErr := service.Tokens.RevokeRefreshFamily(ctx, tokens.RefreshToken); revokeErr != nil {
+			service.logger.Warn("failed to revoke refresh family of signed out session", zap.Error(revokeErr))
+		}
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Logout revokes the refresh token family so none of its refresh tokens can be used again and ends its session
+func (service *UserService) Logout(request api.LogoutRequest) error {
+
+	ctx := context.Background()
+
+	sessionID, err := service.Tokens.RevokeRefreshFamily(ctx, request.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	return service.Sessions.EndSession(ctx, sessionID)
+}
+
+// revokeUserSessions signs the user out everywhere, every token they hold is revoked along with their sessions
+// and personal access tokens
+func (service *UserService) revokeUserSessions(ctx context.Context, userID uint) error {
+
+	if err := service.signOutUser(ctx, userID); err != nil {
+		return err
+	}
+
+	return service.PersonalTokens.RevokeUserTokens(ctx, userID)
+}
+
+// signOutUser revokes the access tokens and sessions of the user, their personal access tokens are kept
+func (service *UserService) signOutUser(ctx context.Context, userID uint) error {
+
+	if err := service.Tokens.RevokeUserTokens(ctx, userID); err != nil {
+		return err
+	}
+
+	_, err := service.Sessions.RevokeSessions(ctx, userID, "")
+
+	return err
+}
+
+// checkNewPassword enforces the password policy and rejects passwords known to have leaked in a breach
+func (service *UserService) checkNewPassword(pwd, username, email string) error {
+
+	if violations := service.Passwords.Check(pwd, username, email); len(violations) > 0 {
+		return NewFieldError("password", strings.Join(violations, ", "))
+	}
+
+	breached, err := service.Passwords.IsBreached(pwd)
+	if err != nil {
+		service.logger.Error("something went wrong checking breached passwords", zap.Error(err))
+		return err
+	} else if breached {
+		return ErrBreachedPassword
+	}
+
+	return nil
+}
+
+// checkCurrentPassword makes sure pwd is the password the user has now
+func (service *UserService) checkCurrentPassword(user *pkg.User, pwd string) error {
+
+	isSame, err := utils.ComparePasswords(user.Password, []byte(pwd))
+	if err != nil {
+		service.logger.Error("something went wrong comparing the passwords", zap.Error(err))
+		return err
+	} else if !isSame {
+		service.logger.Error("passwords don't match", zap.Uint("userID", user.ID))
+		return ErrPasswordMismatch
 	}
 
 	return nil
@@ -283,6 +836,12 @@ func (service *UserService) UpdateUser(req api.UpdateUserRequest) error {
 		return err
 	}
 
+	if user.Email != req.Email || user.Username != req.Username {
+		if err = service.checkUserAvailability(req.Email, req.Username, user.ID); err != nil {
+			return err
+		}
+	}
+
 	fieldDataMap := map[string]interface{}{
 		"first_name": req.FirstName,
 		"last_name":  req.LastName,
@@ -291,61 +850,304 @@ func (service *UserService) UpdateUser(req api.UpdateUserRequest) error {
 		"age":        req.Age,
 	}
 
+	// a new address has to be verified again
+	emailChanged := !strings.EqualFold(user.Email, req.Email)
+	if emailChanged {
+		fieldDataMap["email_verified_at"] = nil
+	}
+
+	// a new address is all a password reset needs to take over the account, so owners have to prove they know
+	// their password. Admins changing it for someone else and users without a password can't.
+	if emailChanged && req.Self && user.Password != "" {
+		if req.OldPassword == "" {
+			return ErrPasswordRequired
+		}
+
+		if err = service.checkCurrentPassword(user, req.OldPassword); err != nil {
+			return err
+		}
+	}
+
+	var encryptedPass string
+
 	if req.OldPassword != "" && req.NewPassword != "" {
 
-		isSame, err := utils.ComparePasswords(user.Password, []byte(req.OldPassword))
-		if err != nil {
-			service.logger.Error("something went wrong comparing the passwords", zap.Error(err))
+		if err = service.checkCurrentPassword(user, req.OldPassword); err != nil {
 			return err
-		} else if !isSame {
-			service.logger.Error("passwords don't match", zap.Any("req pass", req.OldPassword))
-			return fmt.Errorf("passwords don't match")
 		}
 
-		if err = service.checkDuplicatePasswords(req.NewPassword); err != nil {
-			service.logger.Error("password is taken", zap.Error(err), zap.String("password", req.NewPassword))
+		if err = service.checkNewPassword(req.NewPassword, req.Username, req.Email); err != nil {
 			return err
 		}
 
-		encryptedPass, err := utils.HashAndSalt([]byte(req.NewPassword))
+		if err = service.checkPasswordReuse(user, req.NewPassword); err != nil {
+			return err
+		}
+
+		encryptedPass, err = service.Hasher.Hash([]byte(req.NewPassword))
 		if err != nil {
 			service.logger.Error("something went wrong encrypting the new password", zap.Error(err))
 			return err
 		}
 
 		fieldDataMap["password"] = encryptedPass
+		fieldDataMap["password_changed_at"] = service.DBConn.NowFunc()
+	}
+
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Table("users").
+			Where("id = ?", user.ID).
+			Updates(fieldDataMap)
+		if res.Error != nil {
+			service.logger.Error("something went wrong updating a user", zap.Error(res.Error))
+			return translateDuplicateKey(res.Error)
+		}
+
+		if encryptedPass != "" {
+			if err := service.recordPassword(tx, user.ID, encryptedPass); err != nil {
+				return err
+			}
+		}
+
+		return enqueueEvent(tx, pkg.UserUpdated, api.UserUpdatedEvent{
+			UserID:          user.ID,
+			Username:        req.Username,
+			Email:           req.Email,
+			FirstName:       req.FirstName,
+			LastName:        req.LastName,
+			Age:             req.Age,
+			PasswordChanged: encryptedPass != "",
+			UpdatedAt:       service.DBConn.NowFunc(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// tokens issued with the old password shouldn't outlive it
+	if encryptedPass != "" {
+		if err = service.revokeUserSessions(context.Background(), user.ID); err != nil {
+			return err
+		}
+	}
+
+	if emailChanged {
+		if err = service.Verifier.SendVerification(context.Background(), user.ID, req.Email); err != nil {
+			service.logger.Warn("couldn't send verification email", zap.Uint("userID", user.ID), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// VerifyEmail redeems a verification token, the address it was sent to has to still be the user's
+func (service *UserService) VerifyEmail(req api.VerifyEmailRequest) error {
+
+	userID, email, err := service.Verifier.ConsumeVerificationToken(context.Background(), req.Token)
+	if err != nil {
+		return err
+	}
+
+	user, err := service.getDBUserByID(userID)
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidVerificationToken
+	} else if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(user.Email, email) {
+		return ErrInvalidVerificationToken
 	}
 
-	// update record with login timestamp
 	res := service.DBConn.
 		Table("users").
-		Where("id = ?", user.ID).
-		Updates(fieldDataMap)
+		Where("id = ? AND email_verified_at IS NULL", user.ID).
+		Update("email_verified_at", service.DBConn.NowFunc())
 	if res.Error != nil {
-		service.logger.Error("something went wrong updating a user", zap.Error(res.Error))
+		service.logger.Error("something went wrong verifying email", zap.Uint("userID", user.ID), zap.Error(res.Error))
 		return res.Error
 	}
 
 	return nil
 }
 
-func (service *UserService) DeleteUser(req api.DeleteUserRequest) error {
+// ResendVerification sends a new verification email. Unknown and already verified addresses are ignored and
+// failing to send is only logged, so the endpoint can't be used to find out which emails are registered.
+func (service *UserService) ResendVerification(req api.ResendVerificationRequest) error {
 
-	var tx *gorm.DB
+	if err := service.Limiter.AllowEmail(context.Background(), req.IP, req.Email); err != nil {
+		return err
+	}
 
-	if req.HardDelete {
-		tx = service.DBConn.Unscoped()
-	} else {
-		// updates record with deleted_at timestamp
-		tx = service.DBConn
+	user, err := service.getDBUserByEmail(req.Email)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	res := tx.Table("users").Where("id = ?", req.ID).Delete(&pkg.User{Model: gorm.Model{ID: req.ID}})
+	if user.EmailVerifiedAt.Valid {
+		return nil
+	}
 
-	if res.Error != nil {
-		service.logger.Error("something went wrong deleting a user", zap.Error(res.Error))
-		return res.Error
+	if err = service.Verifier.SendVerification(context.Background(), user.ID, user.Email); err != nil {
+		service.logger.Warn("couldn't send verification email", zap.Uint("userID", user.ID), zap.Error(err))
+	}
+
+	return nil
+}
+
+// ForgotPassword mails a reset token to the user, unknown addresses are ignored like in ResendVerification.
+// Failing to send is only logged, answering differently for registered addresses would give them away.
+func (service *UserService) ForgotPassword(req api.ForgotPasswordRequest) error {
+
+	if err := service.Limiter.AllowEmail(context.Background(), req.IP, req.Email); err != nil {
+		return err
+	}
+
+	user, err := service.getDBUserByEmail(req.Email)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = service.Verifier.SendPasswordReset(context.Background(), user.ID, user.Email); err != nil {
+		service.logger.Error("couldn't send password reset email", zap.Uint("userID", user.ID), zap.Error(err))
 	}
 
 	return nil
 }
+
+// ResetPassword redeems a reset token and sets the new password, every session of the user is revoked
+func (service *UserService) ResetPassword(req api.ResetPasswordRequest) error {
+
+	ctx := context.Background()
+
+	userID, err := service.Verifier.PasswordResetUser(ctx, req.Token)
+	if err != nil {
+		return err
+	}
+
+	user, err := service.getDBUserByID(userID)
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidResetToken
+	} else if err != nil {
+		return err
+	}
+
+	// a password the policy turns down or that was used before leaves the token to try again with
+	if err = service.checkNewPassword(req.Password, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	if err = service.checkPasswordReuse(user, req.Password); err != nil {
+		return err
+	}
+
+	// redeemed only now, a concurrent reset with the same token gets turned away here
+	if userID, err = service.Verifier.ConsumePasswordResetToken(ctx, req.Token); err != nil {
+		return err
+	} else if userID != user.ID {
+		return ErrInvalidResetToken
+	}
+
+	encryptedPass, err := service.Hasher.Hash([]byte(req.Password))
+	if err != nil {
+		service.logger.Error("something went wrong encrypting the new password", zap.Error(err))
+		return err
+	}
+
+	resetAt := service.DBConn.NowFunc()
+
+	err = service.DBConn.Transaction(func(tx *gorm.DB) error {
+		res := tx.
+			Table("users").
+			Where("id = ?", user.ID).
+			Updates(map[string]interface{}{"password": encryptedPass, "password_changed_at": resetAt, "updated_at": resetAt})
+		if res.Error != nil {
+			service.logger.Error("something went wrong resetting password", zap.Uint("userID", user.ID), zap.Error(res.Error))
+			return res.Error
+		}
+
+		if err := service.recordPassword(tx, user.ID, encryptedPass); err != nil {
+			return err
+		}
+
+		return enqueueEvent(tx, pkg.UserPasswordReset, api.PasswordResetEvent{UserID: user.ID, Email: user.Email, ResetAt: resetAt})
+	})
+	if err != nil {
+		return err
+	}
+
+	return service.revokeUserSessions(ctx, user.ID)
+}
+
+// getDBUserByEmail looks up a user by email, only the id, email and verification state are loaded
+func (service *UserService) getDBUserByEmail(email string) (*pkg.User, error) {
+
+	var user pkg.User
+
+	res := service.DBConn.
+		Select("id", "email", "email_verified_at").
+		Where("email = ?", email).
+		First(&user)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting user by email", zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return &user, nil
+}
+
+// DeleteUser soft deletes the user, who can be restored until purged after the grace period, or hard deletes it straight away
+func (service *UserService) DeleteUser(req api.DeleteUserRequest) error {
+
+	// signed out first, a hard delete takes the sessions with it and would leave them cached
+	if err := service.revokeUserSessions(context.Background(), req.ID); err != nil {
+		return err
+	}
+
+	deletedAt := service.DBConn.NowFunc()
+
+	return service.DBConn.Transaction(func(tx *gorm.DB) error {
+		// a soft delete updates the record with the deleted_at timestamp
+		deleteTx := tx
+		if req.HardDelete {
+			deleteTx = tx.Unscoped()
+		}
+
+		res := deleteTx.Table("users").Where("id = ?", req.ID).Delete(&pkg.User{Model: gorm.Model{ID: req.ID}})
+
+		if res.Error != nil {
+			service.logger.Error("something went wrong deleting a user", zap.Error(res.Error))
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+
+		if req.HardDelete {
+			if err := dropUserEvents(tx, req.ID); err != nil {
+				service.logger.Error("something went wrong dropping events of deleted user", zap.Uint("userID", req.ID), zap.Error(err))
+				return err
+			}
+
+			return enqueueEvent(tx, pkg.UserPurged, api.UserPurgedEvent{UserID: req.ID, PurgedAt: deletedAt})
+		}
+
+		event := api.UserDeletedEvent{UserID: req.ID, DeletedAt: deletedAt}
+
+		// without a grace period the purge job doesn't run and the user stays restorable
+		if service.settings.DeletionGracePeriod > 0 {
+			purgeAt := deletedAt.Add(service.settings.DeletionGracePeriod)
+			event.PurgeAt = &purgeAt
+		}
+
+		return enqueueEvent(tx, pkg.UserDeleted, event)
+	})
+}
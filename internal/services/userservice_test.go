@@ -1,13 +1,21 @@
 package services
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/magiconair/properties/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/mailer"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
 )
 
 type genericTestCase struct {
@@ -19,6 +27,7 @@ type InsertUserTest struct {
 	genericTestCase
 	Input          api.NewUserRequest
 	ExpectedResult *api.User
+	ExpectedErrIs  error
 	SqlMock        func(test InsertUserTest) bool
 	SqlMockRows    *sqlmock.Rows
 }
@@ -38,6 +47,70 @@ func TestUserService_InsertUser(t *testing.T) {
 				return false
 			},
 		},
+		{
+			genericTestCase: genericTestCase{
+				Name:        "Email already registered",
+				ExpectedErr: true,
+			},
+			Input: api.NewUserRequest{
+				User: &api.User{Email: "alexanderm1496@gmail.com", Username: "alexm1496"},
+			},
+			ExpectedErrIs: ErrEmailTaken,
+			SqlMock: func(test InsertUserTest) bool {
+				sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE \\(email = \\? OR username = \\?\\) AND id <> \\? LIMIT 2").
+					WithArgs(test.Input.Email, test.Input.Username, 0).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "username"}).AddRow("Alexanderm1496@gmail.com", "someoneelse"))
+				return true
+			},
+		},
+		{
+			genericTestCase: genericTestCase{
+				Name:        "Username taken",
+				ExpectedErr: true,
+			},
+			Input: api.NewUserRequest{
+				User: &api.User{Email: "alexanderm1496@gmail.com", Username: "alexm1496"},
+			},
+			ExpectedErrIs: ErrUsernameTaken,
+			SqlMock: func(test InsertUserTest) bool {
+				sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE").
+					WithArgs(test.Input.Email, test.Input.Username, 0).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "username"}).AddRow("someone@gmail.com", "alexm1496"))
+				return true
+			},
+		},
+		{
+			genericTestCase: genericTestCase{
+				Name:        "Weak password",
+				ExpectedErr: true,
+			},
+			Input: api.NewUserRequest{
+				User: &api.User{Email: "alexanderm1496@gmail.com", Username: "alexm1496", Password: "alexm1496!"},
+			},
+			ExpectedErrIs: ErrValidation,
+			SqlMock: func(test InsertUserTest) bool {
+				sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE").
+					WithArgs(test.Input.Email, test.Input.Username, 0).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "username"}))
+				return true
+			},
+		},
+		{
+			genericTestCase: genericTestCase{
+				Name:        "Breached password",
+				ExpectedErr: true,
+			},
+			Input: api.NewUserRequest{
+				User: &api.User{Email: "alexanderm1496@gmail.com", Username: "alexm1496", Password: "Leaked-Sunrise-2931"},
+			},
+			ExpectedErrIs: ErrBreachedPassword,
+			SqlMock: func(test InsertUserTest) bool {
+				sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE").
+					WithArgs(test.Input.Email, test.Input.Username, 0).
+					WillReturnRows(sqlmock.NewRows([]string{"email", "username"}))
+				return true
+			},
+		},
 		//{
 		//	genericTestCase: genericTestCase{
 		//		Name:        "Simple test",
@@ -79,6 +152,9 @@ func TestUserService_InsertUser(t *testing.T) {
 			}
 			if test.ExpectedErr {
 				require.Error(t, err)
+				if test.ExpectedErrIs != nil {
+					require.ErrorIs(t, err, test.ExpectedErrIs)
+				}
 			} else {
 				require.NoError(t, err)
 				assert.Equal(t, res, test.ExpectedResult)
@@ -87,3 +163,261 @@ func TestUserService_InsertUser(t *testing.T) {
 	}
 
 }
+
+func TestTranslateDuplicateKey(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Input    error
+		Expected error
+	}{
+		{
+			Name:     "Duplicate email",
+			Input:    &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a@b.com' for key 'users.idx_users_email'"},
+			Expected: ErrEmailTaken,
+		},
+		{
+			Name:     "Duplicate username",
+			Input:    &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'alex' for key 'users.idx_users_username'"},
+			Expected: ErrUsernameTaken,
+		},
+		{
+			Name:     "External account linked twice",
+			Input:    &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'google-123' for key 'identities.idx_identities_provider_subject'"},
+			Expected: ErrIdentityLinked,
+		},
+		{
+			Name:     "Provider linked twice to a user",
+			Input:    &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '4-google' for key 'identities.idx_identities_user_provider'"},
+			Expected: ErrProviderLinked,
+		},
+		{
+			Name:     "Other mysql error is untouched",
+			Input:    &mysql.MySQLError{Number: 1213, Message: "Deadlock found"},
+			Expected: nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			err := translateDuplicateKey(test.Input)
+			if test.Expected == nil {
+				require.Equal(t, test.Input, err)
+			} else {
+				require.ErrorIs(t, err, test.Expected)
+			}
+		})
+	}
+}
+
+func TestUserService_Login_UnknownUser(t *testing.T) {
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE username = \\?").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err := userService.Login(api.LoginRequest{Username: "nobody", Password: "whatever", IP: "10.0.2.1"})
+	require.ErrorIs(t, err, ErrInvalidLogin)
+
+	failures, err := redisServer.Get("auth:login:failures:nobody")
+	require.NoError(t, err)
+	require.Equal(t, "1", failures)
+}
+
+func TestUserService_Login_RehashesPassword(t *testing.T) {
+	oldHasher := &utils.Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	oldHash, err := oldHasher.Hash([]byte("correct horse"))
+	require.NoError(t, err)
+
+	sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE username = \\?").
+		WithArgs("rehashed").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "email_verified_at"}).
+			AddRow(30, "rehashed", oldHash, time.Now()))
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `users` SET `password`=\\? WHERE id = \\? AND password = \\?").
+		WithArgs(sqlmock.AnyArg(), 30, oldHash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectCommit()
+	sqlMock.ExpectQuery("SELECT \\* FROM `user_totp` WHERE user_id = \\?").
+		WithArgs(30).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\?").
+		WithArgs(30).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+	expectSessionCreated(30)
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("UPDATE `users` SET `last_login_time_stamp`=\\? WHERE id = \\?").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectOutboxEvent(pkg.UserLoggedIn)
+	sqlMock.ExpectCommit()
+
+	res, err := userService.Login(api.LoginRequest{Username: "rehashed", Password: "correct horse", IP: "10.0.2.2"})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.Token)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestUserService_ForgotPassword(t *testing.T) {
+	expectUserByEmail := func(email string, rows *sqlmock.Rows) {
+		sqlMock.ExpectQuery("SELECT `id`,`email`,`email_verified_at` FROM `users` WHERE email = \\?").
+			WithArgs(email).
+			WillReturnRows(rows)
+	}
+
+	t.Run("unknown email", func(t *testing.T) {
+		expectUserByEmail("nobody@example.com", sqlmock.NewRows([]string{"id"}))
+
+		require.NoError(t, userService.ForgotPassword(api.ForgotPasswordRequest{Email: "nobody@example.com"}))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("failing to send answers like an unknown email", func(t *testing.T) {
+		expectUserByEmail("reset@example.com", sqlmock.NewRows([]string{"id", "email"}).AddRow(20, "reset@example.com"))
+
+		// a file where the mails are written to makes sending fail
+		notADir := filepath.Join(t.TempDir(), "mails")
+		require.NoError(t, os.WriteFile(notADir, nil, 0o600))
+
+		service := *userService
+		service.Verifier = NewVerificationService(loginLimiter.Redis, mailer.NewLogMailer(notADir, log), log, VerificationServiceSettings{
+			Secret:   "testemailsecret",
+			ResetTTL: time.Hour,
+		})
+
+		require.NoError(t, service.ForgotPassword(api.ForgotPasswordRequest{Email: "reset@example.com"}))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("requests are limited per address, registered or not", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			expectUserByEmail("limited@example.com", sqlmock.NewRows([]string{"id"}))
+			require.NoError(t, userService.ForgotPassword(api.ForgotPasswordRequest{Email: "limited@example.com", IP: "10.0.4.1"}))
+		}
+
+		err := userService.ForgotPassword(api.ForgotPasswordRequest{Email: "limited@example.com", IP: "10.0.4.2"})
+		require.ErrorIs(t, err, ErrRateLimited)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestUserService_ResetPassword(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, verificationService.SendPasswordReset(ctx, 21, "lantern@example.com"))
+	token := lastMailedToken(t)
+
+	expectUser := func() {
+		sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE id = \\?").
+			WithArgs(21).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "password"}).
+				AddRow(21, "lanternkeeper", "lantern@example.com", "hash"))
+	}
+
+	t.Run("password turned down by the policy keeps the token", func(t *testing.T) {
+		expectUser()
+
+		err := userService.ResetPassword(api.ResetPasswordRequest{Token: token, Password: "lanternkeeper-1984"})
+		require.ErrorIs(t, err, ErrValidation)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		userID, err := verificationService.PasswordResetUser(ctx, token)
+		require.NoError(t, err)
+		require.Equal(t, uint(21), userID)
+	})
+
+	t.Run("password used before keeps the token", func(t *testing.T) {
+		previous, err := userService.Hasher.Hash([]byte("Previous-Harbour-84"))
+		require.NoError(t, err)
+
+		expectUser()
+		sqlMock.ExpectQuery("SELECT `password` FROM `password_history` WHERE user_id = \\? ORDER BY id DESC LIMIT 3").
+			WithArgs(21).
+			WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(previous))
+
+		err = userService.ResetPassword(api.ResetPasswordRequest{Token: token, Password: "Previous-Harbour-84"})
+		require.ErrorIs(t, err, ErrPasswordReused)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		userID, err := verificationService.PasswordResetUser(ctx, token)
+		require.NoError(t, err)
+		require.Equal(t, uint(21), userID)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		err := userService.ResetPassword(api.ResetPasswordRequest{Token: "not-a-token", Password: "Brand-New-Lantern-84"})
+		require.ErrorIs(t, err, ErrInvalidResetToken)
+	})
+}
+
+func TestUserService_UpdateUser_EmailChange(t *testing.T) {
+	hash, err := userService.Hasher.Hash([]byte("Current-Harbour-84"))
+	require.NoError(t, err)
+
+	req := api.UpdateUserRequest{
+		ID:        50,
+		FirstName: "Ada",
+		LastName:  "Lovelace",
+		Email:     "attacker@example.com",
+		Age:       36,
+		Username:  "ada",
+	}
+
+	expectUser := func() {
+		sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE id = \\?").
+			WithArgs(50).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "password"}).
+				AddRow(50, "ada", "ada@example.com", hash))
+		sqlMock.ExpectQuery("SELECT `email`,`username` FROM `users` WHERE").
+			WithArgs(req.Email, req.Username, 50).
+			WillReturnRows(sqlmock.NewRows([]string{"email", "username"}))
+	}
+
+	testCases := []struct {
+		Name        string
+		OldPassword string
+		ExpectedErr error
+	}{
+		{Name: "owner without the current password", ExpectedErr: ErrPasswordRequired},
+		{Name: "owner with a wrong password", OldPassword: "Wrong-Harbour-84", ExpectedErr: ErrPasswordMismatch},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			expectUser()
+
+			selfReq := req
+			selfReq.Self = true
+			selfReq.OldPassword = test.OldPassword
+
+			require.ErrorIs(t, userService.UpdateUser(selfReq), test.ExpectedErr)
+			require.NoError(t, sqlMock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("owner with the current password", func(t *testing.T) {
+		expectUser()
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectOutboxEvent(pkg.UserUpdated)
+		sqlMock.ExpectCommit()
+
+		selfReq := req
+		selfReq.Self = true
+		selfReq.OldPassword = "Current-Harbour-84"
+
+		require.NoError(t, userService.UpdateUser(selfReq))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("admins don't need the password of the user", func(t *testing.T) {
+		expectUser()
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectOutboxEvent(pkg.UserUpdated)
+		sqlMock.ExpectCommit()
+
+		require.NoError(t, userService.UpdateUser(req))
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"github.com/knave-de-coeur/user-api-service/internal/mailer"
+	"github.com/knave-de-coeur/user-api-service/internal/utils"
+)
+
+const (
+	// emailVerificationKey holds the jti of the only verification token a user can currently redeem
+	emailVerificationKey = "auth:verify:%d"
+
+	verifyEmailTokenType = "verify_email"
+
+	// passwordResetKey maps the sha256 of a reset token to the user it was issued to, the token itself is never stored
+	passwordResetKey = "auth:reset:%s"
+	// userPasswordResetKey holds the hash of the only reset token of a user that is still outstanding
+	userPasswordResetKey = "auth:user:%d:reset"
+)
+
+var (
+	ErrInvalidVerificationToken = &Error{Kind: ErrValidation, Code: "invalid_verification_token", Message: "invalid or expired verification token", Field: "token"}
+	ErrInvalidResetToken        = &Error{Kind: ErrValidation, Code: "invalid_reset_token", Message: "invalid or expired reset token", Field: "token"}
+)
+
+// consumeTokenScript deletes the key only if it still holds the jti passed so a token can be redeemed once
+var consumeTokenScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// takeKeyScript returns the value of the key and deletes it in one go
+var takeKeyScript = redis.NewScript(`
+local value = redis.call('GET', KEYS[1])
+if value then
+	redis.call('DEL', KEYS[1])
+end
+return value
+`)
+
+type VerificationService struct {
+	Redis    *redis.Client
+	Mailer   mailer.Mailer
+	logger   *zap.Logger
+	settings VerificationServiceSettings
+}
+
+// VerificationServiceSettings holds the secret verification tokens are signed with and how long the mailed tokens last
+type VerificationServiceSettings struct {
+	Secret   string
+	TTL      time.Duration
+	ResetTTL time.Duration
+	BaseURL  string
+}
+
+type IVerificationService interface {
+	SendVerification(ctx context.Context, userID uint, email string) error
+	ConsumeVerificationToken(ctx context.Context, token string) (userID uint, email string, err error)
+	SendPasswordReset(ctx context.Context, userID uint, email string) error
+	PasswordResetUser(ctx context.Context, token string) (userID uint, err error)
+	ConsumePasswordResetToken(ctx context.Context, token string) (userID uint, err error)
+}
+
+func NewVerificationService(redisClient *redis.Client, mail mailer.Mailer, logger *zap.Logger, settings VerificationServiceSettings) *VerificationService {
+	return &VerificationService{
+		Redis:    redisClient,
+		Mailer:   mail,
+		logger:   logger,
+		settings: settings,
+	}
+}
+
+// SendVerification mails a new verification token to the address, any token sent before stops working
+func (service *VerificationService) SendVerification(ctx context.Context, userID uint, email string) error {
+
+	jti, err := utils.RandomToken(16)
+	if err != nil {
+		service.logger.Error("failed to generate verification token id", zap.Error(err))
+		return err
+	}
+
+	expiry := time.Now().Add(service.settings.TTL)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   userID,
+		"email": email,
+		"jti":   jti,
+		"typ":   verifyEmailTokenType,
+		"exp":   expiry.Unix(),
+	}).SignedString([]byte(service.settings.Secret))
+	if err != nil {
+		service.logger.Error("failed to sign verification token", zap.Error(err))
+		return err
+	}
+
+	if res := service.Redis.Set(ctx, fmt.Sprintf(emailVerificationKey, userID), jti, service.settings.TTL); res.Err() != nil {
+		service.logger.Error("failed to store verification token", zap.Uint("userID", userID), zap.Error(res.Err()))
+		return res.Err()
+	}
+
+	err = service.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Welcome!\n\nConfirm your email address by opening %s/verify-email?token=%s\n\nor by submitting the token below, it expires at %s.\n\ntoken: %s\n",
+			service.settings.BaseURL, token, expiry.UTC().Format(time.RFC1123), token,
+		),
+	})
+	if err != nil {
+		service.logger.Error("failed to send verification email", zap.Uint("userID", userID), zap.Error(err))
+		return upstreamError("mail_unavailable", "failed to send verification email", err)
+	}
+
+	return nil
+}
+
+// ConsumeVerificationToken checks the token and redeems it, returning who it was issued to
+func (service *VerificationService) ConsumeVerificationToken(ctx context.Context, token string) (uint, string, error) {
+
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected method: %s", token.Header["alg"])
+		}
+		return []byte(service.settings.Secret), nil
+	})
+	if err != nil {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid || claims["typ"] != verifyEmailTokenType {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	sub, _ := claims["sub"].(float64)
+	email, _ := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+	if sub < 1 || email == "" || jti == "" {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	userID := uint(sub)
+
+	consumed, err := consumeTokenScript.Run(ctx, service.Redis, []string{fmt.Sprintf(emailVerificationKey, userID)}, jti).Int()
+	if err != nil {
+		service.logger.Error("failed to redeem verification token", zap.Uint("userID", userID), zap.Error(err))
+		return 0, "", err
+	}
+
+	if consumed == 0 {
+		return 0, "", ErrInvalidVerificationToken
+	}
+
+	return userID, email, nil
+}
+
+// SendPasswordReset mails a random reset token to the address, only its hash is kept and any token sent before stops working
+func (service *VerificationService) SendPasswordReset(ctx context.Context, userID uint, email string) error {
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		service.logger.Error("failed to generate reset token", zap.Error(err))
+		return err
+	}
+
+	userKey := fmt.Sprintf(userPasswordResetKey, userID)
+
+	previous, err := service.Redis.Get(ctx, userKey).Result()
+	if err != nil && err != redis.Nil {
+		service.logger.Error("failed to get outstanding reset token", zap.Uint("userID", userID), zap.Error(err))
+		return err
+	}
+
+	hash := hashToken(token)
+
+	_, err = service.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if previous != "" {
+			pipe.Del(ctx, fmt.Sprintf(passwordResetKey, previous))
+		}
+		pipe.Set(ctx, fmt.Sprintf(passwordResetKey, hash), userID, service.settings.ResetTTL)
+		pipe.Set(ctx, userKey, hash, service.settings.ResetTTL)
+		return nil
+	})
+	if err != nil {
+		service.logger.Error("failed to store reset token", zap.Uint("userID", userID), zap.Error(err))
+		return err
+	}
+
+	expiry := time.Now().Add(service.settings.ResetTTL)
+
+	err = service.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of your account, if it wasn't you ignore this email.\n\nChoose a new password by opening %s/reset-password?token=%s\n\nor by submitting the token below, it expires at %s.\n\ntoken: %s\n",
+			service.settings.BaseURL, token, expiry.UTC().Format(time.RFC1123), token,
+		),
+	})
+	if err != nil {
+		service.logger.Error("failed to send reset email", zap.Uint("userID", userID), zap.Error(err))
+		return upstreamError("mail_unavailable", "failed to send reset email", err)
+	}
+
+	return nil
+}
+
+// PasswordResetUser returns the user the reset token was issued to without redeeming it,
+// so a new password can be checked before the token is used up
+func (service *VerificationService) PasswordResetUser(ctx context.Context, token string) (uint, error) {
+
+	userID, err := service.Redis.Get(ctx, fmt.Sprintf(passwordResetKey, hashToken(token))).Uint64()
+	if err == redis.Nil {
+		return 0, ErrInvalidResetToken
+	} else if err != nil {
+		service.logger.Error("failed to get reset token", zap.Error(err))
+		return 0, err
+	}
+
+	return uint(userID), nil
+}
+
+// ConsumePasswordResetToken redeems the reset token, returning the user it was issued to
+func (service *VerificationService) ConsumePasswordResetToken(ctx context.Context, token string) (uint, error) {
+
+	hash := hashToken(token)
+
+	userID, err := takeKeyScript.Run(ctx, service.Redis, []string{fmt.Sprintf(passwordResetKey, hash)}).Uint64()
+	if err == redis.Nil {
+		return 0, ErrInvalidResetToken
+	} else if err != nil {
+		service.logger.Error("failed to redeem reset token", zap.Error(err))
+		return 0, err
+	}
+
+	if err = consumeTokenScript.Run(ctx, service.Redis, []string{fmt.Sprintf(userPasswordResetKey, userID)}, hash).Err(); err != nil {
+		service.logger.Error("failed to clear outstanding reset token", zap.Uint64("userID", userID), zap.Error(err))
+		return 0, err
+	}
+
+	return uint(userID), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lastMailedToken pulls the token out of the body of the last email sent
+func lastMailedToken(t *testing.T) string {
+	sent := testMailer.Sent()
+	require.NotEmpty(t, sent)
+
+	body := sent[len(sent)-1].Body
+	idx := strings.LastIndex(body, "token: ")
+	require.NotEqual(t, -1, idx)
+
+	return strings.TrimSpace(body[idx+len("token: "):])
+}
+
+func TestVerificationService_ConsumeVerificationToken(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, verificationService.SendVerification(ctx, 10, "verify@example.com"))
+	token := lastMailedToken(t)
+
+	t.Run("token is redeemed once", func(t *testing.T) {
+		userID, email, err := verificationService.ConsumeVerificationToken(ctx, token)
+		require.NoError(t, err)
+		require.Equal(t, uint(10), userID)
+		require.Equal(t, "verify@example.com", email)
+
+		_, _, err = verificationService.ConsumeVerificationToken(ctx, token)
+		require.ErrorIs(t, err, ErrInvalidVerificationToken)
+	})
+
+	t.Run("resending invalidates the previous token", func(t *testing.T) {
+		require.NoError(t, verificationService.SendVerification(ctx, 11, "resend@example.com"))
+		first := lastMailedToken(t)
+
+		require.NoError(t, verificationService.SendVerification(ctx, 11, "resend@example.com"))
+		second := lastMailedToken(t)
+
+		_, _, err := verificationService.ConsumeVerificationToken(ctx, first)
+		require.ErrorIs(t, err, ErrInvalidVerificationToken)
+
+		userID, _, err := verificationService.ConsumeVerificationToken(ctx, second)
+		require.NoError(t, err)
+		require.Equal(t, uint(11), userID)
+	})
+
+	t.Run("expired token is rejected", func(t *testing.T) {
+		expiring := NewVerificationService(verificationService.Redis, testMailer, log, VerificationServiceSettings{
+			Secret: "testemailsecret",
+			TTL:    -time.Minute,
+		})
+
+		require.NoError(t, expiring.SendVerification(ctx, 12, "expired@example.com"))
+
+		_, _, err := verificationService.ConsumeVerificationToken(ctx, lastMailedToken(t))
+		require.ErrorIs(t, err, ErrInvalidVerificationToken)
+	})
+
+	t.Run("access token is not accepted", func(t *testing.T) {
+		pair, err := tokenService.IssueTokenPair(ctx, TokenSubject{UserID: 10})
+		require.NoError(t, err)
+
+		_, _, err = verificationService.ConsumeVerificationToken(ctx, pair.Token)
+		require.ErrorIs(t, err, ErrInvalidVerificationToken)
+	})
+}
+
+func TestVerificationService_ConsumePasswordResetToken(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, verificationService.SendPasswordReset(ctx, 20, "reset@example.com"))
+	first := lastMailedToken(t)
+
+	require.NoError(t, verificationService.SendPasswordReset(ctx, 20, "reset@example.com"))
+	second := lastMailedToken(t)
+
+	t.Run("only the hash is stored", func(t *testing.T) {
+		require.False(t, redisServer.Exists("auth:reset:"+second))
+		require.True(t, redisServer.Exists("auth:reset:"+hashToken(second)))
+	})
+
+	t.Run("resending invalidates the previous token", func(t *testing.T) {
+		_, err := verificationService.ConsumePasswordResetToken(ctx, first)
+		require.ErrorIs(t, err, ErrInvalidResetToken)
+	})
+
+	t.Run("token is redeemed once", func(t *testing.T) {
+		userID, err := verificationService.ConsumePasswordResetToken(ctx, second)
+		require.NoError(t, err)
+		require.Equal(t, uint(20), userID)
+		require.False(t, redisServer.Exists("auth:user:20:reset"))
+
+		_, err = verificationService.ConsumePasswordResetToken(ctx, second)
+		require.ErrorIs(t, err, ErrInvalidResetToken)
+	})
+}
@@ -0,0 +1,456 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+// webAuthnSessionKey holds the session data of a registration or login ceremony, keyed by its challenge
+// which the client signs and sends back so no other handle has to be passed around
+const webAuthnSessionKey = "auth:webauthn:session:%s"
+
+var (
+	ErrInvalidPasskey             = &Error{Kind: ErrInvalidCredentials, Code: "invalid_passkey", Message: "passkey couldn't be verified"}
+	ErrInvalidPasskeyRegistration = &Error{Kind: ErrValidation, Code: "invalid_passkey_registration", Message: "passkey registration couldn't be verified", Field: "credential"}
+	ErrPasskeyNotFound            = &Error{Kind: ErrNotFound, Code: "passkey_not_found", Message: "passkey not found"}
+	ErrPasskeyRegistered          = &Error{Kind: ErrConflict, Code: "passkey_already_registered", Message: "passkey already registered", Field: "credential"}
+)
+
+type WebAuthnService struct {
+	DBConn   *gorm.DB
+	Redis    *redis.Client
+	WebAuthn *webauthn.WebAuthn
+	logger   *zap.Logger
+	settings WebAuthnServiceSettings
+}
+
+// WebAuthnServiceSettings holds the relying party passkeys are bound to and how long a ceremony can take
+type WebAuthnServiceSettings struct {
+	RPID         string
+	RPName       string
+	RPOrigins    []string
+	ChallengeTTL time.Duration
+}
+
+type IWebAuthnService interface {
+	BeginRegistration(ctx context.Context, userID uint) (*protocol.CredentialCreation, error)
+	FinishRegistration(ctx context.Context, req api.FinishPasskeyRegistrationRequest) (*api.WebAuthnCredential, error)
+	ListCredentials(userID uint) ([]api.WebAuthnCredential, error)
+	DeleteCredential(req api.DeletePasskeyRequest) error
+	BeginLogin(ctx context.Context, req api.BeginPasskeyLoginRequest) (*protocol.CredentialAssertion, error)
+	FinishLogin(ctx context.Context, req api.FinishPasskeyLoginRequest) (uint, error)
+}
+
+func NewWebAuthnService(dbConn *gorm.DB, redisClient *redis.Client, logger *zap.Logger, settings WebAuthnServiceSettings) (*WebAuthnService, error) {
+
+	// passkeys are the only factor of a passwordless login so the authenticator has to verify the user too
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: settings.ChallengeTTL, TimeoutUVD: settings.ChallengeTTL}
+
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          settings.RPID,
+		RPDisplayName: settings.RPName,
+		RPOrigins:     settings.RPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnService{
+		DBConn:   dbConn,
+		Redis:    redisClient,
+		WebAuthn: wa,
+		logger:   logger,
+		settings: settings,
+	}, nil
+}
+
+// BeginRegistration returns the options to pass to navigator.credentials.create, passkeys the user already has are excluded
+func (service *WebAuthnService) BeginRegistration(ctx context.Context, userID uint) (*protocol.CredentialCreation, error) {
+
+	user, err := service.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := service.WebAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		service.logger.Error("failed to begin passkey registration", zap.Uint("userID", userID), zap.Error(err))
+		return nil, err
+	}
+
+	if err = service.storeSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return creation, nil
+}
+
+// FinishRegistration verifies the credential created by the authenticator and stores it
+func (service *WebAuthnService) FinishRegistration(ctx context.Context, req api.FinishPasskeyRegistrationRequest) (*api.WebAuthnCredential, error) {
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		service.logger.Info("unparsable passkey registration", zap.Uint("userID", req.UserID), zap.Error(err))
+		return nil, ErrInvalidPasskeyRegistration
+	}
+
+	session, err := service.takeSession(ctx, parsed.Response.CollectedClientData.Challenge)
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrInvalidPasskeyRegistration
+	} else if err != nil {
+		return nil, err
+	}
+
+	user, err := service.loadUser(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := service.WebAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		service.logger.Info("passkey registration rejected", zap.Uint("userID", req.UserID), zap.Error(err))
+		return nil, ErrInvalidPasskeyRegistration
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	row := &pkg.WebAuthnCredential{
+		UserID:          req.UserID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Transports:      strings.Join(transports, ","),
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		Name:            name,
+	}
+
+	if res := service.DBConn.Create(row); res.Error != nil {
+		service.logger.Error("something went wrong storing passkey", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return nil, translateDuplicateKey(res.Error)
+	}
+
+	response := toAPIWebAuthnCredential(*row)
+
+	return &response, nil
+}
+
+// ListCredentials returns the passkeys of the user, oldest first
+func (service *WebAuthnService) ListCredentials(userID uint) ([]api.WebAuthnCredential, error) {
+
+	var rows []pkg.WebAuthnCredential
+
+	res := service.DBConn.Where("user_id = ?", userID).Order("id").Find(&rows)
+	if res.Error != nil {
+		service.logger.Error("something went wrong listing passkeys", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	credentials := make([]api.WebAuthnCredential, 0, len(rows))
+	for _, row := range rows {
+		credentials = append(credentials, toAPIWebAuthnCredential(row))
+	}
+
+	return credentials, nil
+}
+
+// DeleteCredential removes a passkey of the user so it can't be used to log in anymore
+func (service *WebAuthnService) DeleteCredential(req api.DeletePasskeyRequest) error {
+
+	res := service.DBConn.Where("id = ? AND user_id = ?", req.CredentialID, req.UserID).Delete(&pkg.WebAuthnCredential{})
+	if res.Error != nil {
+		service.logger.Error("something went wrong deleting passkey", zap.Uint("userID", req.UserID), zap.Error(res.Error))
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrPasskeyNotFound
+	}
+
+	return nil
+}
+
+// BeginLogin returns the options to pass to navigator.credentials.get. With a username only its passkeys are allowed,
+// unknown usernames and users without passkeys get the same options as a login without one so they can't be told apart.
+func (service *WebAuthnService) BeginLogin(ctx context.Context, req api.BeginPasskeyLoginRequest) (*protocol.CredentialAssertion, error) {
+
+	var (
+		assertion *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		err       error
+	)
+
+	user, err := service.loadUserByUsername(req.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user != nil && len(user.credentials) > 0 {
+		assertion, session, err = service.WebAuthn.BeginLogin(user)
+	} else {
+		assertion, session, err = service.WebAuthn.BeginDiscoverableLogin()
+	}
+	if err != nil {
+		service.logger.Error("failed to begin passkey login", zap.Error(err))
+		return nil, err
+	}
+
+	if err = service.storeSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return assertion, nil
+}
+
+// FinishLogin verifies the assertion signed by the authenticator and returns the user it belongs to
+func (service *WebAuthnService) FinishLogin(ctx context.Context, req api.FinishPasskeyLoginRequest) (uint, error) {
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		service.logger.Info("unparsable passkey assertion", zap.Error(err))
+		return 0, ErrInvalidPasskey
+	}
+
+	session, err := service.takeSession(ctx, parsed.Response.CollectedClientData.Challenge)
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrInvalidPasskey
+	} else if err != nil {
+		return 0, err
+	}
+
+	var (
+		user       *webAuthnUser
+		credential *webauthn.Credential
+	)
+
+	if session.UserID == nil {
+		credential, err = service.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			user, err = service.loadUserByHandle(userHandle)
+			return user, err
+		}, *session, parsed)
+	} else {
+		if user, err = service.loadUserByHandle(session.UserID); err == nil {
+			credential, err = service.WebAuthn.ValidateLogin(user, *session, parsed)
+		}
+	}
+	if err != nil {
+		service.logger.Info("passkey login rejected", zap.Error(err))
+		return 0, ErrInvalidPasskey
+	}
+
+	if credential.Authenticator.CloneWarning {
+		service.logger.Warn("passkey sign count went backwards, it may have been cloned", zap.Uint("userID", user.user.ID))
+		return 0, ErrInvalidPasskey
+	}
+
+	res := service.DBConn.
+		Model(&pkg.WebAuthnCredential{}).
+		Where("credential_id = ? AND user_id = ?", credential.ID, user.user.ID).
+		Updates(map[string]interface{}{
+			"sign_count":   credential.Authenticator.SignCount,
+			"backup_state": credential.Flags.BackupState,
+			"last_used_at": service.DBConn.NowFunc(),
+		})
+	if res.Error != nil {
+		service.logger.Error("something went wrong updating passkey", zap.Uint("userID", user.user.ID), zap.Error(res.Error))
+		return 0, res.Error
+	}
+
+	return user.user.ID, nil
+}
+
+func (service *WebAuthnService) storeSession(ctx context.Context, session *webauthn.SessionData) error {
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	if err = service.Redis.Set(ctx, fmt.Sprintf(webAuthnSessionKey, session.Challenge), data, service.settings.ChallengeTTL).Err(); err != nil {
+		service.logger.Error("failed to store passkey session", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// takeSession redeems the session of a challenge so every challenge is only answered once, redis.Nil when there's none
+func (service *WebAuthnService) takeSession(ctx context.Context, challenge string) (*webauthn.SessionData, error) {
+
+	data, err := takeKeyScript.Run(ctx, service.Redis, []string{fmt.Sprintf(webAuthnSessionKey, challenge)}).Text()
+	if err == redis.Nil {
+		return nil, err
+	} else if err != nil {
+		service.logger.Error("failed to redeem passkey session", zap.Error(err))
+		return nil, err
+	}
+
+	var session webauthn.SessionData
+	if err = json.Unmarshal([]byte(data), &session); err != nil {
+		service.logger.Error("something went wrong unmarshalling passkey session", zap.Error(err))
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (service *WebAuthnService) loadUser(userID uint) (*webAuthnUser, error) {
+
+	var user pkg.User
+
+	res := service.DBConn.Select("id", "username", "first_name", "last_name").Where("id = ?", userID).First(&user)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting user", zap.Uint("userID", userID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return service.withCredentials(&user)
+}
+
+// loadUserByUsername is nil without an error when the username is empty or unknown
+func (service *WebAuthnService) loadUserByUsername(username string) (*webAuthnUser, error) {
+
+	if username == "" {
+		return nil, nil
+	}
+
+	var user pkg.User
+
+	res := service.DBConn.Select("id", "username", "first_name", "last_name").Where("username = ?", username).First(&user)
+	if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if res.Error != nil {
+		service.logger.Error("something went wrong getting user by username", zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return service.withCredentials(&user)
+}
+
+// loadUserByHandle loads the user a passkey was registered for from the user handle stored on the authenticator
+func (service *WebAuthnService) loadUserByHandle(handle []byte) (*webAuthnUser, error) {
+
+	userID, err := strconv.ParseUint(string(handle), 10, 64)
+	if err != nil || userID == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	return service.loadUser(uint(userID))
+}
+
+func (service *WebAuthnService) withCredentials(user *pkg.User) (*webAuthnUser, error) {
+
+	var credentials []pkg.WebAuthnCredential
+
+	res := service.DBConn.Where("user_id = ?", user.ID).Find(&credentials)
+	if res.Error != nil {
+		service.logger.Error("something went wrong getting passkeys", zap.Uint("userID", user.ID), zap.Error(res.Error))
+		return nil, res.Error
+	}
+
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// webAuthnUser adapts a user and their passkeys to what the webauthn library expects
+type webAuthnUser struct {
+	user        *pkg.User
+	credentials []pkg.WebAuthnCredential
+}
+
+// WebAuthnID is the user handle stored on the authenticator, the user id as it doesn't reveal anything about the user
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.FormatUint(uint64(u.user.ID), 10))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.FirstName + " " + u.user.LastName); name != "" {
+		return name
+	}
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+
+	for _, row := range u.credentials {
+		var transports []protocol.AuthenticatorTransport
+		for _, transport := range strings.Split(row.Transports, ",") {
+			if transport != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(transport))
+			}
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              row.CredentialID,
+			PublicKey:       row.PublicKey,
+			AttestationType: row.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.CredentialFlags{BackupEligible: row.BackupEligible, BackupState: row.BackupState},
+			Authenticator:   webauthn.Authenticator{AAGUID: row.AAGUID, SignCount: row.SignCount},
+		})
+	}
+
+	return credentials
+}
+
+func toAPIWebAuthnCredential(row pkg.WebAuthnCredential) api.WebAuthnCredential {
+
+	credential := api.WebAuthnCredential{
+		ID:             row.ID,
+		Name:           row.Name,
+		BackupEligible: row.BackupEligible,
+		CreatedAt:      row.CreatedAt,
+	}
+
+	if row.LastUsedAt.Valid {
+		credential.LastUsedAt = &row.LastUsedAt.Time
+	}
+
+	return credential
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/stretchr/testify/require"
+
+	"github.com/knave-de-coeur/user-api-service/internal/api"
+	"github.com/knave-de-coeur/user-api-service/internal/pkg"
+)
+
+// softAuthenticator is a platform authenticator in software holding a single ES256 passkey
+type softAuthenticator struct {
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+
+	return &softAuthenticator{origin: origin, key: key, credentialID: credentialID}
+}
+
+// publicKey is the COSE encoding of the public key as stored by the relying party
+func (a *softAuthenticator) publicKey(t *testing.T) []byte {
+	key, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         1,
+		XCoord:        a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord:        a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(t, err)
+
+	return key
+}
+
+// authData builds the authenticator data with the user present and verified
+func (a *softAuthenticator) authData(rpID string, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	if attested != nil {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      string(ceremony),
+		"challenge": challenge.String(),
+		"origin":    a.origin,
+	})
+
+	return data
+}
+
+// create answers navigator.credentials.create with a none attestation
+func (a *softAuthenticator) create(t *testing.T, options *protocol.CredentialCreation) json.RawMessage {
+	a.userHandle = options.Response.User.ID.(protocol.URLEncodedBase64)
+
+	attested := make([]byte, 16) // zeroed aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, a.publicKey(t)...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(options.Response.RelyingParty.ID, attested),
+	})
+	require.NoError(t, err)
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(protocol.CreateCeremony, options.Response.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"transports":        []string{"internal"},
+		},
+	})
+	require.NoError(t, err)
+
+	return credential
+}
+
+// get answers navigator.credentials.get by signing the challenge
+func (a *softAuthenticator) get(t *testing.T, options *protocol.CredentialAssertion) json.RawMessage {
+	a.signCount++
+
+	authData := a.authData(options.Response.RelyingPartyID, nil)
+	clientData := a.clientData(protocol.AssertCeremony, options.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	require.NoError(t, err)
+
+	return credential
+}
+
+func expectPasskeyUser(userID uint, credentials *sqlmock.Rows) {
+	sqlMock.ExpectQuery("SELECT `id`,`username`,`first_name`,`last_name` FROM `users` WHERE id = \\?").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "first_name", "last_name"}).AddRow(userID, "passkeyuser", "Pass", "Key"))
+	sqlMock.ExpectQuery("SELECT \\* FROM `webauthn_credentials` WHERE user_id = \\?").
+		WithArgs(userID).
+		WillReturnRows(credentials)
+}
+
+func passkeyRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "credential_id", "public_key", "attestation_type", "sign_count", "transports"})
+}
+
+func TestWebAuthnService_Registration(t *testing.T) {
+	ctx := context.Background()
+	authenticator := newSoftAuthenticator(t, "http://localhost:8080")
+
+	expectPasskeyUser(60, passkeyRows())
+
+	options, err := webAuthnService.BeginRegistration(ctx, 60)
+	require.NoError(t, err)
+	require.Equal(t, "localhost", options.Response.RelyingParty.ID)
+	require.Equal(t, protocol.VerificationRequired, options.Response.AuthenticatorSelection.UserVerification)
+
+	credential := authenticator.create(t, options)
+
+	expectPasskeyUser(60, passkeyRows())
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("INSERT INTO `webauthn_credentials`").
+		WithArgs(60, authenticator.credentialID, authenticator.publicKey(t), "none", sqlmock.AnyArg(), 0, "internal", false, false, "Laptop", nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	sqlMock.ExpectCommit()
+
+	passkey, err := webAuthnService.FinishRegistration(ctx, api.FinishPasskeyRegistrationRequest{UserID: 60, Name: "Laptop", Credential: credential})
+	require.NoError(t, err)
+	require.Equal(t, uint(7), passkey.ID)
+	require.Equal(t, "Laptop", passkey.Name)
+	require.NoError(t, sqlMock.ExpectationsWereMet())
+
+	t.Run("challenge can't be answered twice", func(t *testing.T) {
+		_, err := webAuthnService.FinishRegistration(ctx, api.FinishPasskeyRegistrationRequest{UserID: 60, Credential: credential})
+		require.ErrorIs(t, err, ErrInvalidPasskeyRegistration)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("registration can't be finished for another user", func(t *testing.T) {
+		expectPasskeyUser(60, passkeyRows())
+
+		options, err := webAuthnService.BeginRegistration(ctx, 60)
+		require.NoError(t, err)
+
+		expectPasskeyUser(61, passkeyRows())
+
+		_, err = webAuthnService.FinishRegistration(ctx, api.FinishPasskeyRegistrationRequest{UserID: 61, Credential: authenticator.create(t, options)})
+		require.ErrorIs(t, err, ErrInvalidPasskeyRegistration)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
+
+func TestUserService_PasskeyLogin(t *testing.T) {
+	ctx := context.Background()
+	authenticator := newSoftAuthenticator(t, "http://localhost:8080")
+	authenticator.userHandle = []byte("62")
+
+	// storedPasskey is the passkey row as left by the previous login
+	storedPasskey := func(signCount uint32) *sqlmock.Rows {
+		return passkeyRows().AddRow(8, 62, authenticator.credentialID, authenticator.publicKey(t), "none", signCount, "internal")
+	}
+
+	t.Run("discoverable login issues tokens", func(t *testing.T) {
+		options, err := webAuthnService.BeginLogin(ctx, api.BeginPasskeyLoginRequest{})
+		require.NoError(t, err)
+		require.Empty(t, options.Response.AllowedCredentials)
+
+		credential := authenticator.get(t, options)
+
+		expectPasskeyUser(62, storedPasskey(0))
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `webauthn_credentials` SET `backup_state`=\\?,`last_used_at`=\\?,`sign_count`=\\? WHERE credential_id = \\? AND user_id = \\?").
+			WithArgs(false, sqlmock.AnyArg(), authenticator.signCount, authenticator.credentialID, 62).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlMock.ExpectCommit()
+		sqlMock.ExpectQuery("SELECT .* FROM `users` WHERE id = \\?").
+			WithArgs(62).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email_verified_at"}).AddRow(62, "passkeyuser", time.Now()))
+		sqlMock.ExpectQuery("SELECT `role` FROM `user_roles` WHERE user_id = \\?").
+			WithArgs(62).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+		expectSessionCreated(62)
+		sqlMock.ExpectBegin()
+		sqlMock.ExpectExec("UPDATE `users` SET `last_login_time_stamp`=\\? WHERE id = \\?").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectOutboxEvent(pkg.UserLoggedIn)
+		sqlMock.ExpectCommit()
+
+		res, err := userService.PasskeyLogin(api.FinishPasskeyLoginRequest{Credential: credential})
+		require.NoError(t, err)
+		require.NotEmpty(t, res.Token)
+		require.NotEmpty(t, res.RefreshToken)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+
+		t.Run("assertion can't be replayed", func(t *testing.T) {
+			_, err := userService.PasskeyLogin(api.FinishPasskeyLoginRequest{Credential: credential})
+			require.ErrorIs(t, err, ErrInvalidPasskey)
+			require.NoError(t, sqlMock.ExpectationsWereMet())
+		})
+	})
+
+	t.Run("login with a username only allows its passkeys", func(t *testing.T) {
+		sqlMock.ExpectQuery("SELECT `id`,`username`,`first_name`,`last_name` FROM `users` WHERE username = \\?").
+			WithArgs("passkeyuser").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(62, "passkeyuser"))
+		sqlMock.ExpectQuery("SELECT \\* FROM `webauthn_credentials` WHERE user_id = \\?").
+			WithArgs(62).
+			WillReturnRows(storedPasskey(authenticator.signCount))
+
+		options, err := webAuthnService.BeginLogin(ctx, api.BeginPasskeyLoginRequest{Username: "passkeyuser"})
+		require.NoError(t, err)
+		require.Len(t, options.Response.AllowedCredentials, 1)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("assertion from another origin is rejected", func(t *testing.T) {
+		options, err := webAuthnService.BeginLogin(ctx, api.BeginPasskeyLoginRequest{})
+		require.NoError(t, err)
+
+		authenticator.origin = "https://phishing.example"
+		defer func() { authenticator.origin = "http://localhost:8080" }()
+
+		expectPasskeyUser(62, storedPasskey(authenticator.signCount))
+
+		_, err = userService.PasskeyLogin(api.FinishPasskeyLoginRequest{Credential: authenticator.get(t, options)})
+		require.ErrorIs(t, err, ErrInvalidPasskey)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+
+	t.Run("sign count going backwards is rejected", func(t *testing.T) {
+		options, err := webAuthnService.BeginLogin(ctx, api.BeginPasskeyLoginRequest{})
+		require.NoError(t, err)
+
+		credential := authenticator.get(t, options)
+
+		expectPasskeyUser(62, storedPasskey(authenticator.signCount+10))
+
+		_, err = userService.PasskeyLogin(api.FinishPasskeyLoginRequest{Credential: credential})
+		require.ErrorIs(t, err, ErrInvalidPasskey)
+		require.NoError(t, sqlMock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedChecker looks passwords up in a list of passwords leaked in data breaches
+type BreachedChecker interface {
+	IsBreached(pwd string) (bool, error)
+}
+
+// PrefixFileChecker checks passwords against a local copy of the Pwned Passwords range files. Dir holds one file
+// per 5 character SHA-1 prefix, named <PREFIX>.txt, listing the <SUFFIX>:<COUNT> of every breached hash starting with it,
+// so only the file of the prefix is read and the list never has to be loaded in memory.
+type PrefixFileChecker struct {
+	Dir string
+	// MinCount ignores hashes seen fewer times than this in breaches
+	MinCount int
+}
+
+func NewPrefixFileChecker(dir string, minCount int) *PrefixFileChecker {
+	return &PrefixFileChecker{Dir: dir, MinCount: minCount}
+}
+
+func (checker *PrefixFileChecker) IsBreached(pwd string) (bool, error) {
+
+	sum := sha1.Sum([]byte(pwd))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(checker.Dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		lineSuffix, count, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+
+		seen, _ := strconv.Atoi(count)
+
+		return checker.MinCount <= 1 || seen >= checker.MinCount, nil
+	}
+
+	return false, scanner.Err()
+}
@@ -1,30 +1,54 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
-// HashAndSalt uses bcrypt package to encrypt pass
-func HashAndSalt(pwd []byte) (string, error) {
-	// MinCost is just an integer constant provided by the bcrypt
-	// package along with DefaultCost & MaxCost.
-	// The cost can be any value you want provided it isn't lower
-	// than the MinCost (4)
-	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.MinCost)
-	if err != nil {
-		return "", err
+// ComparePasswords checks the stored password with the plain string password,
+// the algorithm is picked from the format of the stored hash and a mismatch isn't an error
+func ComparePasswords(hashedPwd string, plainPwd []byte) (bool, error) {
+	if strings.HasPrefix(hashedPwd, argon2idPrefix) {
+		return compareArgon2id(hashedPwd, plainPwd)
 	}
 
-	return string(hash), nil
-}
-
-// ComparePasswords uses bcyrpt library to check the stored password with the plain string password
-func ComparePasswords(hashedPwd string, plainPwd []byte) (bool, error) {
-	byteHash := []byte(hashedPwd)
-	err := bcrypt.CompareHashAndPassword(byteHash, plainPwd)
-	if err != nil {
+	err := bcrypt.CompareHashAndPassword([]byte(hashedPwd), plainPwd)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
 	return true, nil
 }
+
+// IsPasswordHash reports whether encoded is a bcrypt or argon2id hash ComparePasswords can check passwords against
+func IsPasswordHash(encoded string) bool {
+	if strings.HasPrefix(encoded, argon2idPrefix) {
+		_, err := parseArgon2id(encoded)
+		return err == nil
+	}
+
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			_, err := bcrypt.Cost([]byte(encoded))
+			return err == nil
+		}
+	}
+
+	return false
+}
+
+// RandomToken returns a hex encoded string generated from n cryptographically secure random bytes
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HasherBcrypt   = "bcrypt"
+	HasherArgon2id = "argon2id"
+
+	argon2idPrefix = "$argon2id$"
+)
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// PasswordHasher hashes new passwords following the configured policy,
+// stored hashes are checked with ComparePasswords whatever algorithm made them
+type PasswordHasher interface {
+	Hash(pwd []byte) (string, error)
+	// NeedsRehash reports whether the stored hash was made with another algorithm or weaker parameters than the policy's
+	NeedsRehash(encoded string) bool
+}
+
+// HasherSettings picks the algorithm new passwords are hashed with along with its parameters
+type HasherSettings struct {
+	Algorithm         string
+	BcryptCost        int
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+}
+
+// NewPasswordHasher returns the hasher of the configured algorithm
+func NewPasswordHasher(settings HasherSettings) (PasswordHasher, error) {
+	switch settings.Algorithm {
+	case HasherBcrypt:
+		if settings.BcryptCost < bcrypt.MinCost || settings.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return &BcryptHasher{Cost: settings.BcryptCost}, nil
+	case HasherArgon2id:
+		if settings.Argon2Memory == 0 || settings.Argon2Iterations == 0 || settings.Argon2Parallelism == 0 {
+			return nil, errors.New("argon2id memory, iterations and parallelism must be set")
+		}
+		return &Argon2idHasher{
+			Memory:      settings.Argon2Memory,
+			Iterations:  settings.Argon2Iterations,
+			Parallelism: settings.Argon2Parallelism,
+			SaltLength:  16,
+			KeyLength:   32,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown password hasher %s", settings.Algorithm)
+}
+
+// BcryptHasher hashes with bcrypt in its usual $2a$ modular crypt format
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(pwd []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(pwd, h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+// Argon2idHasher hashes with argon2id, encoded as $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+// argon2idHash is a parsed argon2id PHC string
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h *Argon2idHasher) Hash(pwd []byte) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(pwd, salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	parsed, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return parsed.memory < h.Memory || parsed.iterations < h.Iterations ||
+		parsed.parallelism != h.Parallelism || uint32(len(parsed.key)) < h.KeyLength
+}
+
+func parseArgon2id(encoded string) (*argon2idHash, error) {
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HasherArgon2id {
+		return nil, errMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errMalformedHash
+	}
+
+	parsed := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.iterations, &parsed.parallelism); err != nil {
+		return nil, errMalformedHash
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errMalformedHash
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, errMalformedHash
+	}
+
+	return parsed, nil
+}
+
+func compareArgon2id(encoded string, pwd []byte) (bool, error) {
+	parsed, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey(pwd, parsed.salt, parsed.iterations, parsed.memory, parsed.parallelism, uint32(len(parsed.key)))
+
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1, nil
+}
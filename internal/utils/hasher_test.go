@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	bcryptHasher, err := NewPasswordHasher(HasherSettings{Algorithm: HasherBcrypt, BcryptCost: bcrypt.MinCost})
+	require.NoError(t, err)
+
+	argonHasher, err := NewPasswordHasher(HasherSettings{Algorithm: HasherArgon2id, Argon2Memory: 1024, Argon2Iterations: 1, Argon2Parallelism: 1})
+	require.NoError(t, err)
+
+	for name, hasher := range map[string]PasswordHasher{"bcrypt": bcryptHasher, "argon2id": argonHasher} {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := hasher.Hash([]byte("correct horse"))
+			require.NoError(t, err)
+			require.False(t, hasher.NeedsRehash(encoded))
+			require.True(t, IsPasswordHash(encoded))
+
+			same, err := ComparePasswords(encoded, []byte("correct horse"))
+			require.NoError(t, err)
+			require.True(t, same)
+
+			same, err = ComparePasswords(encoded, []byte("battery staple"))
+			require.NoError(t, err)
+			require.False(t, same)
+		})
+	}
+
+	t.Run("argon2id is encoded as a PHC string", func(t *testing.T) {
+		encoded, err := argonHasher.Hash([]byte("correct horse"))
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	})
+
+	t.Run("hashes made under another policy need a rehash", func(t *testing.T) {
+		weakBcrypt, err := bcryptHasher.Hash([]byte("correct horse"))
+		require.NoError(t, err)
+		require.True(t, argonHasher.NeedsRehash(weakBcrypt))
+		require.True(t, (&BcryptHasher{Cost: bcrypt.MinCost + 1}).NeedsRehash(weakBcrypt))
+
+		weakArgon, err := argonHasher.Hash([]byte("correct horse"))
+		require.NoError(t, err)
+		require.True(t, bcryptHasher.NeedsRehash(weakArgon))
+		require.True(t, (&Argon2idHasher{Memory: 2048, Iterations: 1, Parallelism: 1, KeyLength: 32}).NeedsRehash(weakArgon))
+	})
+
+	t.Run("only hashes passwords can be checked against are recognised", func(t *testing.T) {
+		for _, encoded := range []string{"", "Correct-Horse-2931", "$1$salt$hash", "$argon2id$v=19$m=1024", "$2a$04$short"} {
+			require.False(t, IsPasswordHash(encoded), encoded)
+		}
+	})
+
+	t.Run("unknown algorithm", func(t *testing.T) {
+		_, err := NewPasswordHasher(HasherSettings{Algorithm: "md5"})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"go.uber.org/zap"
+)
+
+// natsReadyTimeout is how long an embedded server gets to start accepting connections
+const natsReadyTimeout = 5 * time.Second
+
+// NatsServerSettings configures an embedded nats server, a negative Port picks a free one
+type NatsServerSettings struct {
+	Host      string
+	Port      int
+	JetStream bool
+	StoreDir  string
+}
+
+// StartNatsServer runs a nats server inside this process, with jetstream storing under StoreDir when enabled.
+// Connect to it on its ClientURL and Shutdown it when done.
+func StartNatsServer(settings NatsServerSettings, logger *zap.Logger) (*server.Server, error) {
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      settings.Host,
+		Port:      settings.Port,
+		JetStream: settings.JetStream,
+		StoreDir:  settings.StoreDir,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		logger.Error("❌ something went wrong configuring the embedded nats server", zap.Error(err))
+		return nil, err
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(natsReadyTimeout) {
+		ns.Shutdown()
+		err = errors.New("embedded nats server didn't start in time")
+		logger.Error("❌ something went wrong starting the embedded nats server", zap.Error(err))
+		return nil, err
+	}
+
+	return ns, nil
+}
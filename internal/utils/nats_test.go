@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStartNatsServer(t *testing.T) {
+	connect := func(t *testing.T, settings NatsServerSettings) *nats.Conn {
+		ns, err := StartNatsServer(settings, zap.NewNop())
+		require.NoError(t, err)
+		t.Cleanup(ns.Shutdown)
+
+		nc, err := nats.Connect(ns.ClientURL())
+		require.NoError(t, err)
+		t.Cleanup(nc.Close)
+
+		return nc
+	}
+
+	t.Run("core nats", func(t *testing.T) {
+		nc := connect(t, NatsServerSettings{Host: "127.0.0.1", Port: -1})
+
+		sub, err := nc.SubscribeSync("ping")
+		require.NoError(t, err)
+		require.NoError(t, nc.Publish("ping", []byte("pong")))
+
+		msg, err := sub.NextMsg(natsReadyTimeout)
+		require.NoError(t, err)
+		require.Equal(t, "pong", string(msg.Data))
+
+		js, err := nc.JetStream()
+		require.NoError(t, err)
+
+		_, err = js.AccountInfo()
+		require.Error(t, err)
+	})
+
+	t.Run("jetstream stores under the dir", func(t *testing.T) {
+		nc := connect(t, NatsServerSettings{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+
+		js, err := nc.JetStream()
+		require.NoError(t, err)
+
+		_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"test.>"}, Storage: nats.FileStorage})
+		require.NoError(t, err)
+
+		ack, err := js.Publish("test.created", []byte("{}"))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, ack.Sequence)
+	})
+}
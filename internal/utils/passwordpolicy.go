@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy is what a new password has to satisfy
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	MinCharClasses   int
+	MinScore         int
+	DisallowPersonal bool
+	Breached         BreachedChecker
+}
+
+// Check returns every rule the password breaks, personal is the username, email and such of the user
+// which the password shouldn't contain. The breached list is checked separately by IsBreached.
+func (policy *PasswordPolicy) Check(pwd string, personal ...string) []string {
+
+	var violations []string
+
+	length := len([]rune(pwd))
+	if length < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters long", policy.MaxLength))
+	}
+
+	if charClasses(pwd) < policy.MinCharClasses {
+		violations = append(violations, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", policy.MinCharClasses))
+	}
+
+	if policy.DisallowPersonal && containsPersonal(pwd, personal) {
+		violations = append(violations, "must not contain the username or email")
+	}
+
+	if PasswordScore(pwd, personal...) < policy.MinScore {
+		violations = append(violations, "is too easy to guess")
+	}
+
+	return violations
+}
+
+// IsBreached reports whether the password is in the breached password list, always false without one
+func (policy *PasswordPolicy) IsBreached(pwd string) (bool, error) {
+	if policy.Breached == nil {
+		return false, nil
+	}
+
+	return policy.Breached.IsBreached(pwd)
+}
+
+// charClassSizes is how many characters each class of characters holds, symbols are counted as printable ascii ones
+var charClassSizes = [4]int{26, 26, 10, 33}
+
+// usedCharClasses flags which of lowercase, uppercase, digits and symbols the password uses
+func usedCharClasses(pwd string) [4]bool {
+
+	var used [4]bool
+
+	for _, r := range pwd {
+		switch {
+		case unicode.IsLower(r):
+			used[0] = true
+		case unicode.IsUpper(r):
+			used[1] = true
+		case unicode.IsDigit(r):
+			used[2] = true
+		default:
+			used[3] = true
+		}
+	}
+
+	return used
+}
+
+func charClasses(pwd string) int {
+
+	count := 0
+	for _, used := range usedCharClasses(pwd) {
+		if used {
+			count++
+		}
+	}
+
+	return count
+}
+
+// charsetSize is the number of characters an attacker brute forcing the password would have to try at each position
+func charsetSize(pwd string) int {
+
+	size := 0
+	for i, used := range usedCharClasses(pwd) {
+		if used {
+			size += charClassSizes[i]
+		}
+	}
+
+	return size
+}
+
+// containsPersonal checks the password against the inputs and the local part of emails, short inputs are ignored
+func containsPersonal(pwd string, personal []string) bool {
+
+	lowered := strings.ToLower(pwd)
+
+	for _, input := range personal {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if at := strings.Index(input, "@"); at > 0 {
+			input = input[:at]
+		}
+
+		if len(input) >= 3 && strings.Contains(lowered, input) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commonPasswords are guessed first by any attacker, along with the inputs passed to PasswordScore
+var commonPasswords = []string{
+	"password", "qwerty", "qwertyuiop", "asdfgh", "zxcvbn", "letmein", "welcome", "admin", "administrator",
+	"login", "master", "dragon", "monkey", "football", "baseball", "soccer", "hockey", "iloveyou", "sunshine",
+	"princess", "shadow", "superman", "batman", "trustno1", "starwars", "whatever", "freedom", "secret", "hello",
+	"charlie", "michael", "jordan", "jennifer", "hunter", "ranger", "buster", "pepper", "ginger", "summer",
+	"winter", "spring", "autumn", "changeme", "default", "access", "computer", "internet", "google", "quiz",
+}
+
+// leetReplacer undoes the usual character substitutions before looking for common words
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// PasswordScore estimates how hard the password is to guess on the 0 to 4 scale used by zxcvbn,
+// 3 holds off an offline attack on a slow hash and 4 is very unguessable.
+// Common words, personal inputs, repeats and sequences only count for a few bits instead of a full character each.
+func PasswordScore(pwd string, personal ...string) int {
+
+	bits := passwordEntropy(pwd, personal)
+
+	// the zxcvbn thresholds are 10^3, 10^6, 10^8 and 10^10 guesses
+	switch {
+	case bits < 10:
+		return 0
+	case bits < 20:
+		return 1
+	case bits < 26.6:
+		return 2
+	case bits < 33.2:
+		return 3
+	}
+
+	return 4
+}
+
+func passwordEntropy(pwd string, personal []string) float64 {
+
+	if pwd == "" {
+		return 0
+	}
+
+	perChar := math.Log2(float64(charsetSize(pwd)))
+
+	// dictionary words are worth the bits needed to pick them from the dictionary plus one for their case
+	words := make([]string, 0, len(commonPasswords)+len(personal))
+	for _, word := range commonPasswords {
+		words = append(words, leetReplacer.Replace(word))
+	}
+	for _, input := range personal {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if at := strings.Index(input, "@"); at > 0 {
+			input = input[:at]
+		}
+		if len(input) >= 3 {
+			words = append(words, leetReplacer.Replace(input))
+		}
+	}
+
+	// every substitution swaps a single character so both line up, words are looked for with the substitutions undone
+	runes := []rune(strings.ToLower(pwd))
+	unleeted := []rune(leetReplacer.Replace(string(runes)))
+	wordBits := math.Log2(float64(len(words))) + 1
+
+	var bits float64
+
+	for i := 0; i < len(runes); {
+		if length := longestWord(unleeted[i:], words); length > 0 {
+			bits += wordBits
+			i += length
+			continue
+		}
+
+		if length := patternLength(runes[i:]); length >= 3 {
+			// a run or sequence costs its first character plus a couple of bits for its length and direction
+			bits += perChar + 2
+			i += length
+			continue
+		}
+
+		bits += perChar
+		i++
+	}
+
+	return bits
+}
+
+// longestWord returns the length of the longest word the runes start with
+func longestWord(runes []rune, words []string) int {
+
+	longest := 0
+	s := string(runes)
+
+	for _, word := range words {
+		if len(word) > longest && strings.HasPrefix(s, word) {
+			longest = len([]rune(word))
+		}
+	}
+
+	return longest
+}
+
+// patternLength returns how many runes the repeated character or ascending/descending sequence at the start spans
+func patternLength(runes []rune) int {
+
+	if len(runes) < 2 {
+		return len(runes)
+	}
+
+	step := runes[1] - runes[0]
+	if step < -1 || step > 1 {
+		return 1
+	}
+
+	length := 2
+	for length < len(runes) && runes[length]-runes[length-1] == step {
+		length++
+	}
+
+	return length
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 10, MaxLength: 20, MinCharClasses: 2, MinScore: 3, DisallowPersonal: true}
+
+	testCases := []struct {
+		Name               string
+		Input              string
+		ExpectedViolations []string
+	}{
+		{
+			Name:  "Too short",
+			Input: "a",
+			ExpectedViolations: []string{
+				"must be at least 10 characters long",
+				"must mix at least 2 of lowercase letters, uppercase letters, digits and symbols",
+				"is too easy to guess",
+			},
+		},
+		{
+			Name:               "Too long",
+			Input:              "k9#Lm2vQ-k9#Lm2vQ-k9#Lm2vQ",
+			ExpectedViolations: []string{"must be at most 20 characters long"},
+		},
+		{
+			Name:               "Common password with substitutions",
+			Input:              "P@ssw0rd123",
+			ExpectedViolations: []string{"is too easy to guess"},
+		},
+		{
+			Name:               "Keyboard walk and sequence",
+			Input:              "qwerty123456",
+			ExpectedViolations: []string{"is too easy to guess"},
+		},
+		{
+			Name:               "Contains the username",
+			Input:              "alexm1496!xyz",
+			ExpectedViolations: []string{"must not contain the username or email", "is too easy to guess"},
+		},
+		{
+			Name:               "Contains the email",
+			Input:              "Kq!alexander7Zp",
+			ExpectedViolations: []string{"must not contain the username or email"},
+		},
+		{
+			Name:  "Strong password",
+			Input: "Tr0ub4dor&3x",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.Name, func(t *testing.T) {
+			require.ElementsMatch(t, test.ExpectedViolations, policy.Check(test.Input, "alexm1496", "alexander@example.com"))
+		})
+	}
+}
+
+func TestPrefixFileChecker_IsBreached(t *testing.T) {
+	dir := t.TempDir()
+
+	// sha1("Leaked-Sunrise-2931") = 81D323DB06C951DB597494D60C44E020F5D5677E
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "81D32.txt"),
+		[]byte("0018A45C4D1DEF81644B54AB7F969B88D65:3\r\n3DB06C951DB597494D60C44E020F5D5677E:42\r\n"), 0o600))
+
+	breached, err := NewPrefixFileChecker(dir, 1).IsBreached("Leaked-Sunrise-2931")
+	require.NoError(t, err)
+	require.True(t, breached)
+
+	breached, err = NewPrefixFileChecker(dir, 100).IsBreached("Leaked-Sunrise-2931")
+	require.NoError(t, err)
+	require.False(t, breached)
+
+	breached, err = NewPrefixFileChecker(dir, 1).IsBreached("Tr0ub4dor&3x")
+	require.NoError(t, err)
+	require.False(t, breached)
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP parameters, the defaults of RFC 6238 which every authenticator app supports
+const (
+	TOTPPeriod = 30
+	TOTPDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160 bit secret encoded in base32 as authenticator apps expect it
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPStep is the number of periods elapsed since the epoch at t
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// TOTPCode computes the code of the secret for the step passed as described in RFC 4226
+func TOTPCode(secret string, step int64) (string, error) {
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000), nil
+}
+
+// ValidateTOTP checks the code against the steps around t, skew steps either side are accepted to make up for clock drift.
+// The step the code matched is returned so callers can refuse it being used again.
+func ValidateTOTP(secret, code string, t time.Time, skew int64) (int64, bool) {
+
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	current := TOTPStep(t)
+
+	for step := current - skew; step <= current+skew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// TOTPURI builds the otpauth:// uri authenticator apps enrol with
+func TOTPURI(issuer, account, secret string) string {
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(TOTPDigits))
+	values.Set("period", fmt.Sprint(TOTPPeriod))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, values.Encode())
+}
+
+// QRCodePNG renders the content as a square PNG QR code of size pixels
+func QRCodePNG(content string, size int) ([]byte, error) {
+	return qrcode.Encode(content, qrcode.Medium, size)
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, the SHA1 secret is the ascii string "12345678901234567890"
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	testCases := []struct {
+		Time     int64
+		Expected string
+	}{
+		{Time: 59, Expected: "287082"},
+		{Time: 1111111109, Expected: "081804"},
+		{Time: 1111111111, Expected: "050471"},
+		{Time: 1234567890, Expected: "005924"},
+		{Time: 2000000000, Expected: "279037"},
+	}
+
+	for _, test := range testCases {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(test.Time, 0)))
+		require.NoError(t, err)
+		require.Equal(t, test.Expected, code)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	previous, err := TOTPCode(secret, TOTPStep(now)-1)
+	require.NoError(t, err)
+
+	step, ok := ValidateTOTP(secret, previous, now, 1)
+	require.True(t, ok)
+	require.Equal(t, TOTPStep(now)-1, step)
+
+	_, ok = ValidateTOTP(secret, previous, now.Add(2*TOTPPeriod*time.Second), 1)
+	require.False(t, ok)
+
+	_, ok = ValidateTOTP(secret, "12345", now, 1)
+	require.False(t, ok)
+}